@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,30 +24,49 @@ import (
 	"github.com/unok/local-text-history/web"
 )
 
+// stringList is a flag.Value that collects repeated flag occurrences.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 func main() {
-	configPath := flag.String("config", "", "path to config file")
+	var configPaths stringList
+	flag.Var(&configPaths, "config", "path to config file (repeatable; later files override earlier ones)")
+	validate := flag.Bool("validate", false, "check the config, print the resolved watch sets and exit")
 	flag.Parse()
 
-	if *configPath == "" {
+	if len(configPaths) == 0 {
 		fmt.Fprintln(os.Stderr, "error: --config flag is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	cfg, err := config.Load(*configPath)
+	cfg, err := config.LoadMany(configPaths)
+	if *validate {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config invalid: %v\n", err)
+			os.Exit(1)
+		}
+		if !printValidation(os.Stdout, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	// Ensure DB directory exists
-	dbDir := filepath.Dir(cfg.DBPath)
-	if err := os.MkdirAll(dbDir, 0o700); err != nil {
-		log.Fatalf("failed to create db directory: %v", err)
-	}
+	logger := newLogger(cfg)
+	slog.SetDefault(logger)
 
-	database, err := db.New(cfg.DBPath)
+	database, err := openDatabaseRetry(cfg.DBPath, cfg, logger)
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		fatal("failed to open database", "path", cfg.DBPath, "err", err)
 	}
 	defer database.Close()
 
@@ -51,24 +74,78 @@ func main() {
 	var staticFS fs.FS
 	sub, err := fs.Sub(web.DistFS, "dist")
 	if err != nil {
-		log.Printf("warning: static files not available: %v", err)
+		logger.Warn("static files not available", "err", err)
 	} else {
 		staticFS = sub
 	}
 
 	// Set up watcher
-	watchCfg := watcher.Config{WatchSets: cfg.WatchSets}
+	watchCfg := watcher.Config{WatchSets: cfg.WatchSets, ScanConcurrency: cfg.ScanConcurrency, MaxPendingTimers: cfg.MaxPendingTimers, MaxBatchSnapshots: cfg.MaxBatchSnapshots, MaxBatchBytes: cfg.MaxBatchBytes, AllowMissingDirs: cfg.AllowMissingWatchDirs, RenameTimeout: time.Duration(cfg.RenameTimeoutMs) * time.Millisecond, Logger: logger}
 	w, err := watcher.New(watchCfg, database.SaveSnapshot)
 	if err != nil {
-		log.Fatalf("failed to create watcher: %v", err)
+		fatal("failed to create watcher", "err", err)
 	}
 
 	// Wire rename detection and batch saving
 	w.SetRenameSaver(database.SaveRename)
-	w.SetBatchSaver(database.SaveSnapshotBatch)
+	w.SetBatchSaver(database.SaveSnapshotRequests)
+	w.SetFingerprintLookup(database.GetFileFingerprint)
+	w.SetDeletionTracker(database.TrackedPaths, database.SaveDeletion)
+
+	// Open separate databases for watch sets that have their own dbPath
+	watchSetDBs := make(map[string]*db.DB)
+	for _, ws := range cfg.WatchSets {
+		if ws.DBPath == "" {
+			continue
+		}
+		wsDB, err := openDatabaseRetry(ws.DBPath, cfg, logger)
+		if err != nil {
+			fatal("failed to open database for watch set", "set", ws.Name, "path", ws.DBPath, "err", err)
+		}
+		defer wsDB.Close()
+		if err := w.SetWatchSetSavers(ws.Name, wsDB.SaveSnapshotRequests, wsDB.SaveRename); err != nil {
+			fatal("failed to route watch set", "set", ws.Name, "err", err)
+		}
+		if err := w.SetWatchSetFingerprintLookup(ws.Name, wsDB.GetFileFingerprint); err != nil {
+			fatal("failed to route watch set", "set", ws.Name, "err", err)
+		}
+		if err := w.SetWatchSetDeletionTracker(ws.Name, wsDB.TrackedPaths, wsDB.SaveDeletion); err != nil {
+			fatal("failed to route watch set", "set", ws.Name, "err", err)
+		}
+		watchSetDBs[ws.Name] = wsDB
+	}
+
+	gate := maintenanceGate{cfg: cfg, queuedSaves: w.QueuedSaves}
 
 	// Set up HTTP server
-	srv := server.New(database, staticFS, cfg.WatchSets, cfg.BasicAuth)
+	srv := server.New(database, staticFS, cfg.WatchSets, cfg.BasicAuth, server.Options{
+		HistoryDefaultLimit:       cfg.HistoryDefaultLimit,
+		HistoryMaxLimit:           cfg.HistoryMaxLimit,
+		SearchDefaultLimit:        cfg.SearchDefaultLimit,
+		SearchMaxLimit:            cfg.SearchMaxLimit,
+		WatchSetDBs:               watchSetDBs,
+		MaxSSEClients:             cfg.MaxSSEClients,
+		MaxConcurrentRequests:     cfg.MaxConcurrentRequests,
+		RequestTimeout:            time.Duration(cfg.RequestTimeoutSec) * time.Second,
+		Logger:                    logger,
+		MaxDiffBytes:              cfg.MaxDiffBytes,
+		MaxInitialDiffBytes:       max(cfg.MaxInitialDiffBytes, 0),
+		RejectConcurrentDownloads: cfg.DatabaseDownloadMode == config.DownloadModeReject,
+		TrashFiles:                cfg.TrashRetentionDays > 0,
+		SnapshotTmpDir:            cfg.SnapshotTmpDir,
+		AccessLog:                 cfg.AccessLog,
+		BasePath:                  cfg.BasePath,
+		HeavyOpCheck:              gate.checkRequest,
+		WatchStats: func() server.WatchStats {
+			ws := w.WatchStats()
+			dirs := ws.UnavailableDirs
+			if dirs == nil {
+				dirs = []string{}
+			}
+			return server.WatchStats{Watches: ws.Watches, LimitReached: ws.LimitReached, UnavailableDirs: dirs}
+		},
+		Rescan: w.Rescan,
+	})
 
 	// Wire watcher snapshot notifications to SSE
 	w.OnSnapshot = func(filePath string) {
@@ -80,6 +157,11 @@ func main() {
 		srv.Notify(newPath)
 	}
 
+	// Wire deletions found by scans to SSE
+	w.OnDelete = func(filePath string) {
+		srv.Notify(filePath)
+	}
+
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.Port),
 		Handler: srv.Handler(),
@@ -91,27 +173,284 @@ func main() {
 
 	done := make(chan struct{})
 	go w.Run(done)
+	go watchReload(configPaths, srv, done)
+
+	if cfg.TrashRetentionDays > 0 || cfg.MaxRenameAgeSec > 0 {
+		go runMaintenance(database, cfg, gate, done)
+		for _, wsDB := range watchSetDBs {
+			go runMaintenance(wsDB, cfg, gate, done)
+		}
+	}
+
+	if cfg.Backup != nil {
+		go runBackup(database, "history-", cfg.Backup, gate, done)
+		for name, wsDB := range watchSetDBs {
+			go runBackup(wsDB, "history-"+name+"-", cfg.Backup, gate, done)
+		}
+	}
 
 	go func() {
-		log.Printf("server starting on http://%s:%d", cfg.BindAddress, cfg.Port)
+		logger.Info("server starting", "url", fmt.Sprintf("http://%s:%d", cfg.BindAddress, cfg.Port))
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+			fatal("server error", "err", err)
 		}
 	}()
 
 	<-ctx.Done()
-	log.Println("shutting down...")
+	logger.Info("shutting down...")
 
 	close(done)
 	if err := w.Close(); err != nil {
-		log.Printf("error closing watcher: %v", err)
+		logger.Error("error closing watcher", "err", err)
 	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Printf("error shutting down server: %v", err)
+		logger.Error("error shutting down server", "err", err)
+	}
+
+	logger.Info("shutdown complete")
+}
+
+// watchReload re-reads the config files on SIGHUP. The running daemon keeps
+// its current settings either way: a config that fails to load is logged
+// and reported at /api/health, and a valid one takes effect on restart.
+// It returns when done is closed.
+func watchReload(configPaths []string, srv *server.Server, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+		}
+
+		if _, err := config.LoadMany(configPaths); err != nil {
+			slog.Error("config reload rejected, keeping current config", "err", err)
+			srv.SetConfigError(err)
+			continue
+		}
+		srv.SetConfigError(nil)
+		slog.Info("config reloaded and valid; restart to apply changes")
+	}
+}
+
+// runBackup copies database into the backup directory every interval,
+// keeping the newest copies. Failures are logged and retried at the next
+// interval. It returns when done is closed.
+func runBackup(database *db.DB, prefix string, backup *config.BackupConfig, gate maintenanceGate, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(backup.IntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !gate.wait(done) {
+			return
+		}
+
+		path, err := database.Backup(backup.Dir, prefix, backup.Keep)
+		if err != nil {
+			slog.Error("failed to back up database", "dir", backup.Dir, "err", err)
+		} else {
+			slog.Info("database backed up", "path", path)
+		}
 	}
+}
 
-	log.Println("shutdown complete")
+// printValidation writes the resolved watch sets of cfg to out along with a
+// shallow count of the existing files each would track. It returns false if
+// a watch directory could not be read.
+func printValidation(out io.Writer, cfg config.Config) bool {
+	ok := true
+	fmt.Fprintf(out, "config OK: %d watch set(s), database %s\n", len(cfg.WatchSets), cfg.DBPath)
+	for _, ws := range cfg.WatchSets {
+		fmt.Fprintf(out, "\nwatch set %q\n", ws.Name)
+		fmt.Fprintf(out, "  dirs:         %s\n", strings.Join(ws.Dirs, ", "))
+		fmt.Fprintf(out, "  extensions:   %s\n", listOrNone(ws.Extensions, "(all)"))
+		fmt.Fprintf(out, "  excludes:     %s\n", listOrNone(ws.ExcludePatterns, "(none)"))
+		fmt.Fprintf(out, "  limits:       debounce=%ds minFileSize=%d maxFileSize=%d maxSnapshots=%d\n",
+			ws.DebounceSec, ws.MinFileSize, ws.MaxFileSize, ws.MaxSnapshots)
+		if ws.DBPath != "" {
+			fmt.Fprintf(out, "  database:     %s\n", ws.DBPath)
+		}
+		n, err := watcher.CountTrackableFiles(ws)
+		if err != nil {
+			fmt.Fprintf(out, "  files:        error: %v\n", err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(out, "  files:        %d directly in dirs (subdirectories not counted)\n", n)
+	}
+	return ok
+}
+
+// listOrNone joins items with commas, or returns empty when there are none.
+func listOrNone(items []string, empty string) string {
+	if len(items) == 0 {
+		return empty
+	}
+	return strings.Join(items, ", ")
+}
+
+// newLogger builds the logger selected by cfg's logFormat and logLevel.
+func newLogger(cfg config.Config) *slog.Logger {
+	level, _ := cfg.SlogLevel() // validated by config.Load
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.LogFormat == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Opening a database is retried a few times so a transient failure at
+// startup (e.g. a lock held by a previous instance still shutting down)
+// does not stop the daemon.
+const (
+	dbOpenAttempts   = 3
+	dbOpenRetryDelay = 2 * time.Second
+)
+
+// openDatabaseRetry calls openDatabase up to dbOpenAttempts times. A
+// database written in another idFormat is refused at once.
+func openDatabaseRetry(dbPath string, cfg config.Config, logger *slog.Logger) (*db.DB, error) {
+	for attempt := 1; ; attempt++ {
+		database, err := openDatabase(dbPath, cfg, logger)
+		if err == nil || attempt == dbOpenAttempts || errors.Is(err, db.ErrIDFormatMismatch) {
+			return database, err
+		}
+		logger.Warn("failed to open database, retrying", "path", dbPath, "attempt", attempt, "err", err)
+		time.Sleep(dbOpenRetryDelay)
+	}
+}
+
+// openDatabase creates the database directory if needed and opens the
+// SQLite database at dbPath with the storage settings from cfg. An
+// in-memory dbPath needs no directory; its history is lost on exit.
+func openDatabase(dbPath string, cfg config.Config, logger *slog.Logger) (*db.DB, error) {
+	if db.IsMemoryPath(dbPath) {
+		logger.Warn("using an in-memory database; history is lost on exit", "path", dbPath)
+	} else if err := os.MkdirAll(filepath.Dir(dbPath), 0o700); err != nil {
+		return nil, fmt.Errorf("creating db directory: %w", err)
+	}
+	database, err := db.New(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	database.SetLogger(logger)
+	database.SetNoCompressExtensions(cfg.NoCompressExtensions)
+	database.SetSizeLimit(cfg.MaxDatabaseSize, cfg.MaxDatabaseSizeMode == config.SizeModeEvict)
+	database.SetMaxTrackedFiles(cfg.MaxTrackedFiles)
+	database.SetOrderByMtime(cfg.OrderBy == config.OrderByMtime)
+	database.SetRenameCollapseWindow(cfg.RenameCollapseSec)
+	database.SetCarryOverOnRename(cfg.CarryOverOnRename)
+	database.SetDedupHash(cfg.DedupHash)
+	database.SetDedupWindow(cfg.DedupWindow)
+	if err := database.SetIDFormat(cfg.IDFormat); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return database, nil
+}
+
+// maintenanceRetryInterval is how often deferred heavy work checks again
+// whether it may run.
+const maintenanceRetryInterval = time.Minute
+
+// maintenanceGate decides when heavy database work may run, following
+// cfg.MaintenanceWindow and cfg.DeferMaintenanceWhenBusy.
+type maintenanceGate struct {
+	cfg         config.Config
+	queuedSaves func() int
+}
+
+// allowed reports whether scheduled heavy work may run now: inside the
+// maintenance window and, if deferring is enabled, with no saves queued.
+func (g maintenanceGate) allowed() bool {
+	if !g.cfg.InMaintenanceWindow(time.Now()) {
+		return false
+	}
+	return !g.cfg.DeferMaintenanceWhenBusy || g.queuedSaves() == 0
+}
+
+// wait blocks until scheduled heavy work is allowed. It returns false if
+// done is closed first.
+func (g maintenanceGate) wait(done <-chan struct{}) bool {
+	for !g.allowed() {
+		select {
+		case <-done:
+			return false
+		case <-time.After(maintenanceRetryInterval):
+		}
+	}
+	return true
+}
+
+// checkRequest refuses a heavy operation requested through the API while
+// outside the maintenance window with snapshot saves queued.
+func (g maintenanceGate) checkRequest() error {
+	if g.cfg.InMaintenanceWindow(time.Now()) {
+		return nil
+	}
+	if n := g.queuedSaves(); n > 0 {
+		return fmt.Errorf("database is busy saving %d snapshot(s); retry later or during the maintenance window %s", n, g.cfg.MaintenanceWindow)
+	}
+	return nil
+}
+
+// maintenanceInterval is how often expired trash and renames are purged.
+const maintenanceInterval = time.Hour
+
+// runMaintenance periodically hard-deletes files that have been in the trash
+// longer than cfg.TrashRetentionDays, then prunes renames older than
+// cfg.MaxRenameAgeSec. Either step is skipped when its setting is 0. Trash
+// goes first so renames of purged files are already gone. Each run waits
+// for gate. It returns when done is closed.
+func runMaintenance(database *db.DB, cfg config.Config, gate maintenanceGate, done <-chan struct{}) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		if !gate.wait(done) {
+			return
+		}
+		now := time.Now()
+		if days := cfg.TrashRetentionDays; days > 0 {
+			cutoff := now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+			n, err := database.PurgeTrash(cutoff)
+			if err != nil {
+				slog.Error("failed to purge trash", "err", err)
+			} else if n > 0 {
+				slog.Info("trash purged", "files", n, "retentionDays", days)
+			}
+		}
+		if sec := cfg.MaxRenameAgeSec; sec > 0 {
+			cutoff := now.Add(-time.Duration(sec) * time.Second).Unix()
+			n, err := database.PruneRenames(cutoff)
+			if err != nil {
+				slog.Error("failed to prune renames", "err", err)
+			} else if n > 0 {
+				slog.Info("renames pruned", "renames", n, "maxRenameAgeSec", sec)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
 }
@@ -4,6 +4,7 @@ go 1.25.5
 
 require (
 	github.com/bmatcuk/doublestar/v4 v4.10.0
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/google/uuid v1.6.0
 	github.com/klauspost/compress v1.18.3
@@ -11,4 +12,7 @@ require (
 	github.com/sergi/go-diff v1.4.0
 )
 
-require golang.org/x/sys v0.40.0
+require (
+	golang.org/x/sys v0.40.0
+	golang.org/x/text v0.33.0
+)
@@ -4,9 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // BasicAuthConfig holds Basic authentication credentials.
@@ -15,6 +22,13 @@ type BasicAuthConfig struct {
 	Password string `json:"password"`
 }
 
+// BackupConfig enables periodic copies of the databases into Dir.
+type BackupConfig struct {
+	Dir         string `json:"dir"`
+	IntervalSec int    `json:"intervalSec"` // default 86400 (daily)
+	Keep        int    `json:"keep"`        // copies kept per database, default 7
+}
+
 // WatchSet defines a named group of directories with shared monitoring settings.
 type WatchSet struct {
 	Name            string   `json:"name"`
@@ -23,13 +37,75 @@ type WatchSet struct {
 	ExcludePatterns []string `json:"excludePatterns"`
 	DebounceSec     int      `json:"debounceSec"`
 	MaxFileSize     int64    `json:"maxFileSize"`
+	MinFileSize     int64    `json:"minFileSize"` // files smaller than this are skipped (default 1: only empty files)
 	MaxSnapshots    int      `json:"maxSnapshots"`
+	// ImmediateExtensions lists extensions (e.g. ".log") snapshotted about
+	// once per second while being written instead of after DebounceSec.
+	ImmediateExtensions []string `json:"immediateExtensions,omitempty"`
+	// ExtraExtensions are appended to the effective extension list (the
+	// set's own extensions, or the global ones when the set omits them).
+	ExtraExtensions []string `json:"extraExtensions,omitempty"`
+	// ExtensionsPreset names a curated extension list (see
+	// extensionPresets) merged into the set's own extensions. A set with a
+	// preset does not inherit the global extensions.
+	ExtensionsPreset string `json:"extensionsPreset,omitempty"`
+	// Stabilize delays a snapshot until the file's size and mtime stop
+	// changing between two checks one debounce period apart.
+	Stabilize bool `json:"stabilize"`
+	// DBPath stores this set's history in its own SQLite file instead of
+	// the global database. Empty means the global dbPath.
+	DBPath string `json:"dbPath,omitempty"`
+	// SnapshotTmpDir overrides the global snapshotTmpDir for downloads of
+	// this set's database. Empty means the global setting.
+	SnapshotTmpDir string `json:"snapshotTmpDir,omitempty"`
+	// DetectEncoding transcodes BOM-prefixed UTF-16 files to UTF-8 for
+	// storage and diffing, recording the original encoding for downloads.
+	DetectEncoding bool `json:"detectEncoding"`
+	// TrackBinaryMetadata records size and hash (but no content) for files
+	// detected as binary instead of skipping them.
+	TrackBinaryMetadata bool `json:"trackBinaryMetadata"`
+	// MaxInitialScanFiles caps how many existing files a directory scan
+	// imports (0 = unlimited). SkipInitialScan disables the scan entirely.
+	// Changes detected afterwards are always captured.
+	MaxInitialScanFiles int  `json:"maxInitialScanFiles"`
+	SkipInitialScan     bool `json:"skipInitialScan"`
+	// SkipOversizedDirs leaves directories unwatched when a sample of their
+	// files shows nearly all of them are too large or binary. Their
+	// subdirectories are still considered individually.
+	SkipOversizedDirs bool `json:"skipOversizedDirs"`
+	// FollowSymlinks watches directories reached through symlinks under the
+	// set's dirs. Each linked tree adds its own inotify watches; circular
+	// links are detected and walked once.
+	FollowSymlinks bool `json:"followSymlinks"`
+	// NormalizeLineEndings detects duplicates by content with CRLF
+	// converted to LF so a file that only flips line endings is not
+	// recorded again. Snapshots still store the original bytes and hash.
+	NormalizeLineEndings bool `json:"normalizeLineEndings"`
+	// TrackDeletions makes directory scans record tracked files that are
+	// gone from disk as deletions in their history. Off by default, as a
+	// temporarily unmounted directory looks the same.
+	TrackDeletions bool `json:"trackDeletions"`
+	// MaxSnapshotsPerMinute caps how often a single file is snapshotted.
+	// Changes to a file over the limit are coalesced until the oldest
+	// snapshot of the last minute ages out. 0 means unlimited.
+	MaxSnapshotsPerMinute int `json:"maxSnapshotsPerMinute"`
+	// MaxStoredBytes stores only part of files larger than this many bytes,
+	// marking their snapshots as truncated; TruncateKeep selects whether the
+	// "tail" (default, for append-only logs) or the "head" is kept. The
+	// hash covers the stored part. 0 stores whole files.
+	MaxStoredBytes int64  `json:"maxStoredBytes"`
+	TruncateKeep   string `json:"truncateKeep,omitempty"`
+	// RedactPatterns are regular expressions whose matches in this set's
+	// content are shown as "***" by the API. A pattern with capture groups
+	// masks only the groups. Stored content is not changed.
+	RedactPatterns []string `json:"redactPatterns,omitempty"`
 }
 
 // Config holds all application configuration.
 type Config struct {
 	// Legacy fields for JSON deserialization only.
 	// After normalizeWatchSets, these are cleared; use WatchSets[] instead.
+	// Extensions also serves as the default for watch sets that omit theirs.
 	WatchDirs       []string `json:"watchDirs,omitempty"`
 	Extensions      []string `json:"extensions,omitempty"`
 	ExcludePatterns []string `json:"excludePatterns,omitempty"`
@@ -45,6 +121,227 @@ type Config struct {
 	Port        int              `json:"port"`
 	DBPath      string           `json:"dbPath"`
 	BasicAuth   *BasicAuthConfig `json:"basicAuth,omitempty"`
+	Backup      *BackupConfig    `json:"backup,omitempty"`
+
+	// BasePath serves the UI and API under a path prefix (e.g. "/history"
+	// behind a reverse proxy). Normalized to a leading slash and no
+	// trailing slash; empty serves at the root.
+	BasePath string `json:"basePath,omitempty"`
+
+	// Pagination limits for the history feed and file search APIs.
+	HistoryDefaultLimit int `json:"historyDefaultLimit"`
+	HistoryMaxLimit     int `json:"historyMaxLimit"`
+	SearchDefaultLimit  int `json:"searchDefaultLimit"`
+	SearchMaxLimit      int `json:"searchMaxLimit"`
+
+	// MaxSSEClients caps concurrent /api/events connections.
+	MaxSSEClients int `json:"maxSSEClients"`
+
+	// MaxConcurrentRequests caps the HTTP requests served at once, not
+	// counting /api/events streams. Requests beyond it are answered 503.
+	// 0 means no limit.
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+
+	// RequestTimeoutSec bounds the database queries of the search, history
+	// and diff APIs. A query still running after this many seconds is
+	// aborted and answered 504.
+	RequestTimeoutSec int `json:"requestTimeoutSec"`
+
+	// MaxDiffBytes is the snapshot size above which /api/diff, /api/compare
+	// and diff-live skip the semantic cleanup pass and report truncated.
+	// 0 means no limit.
+	MaxDiffBytes int64 `json:"maxDiffBytes"`
+
+	// MaxInitialDiffBytes is the snapshot size above which /api/diff
+	// without 'from' returns a summary instead of the whole file as
+	// additions. Default 1 MiB; -1 means no limit.
+	MaxInitialDiffBytes int64 `json:"maxInitialDiffBytes"`
+
+	// ScanConcurrency is the number of files read in parallel during scans.
+	ScanConcurrency int `json:"scanConcurrency"`
+
+	// MaxPendingTimers caps how many changed files may wait for their
+	// debounce at once. Beyond it the oldest pending files are snapshotted
+	// immediately. 0 means unlimited.
+	MaxPendingTimers int `json:"maxPendingTimers"`
+
+	// MaxBatchSnapshots and MaxBatchBytes bound one save transaction. Queued
+	// snapshots beyond either limit are saved in further transactions so
+	// readers are not blocked by one long write.
+	MaxBatchSnapshots int   `json:"maxBatchSnapshots"`
+	MaxBatchBytes     int64 `json:"maxBatchBytes"`
+
+	// AllowMissingWatchDirs lets the daemon start when a WatchSet dir does
+	// not exist (e.g. an unmounted drive); it is watched once it appears.
+	// By default a missing dir is a startup error.
+	AllowMissingWatchDirs bool `json:"allowMissingWatchDirs"`
+
+	// TrashRetentionDays is how long trashed files are kept before being
+	// purged permanently. When set, deleting a file through the API moves
+	// it to the trash. 0 deletes files at once and disables the purge task.
+	TrashRetentionDays int `json:"trashRetentionDays"`
+
+	// MaxRenameAgeSec is how long rename records are kept. Older renames are
+	// pruned once they no longer link any snapshot history to a current
+	// path. 0 keeps them forever.
+	MaxRenameAgeSec int `json:"maxRenameAgeSec"`
+
+	// NoCompressExtensions lists path suffixes whose snapshots are stored
+	// without zstd compression (e.g. already-compressed exports).
+	NoCompressExtensions []string `json:"noCompressExtensions,omitempty"`
+
+	// MaxDatabaseSize caps each database file in bytes. 0 means unlimited.
+	MaxDatabaseSize int64 `json:"maxDatabaseSize"`
+	// MaxDatabaseSizeMode selects what happens once MaxDatabaseSize is
+	// exceeded: "reject" stops saving snapshots, "evict" deletes the oldest.
+	MaxDatabaseSizeMode string `json:"maxDatabaseSizeMode"`
+	// MaxTrackedFiles keeps at most this many files in each database,
+	// deleting the least recently updated ones (and their snapshots) when a
+	// save exceeds it. 0 means unlimited.
+	MaxTrackedFiles int `json:"maxTrackedFiles"`
+
+	// RenameCollapseSec merges rename chains (A→B then B→C within this many
+	// seconds) into one A→C entry in the history feed. 0 disables it.
+	RenameCollapseSec int `json:"renameCollapseSec"`
+	// CarryOverOnRename copies a renamed file's last snapshot to its new
+	// path when that path has none yet, so the new path always has content.
+	CarryOverOnRename bool `json:"carryOverOnRename"`
+	// RenameTimeoutMs is how long the watcher waits after a Rename event
+	// for the Create that pairs with it. Default 500. A longer window
+	// catches slow filesystems but may pair unrelated events.
+	RenameTimeoutMs int `json:"renameTimeoutMs"`
+
+	// IDFormat selects how IDs of new records are written: "uuidv7"
+	// (hyphenated UUID) or "base32" (the same UUIDv7 in 26 characters).
+	// A database keeps the format it was created with, since records saved
+	// in the same second are ordered by ID and the two formats do not sort
+	// against each other by time; opening it with the other one fails.
+	IDFormat string `json:"idFormat"`
+
+	// DedupHash selects the content hash used to skip unchanged saves:
+	// "sha256" or the faster, non-cryptographic "xxhash". Each snapshot's
+	// hash records its algorithm, so databases mixing both stay valid.
+	DedupHash string `json:"dedupHash"`
+	// DedupWindow is how many of a file's latest snapshots a save is
+	// compared with: content matching any of them is not stored again, so
+	// A→B→A flip-flops keep one copy of A. -1 compares with all of them.
+	// Default 1, the latest only.
+	DedupWindow int `json:"dedupWindow"`
+
+	// OrderBy selects the timestamp snapshot lists are sorted by:
+	// "detected" (when the change was captured) or "mtime" (file mtime).
+	OrderBy string `json:"orderBy"`
+
+	// DatabaseDownloadMode selects how a download request is handled while
+	// another one is preparing or streaming a database copy: "share" reuses
+	// the in-progress copy, "reject" answers 429.
+	DatabaseDownloadMode string `json:"databaseDownloadMode"`
+
+	// SnapshotTmpDir is where the VACUUM copy served by a database download
+	// is written. Empty means the system temp dir, which may be a small
+	// tmpfs.
+	SnapshotTmpDir string `json:"snapshotTmpDir,omitempty"`
+
+	// MaintenanceWindow limits heavy database work (trash purge, rename
+	// pruning, scheduled backups) to the local hours "start-end", end
+	// exclusive, e.g. "2-5", or "22-4" across midnight. Outside it, database
+	// downloads and dictionary training are refused while saves are queued.
+	// Empty allows heavy work at any time.
+	MaintenanceWindow string `json:"maintenanceWindow,omitempty"`
+	// DeferMaintenanceWhenBusy postpones scheduled heavy work while
+	// snapshot saves are queued, so its locks do not stall the watcher.
+	DeferMaintenanceWhenBusy bool `json:"deferMaintenanceWhenBusy"`
+
+	// LogFormat selects "text" (human-readable) or "json" log lines, and
+	// LogLevel the minimum level logged: "debug", "info", "warn" or "error".
+	LogFormat string `json:"logFormat"`
+	LogLevel  string `json:"logLevel"`
+	// AccessLog logs each HTTP request at info level, except the
+	// /api/events stream.
+	AccessLog bool `json:"accessLog"`
+}
+
+// DefaultMaxFileSize is the maxFileSize of a WatchSet that sets none.
+const DefaultMaxFileSize = 1048576 // 1MB
+
+// Values for WatchSet.TruncateKeep.
+const (
+	TruncateKeepTail = "tail"
+	TruncateKeepHead = "head"
+)
+
+// Values for Config.MaxDatabaseSizeMode.
+const (
+	SizeModeReject = "reject"
+	SizeModeEvict  = "evict"
+)
+
+// Values for Config.IDFormat.
+const (
+	IDFormatUUIDv7 = "uuidv7"
+	IDFormatBase32 = "base32"
+)
+
+// Values for Config.DedupHash.
+const (
+	DedupHashSHA256 = "sha256"
+	DedupHashXXHash = "xxhash"
+)
+
+// Values for Config.DatabaseDownloadMode.
+const (
+	DownloadModeShare  = "share"
+	DownloadModeReject = "reject"
+)
+
+// Values for Config.LogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Values for Config.OrderBy.
+const (
+	OrderByDetected = "detected"
+	OrderByMtime    = "mtime"
+)
+
+// SlogLevel parses LogLevel.
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return 0, fmt.Errorf("logLevel must be debug, info, warn or error: %q", c.LogLevel)
+	}
+	return level, nil
+}
+
+// InMaintenanceWindow reports whether t falls in MaintenanceWindow. It is
+// always true when no window is configured.
+func (c *Config) InMaintenanceWindow(t time.Time) bool {
+	start, end, err := parseHourRange(c.MaintenanceWindow)
+	if c.MaintenanceWindow == "" || err != nil {
+		return true
+	}
+	h := t.Hour()
+	if start < end {
+		return start <= h && h < end
+	}
+	return h >= start || h < end
+}
+
+// parseHourRange parses "start-end" with start in 0-23, end in 0-24 and
+// start != end.
+func parseHourRange(s string) (start, end int, err error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("maintenanceWindow must be \"start-end\" in hours: %q", s)
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(a))
+	end, err2 := strconv.Atoi(strings.TrimSpace(b))
+	if err1 != nil || err2 != nil || start < 0 || start > 23 || end < 0 || end > 24 || start == end {
+		return 0, 0, fmt.Errorf("maintenanceWindow must be \"start-end\" with different hours from 0 to 24: %q", s)
+	}
+	return start, end, nil
 }
 
 // AllWatchDirs returns all directories from all WatchSets flattened.
@@ -58,14 +355,43 @@ func (c *Config) AllWatchDirs() []string {
 
 // Load reads a JSON config file and returns a validated Config.
 func Load(path string) (Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return Config{}, fmt.Errorf("reading config file: %w", err)
+	return LoadMany([]string{path})
+}
+
+// LoadMany reads several JSON config files and merges them in order:
+// fields present in a later file override earlier values, and watch sets
+// with the same name are replaced while new names are appended.
+// Defaults and validation are applied once to the merged result.
+func LoadMany(paths []string) (Config, error) {
+	if len(paths) == 0 {
+		return Config{}, errors.New("no config files given")
 	}
 
 	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return Config{}, fmt.Errorf("parsing config file: %w", err)
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("resolving config path: %w", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+
+		// Unmarshalling into the accumulated config only overwrites the keys
+		// present in this file; watch sets are merged by name separately.
+		prevSets := cfg.WatchSets
+		cfg.WatchSets = nil
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+		cfg.WatchSets = mergeWatchSets(prevSets, cfg.WatchSets)
+
+		// Paths from earlier files are already absolute, so only the ones
+		// set by this file are resolved against its directory.
+		if err := resolvePaths(&cfg, filepath.Dir(absPath)); err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
 	}
 
 	applyDefaults(&cfg)
@@ -83,6 +409,27 @@ func Load(path string) (Config, error) {
 	return cfg, nil
 }
 
+// mergeWatchSets overlays sets onto base: a set whose name matches one in
+// base replaces it in place, others are appended. Duplicates within a single
+// file are left alone so validate can report them.
+func mergeWatchSets(base, overlay []WatchSet) []WatchSet {
+	merged := append([]WatchSet(nil), base...)
+	for _, ws := range overlay {
+		replaced := false
+		for i := range base {
+			if ws.Name != "" && merged[i].Name == ws.Name {
+				merged[i] = ws
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, ws)
+		}
+	}
+	return merged
+}
+
 func applyDefaults(cfg *Config) {
 	if cfg.BindAddress == "" {
 		cfg.BindAddress = "0.0.0.0"
@@ -90,19 +437,90 @@ func applyDefaults(cfg *Config) {
 	if cfg.Port == 0 {
 		cfg.Port = 9876
 	}
+	if p := strings.Trim(cfg.BasePath, "/"); p != "" {
+		cfg.BasePath = "/" + p
+	} else {
+		cfg.BasePath = ""
+	}
 	if cfg.DBPath == "" {
 		cfg.DBPath = "~/.local/share/file-history/history.db"
 	}
+	if cfg.ScanConcurrency == 0 {
+		cfg.ScanConcurrency = 4
+	}
+	if cfg.MaxBatchSnapshots == 0 {
+		cfg.MaxBatchSnapshots = 1000
+	}
+	if cfg.MaxBatchBytes == 0 {
+		cfg.MaxBatchBytes = 16 << 20 // 16MB
+	}
+	if cfg.Backup != nil {
+		if cfg.Backup.IntervalSec == 0 {
+			cfg.Backup.IntervalSec = 86400
+		}
+		if cfg.Backup.Keep == 0 {
+			cfg.Backup.Keep = 7
+		}
+	}
+	if cfg.MaxSSEClients == 0 {
+		cfg.MaxSSEClients = 64
+	}
+	if cfg.RequestTimeoutSec == 0 {
+		cfg.RequestTimeoutSec = 30
+	}
+	if cfg.MaxDatabaseSizeMode == "" {
+		cfg.MaxDatabaseSizeMode = SizeModeReject
+	}
+	if cfg.OrderBy == "" {
+		cfg.OrderBy = OrderByDetected
+	}
+	if cfg.IDFormat == "" {
+		cfg.IDFormat = IDFormatUUIDv7
+	}
+	if cfg.DedupHash == "" {
+		cfg.DedupHash = DedupHashSHA256
+	}
+	if cfg.DedupWindow == 0 {
+		cfg.DedupWindow = 1
+	}
+	if cfg.RenameTimeoutMs == 0 {
+		cfg.RenameTimeoutMs = 500
+	}
+	if cfg.MaxInitialDiffBytes == 0 {
+		cfg.MaxInitialDiffBytes = 1 << 20
+	}
+	if cfg.DatabaseDownloadMode == "" {
+		cfg.DatabaseDownloadMode = DownloadModeShare
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = LogFormatText
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if cfg.HistoryDefaultLimit == 0 {
+		cfg.HistoryDefaultLimit = 50
+	}
+	if cfg.HistoryMaxLimit == 0 {
+		cfg.HistoryMaxLimit = 200
+	}
+	if cfg.SearchDefaultLimit == 0 {
+		cfg.SearchDefaultLimit = 20
+	}
+	if cfg.SearchMaxLimit == 0 {
+		cfg.SearchMaxLimit = 100
+	}
 
 	normalizeWatchSets(cfg)
 }
 
 // normalizeWatchSets converts legacy watchDirs format to WatchSets,
-// or applies defaults to existing WatchSets.
+// or applies defaults to existing WatchSets, with the top-level extensions
+// as the default for sets that omit their own.
 func normalizeWatchSets(cfg *Config) {
 	if len(cfg.WatchSets) > 0 {
 		for i := range cfg.WatchSets {
-			applyWatchSetDefaults(&cfg.WatchSets[i])
+			applyWatchSetDefaults(&cfg.WatchSets[i], cfg.Extensions)
 		}
 		cfg.WatchDirs = cfg.AllWatchDirs()
 
@@ -124,7 +542,7 @@ func normalizeWatchSets(cfg *Config) {
 			MaxFileSize:     cfg.MaxFileSize,
 			MaxSnapshots:    cfg.MaxSnapshots,
 		}
-		applyWatchSetDefaults(&ws)
+		applyWatchSetDefaults(&ws, nil)
 		cfg.WatchSets = []WatchSet{ws}
 	}
 
@@ -137,12 +555,38 @@ func normalizeWatchSets(cfg *Config) {
 	cfg.MaxSnapshots = 0
 }
 
-func applyWatchSetDefaults(ws *WatchSet) {
+// applyWatchSetDefaults fills unset fields of ws. The extensionsPreset
+// expands into the set's own extensions; a set with neither inherits
+// globalExtensions. extraExtensions are then appended unless no extension
+// filter is in effect (all text files are tracked).
+func applyWatchSetDefaults(ws *WatchSet, globalExtensions []string) {
+	for _, ext := range extensionPresets[ws.ExtensionsPreset] {
+		if !slices.Contains(ws.Extensions, ext) {
+			ws.Extensions = append(ws.Extensions, ext)
+		}
+	}
+	if ws.Extensions == nil && len(globalExtensions) > 0 {
+		ws.Extensions = append([]string(nil), globalExtensions...)
+	}
+	if len(ws.Extensions) > 0 {
+		for _, ext := range ws.ExtraExtensions {
+			if !slices.Contains(ws.Extensions, ext) {
+				ws.Extensions = append(ws.Extensions, ext)
+			}
+		}
+	}
+
 	if ws.DebounceSec == 0 {
 		ws.DebounceSec = 2
 	}
 	if ws.MaxFileSize == 0 {
-		ws.MaxFileSize = 1048576 // 1MB
+		ws.MaxFileSize = DefaultMaxFileSize
+	}
+	if ws.MinFileSize == 0 {
+		ws.MinFileSize = 1
+	}
+	if ws.TruncateKeep == "" {
+		ws.TruncateKeep = TruncateKeepTail
 	}
 	if ws.ExcludePatterns == nil {
 		ws.ExcludePatterns = defaultExcludePatterns()
@@ -167,6 +611,21 @@ func validate(cfg Config) error {
 	if cfg.Port < 1 || cfg.Port > 65535 {
 		return errors.New("port must be between 1 and 65535")
 	}
+	if strings.ContainsAny(cfg.BasePath, " ?#{}") || slices.Contains(strings.Split(cfg.BasePath, "/"), "..") {
+		return fmt.Errorf("basePath %q must be a plain URL path", cfg.BasePath)
+	}
+	if cfg.HistoryDefaultLimit < 1 || cfg.HistoryMaxLimit < 1 {
+		return errors.New("historyDefaultLimit and historyMaxLimit must be >= 1")
+	}
+	if cfg.HistoryDefaultLimit > cfg.HistoryMaxLimit {
+		return errors.New("historyDefaultLimit must not exceed historyMaxLimit")
+	}
+	if cfg.SearchDefaultLimit < 1 || cfg.SearchMaxLimit < 1 {
+		return errors.New("searchDefaultLimit and searchMaxLimit must be >= 1")
+	}
+	if cfg.SearchDefaultLimit > cfg.SearchMaxLimit {
+		return errors.New("searchDefaultLimit must not exceed searchMaxLimit")
+	}
 	if cfg.BasicAuth != nil {
 		if cfg.BasicAuth.Username == "" {
 			return errors.New("basicAuth.username must not be empty when basicAuth is configured")
@@ -175,9 +634,99 @@ func validate(cfg Config) error {
 			return errors.New("basicAuth.password must not be empty when basicAuth is configured")
 		}
 	}
+	if cfg.Backup != nil {
+		if cfg.Backup.Dir == "" {
+			return errors.New("backup.dir must not be empty when backup is configured")
+		}
+		if cfg.Backup.IntervalSec < 1 {
+			return errors.New("backup.intervalSec must be >= 1")
+		}
+		if cfg.Backup.Keep < 1 {
+			return errors.New("backup.keep must be >= 1")
+		}
+	}
+
+	if cfg.ScanConcurrency < 1 {
+		return errors.New("scanConcurrency must be >= 1")
+	}
+	if cfg.MaxPendingTimers < 0 {
+		return errors.New("maxPendingTimers must be >= 0")
+	}
+	if cfg.MaxBatchSnapshots < 1 {
+		return errors.New("maxBatchSnapshots must be >= 1")
+	}
+	if cfg.MaxBatchBytes < 1 {
+		return errors.New("maxBatchBytes must be >= 1")
+	}
+	if cfg.MaxSSEClients < 1 {
+		return errors.New("maxSSEClients must be >= 1")
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		return errors.New("maxConcurrentRequests must be >= 0")
+	}
+	if cfg.RequestTimeoutSec < 1 {
+		return errors.New("requestTimeoutSec must be >= 1")
+	}
+	if cfg.TrashRetentionDays < 0 {
+		return errors.New("trashRetentionDays must be >= 0")
+	}
+	if cfg.MaxRenameAgeSec < 0 {
+		return errors.New("maxRenameAgeSec must be >= 0")
+	}
+	if cfg.RenameCollapseSec < 0 {
+		return errors.New("renameCollapseSec must be >= 0")
+	}
+	if cfg.MaxDiffBytes < 0 {
+		return errors.New("maxDiffBytes must be >= 0")
+	}
+	if cfg.RenameTimeoutMs < 0 {
+		return errors.New("renameTimeoutMs must be >= 0")
+	}
+	if cfg.MaxInitialDiffBytes < -1 {
+		return errors.New("maxInitialDiffBytes must be >= 1, or -1 for no limit")
+	}
+	if cfg.MaxDatabaseSize < 0 {
+		return errors.New("maxDatabaseSize must be >= 0")
+	}
+	if cfg.MaxTrackedFiles < 0 {
+		return errors.New("maxTrackedFiles must be >= 0")
+	}
+	if cfg.MaintenanceWindow != "" {
+		if _, _, err := parseHourRange(cfg.MaintenanceWindow); err != nil {
+			return err
+		}
+	}
+	if cfg.MaxDatabaseSizeMode != SizeModeReject && cfg.MaxDatabaseSizeMode != SizeModeEvict {
+		return fmt.Errorf("maxDatabaseSizeMode must be %q or %q", SizeModeReject, SizeModeEvict)
+	}
+	if cfg.OrderBy != OrderByDetected && cfg.OrderBy != OrderByMtime {
+		return fmt.Errorf("orderBy must be %q or %q", OrderByDetected, OrderByMtime)
+	}
+	if cfg.IDFormat != IDFormatUUIDv7 && cfg.IDFormat != IDFormatBase32 {
+		return fmt.Errorf("idFormat must be %q or %q", IDFormatUUIDv7, IDFormatBase32)
+	}
+	if cfg.DedupHash != DedupHashSHA256 && cfg.DedupHash != DedupHashXXHash {
+		return fmt.Errorf("dedupHash must be %q or %q", DedupHashSHA256, DedupHashXXHash)
+	}
+	if cfg.DedupWindow < -1 {
+		return errors.New("dedupWindow must be >= 1, or -1 for all snapshots")
+	}
+	if cfg.DatabaseDownloadMode != DownloadModeShare && cfg.DatabaseDownloadMode != DownloadModeReject {
+		return fmt.Errorf("databaseDownloadMode must be %q or %q", DownloadModeShare, DownloadModeReject)
+	}
+	if err := validateTmpDir(cfg.SnapshotTmpDir); err != nil {
+		return fmt.Errorf("snapshotTmpDir: %w", err)
+	}
+	if cfg.LogFormat != LogFormatText && cfg.LogFormat != LogFormatJSON {
+		return fmt.Errorf("logFormat must be %q or %q", LogFormatText, LogFormatJSON)
+	}
+	if _, err := cfg.SlogLevel(); err != nil {
+		return err
+	}
 
 	nameSet := make(map[string]struct{})
 	dirSet := make(map[string]struct{})
+	dbPathSet := map[string]struct{}{cfg.DBPath: {}}
 
 	for i, ws := range cfg.WatchSets {
 		if len(ws.Dirs) == 0 {
@@ -189,15 +738,52 @@ func validate(cfg Config) error {
 		if ws.MaxFileSize < 1 {
 			return fmt.Errorf("watchSets[%d].maxFileSize must be >= 1", i)
 		}
+		if ws.MinFileSize < 1 || ws.MinFileSize > ws.MaxFileSize {
+			return fmt.Errorf("watchSets[%d].minFileSize must be between 1 and maxFileSize", i)
+		}
 		if ws.MaxSnapshots < 0 {
 			return fmt.Errorf("watchSets[%d].maxSnapshots must be >= 0", i)
 		}
+		if ws.MaxInitialScanFiles < 0 {
+			return fmt.Errorf("watchSets[%d].maxInitialScanFiles must be >= 0", i)
+		}
+		if ws.MaxSnapshotsPerMinute < 0 {
+			return fmt.Errorf("watchSets[%d].maxSnapshotsPerMinute must be >= 0", i)
+		}
+		if ws.MaxStoredBytes < 0 {
+			return fmt.Errorf("watchSets[%d].maxStoredBytes must be >= 0", i)
+		}
+		if ws.TruncateKeep != TruncateKeepTail && ws.TruncateKeep != TruncateKeepHead {
+			return fmt.Errorf("watchSets[%d].truncateKeep must be %q or %q", i, TruncateKeepTail, TruncateKeepHead)
+		}
+		for _, p := range ws.RedactPatterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("watchSets[%d].redactPatterns: %w", i, err)
+			}
+		}
+		if _, ok := extensionPresets[ws.ExtensionsPreset]; ws.ExtensionsPreset != "" && !ok {
+			return fmt.Errorf("watchSets[%d].extensionsPreset %q is unknown (available: %s)",
+				i, ws.ExtensionsPreset, strings.Join(slices.Sorted(maps.Keys(extensionPresets)), ", "))
+		}
 
 		if _, exists := nameSet[ws.Name]; exists {
 			return fmt.Errorf("duplicate watchSet name %q", ws.Name)
 		}
 		nameSet[ws.Name] = struct{}{}
 
+		if err := validateTmpDir(ws.SnapshotTmpDir); err != nil {
+			return fmt.Errorf("watchSet %q snapshotTmpDir: %w", ws.Name, err)
+		}
+
+		// Every ":memory:" connection is a separate database, so only
+		// file paths and named shared-cache databases must be unique.
+		if ws.DBPath != "" && ws.DBPath != ":memory:" {
+			if _, exists := dbPathSet[ws.DBPath]; exists {
+				return fmt.Errorf("watchSet %q dbPath %q is already used by another database", ws.Name, ws.DBPath)
+			}
+			dbPathSet[ws.DBPath] = struct{}{}
+		}
+
 		for _, dir := range ws.Dirs {
 			if _, exists := dirSet[dir]; exists {
 				return fmt.Errorf("directory %q appears in multiple watchSets", dir)
@@ -205,6 +791,9 @@ func validate(cfg Config) error {
 			dirSet[dir] = struct{}{}
 
 			info, err := os.Stat(dir)
+			if errors.Is(err, os.ErrNotExist) && cfg.AllowMissingWatchDirs {
+				continue
+			}
 			if err != nil {
 				return fmt.Errorf("watchSet %q dir %q: %w", ws.Name, dir, err)
 			}
@@ -217,16 +806,126 @@ func validate(cfg Config) error {
 	return nil
 }
 
-// expandPath replaces a leading ~ with the user's home directory.
+// expandPath replaces a leading ~ with the current user's home directory and
+// a leading ~name with that user's home directory.
 func expandPath(path string) (string, error) {
 	if !strings.HasPrefix(path, "~") {
 		return path, nil
 	}
-	home, err := os.UserHomeDir()
+	name, rest, _ := strings.Cut(path[1:], "/")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("getting home directory: %w", err)
+		}
+		return filepath.Join(home, rest), nil
+	}
+	u, err := user.Lookup(name)
 	if err != nil {
-		return "", fmt.Errorf("getting home directory: %w", err)
+		return "", fmt.Errorf("looking up home directory of %q: %w", name, err)
+	}
+	return filepath.Join(u.HomeDir, rest), nil
+}
+
+// resolvePath expands ~ forms and makes a relative path absolute against
+// baseDir. Empty paths are returned unchanged.
+func resolvePath(path, baseDir string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	expanded, err := expandPath(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(expanded) {
+		expanded = filepath.Join(baseDir, expanded)
+	}
+	return filepath.Clean(expanded), nil
+}
+
+// validateTmpDir checks that dir, when set, is an existing directory.
+func validateTmpDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	return nil
+}
+
+// isMemoryDBPath reports whether a dbPath names an in-memory SQLite
+// database (":memory:" or a "file:" URI with mode=memory) instead of a file.
+// It mirrors db.IsMemoryPath without importing the db package.
+func isMemoryDBPath(path string) bool {
+	if path == ":memory:" || strings.HasPrefix(path, "file::memory:") {
+		return true
+	}
+	_, query, _ := strings.Cut(path, "?")
+	return strings.HasPrefix(path, "file:") && slices.Contains(strings.Split(query, "&"), "mode=memory")
+}
+
+// resolveDBPath is resolvePath for dbPath values, leaving in-memory
+// database names as they are.
+func resolveDBPath(path, baseDir string) (string, error) {
+	if isMemoryDBPath(path) {
+		return path, nil
+	}
+	return resolvePath(path, baseDir)
+}
+
+// resolvePaths applies resolvePath to dbPath, backup.dir, snapshotTmpDir,
+// the legacy watchDirs, and the dirs, dbPath and snapshotTmpDir of every
+// watch set.
+func resolvePaths(cfg *Config, baseDir string) error {
+	var err error
+	if cfg.DBPath, err = resolveDBPath(cfg.DBPath, baseDir); err != nil {
+		return fmt.Errorf("resolving dbPath: %w", err)
+	}
+	if cfg.SnapshotTmpDir, err = resolvePath(cfg.SnapshotTmpDir, baseDir); err != nil {
+		return fmt.Errorf("resolving snapshotTmpDir: %w", err)
 	}
-	return filepath.Join(home, path[1:]), nil
+	if cfg.Backup != nil {
+		if cfg.Backup.Dir, err = resolvePath(cfg.Backup.Dir, baseDir); err != nil {
+			return fmt.Errorf("resolving backup.dir: %w", err)
+		}
+	}
+	for i, dir := range cfg.WatchDirs {
+		if cfg.WatchDirs[i], err = resolvePath(dir, baseDir); err != nil {
+			return fmt.Errorf("resolving watchDirs[%d]: %w", i, err)
+		}
+	}
+	for i := range cfg.WatchSets {
+		ws := &cfg.WatchSets[i]
+		for j, dir := range ws.Dirs {
+			if ws.Dirs[j], err = resolvePath(dir, baseDir); err != nil {
+				return fmt.Errorf("resolving watchSets[%d].dirs[%d]: %w", i, j, err)
+			}
+		}
+		if ws.DBPath, err = resolveDBPath(ws.DBPath, baseDir); err != nil {
+			return fmt.Errorf("resolving watchSets[%d].dbPath: %w", i, err)
+		}
+		if ws.SnapshotTmpDir, err = resolvePath(ws.SnapshotTmpDir, baseDir); err != nil {
+			return fmt.Errorf("resolving watchSets[%d].snapshotTmpDir: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// extensionPresets maps each extensionsPreset name to the extensions it
+// expands to: the project's source files plus the config and docs formats
+// usually kept next to them.
+var extensionPresets = map[string][]string{
+	"go":     {".go", ".mod", ".sum", ".tmpl", ".proto", ".sql", ".md", ".yaml", ".yml", ".json", ".toml"},
+	"web":    {".html", ".htm", ".css", ".scss", ".sass", ".less", ".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".vue", ".svelte", ".md", ".yaml", ".yml", ".json"},
+	"python": {".py", ".pyi", ".pyx", ".cfg", ".ini", ".toml", ".txt", ".rst", ".md", ".yaml", ".yml", ".json"},
+	"rust":   {".rs", ".toml", ".md", ".yaml", ".yml", ".json"},
+	"java":   {".java", ".kt", ".kts", ".gradle", ".xml", ".properties", ".md", ".yaml", ".yml"},
+	"docs":   {".md", ".markdown", ".rst", ".txt", ".adoc", ".org", ".tex"},
 }
 
 func defaultExcludePatterns() []string {
@@ -2,9 +2,14 @@ package config
 
 import (
 	"encoding/json"
+	"log/slog"
 	"os"
+	"os/user"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad_ValidConfig(t *testing.T) {
@@ -83,6 +88,9 @@ func TestLoad_DefaultValues(t *testing.T) {
 	if ws.MaxFileSize != 1048576 {
 		t.Errorf("MaxFileSize = %d, want 1048576", ws.MaxFileSize)
 	}
+	if ws.MinFileSize != 1 {
+		t.Errorf("MinFileSize = %d, want 1", ws.MinFileSize)
+	}
 	if ws.MaxSnapshots != 0 {
 		t.Errorf("MaxSnapshots = %d, want 0", ws.MaxSnapshots)
 	}
@@ -175,6 +183,54 @@ func TestLoad_InvalidPort(t *testing.T) {
 	}
 }
 
+func TestLoad_PaginationLimits(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		extra   string
+		wantErr bool
+	}{
+		{"defaults", ``, false},
+		{"custom", `, "historyDefaultLimit": 100, "historyMaxLimit": 1000, "searchMaxLimit": 500`, false},
+		{"historyDefaultAboveMax", `, "historyDefaultLimit": 300`, true},
+		{"searchDefaultAboveMax", `, "searchDefaultLimit": 50, "searchMaxLimit": 40`, true},
+		{"negative", `, "historyMaxLimit": -1`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgPath := filepath.Join(dir, tt.name+".json")
+			content := `{"watchDirs": ["` + watchDir + `"]` + tt.extra + `}`
+			if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := Load(cfgPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Load() should error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error: %v", err)
+			}
+			if tt.name == "defaults" {
+				if cfg.HistoryDefaultLimit != 50 || cfg.HistoryMaxLimit != 200 ||
+					cfg.SearchDefaultLimit != 20 || cfg.SearchMaxLimit != 100 {
+					t.Errorf("limits = %d/%d/%d/%d, want 50/200/20/100",
+						cfg.HistoryDefaultLimit, cfg.HistoryMaxLimit, cfg.SearchDefaultLimit, cfg.SearchMaxLimit)
+				}
+			}
+		})
+	}
+}
+
 func TestLoad_TildeExpansion(t *testing.T) {
 	dir := t.TempDir()
 	watchDir := filepath.Join(dir, "watch")
@@ -278,6 +334,44 @@ func TestLoad_BasicAuthMissingPassword(t *testing.T) {
 	}
 }
 
+func TestLoad_Backup(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig := func(extra string) string {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"]` + extra + `}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return cfgPath
+	}
+
+	cfg, err := Load(writeConfig(`, "backup": {"dir": "backups"}`))
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.Backup == nil {
+		t.Fatal("Backup is nil")
+	}
+	if want := filepath.Join(dir, "backups"); cfg.Backup.Dir != want {
+		t.Errorf("Backup.Dir = %q, want %q", cfg.Backup.Dir, want)
+	}
+	if cfg.Backup.IntervalSec != 86400 || cfg.Backup.Keep != 7 {
+		t.Errorf("Backup = %+v, want intervalSec 86400 and keep 7", *cfg.Backup)
+	}
+
+	if _, err := Load(writeConfig(`, "backup": {"intervalSec": 60}`)); err == nil {
+		t.Error("Load() should error when backup.dir is empty")
+	}
+	if _, err := Load(writeConfig(`, "backup": {"dir": "b", "keep": -1}`)); err == nil {
+		t.Error("Load() should error on negative backup.keep")
+	}
+}
+
 func TestLoad_BasicAuthOmitted(t *testing.T) {
 	dir := t.TempDir()
 	watchDir := filepath.Join(dir, "watch")
@@ -615,6 +709,523 @@ func TestLoad_WatchSetAutoName(t *testing.T) {
 	}
 }
 
+func TestLoad_WatchSetDBPath(t *testing.T) {
+	dir := t.TempDir()
+	dirA := filepath.Join(dir, "a")
+	dirB := filepath.Join(dir, "b")
+	for _, d := range []string{dirA, dirB} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig := func(dbPathB string) string {
+		cfgPath := filepath.Join(dir, "config.json")
+		cfgData := map[string]any{
+			"watchSets": []map[string]any{
+				{"name": "A", "dirs": []string{dirA}},
+				{"name": "B", "dirs": []string{dirB}, "dbPath": dbPathB},
+			},
+			"dbPath": filepath.Join(dir, "history.db"),
+		}
+		data, err := json.Marshal(cfgData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cfgPath, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return cfgPath
+	}
+
+	cfg, err := Load(writeConfig(filepath.Join(dir, "b.db")))
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.WatchSets[0].DBPath != "" {
+		t.Errorf("A dbPath = %q, want empty", cfg.WatchSets[0].DBPath)
+	}
+	if cfg.WatchSets[1].DBPath != filepath.Join(dir, "b.db") {
+		t.Errorf("B dbPath = %q, want %q", cfg.WatchSets[1].DBPath, filepath.Join(dir, "b.db"))
+	}
+
+	// Sharing the global database file is rejected.
+	if _, err := Load(writeConfig(filepath.Join(dir, "history.db"))); err == nil {
+		t.Error("Load() should error when a watchSet dbPath equals the global dbPath")
+	}
+}
+
+func TestLoad_InMemoryDBPath(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(dir, "config.json")
+	data, err := json.Marshal(map[string]any{"watchDirs": []string{watchDir}, "dbPath": ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfgPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.DBPath != ":memory:" {
+		t.Errorf("dbPath = %q, want :memory: left unresolved", cfg.DBPath)
+	}
+}
+
+func TestLoad_SnapshotTmpDir(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	tmpDir := filepath.Join(dir, "tmp")
+	for _, d := range []string{watchDir, tmpDir} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig := func(globalTmp, setTmp string) string {
+		cfgPath := filepath.Join(dir, "config.json")
+		cfgData := map[string]any{
+			"watchSets": []map[string]any{
+				{"name": "A", "dirs": []string{watchDir}, "snapshotTmpDir": setTmp},
+			},
+			"dbPath":         filepath.Join(dir, "history.db"),
+			"snapshotTmpDir": globalTmp,
+		}
+		data, err := json.Marshal(cfgData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cfgPath, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return cfgPath
+	}
+
+	cfg, err := Load(writeConfig("./tmp", tmpDir))
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.SnapshotTmpDir != tmpDir {
+		t.Errorf("snapshotTmpDir = %q, want %q", cfg.SnapshotTmpDir, tmpDir)
+	}
+	if cfg.WatchSets[0].SnapshotTmpDir != tmpDir {
+		t.Errorf("watchSet snapshotTmpDir = %q, want %q", cfg.WatchSets[0].SnapshotTmpDir, tmpDir)
+	}
+
+	if _, err := Load(writeConfig(filepath.Join(dir, "missing"), "")); err == nil {
+		t.Error("Load() should error when snapshotTmpDir does not exist")
+	}
+	if _, err := Load(writeConfig("", filepath.Join(dir, "history.db.missing"))); err == nil {
+		t.Error("Load() should error when a watchSet snapshotTmpDir does not exist")
+	}
+}
+
+func TestLoad_MaxDatabaseSize(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig := func(extra string) string {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"]` + extra + `}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return cfgPath
+	}
+
+	cfg, err := Load(writeConfig(`, "maxDatabaseSize": 1048576`))
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.MaxDatabaseSize != 1048576 {
+		t.Errorf("MaxDatabaseSize = %d, want 1048576", cfg.MaxDatabaseSize)
+	}
+	if cfg.MaxDatabaseSizeMode != SizeModeReject {
+		t.Errorf("MaxDatabaseSizeMode = %q, want %q", cfg.MaxDatabaseSizeMode, SizeModeReject)
+	}
+
+	cfg, err = Load(writeConfig(`, "maxDatabaseSizeMode": "evict"`))
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.MaxDatabaseSizeMode != SizeModeEvict {
+		t.Errorf("MaxDatabaseSizeMode = %q, want %q", cfg.MaxDatabaseSizeMode, SizeModeEvict)
+	}
+
+	if _, err := Load(writeConfig(`, "maxDatabaseSizeMode": "drop"`)); err == nil {
+		t.Error("Load() should error on unknown maxDatabaseSizeMode")
+	}
+	if _, err := Load(writeConfig(`, "maxDatabaseSize": -1`)); err == nil {
+		t.Error("Load() should error on negative maxDatabaseSize")
+	}
+	if _, err := Load(writeConfig(`, "maxTrackedFiles": -1`)); err == nil {
+		t.Error("Load() should error on negative maxTrackedFiles")
+	}
+	if _, err := Load(writeConfig(`, "maxDiffBytes": -1`)); err == nil {
+		t.Error("Load() should error on negative maxDiffBytes")
+	}
+	if _, err := Load(writeConfig(`, "maxConcurrentRequests": -1`)); err == nil {
+		t.Error("Load() should error on negative maxConcurrentRequests")
+	}
+	if _, err := Load(writeConfig(`, "maxPendingTimers": -1`)); err == nil {
+		t.Error("Load() should error on negative maxPendingTimers")
+	}
+	if _, err := Load(writeConfig(`, "maxBatchSnapshots": -1`)); err == nil {
+		t.Error("Load() should error on negative maxBatchSnapshots")
+	}
+	if _, err := Load(writeConfig(`, "maxBatchBytes": -1`)); err == nil {
+		t.Error("Load() should error on negative maxBatchBytes")
+	}
+	if _, err := Load(writeConfig(`, "requestTimeoutSec": -1`)); err == nil {
+		t.Error("Load() should error on negative requestTimeoutSec")
+	}
+	if _, err := Load(writeConfig(`, "maxRenameAgeSec": -1`)); err == nil {
+		t.Error("Load() should error on negative maxRenameAgeSec")
+	}
+}
+
+func TestLoad_DatabaseDownloadMode(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		json    string
+		want    string
+		wantErr bool
+	}{
+		{``, DownloadModeShare, false},
+		{`, "databaseDownloadMode": "reject"`, DownloadModeReject, false},
+		{`, "databaseDownloadMode": "queue"`, "", true},
+	}
+	for _, tt := range tests {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"]` + tt.json + `}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(cfgPath)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Load(%s) should error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Load(%s) error: %v", tt.json, err)
+		}
+		if cfg.DatabaseDownloadMode != tt.want {
+			t.Errorf("DatabaseDownloadMode = %q, want %q", cfg.DatabaseDownloadMode, tt.want)
+		}
+	}
+}
+
+func TestLoad_Logging(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		json       string
+		wantFormat string
+		wantLevel  slog.Level
+		wantErr    bool
+	}{
+		{``, LogFormatText, slog.LevelInfo, false},
+		{`, "logFormat": "json", "logLevel": "debug"`, LogFormatJSON, slog.LevelDebug, false},
+		{`, "logLevel": "warn"`, LogFormatText, slog.LevelWarn, false},
+		{`, "logFormat": "xml"`, "", 0, true},
+		{`, "logLevel": "verbose"`, "", 0, true},
+	}
+	for _, tt := range tests {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"]` + tt.json + `}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(cfgPath)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Load(%s) should error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Load(%s) error: %v", tt.json, err)
+		}
+		if cfg.LogFormat != tt.wantFormat {
+			t.Errorf("LogFormat = %q, want %q", cfg.LogFormat, tt.wantFormat)
+		}
+		if level, _ := cfg.SlogLevel(); level != tt.wantLevel {
+			t.Errorf("SlogLevel() = %v, want %v", level, tt.wantLevel)
+		}
+	}
+}
+
+func TestLoad_OrderBy(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		json    string
+		want    string
+		wantErr bool
+	}{
+		{``, OrderByDetected, false},
+		{`, "orderBy": "mtime"`, OrderByMtime, false},
+		{`, "orderBy": "size"`, "", true},
+	}
+	for _, tt := range tests {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"]` + tt.json + `}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(cfgPath)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Load(%s) should error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Load(%s) error: %v", tt.json, err)
+		}
+		if cfg.OrderBy != tt.want {
+			t.Errorf("OrderBy = %q, want %q", cfg.OrderBy, tt.want)
+		}
+	}
+}
+
+func TestLoad_MaintenanceWindow(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, window := range []string{"2", "5-5", "24-3", "1-25", "a-b"} {
+		cfgPath := filepath.Join(dir, "config.json")
+		content := `{"watchDirs": ["` + watchDir + `"], "maintenanceWindow": "` + window + `"}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(cfgPath); err == nil {
+			t.Errorf("Load(maintenanceWindow=%q) should error", window)
+		}
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local) }
+	tests := []struct {
+		window string
+		hour   int
+		want   bool
+	}{
+		{"", 12, true},
+		{"2-5", 2, true},
+		{"2-5", 4, true},
+		{"2-5", 5, false},
+		{"2-5", 1, false},
+		{"22-4", 23, true},
+		{"22-4", 3, true},
+		{"22-4", 12, false},
+		{"0-24", 23, true},
+	}
+	for _, tt := range tests {
+		cfg := Config{MaintenanceWindow: tt.window}
+		if got := cfg.InMaintenanceWindow(at(tt.hour)); got != tt.want {
+			t.Errorf("InMaintenanceWindow(%q) at %d:30 = %v, want %v", tt.window, tt.hour, got, tt.want)
+		}
+	}
+}
+
+func TestLoad_GlobalExtensionsWithOverrides(t *testing.T) {
+	dir := t.TempDir()
+	var dirs []string
+	for _, name := range []string{"inherit", "extra", "replace", "replaceExtra"} {
+		d := filepath.Join(dir, name)
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, d)
+	}
+
+	cfgPath := filepath.Join(dir, "config.json")
+	cfgData := map[string]any{
+		"extensions": []string{".go", ".md"},
+		"watchSets": []map[string]any{
+			{"name": "inherit", "dirs": []string{dirs[0]}},
+			{"name": "extra", "dirs": []string{dirs[1]}, "extraExtensions": []string{".sql", ".go"}},
+			{"name": "replace", "dirs": []string{dirs[2]}, "extensions": []string{".py"}},
+			{"name": "replaceExtra", "dirs": []string{dirs[3]}, "extensions": []string{".py"}, "extraExtensions": []string{".toml"}},
+		},
+		"dbPath": filepath.Join(dir, "history.db"),
+	}
+	data, err := json.Marshal(cfgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfgPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+
+	want := map[string][]string{
+		"inherit":      {".go", ".md"},
+		"extra":        {".go", ".md", ".sql"},
+		"replace":      {".py"},
+		"replaceExtra": {".py", ".toml"},
+	}
+	for _, ws := range cfg.WatchSets {
+		if !slices.Equal(ws.Extensions, want[ws.Name]) {
+			t.Errorf("%s extensions = %v, want %v", ws.Name, ws.Extensions, want[ws.Name])
+		}
+	}
+	if cfg.Extensions != nil {
+		t.Errorf("global extensions should be cleared after normalization, got %v", cfg.Extensions)
+	}
+}
+
+func TestApplyWatchSetDefaults_ExtensionsPreset(t *testing.T) {
+	tests := []struct {
+		preset string
+		want   []string
+	}{
+		{"go", []string{".go", ".mod", ".sum", ".tmpl", ".proto", ".sql", ".md", ".yaml", ".yml", ".json", ".toml"}},
+		{"web", []string{".html", ".htm", ".css", ".scss", ".sass", ".less", ".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".vue", ".svelte", ".md", ".yaml", ".yml", ".json"}},
+		{"python", []string{".py", ".pyi", ".pyx", ".cfg", ".ini", ".toml", ".txt", ".rst", ".md", ".yaml", ".yml", ".json"}},
+		{"rust", []string{".rs", ".toml", ".md", ".yaml", ".yml", ".json"}},
+		{"java", []string{".java", ".kt", ".kts", ".gradle", ".xml", ".properties", ".md", ".yaml", ".yml"}},
+		{"docs", []string{".md", ".markdown", ".rst", ".txt", ".adoc", ".org", ".tex"}},
+	}
+	if len(tests) != len(extensionPresets) {
+		t.Errorf("%d presets tested, %d defined", len(tests), len(extensionPresets))
+	}
+	for _, tt := range tests {
+		// Global extensions are not inherited by a set with a preset
+		ws := WatchSet{Dirs: []string{"/tmp"}, ExtensionsPreset: tt.preset}
+		applyWatchSetDefaults(&ws, []string{".global"})
+		if !slices.Equal(ws.Extensions, tt.want) {
+			t.Errorf("preset %q extensions = %v, want %v", tt.preset, ws.Extensions, tt.want)
+		}
+	}
+
+	// Explicit and extra extensions combine with the preset without duplicates
+	ws := WatchSet{
+		Dirs:             []string{"/tmp"},
+		Extensions:       []string{".sh", ".go"},
+		ExtensionsPreset: "rust",
+		ExtraExtensions:  []string{".lock", ".rs"},
+	}
+	applyWatchSetDefaults(&ws, nil)
+	want := []string{".sh", ".go", ".rs", ".toml", ".md", ".yaml", ".yml", ".json", ".lock"}
+	if !slices.Equal(ws.Extensions, want) {
+		t.Errorf("combined extensions = %v, want %v", ws.Extensions, want)
+	}
+}
+
+func TestLoad_UnknownExtensionsPreset(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.json")
+	content := `{"watchSets": [{"dirs": ["` + dir + `"], "extensionsPreset": "cobol"}], "dbPath": "` + filepath.Join(dir, "history.db") + `"}`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(cfgPath)
+	if err == nil || !strings.Contains(err.Error(), "extensionsPreset") {
+		t.Errorf("Load() error = %v, want unknown extensionsPreset error", err)
+	}
+}
+
+func TestLoad_MaxStoredBytes(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.json")
+	load := func(extra string) (Config, error) {
+		content := `{"watchSets": [{"dirs": ["` + dir + `"]` + extra + `}], "dbPath": "` + filepath.Join(dir, "history.db") + `"}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return Load(cfgPath)
+	}
+
+	cfg, err := load(`, "maxStoredBytes": 65536`)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if ws := cfg.WatchSets[0]; ws.MaxStoredBytes != 65536 || ws.TruncateKeep != TruncateKeepTail {
+		t.Errorf("maxStoredBytes = %d truncateKeep = %q, want 65536 %q", ws.MaxStoredBytes, ws.TruncateKeep, TruncateKeepTail)
+	}
+	if _, err := load(`, "truncateKeep": "middle"`); err == nil || !strings.Contains(err.Error(), "truncateKeep") {
+		t.Errorf("Load() error = %v, want truncateKeep error", err)
+	}
+	if _, err := load(`, "maxStoredBytes": -1`); err == nil || !strings.Contains(err.Error(), "maxStoredBytes") {
+		t.Errorf("Load() error = %v, want maxStoredBytes error", err)
+	}
+}
+
+func TestLoad_BasePath(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.json")
+	load := func(basePath string) (Config, error) {
+		content := `{"watchSets": [{"dirs": ["` + dir + `"]}], "dbPath": "` + filepath.Join(dir, "history.db") + `", "basePath": "` + basePath + `"}`
+		if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return Load(cfgPath)
+	}
+
+	for in, want := range map[string]string{"": "", "/": "", "history": "/history", "/history/": "/history", "/a/b": "/a/b"} {
+		cfg, err := load(in)
+		if err != nil {
+			t.Fatalf("Load(basePath %q) error: %v", in, err)
+		}
+		if cfg.BasePath != want {
+			t.Errorf("basePath %q normalized to %q, want %q", in, cfg.BasePath, want)
+		}
+	}
+	for _, bad := range []string{"/a b", "/x/../y", "/q?x=1"} {
+		if _, err := load(bad); err == nil || !strings.Contains(err.Error(), "basePath") {
+			t.Errorf("Load(basePath %q) error = %v, want basePath error", bad, err)
+		}
+	}
+}
+
+func TestLoad_InvalidRedactPattern(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.json")
+	content := `{"watchSets": [{"dirs": ["` + dir + `"], "redactPatterns": ["(unclosed"]}], "dbPath": "` + filepath.Join(dir, "history.db") + `"}`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(cfgPath)
+	if err == nil || !strings.Contains(err.Error(), "redactPatterns") {
+		t.Errorf("Load() error = %v, want redactPatterns error", err)
+	}
+}
+
 func TestLoad_LegacyConversionPreservesSettings(t *testing.T) {
 	dir := t.TempDir()
 	watchDir := filepath.Join(dir, "watch")
@@ -680,3 +1291,182 @@ func TestAllWatchDirs(t *testing.T) {
 		t.Errorf("AllWatchDirs() = %v, want [/a /b /c]", dirs)
 	}
 }
+
+func TestLoad_RelativePathsResolveAgainstConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	cfgDir := filepath.Join(dir, "etc")
+	for _, d := range []string{cfgDir, filepath.Join(cfgDir, "project"), filepath.Join(cfgDir, "legacy")} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfgPath := filepath.Join(cfgDir, "config.json")
+	content := `{
+		"dbPath": "data/history.db",
+		"watchSets": [{"name": "P", "dirs": ["./project"], "dbPath": "../p.db"}]
+	}`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The working directory must not matter.
+	t.Chdir(dir)
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if want := filepath.Join(cfgDir, "data", "history.db"); cfg.DBPath != want {
+		t.Errorf("DBPath = %q, want %q", cfg.DBPath, want)
+	}
+	if want := filepath.Join(cfgDir, "project"); cfg.WatchSets[0].Dirs[0] != want {
+		t.Errorf("Dirs[0] = %q, want %q", cfg.WatchSets[0].Dirs[0], want)
+	}
+	if want := filepath.Join(dir, "p.db"); cfg.WatchSets[0].DBPath != want {
+		t.Errorf("watchSet DBPath = %q, want %q", cfg.WatchSets[0].DBPath, want)
+	}
+
+	legacyPath := filepath.Join(cfgDir, "legacy.json")
+	if err := os.WriteFile(legacyPath, []byte(`{"watchDirs": ["legacy"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(legacyPath)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if want := filepath.Join(cfgDir, "legacy"); cfg.WatchSets[0].Dirs[0] != want {
+		t.Errorf("legacy Dirs[0] = %q, want %q", cfg.WatchSets[0].Dirs[0], want)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user")
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/abs/path", "/abs/path"},
+		{"~", home},
+		{"~/data/h.db", filepath.Join(home, "data/h.db")},
+		{"~" + u.Username + "/data", filepath.Join(u.HomeDir, "data")},
+	}
+	for _, tt := range tests {
+		got, err := expandPath(tt.in)
+		if err != nil {
+			t.Errorf("expandPath(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := expandPath("~no-such-user-xyz/data"); err == nil {
+		t.Error("expandPath() should error for an unknown user")
+	}
+}
+
+func TestLoadMany_MergesFiles(t *testing.T) {
+	dir := t.TempDir()
+	dirA := filepath.Join(dir, "a")
+	dirB := filepath.Join(dir, "b")
+	dirC := filepath.Join(dir, "c")
+	for _, d := range []string{dirA, dirB, dirC} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := filepath.Join(dir, "base.json")
+	baseContent := `{
+		"port": 1111,
+		"bindAddress": "127.0.0.1",
+		"watchSets": [
+			{"name": "a", "dirs": ["` + dirA + `"], "debounceSec": 5},
+			{"name": "b", "dirs": ["` + dirB + `"]}
+		]
+	}`
+	if err := os.WriteFile(base, []byte(baseContent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "local.json")
+	localContent := `{
+		"port": 2222,
+		"watchSets": [
+			{"name": "b", "dirs": ["` + dirB + `"], "debounceSec": 9},
+			{"name": "c", "dirs": ["` + dirC + `"]}
+		]
+	}`
+	if err := os.WriteFile(local, []byte(localContent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadMany([]string{base, local})
+	if err != nil {
+		t.Fatalf("LoadMany() error: %v", err)
+	}
+
+	if cfg.Port != 2222 {
+		t.Errorf("Port = %d, want 2222 (overridden)", cfg.Port)
+	}
+	if cfg.BindAddress != "127.0.0.1" {
+		t.Errorf("BindAddress = %s, want 127.0.0.1 (kept from base)", cfg.BindAddress)
+	}
+	if len(cfg.WatchSets) != 3 {
+		t.Fatalf("WatchSets length = %d, want 3", len(cfg.WatchSets))
+	}
+	wantNames := []string{"a", "b", "c"}
+	for i, name := range wantNames {
+		if cfg.WatchSets[i].Name != name {
+			t.Errorf("WatchSets[%d].Name = %s, want %s", i, cfg.WatchSets[i].Name, name)
+		}
+	}
+	if cfg.WatchSets[0].DebounceSec != 5 {
+		t.Errorf("set a DebounceSec = %d, want 5", cfg.WatchSets[0].DebounceSec)
+	}
+	if cfg.WatchSets[1].DebounceSec != 9 {
+		t.Errorf("set b DebounceSec = %d, want 9 (replaced by overlay)", cfg.WatchSets[1].DebounceSec)
+	}
+}
+
+func TestLoadMany_ValidatesMergedResult(t *testing.T) {
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base alone is incomplete; only the merged config is valid
+	base := filepath.Join(dir, "base.json")
+	if err := os.WriteFile(base, []byte(`{"port": 3333}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "local.json")
+	if err := os.WriteFile(local, []byte(`{"watchSets": [{"name": "w", "dirs": ["`+watchDir+`"]}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(base); err == nil {
+		t.Error("Load(base) should fail validation on its own")
+	}
+	cfg, err := LoadMany([]string{base, local})
+	if err != nil {
+		t.Fatalf("LoadMany() error: %v", err)
+	}
+	if cfg.Port != 3333 || len(cfg.WatchSets) != 1 {
+		t.Errorf("merged config = port %d, %d watch sets; want 3333, 1", cfg.Port, len(cfg.WatchSets))
+	}
+
+	if _, err := LoadMany(nil); err == nil {
+		t.Error("LoadMany(nil) should error")
+	}
+}
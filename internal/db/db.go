@@ -1,26 +1,120 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/google/uuid"
+	"github.com/klauspost/compress/dict"
 	"github.com/klauspost/compress/zstd"
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/sys/unix"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/unok/local-text-history/internal/diff"
+)
+
+// driverName is the SQLite driver with the casefold() SQL function used by
+// case-insensitive path search, since SQLite's own LIKE and NOCASE only fold
+// ASCII, and basename() used to sort files by name.
+const driverName = "sqlite3_texthistory"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("casefold", strings.ToLower, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("basename", filepath.Base, true)
+		},
+	})
+}
+
+// MatchMode selects how path search queries are compared with paths.
+type MatchMode int
+
+const (
+	// MatchCaseInsensitive matches the query anywhere in the path ignoring
+	// case, including non-ASCII letters. It is the default.
+	MatchCaseInsensitive MatchMode = iota
+	// MatchExact matches the query anywhere in the path as is.
+	MatchExact
 )
 
+// pathContains returns a WHERE fragment matching column against one query
+// argument. The query is a literal substring; % and _ are not wildcards.
+func pathContains(column string, mode []MatchMode) string {
+	if len(mode) > 0 && mode[0] == MatchExact {
+		return "instr(" + column + ", ?) > 0"
+	}
+	return "instr(casefold(" + column + "), casefold(?)) > 0"
+}
+
+// FileSortKey is the field file search results are sorted by.
+type FileSortKey int
+
+const (
+	// SortByUpdated sorts by the time of the latest snapshot. It is the
+	// default.
+	SortByUpdated FileSortKey = iota
+	// SortByCreated sorts by when the file was first tracked.
+	SortByCreated
+	// SortByPath sorts by the full path.
+	SortByPath
+	// SortByName sorts by the last path element, then the full path.
+	SortByName
+)
+
+// FileOrder selects the order of file search results. The zero value
+// lists the most recently updated files first.
+type FileOrder struct {
+	Key       FileSortKey
+	Ascending bool
+}
+
+// orderBy returns the ORDER BY clause for o. Only fixed column names are
+// used, so the clause never contains caller-provided text.
+func (o FileOrder) orderBy() string {
+	dir := " DESC"
+	if o.Ascending {
+		dir = " ASC"
+	}
+	switch o.Key {
+	case SortByCreated:
+		return "created" + dir + ", id" + dir
+	case SortByPath:
+		return "path" + dir
+	case SortByName:
+		return "basename(path)" + dir + ", path" + dir
+	default:
+		return "updated" + dir + ", id" + dir
+	}
+}
+
 // File represents a tracked file record.
 type File struct {
-	ID      string `json:"id"`
-	Path    string `json:"path"`
-	Created int64  `json:"created"`
-	Updated int64  `json:"updated"`
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+	WatchSet string `json:"watchSet"`
 }
 
 // Snapshot represents a file snapshot record.
@@ -31,9 +125,14 @@ type Snapshot struct {
 	Size      int64  `json:"size"`
 	Hash      string `json:"hash"`
 	Timestamp int64  `json:"timestamp"`
+	LineCount int    `json:"lineCount"` // -1 when unknown (recorded before line counts were stored)
+	Encoding  string `json:"encoding"`  // original encoding when Content was transcoded to UTF-8, else ""
+	Binary    bool   `json:"binary"`    // metadata-only entry for a binary file; Content is empty
+	ModTime   int64  `json:"mtime"`     // file mtime (unix seconds) when captured; 0 if unknown
+	Truncated bool   `json:"truncated"` // Content is only part of the file; see SnapshotRequest.Truncated
 }
 
-// HistoryEntry represents a recent snapshot or rename event with file path information.
+// HistoryEntry represents a recent snapshot, rename or deletion event with file path information.
 type HistoryEntry struct {
 	SnapshotID  string `json:"snapshotId"`
 	FileID      string `json:"fileId"`
@@ -43,6 +142,57 @@ type HistoryEntry struct {
 	Timestamp   int64  `json:"timestamp"`
 	EntryType   string `json:"entryType"`
 	OldFilePath string `json:"oldFilePath,omitempty"`
+	WatchSet    string `json:"watchSet"`
+	LineCount   int    `json:"lineCount"`
+	Preview     string `json:"preview"`     // leading text of the snapshot; empty for renames and older rows
+	Origin      string `json:"origin"`      // event that triggered the snapshot; empty for renames and older rows
+	FileCreated int64  `json:"fileCreated"` // when the file was first tracked
+	// IsNewFile marks the first snapshot of a file that did not get its
+	// path from a rename; always false for rename entries.
+	IsNewFile bool `json:"isNewFile"`
+	// BecameBinary marks a binary entry whose previous snapshot of the same
+	// file was text, i.e. where its text history ends.
+	BecameBinary bool `json:"becameBinary"`
+}
+
+// ActivityBucket counts the snapshots and renames recorded in one time
+// bucket of ActivityHistogram.
+type ActivityBucket struct {
+	Start   int64 `json:"start"` // unix seconds, a multiple of the bucket size
+	Saves   int   `json:"saves"`
+	Renames int   `json:"renames"`
+}
+
+// CompressionStats compares the logical size of stored snapshot content with
+// the bytes it takes in the snapshots table.
+type CompressionStats struct {
+	Snapshots    int     `json:"snapshots"`
+	LogicalBytes int64   `json:"logicalBytes"` // SUM(size): uncompressed content length
+	StoredBytes  int64   `json:"storedBytes"`  // SUM(LENGTH(content)): bytes after compression
+	Ratio        float64 `json:"ratio"`        // StoredBytes / LogicalBytes, 0 when nothing is stored
+}
+
+// RecentFile is a file with the metadata of its latest snapshot.
+type RecentFile struct {
+	File           File     `json:"file"`
+	LatestSnapshot Snapshot `json:"latestSnapshot"` // Content is not loaded
+}
+
+// StaleFile is a file without recent changes and the storage its snapshots
+// take.
+type StaleFile struct {
+	File      File  `json:"file"`
+	Snapshots int   `json:"snapshots"`
+	TotalSize int64 `json:"totalSize"` // SUM(size) of the snapshots
+}
+
+// ExtensionStats counts the tracked files and snapshots with one file
+// extension.
+type ExtensionStats struct {
+	Extension string `json:"extension"` // lowercased, with the dot; "" for files without one
+	Files     int    `json:"files"`
+	Snapshots int    `json:"snapshots"`
+	Bytes     int64  `json:"bytes"` // SUM(size) of the snapshots
 }
 
 // Rename represents a file rename record.
@@ -55,27 +205,186 @@ type Rename struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+// Paths are stored exactly as the filesystem reported them, which on Unix
+// need not be valid UTF-8. encoding/json replaces invalid bytes with U+FFFD,
+// so such a path is displayable but no longer names the file. The JSON
+// forms of File, HistoryEntry and Rename therefore add a base64 "...Raw"
+// field with the exact bytes next to every path that is not valid UTF-8.
+
+// RawPath returns path base64-encoded if it is not valid UTF-8, or "" if it
+// survives JSON encoding unchanged.
+func RawPath(path string) string {
+	if utf8.ValidString(path) {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(path))
+}
+
+// MarshalJSON adds pathRaw for a path that is not valid UTF-8.
+func (f File) MarshalJSON() ([]byte, error) {
+	type file File
+	return json.Marshal(struct {
+		file
+		PathRaw string `json:"pathRaw,omitempty"`
+	}{file(f), RawPath(f.Path)})
+}
+
+// MarshalJSON adds filePathRaw and oldFilePathRaw for paths that are not
+// valid UTF-8.
+func (e HistoryEntry) MarshalJSON() ([]byte, error) {
+	type historyEntry HistoryEntry
+	return json.Marshal(struct {
+		historyEntry
+		FilePathRaw    string `json:"filePathRaw,omitempty"`
+		OldFilePathRaw string `json:"oldFilePathRaw,omitempty"`
+	}{historyEntry(e), RawPath(e.FilePath), RawPath(e.OldFilePath)})
+}
+
+// MarshalJSON adds oldPathRaw and newPathRaw for paths that are not valid
+// UTF-8.
+func (r Rename) MarshalJSON() ([]byte, error) {
+	type rename Rename
+	return json.Marshal(struct {
+		rename
+		OldPathRaw string `json:"oldPathRaw,omitempty"`
+		NewPathRaw string `json:"newPathRaw,omitempty"`
+	}{rename(r), RawPath(r.OldPath), RawPath(r.NewPath)})
+}
+
+// SnapshotRequest describes a single snapshot to persist.
+type SnapshotRequest struct {
+	FilePath     string
+	Content      []byte
+	MaxSnapshots int    // per-file snapshot limit (0 = unlimited)
+	WatchSet     string // name of the WatchSet that captured the file
+	Encoding     string // original encoding if Content was transcoded to UTF-8
+	Binary       bool   // record size and hash only; Content is not stored
+	ModTime      int64  // file mtime in unix seconds (0 = unknown)
+	Origin       string // what triggered the snapshot, e.g. "write" or "scan" (diagnostic)
+	// Truncated marks Content as only the leading or trailing part of a
+	// file larger than its WatchSet's maxStoredBytes.
+	Truncated bool
+	// Fingerprint is the file's size and mtime when it was read. It is
+	// recorded even when the content is unchanged; zero leaves it as is.
+	Fingerprint FileFingerprint
+	// NormalizeLineEndings detects duplicates by a hash over Content with
+	// CRLF converted to LF, so line-ending-only changes are skipped.
+	// Content and its hash are stored unchanged.
+	NormalizeLineEndings bool
+	// IgnoreDedupWindow only skips Content identical to the latest
+	// snapshot, so content matching an older snapshot within the
+	// dedupWindow is saved again as the newest one.
+	IgnoreDedupWindow bool
+}
+
+// FileFingerprint is the size and mtime a file had when it was last read,
+// used to skip re-reading unchanged files during startup scans.
+type FileFingerprint struct {
+	Size    int64
+	ModTime int64 // unix nanoseconds
+}
+
 // Stats holds aggregate statistics.
 type Stats struct {
 	TotalFiles     int   `json:"totalFiles"`
 	TotalSnapshots int   `json:"totalSnapshots"`
 	TotalSize      int64 `json:"totalSize"`
+	TotalRenames   int   `json:"totalRenames"`
 }
 
+// Compression markers stored in snapshots.compression.
+const (
+	compressionZstd     = "zstd"
+	compressionZstdDict = "zstd-dict" // zstd with a trained dictionary; see TrainDictionary
+	compressionNone     = "none"
+)
+
 // DB wraps a SQLite database connection for file history operations.
 type DB struct {
-	db      *sql.DB
-	encoder *zstd.Encoder
-	decoder *zstd.Decoder
+	db                   *sql.DB
+	encoder              *zstd.Encoder
+	noCompressExtensions []string
+	newID                func() string // generates IDs for new rows; see SetIDGenerator
+	logger               *slog.Logger
+
+	// Replaced when a dictionary is trained; guarded by codecMu. The
+	// decoder knows every stored dictionary, dictEncoder (nil until one is
+	// trained) uses the newest.
+	codecMu     sync.RWMutex
+	decoder     *zstd.Decoder
+	dictEncoder *zstd.Encoder
+
+	// Size limit state; see SetSizeLimit.
+	sizeMu        sync.Mutex
+	sizeLimit     int64
+	sizeEvict     bool
+	sizeCheckedAt time.Time
+	sizeExceeded  bool
+
+	// orderByMtime sorts snapshot lists by file mtime instead of detection
+	// time; see SetOrderByMtime.
+	orderByMtime bool
+
+	// renameCollapseSec is the window for merging rename chains in the
+	// history feed; see SetRenameCollapseWindow.
+	renameCollapseSec int64
+
+	// xxhashDedup hashes new snapshots with xxhash instead of SHA-256; see
+	// SetDedupHash.
+	xxhashDedup bool
+
+	// maxTrackedFiles caps the number of files kept; see SetMaxTrackedFiles.
+	maxTrackedFiles int
+
+	// carryOverOnRename gives renamed files a copy of their last snapshot;
+	// see SetCarryOverOnRename.
+	carryOverOnRename bool
+
+	// dedupWindow is how many recent snapshots a save is deduplicated
+	// against; see SetDedupWindow.
+	dedupWindow int
+}
+
+// ErrDatabaseFull is returned for snapshot saves rejected because the
+// database has reached its configured size limit.
+var ErrDatabaseFull = errors.New("database size limit reached")
+
+// sizeCheckInterval bounds how often the database size is measured on the
+// save path.
+const sizeCheckInterval = 30 * time.Second
+
+// evictBatchSize is the number of snapshots deleted per eviction round.
+const evictBatchSize = 100
+
+// IsMemoryPath reports whether dbPath names an in-memory SQLite database,
+// such as ":memory:" or "file::memory:?cache=shared", rather than a file.
+func IsMemoryPath(dbPath string) bool {
+	if dbPath == ":memory:" || strings.HasPrefix(dbPath, "file::memory:") {
+		return true
+	}
+	_, query, _ := strings.Cut(dbPath, "?")
+	return strings.HasPrefix(dbPath, "file:") && slices.Contains(strings.Split(query, "&"), "mode=memory")
 }
 
 // New opens a SQLite database at the given path, enables WAL mode and
-// foreign keys, creates the schema, and returns a DB instance.
+// foreign keys, creates the schema, and returns a DB instance. An in-memory
+// path (see IsMemoryPath) is served over a single connection, since every
+// new connection would otherwise open a separate empty database; its data
+// is lost when the DB is closed.
 func New(dbPath string) (*DB, error) {
-	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_busy_timeout=5000")
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	sqlDB, err := sql.Open(driverName, dbPath+sep+"_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
+	if IsMemoryPath(dbPath) {
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetConnMaxIdleTime(0)
+		sqlDB.SetConnMaxLifetime(0)
+	}
 
 	if err := sqlDB.Ping(); err != nil {
 		sqlDB.Close()
@@ -91,6 +400,13 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("setting synchronous mode: %w", err)
 	}
 
+	// Must run before createSchema, which would otherwise recreate an empty
+	// files table next to a leftover files_new.
+	if err := recoverPartialMigration(sqlDB); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("recovering partial migration: %w", err)
+	}
+
 	if err := createSchema(sqlDB); err != nil {
 		sqlDB.Close()
 		return nil, fmt.Errorf("creating schema: %w", err)
@@ -101,24 +417,29 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("migrating schema: %w", err)
 	}
 
-	encoder, err := zstd.NewWriter(nil)
-	if err != nil {
+	if err := addMissingColumns(sqlDB); err != nil {
 		sqlDB.Close()
-		return nil, fmt.Errorf("creating zstd encoder: %w", err)
+		return nil, fmt.Errorf("adding columns: %w", err)
 	}
 
-	decoder, err := zstd.NewReader(nil)
+	encoder, err := zstd.NewWriter(nil)
 	if err != nil {
 		sqlDB.Close()
-		encoder.Close()
-		return nil, fmt.Errorf("creating zstd decoder: %w", err)
+		return nil, fmt.Errorf("creating zstd encoder: %w", err)
 	}
 
-	return &DB{
+	d := &DB{
 		db:      sqlDB,
 		encoder: encoder,
-		decoder: decoder,
-	}, nil
+		newID:   newUUIDv7,
+		logger:  slog.Default(),
+	}
+	if err := d.loadDictionaries(); err != nil {
+		sqlDB.Close()
+		encoder.Close()
+		return nil, fmt.Errorf("loading zstd dictionaries: %w", err)
+	}
+	return d, nil
 }
 
 func createSchema(db *sql.DB) error {
@@ -154,13 +475,131 @@ func createSchema(db *sql.DB) error {
 
 	CREATE INDEX IF NOT EXISTS idx_renames_old_file ON renames(old_file_id, timestamp DESC);
 	CREATE INDEX IF NOT EXISTS idx_renames_new_file ON renames(new_file_id, timestamp DESC);
+
+	CREATE TABLE IF NOT EXISTS deletions (
+		id        TEXT PRIMARY KEY,
+		file_id   TEXT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		path      TEXT NOT NULL,
+		timestamp INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_deletions_file ON deletions(file_id, timestamp DESC);
+
+	CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	);
 	`
 	_, err := db.Exec(schema)
 	return err
 }
 
+// recoverPartialMigration repairs the state left behind if a migration was
+// interrupted after files_new/snapshots_new were created. The migration itself
+// runs in a single transaction, so this only matters for databases touched by
+// an interrupted older build or manual intervention.
+//
+// If the original files and snapshots tables are both still present, nothing
+// has been dropped yet and the migration is rolled back by dropping the _new
+// tables (it will run again from scratch). If files already has the new
+// schema it holds the live data, so the leftover _new tables are stale and
+// only a missing snapshots table is restored from snapshots_new. Otherwise
+// the originals are (partly) gone and the migration is rolled forward by
+// putting the _new tables in place.
+func recoverPartialMigration(db *sql.DB) error {
+	hasFilesNew, err := tableExists(db, "files_new")
+	if err != nil {
+		return err
+	}
+	hasSnapshotsNew, err := tableExists(db, "snapshots_new")
+	if err != nil {
+		return err
+	}
+	if !hasFilesNew && !hasSnapshotsNew {
+		return nil
+	}
+
+	hasFiles, err := tableExists(db, "files")
+	if err != nil {
+		return err
+	}
+	hasSnapshots, err := tableExists(db, "snapshots")
+	if err != nil {
+		return err
+	}
+	oldFiles := false
+	if hasFiles {
+		if oldFiles, err = needsSchemaMigration(db); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		return fmt.Errorf("disabling foreign keys: %w", err)
+	}
+	defer db.Exec("PRAGMA foreign_keys = ON")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning recovery transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var stmts []string
+	switch {
+	case oldFiles && hasSnapshots:
+		slog.Warn("found leftover migration tables, rolling back partial migration")
+		stmts = append(stmts, "DROP TABLE IF EXISTS snapshots_new", "DROP TABLE IF EXISTS files_new")
+	case hasFiles && !oldFiles:
+		slog.Warn("found leftover migration tables next to the migrated schema, removing them")
+		stmts = append(stmts, "DROP TABLE IF EXISTS files_new")
+		if hasSnapshotsNew {
+			if hasSnapshots {
+				stmts = append(stmts, "DROP TABLE snapshots_new")
+			} else {
+				stmts = append(stmts, "ALTER TABLE snapshots_new RENAME TO snapshots")
+			}
+		}
+	default:
+		slog.Warn("found leftover migration tables, completing partial migration")
+		if hasSnapshotsNew {
+			stmts = append(stmts, "DROP TABLE IF EXISTS snapshots")
+		}
+		if hasFilesNew {
+			stmts = append(stmts, "DROP TABLE IF EXISTS files", "ALTER TABLE files_new RENAME TO files")
+		}
+		if hasSnapshotsNew {
+			stmts = append(stmts, "ALTER TABLE snapshots_new RENAME TO snapshots")
+		}
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("recovering migration (%s): %w", stmt, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing recovery: %w", err)
+	}
+	return nil
+}
+
+// tableExists reports whether a table with the given name exists.
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name,
+	).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("checking table %s: %w", name, err)
+	}
+	return n > 0, nil
+}
+
 // migrateIfNeeded checks the files table schema and migrates from
 // INTEGER PRIMARY KEY to TEXT PRIMARY KEY (UUIDv7) if needed.
+// All copying, dropping and renaming happens in one transaction, so an
+// interruption leaves either the old or the new schema, never a mix.
 func migrateIfNeeded(db *sql.DB) error {
 	needsMigration, err := needsSchemaMigration(db)
 	if err != nil {
@@ -352,6 +791,66 @@ func migrateIfNeeded(db *sql.DB) error {
 	return nil
 }
 
+// addMissingColumns adds columns introduced after the initial schema to
+// databases created by older versions. New databases get them here as well,
+// so createSchema only contains the original column set.
+func addMissingColumns(db *sql.DB) error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"snapshots", "compression", "TEXT NOT NULL DEFAULT 'zstd'"},
+		{"files", "watch_set", "TEXT NOT NULL DEFAULT ''"},
+		{"files", "deleted_at", "INTEGER"},
+		{"snapshots", "line_count", "INTEGER NOT NULL DEFAULT -1"},
+		{"snapshots", "encoding", "TEXT NOT NULL DEFAULT ''"},
+		{"snapshots", "preview", "TEXT NOT NULL DEFAULT ''"},
+		{"snapshots", "binary", "INTEGER NOT NULL DEFAULT 0"},
+		{"snapshots", "mtime", "INTEGER NOT NULL DEFAULT 0"},
+		{"snapshots", "origin", "TEXT NOT NULL DEFAULT ''"},
+		{"files", "seen_size", "INTEGER NOT NULL DEFAULT 0"},
+		{"files", "seen_mtime", "INTEGER NOT NULL DEFAULT 0"},
+		{"snapshots", "truncated", "INTEGER NOT NULL DEFAULT 0"},
+		{"snapshots", "became_binary", "INTEGER NOT NULL DEFAULT 0"},
+		{"snapshots", "dedup_hash", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		exists, err := columnExists(db, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition)); err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+	return nil
+}
+
+// columnExists reports whether the given table has a column with the given name.
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("reading table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notNull, pk int
+		var dfltValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("scanning column info: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // needsSchemaMigration checks the files table's id column type.
 // Returns true if the type is INTEGER (old schema), false if TEXT (new schema).
 func needsSchemaMigration(db *sql.DB) (bool, error) {
@@ -384,25 +883,326 @@ func needsSchemaMigration(db *sql.DB) (bool, error) {
 // Close closes the database connection and releases zstd resources.
 func (d *DB) Close() error {
 	d.encoder.Close()
+	d.codecMu.Lock()
 	d.decoder.Close()
+	if d.dictEncoder != nil {
+		d.dictEncoder.Close()
+	}
+	d.codecMu.Unlock()
 	return d.db.Close()
 }
 
+// SetNoCompressExtensions sets path suffixes (e.g. ".png.txt") whose snapshots
+// are stored uncompressed. Matching is a case-insensitive suffix match so that
+// multi-part extensions work.
+func (d *DB) SetNoCompressExtensions(exts []string) {
+	d.noCompressExtensions = exts
+}
+
+// encodeContent compresses content for storage and returns the blob along
+// with the compression marker to store alongside it.
+func (d *DB) encodeContent(filePath string, content []byte) ([]byte, string) {
+	lower := strings.ToLower(filePath)
+	for _, ext := range d.noCompressExtensions {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return content, compressionNone
+		}
+	}
+	d.codecMu.RLock()
+	defer d.codecMu.RUnlock()
+	if d.dictEncoder != nil {
+		return d.dictEncoder.EncodeAll(content, nil), compressionZstdDict
+	}
+	return d.encoder.EncodeAll(content, nil), compressionZstd
+}
+
+// decodeContent reverses encodeContent according to the stored compression marker.
+func (d *DB) decodeContent(blob []byte, compression string) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return blob, nil
+	case compressionZstd, compressionZstdDict:
+		// Frames name their dictionary, so one decoder handles both
+		d.codecMu.RLock()
+		defer d.codecMu.RUnlock()
+		return d.decoder.DecodeAll(blob, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// Keys of the zstd dictionaries in the meta table. Every trained dictionary
+// is kept under dictKeyPrefix+ID so older snapshots stay readable;
+// dictCurrentKey names the one used for new snapshots.
+const (
+	dictKeyPrefix  = "zstd_dict:"
+	dictCurrentKey = "zstd_dict_current"
+)
+
+// Dictionary training parameters.
+const (
+	dictMaxSize       = 112 << 10 // zstd's default dictionary size
+	dictSampleMaxSize = 64 << 10  // larger files gain little from a dictionary
+	dictMinSamples    = 8
+)
+
+// ErrNotEnoughSamples is returned by TrainDictionary when the database
+// holds too few text snapshots to train on.
+var ErrNotEnoughSamples = errors.New("not enough snapshots to train a dictionary")
+
+// DictionaryInfo describes a trained zstd dictionary.
+type DictionaryInfo struct {
+	ID      uint32 `json:"id"`
+	Size    int    `json:"size"`
+	Samples int    `json:"samples"`
+}
+
+// TrainDictionary builds a zstd dictionary from up to samples randomly
+// chosen small text snapshots, stores it in the meta table and compresses
+// new snapshots with it. Existing snapshots are not recompressed.
+func (d *DB) TrainDictionary(samples int) (DictionaryInfo, error) {
+	// Sample IDs first so the random sort does not carry every candidate's
+	// content along; only the chosen contents are read afterwards.
+	rows, err := d.db.Query(
+		`SELECT id FROM snapshots
+		 WHERE binary = 0 AND size > 0 AND size <= ?
+		 ORDER BY RANDOM() LIMIT ?`,
+		dictSampleMaxSize, samples,
+	)
+	if err != nil {
+		return DictionaryInfo{}, fmt.Errorf("sampling snapshots: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return DictionaryInfo{}, fmt.Errorf("scanning snapshot id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return DictionaryInfo{}, fmt.Errorf("sampling snapshots: %w", err)
+	}
+
+	var contents [][]byte
+	for _, id := range ids {
+		var blob []byte
+		var compression string
+		err := d.db.QueryRow(`SELECT content, compression FROM snapshots WHERE id = ?`, id).Scan(&blob, &compression)
+		if err == sql.ErrNoRows {
+			continue // deleted since it was sampled
+		}
+		if err != nil {
+			return DictionaryInfo{}, fmt.Errorf("reading snapshot: %w", err)
+		}
+		content, err := d.decodeContent(blob, compression)
+		if err != nil {
+			return DictionaryInfo{}, fmt.Errorf("decompressing snapshot: %w", err)
+		}
+		contents = append(contents, content)
+	}
+	if len(contents) < dictMinSamples {
+		return DictionaryInfo{}, ErrNotEnoughSamples
+	}
+
+	raw, err := dict.BuildZstdDict(contents, dict.Options{
+		MaxDictSize: dictMaxSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+	if err != nil {
+		return DictionaryInfo{}, fmt.Errorf("building dictionary: %w", err)
+	}
+	inspected, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		return DictionaryInfo{}, fmt.Errorf("inspecting dictionary: %w", err)
+	}
+	info := DictionaryInfo{ID: inspected.ID(), Size: len(raw), Samples: len(contents)}
+
+	key := fmt.Sprintf("%s%d", dictKeyPrefix, info.ID)
+	tx, err := d.db.Begin()
+	if err != nil {
+		return DictionaryInfo{}, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, key, raw); err != nil {
+		return DictionaryInfo{}, fmt.Errorf("storing dictionary: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, dictCurrentKey, key); err != nil {
+		return DictionaryInfo{}, fmt.Errorf("storing dictionary: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return DictionaryInfo{}, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	if err := d.loadDictionaries(); err != nil {
+		return DictionaryInfo{}, fmt.Errorf("loading dictionaries: %w", err)
+	}
+	return info, nil
+}
+
+// loadDictionaries (re)creates the decoder with every stored dictionary and
+// the dictionary encoder with the current one.
+func (d *DB) loadDictionaries() error {
+	rows, err := d.db.Query(`SELECT key, value FROM meta WHERE instr(key, ?) = 1`, dictKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("reading dictionaries: %w", err)
+	}
+	dicts := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning dictionary: %w", err)
+		}
+		dicts[key] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading dictionaries: %w", err)
+	}
+
+	var currentKey string
+	err = d.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, dictCurrentKey).Scan(&currentKey)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("reading current dictionary: %w", err)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(slices.Collect(maps.Values(dicts))...))
+	if err != nil {
+		return fmt.Errorf("creating zstd decoder: %w", err)
+	}
+	var dictEncoder *zstd.Encoder
+	if current, ok := dicts[currentKey]; ok {
+		dictEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderDict(current))
+		if err != nil {
+			decoder.Close()
+			return fmt.Errorf("creating dictionary encoder: %w", err)
+		}
+	}
+
+	d.codecMu.Lock()
+	oldDecoder, oldEncoder := d.decoder, d.dictEncoder
+	d.decoder, d.dictEncoder = decoder, dictEncoder
+	d.codecMu.Unlock()
+	if oldDecoder != nil {
+		oldDecoder.Close()
+	}
+	if oldEncoder != nil {
+		oldEncoder.Close()
+	}
+	return nil
+}
+
 func newUUIDv7() string {
 	return uuid.Must(uuid.NewV7()).String()
 }
 
+// base32ID encodes IDs with the base32hex alphabet in lowercase, which keeps
+// the byte order so encoded UUIDv7s still sort by creation time.
+var base32ID = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// NewBase32ID returns a UUIDv7 encoded as 26 base32 characters instead of
+// the 36-character hyphenated form.
+func NewBase32ID() string {
+	id := uuid.Must(uuid.NewV7())
+	return base32ID.EncodeToString(id[:])
+}
+
+// ValidID reports whether s is a record ID in either supported format: a
+// UUID or a NewBase32ID string. Both are accepted regardless of the
+// configured format.
+func ValidID(s string) bool {
+	if _, err := uuid.Parse(s); err == nil {
+		return true
+	}
+	if len(s) != base32ID.EncodedLen(16) {
+		return false
+	}
+	b, err := base32ID.DecodeString(s)
+	return err == nil && len(b) == 16
+}
+
+// SetIDGenerator replaces the function used to generate IDs for new files,
+// snapshots and renames (UUIDv7 strings by default). SetIDFormat also
+// checks the format against the database.
+func (d *DB) SetIDGenerator(gen func() string) {
+	d.newID = gen
+}
+
+// idFormatKey is the meta key holding the ID format of the database.
+const idFormatKey = "id_format"
+
+// ErrIDFormatMismatch is returned by SetIDFormat for a database whose
+// records were written in the other ID format.
+var ErrIDFormatMismatch = errors.New("database uses a different idFormat")
+
+// SetIDFormat makes new rows use format: "base32" for NewBase32ID, anything
+// else UUIDv7. Records saved in the same second are ordered by ID, and the
+// two formats do not sort against each other by time, so a database keeps
+// the format it started with: the format is stored in the meta table, taken
+// from an existing record's ID for databases from before it was stored,
+// and a different one is refused with ErrIDFormatMismatch.
+func (d *DB) SetIDFormat(format string) error {
+	gen := newUUIDv7
+	if format == "base32" {
+		gen = NewBase32ID
+	} else {
+		format = "uuidv7"
+	}
+
+	var stored string
+	err := d.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, idFormatKey).Scan(&stored)
+	inMeta := err == nil
+	if errors.Is(err, sql.ErrNoRows) {
+		var id string
+		err = d.db.QueryRow(`SELECT id FROM files LIMIT 1`).Scan(&id)
+		switch {
+		case err == nil && len(id) == base32ID.EncodedLen(16):
+			stored = "base32"
+		case err == nil:
+			stored = "uuidv7"
+		case errors.Is(err, sql.ErrNoRows):
+			stored, err = format, nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("reading id format: %w", err)
+	}
+	if stored != format {
+		return fmt.Errorf("%w: records use %q, configured %q", ErrIDFormatMismatch, stored, format)
+	}
+	if !inMeta {
+		if _, err := d.db.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, idFormatKey, format); err != nil {
+			return fmt.Errorf("storing id format: %w", err)
+		}
+	}
+	d.newID = gen
+	return nil
+}
+
 // SaveSnapshot saves a file snapshot. It returns false if the content
 // hash matches the latest snapshot (duplicate skip).
 // When maxSnapshots > 0, old snapshots beyond the limit are pruned.
 func (d *DB) SaveSnapshot(filePath string, content []byte, maxSnapshots int) (bool, error) {
+	if err := d.checkSizeLimit(); err != nil {
+		return false, err
+	}
+
 	tx, err := d.db.Begin()
 	if err != nil {
 		return false, fmt.Errorf("beginning transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	saved, err := d.saveSnapshotInTx(tx, filePath, content, maxSnapshots)
+	saved, err := d.saveSnapshotInTx(tx, SnapshotRequest{
+		FilePath:     filePath,
+		Content:      content,
+		MaxSnapshots: maxSnapshots,
+	})
 	if err != nil {
 		return false, err
 	}
@@ -410,6 +1210,9 @@ func (d *DB) SaveSnapshot(filePath string, content []byte, maxSnapshots int) (bo
 	if err := tx.Commit(); err != nil {
 		return false, fmt.Errorf("committing transaction: %w", err)
 	}
+	if saved {
+		d.enforceFileLimit()
+	}
 	return saved, nil
 }
 
@@ -428,9 +1231,27 @@ func (d *DB) SaveSnapshotBatch(filePaths []string, contents [][]byte, maxSnapsho
 		}
 		return saved, errs
 	}
+	reqs := make([]SnapshotRequest, n)
+	for i := range n {
+		reqs[i] = SnapshotRequest{FilePath: filePaths[i], Content: contents[i], MaxSnapshots: maxSnapshots[i]}
+	}
+	return d.SaveSnapshotRequests(reqs)
+}
+
+// SaveSnapshotRequests saves multiple snapshot requests in a single transaction.
+// Returns a saved flag and error for each input item.
+func (d *DB) SaveSnapshotRequests(reqs []SnapshotRequest) ([]bool, []error) {
+	n := len(reqs)
 	saved := make([]bool, n)
 	errs := make([]error, n)
 
+	if err := d.checkSizeLimit(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return saved, errs
+	}
+
 	tx, err := d.db.Begin()
 	if err != nil {
 		for i := range errs {
@@ -441,7 +1262,7 @@ func (d *DB) SaveSnapshotBatch(filePaths []string, contents [][]byte, maxSnapsho
 	defer tx.Rollback()
 
 	for i := range n {
-		saved[i], errs[i] = d.saveSnapshotInTx(tx, filePaths[i], contents[i], maxSnapshots[i])
+		saved[i], errs[i] = d.saveSnapshotInTx(tx, reqs[i])
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -452,30 +1273,73 @@ func (d *DB) SaveSnapshotBatch(filePaths []string, contents [][]byte, maxSnapsho
 			}
 		}
 	}
+	if slices.Contains(saved, true) {
+		d.enforceFileLimit()
+	}
 
 	return saved, errs
 }
 
+// dedupHashExpr is the hash a snapshot is compared by when detecting
+// duplicates: dedup_hash if it was saved with normalized line endings,
+// its content hash otherwise.
+const dedupHashExpr = `CASE WHEN dedup_hash = '' THEN hash ELSE dedup_hash END`
+
 // saveSnapshotInTx performs the snapshot save logic within an existing transaction.
-// When maxSnapshots > 0, old snapshots beyond the limit are pruned.
-func (d *DB) saveSnapshotInTx(tx *sql.Tx, filePath string, content []byte, maxSnapshots int) (bool, error) {
-	hash := sha256sum(content)
+// When req.MaxSnapshots > 0, old snapshots beyond the limit are pruned.
+func (d *DB) saveSnapshotInTx(tx *sql.Tx, req SnapshotRequest) (bool, error) {
+	filePath, content, maxSnapshots := req.FilePath, req.Content, req.MaxSnapshots
+	hash := d.contentHash(content)
+	// dedupHash is what duplicates are detected by. With normalized line
+	// endings it is kept in dedup_hash, so hash always matches the stored
+	// bytes.
+	dedupHash, storedDedupHash := hash, ""
+	if req.NormalizeLineEndings && !req.Binary {
+		dedupHash = d.contentHash(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")))
+		storedDedupHash = dedupHash
+	}
 
 	// Check if file already exists and get its ID + latest snapshot hash
 	var fileID string
 	var lastHash sql.NullString
+	var lastBinary sql.NullBool
+	var deleted, reappeared bool
 	err := tx.QueryRow(
 		`SELECT f.id, (
-			SELECT hash FROM snapshots WHERE file_id = f.id ORDER BY timestamp DESC LIMIT 1
-		 ) FROM files f WHERE f.path = ?`,
+			SELECT `+dedupHashExpr+` FROM snapshots WHERE file_id = f.id ORDER BY timestamp DESC, id DESC LIMIT 1
+		 ), (
+			SELECT binary FROM snapshots WHERE file_id = f.id ORDER BY timestamp DESC, id DESC LIMIT 1
+		 ), f.deleted_at IS NOT NULL, `+recordedDeletedExpr+` FROM files f WHERE f.path = ?`,
 		filePath,
-	).Scan(&fileID, &lastHash)
+	).Scan(&fileID, &lastHash, &lastBinary, &deleted, &reappeared)
 	if err != nil && err != sql.ErrNoRows {
 		return false, fmt.Errorf("checking existing file: %w", err)
 	}
-
-	// Skip if content hasn't changed
-	if lastHash.Valid && lastHash.String == hash {
+	// A trashed file that is saved again leaves the trash, even when its
+	// content is unchanged.
+	if deleted {
+		if _, err := tx.Exec(`UPDATE files SET deleted_at = NULL WHERE id = ?`, fileID); err != nil {
+			return false, fmt.Errorf("restoring file from trash: %w", err)
+		}
+	}
+
+	// Skip if content hasn't changed. A file recorded as deleted is saved
+	// even then, so its history shows it back.
+	duplicate := !reappeared && lastHash.Valid && lastHash.String == dedupHash
+	if !duplicate && !reappeared && lastHash.Valid && !req.IgnoreDedupWindow && (d.dedupWindow < 0 || d.dedupWindow > 1) {
+		if err := tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM (
+				SELECT `+dedupHashExpr+` AS dedup_hash FROM snapshots WHERE file_id = ? ORDER BY timestamp DESC, id DESC LIMIT ?
+			 ) WHERE dedup_hash = ?)`,
+			fileID, d.dedupWindow, dedupHash,
+		).Scan(&duplicate); err != nil {
+			return false, fmt.Errorf("checking recent snapshots: %w", err)
+		}
+	}
+	if duplicate {
+		if err := updateFingerprint(tx, fileID, req.Fingerprint); err != nil {
+			return false, err
+		}
 		return false, nil
 	}
 
@@ -483,29 +1347,52 @@ func (d *DB) saveSnapshotInTx(tx *sql.Tx, filePath string, content []byte, maxSn
 
 	if err == sql.ErrNoRows {
 		// New file: insert with UUIDv7
-		fileID = newUUIDv7()
+		fileID = d.newID()
 		_, err = tx.Exec(
-			`INSERT INTO files (id, path, created, updated) VALUES (?, ?, ?, ?)`,
-			fileID, filePath, now, now,
+			`INSERT INTO files (id, path, created, updated, watch_set, seen_size, seen_mtime) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			fileID, filePath, now, now, req.WatchSet, req.Fingerprint.Size, req.Fingerprint.ModTime,
 		)
 		if err != nil {
 			return false, fmt.Errorf("inserting file: %w", err)
 		}
+		if !utf8.ValidString(filePath) {
+			// Stored byte for byte; JSON responses carry it as pathRaw.
+			d.logger.Warn("tracking file whose path is not valid UTF-8", "path", filePath)
+		}
 	} else {
-		// Existing file with changed content: update timestamp
-		_, err = tx.Exec(`UPDATE files SET updated = ? WHERE id = ?`, now, fileID)
+		// Existing file with changed content: update timestamp.
+		// The originally recorded watch set is kept; rows predating the
+		// watch_set column get it filled in on their next save.
+		_, err = tx.Exec(
+			`UPDATE files SET updated = ?, watch_set = CASE WHEN watch_set = '' THEN ? ELSE watch_set END
+			 WHERE id = ?`,
+			now, req.WatchSet, fileID,
+		)
 		if err != nil {
 			return false, fmt.Errorf("updating file: %w", err)
 		}
+		if err := updateFingerprint(tx, fileID, req.Fingerprint); err != nil {
+			return false, err
+		}
 	}
 
-	// Compress and save with UUIDv7
-	compressed := d.encoder.EncodeAll(content, nil)
-	snapshotID := newUUIDv7()
+	// Compress (unless excluded by extension) and save with UUIDv7.
+	// Binary entries keep only size and hash.
+	blob, compression := []byte{}, compressionNone
+	lineCount, preview := 0, ""
+	if !req.Binary {
+		blob, compression = d.encodeContent(filePath, content)
+		lineCount, preview = countLines(content), makePreview(content)
+	}
+	becameBinary := req.Binary && lastBinary.Valid && !lastBinary.Bool
+	if becameBinary {
+		d.logger.Info("tracked text file became binary; recording metadata only", "path", filePath)
+	}
+	snapshotID := d.newID()
 	_, err = tx.Exec(
-		`INSERT INTO snapshots (id, file_id, content, size, hash, timestamp)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		snapshotID, fileID, compressed, len(content), hash, now,
+		`INSERT INTO snapshots (id, file_id, content, size, hash, timestamp, compression, line_count, encoding, preview, binary, mtime, origin, truncated, became_binary, dedup_hash)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		snapshotID, fileID, blob, len(content), hash, now, compression, lineCount, req.Encoding, preview, req.Binary, req.ModTime, req.Origin, req.Truncated, becameBinary, storedDedupHash,
 	)
 	if err != nil {
 		return false, fmt.Errorf("inserting snapshot: %w", err)
@@ -527,24 +1414,61 @@ func (d *DB) saveSnapshotInTx(tx *sql.Tx, filePath string, content []byte, maxSn
 	return true, nil
 }
 
-// SearchFiles searches for files whose path contains the query string.
+// SearchFiles searches for files whose path contains the query string,
+// ignoring case unless mode is MatchExact.
 // When dirPrefixes is non-empty, results are filtered to files under those directories.
-func (d *DB) SearchFiles(query string, limit, offset int, dirPrefixes []string) ([]File, error) {
-	where := "path LIKE '%' || ? || '%'"
-	args := []any{query}
+func (d *DB) SearchFiles(query string, limit, offset int, dirPrefixes []string, mode ...MatchMode) ([]File, error) {
+	return d.SearchFilesContext(context.Background(), query, limit, offset, dirPrefixes, FileOrder{}, mode...)
+}
 
+// SearchFilesContext is SearchFiles with a context that aborts the query
+// when cancelled and results sorted by order.
+func (d *DB) SearchFilesContext(ctx context.Context, query string, limit, offset int, dirPrefixes []string, order FileOrder, mode ...MatchMode) ([]File, error) {
 	dirFilter, dirArgs := buildDirFilter("path", dirPrefixes)
-	if dirFilter != "" {
-		where += " AND " + dirFilter
+	return d.searchFiles(ctx, query, limit, offset, dirFilter, dirArgs, order, mode)
+}
+
+// SearchFilesInWatchSet searches for files whose path contains the query string
+// and that were captured by the named WatchSet. Files recorded before the
+// watch_set column existed have no stored name; those are matched by
+// legacyDirPrefixes instead (typically the set's current dirs).
+func (d *DB) SearchFilesInWatchSet(query string, limit, offset int, watchSet string, legacyDirPrefixes []string, mode ...MatchMode) ([]File, error) {
+	return d.SearchFilesInWatchSetContext(context.Background(), query, limit, offset, watchSet, legacyDirPrefixes, FileOrder{}, mode...)
+}
+
+// SearchFilesInWatchSetContext is SearchFilesInWatchSet with a context that
+// aborts the query when cancelled and results sorted by order.
+func (d *DB) SearchFilesInWatchSetContext(ctx context.Context, query string, limit, offset int, watchSet string, legacyDirPrefixes []string, order FileOrder, mode ...MatchMode) ([]File, error) {
+	filter := "watch_set = ?"
+	args := []any{watchSet}
+	if dirFilter, dirArgs := buildDirFilter("path", legacyDirPrefixes); dirFilter != "" {
+		filter = "(" + filter + " OR (watch_set = '' AND " + dirFilter + "))"
 		args = append(args, dirArgs...)
 	}
+	return d.searchFiles(ctx, query, limit, offset, filter, args, order, mode)
+}
+
+// searchFiles runs the file search with an optional extra WHERE fragment.
+// Files in the trash (deleted_at set) are left out.
+func (d *DB) searchFiles(ctx context.Context, query string, limit, offset int, filter string, filterArgs []any, order FileOrder, mode []MatchMode) ([]File, error) {
+	where := "deleted_at IS NULL"
+	var args []any
+	if query != "" {
+		where += " AND " + pathContains("path", mode)
+		args = append(args, query)
+	}
+
+	if filter != "" {
+		where += " AND " + filter
+		args = append(args, filterArgs...)
+	}
 
 	args = append(args, limit, offset)
 
-	rows, err := d.db.Query(
-		`SELECT id, path, created, updated FROM files
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT id, path, created, updated, watch_set FROM files
 		 WHERE `+where+`
-		 ORDER BY updated DESC
+		 ORDER BY `+order.orderBy()+`
 		 LIMIT ? OFFSET ?`,
 		args...,
 	)
@@ -556,7 +1480,7 @@ func (d *DB) SearchFiles(query string, limit, offset int, dirPrefixes []string)
 	var files []File
 	for rows.Next() {
 		var f File
-		if err := rows.Scan(&f.ID, &f.Path, &f.Created, &f.Updated); err != nil {
+		if err := rows.Scan(&f.ID, &f.Path, &f.Created, &f.Updated, &f.WatchSet); err != nil {
 			return nil, fmt.Errorf("scanning file: %w", err)
 		}
 		files = append(files, f)
@@ -564,25 +1488,141 @@ func (d *DB) SearchFiles(query string, limit, offset int, dirPrefixes []string)
 	return files, rows.Err()
 }
 
+// updateFingerprint records fp for the file unless fp is zero.
+func updateFingerprint(tx *sql.Tx, fileID string, fp FileFingerprint) error {
+	if fp == (FileFingerprint{}) {
+		return nil
+	}
+	if _, err := tx.Exec(
+		`UPDATE files SET seen_size = ?, seen_mtime = ? WHERE id = ?`,
+		fp.Size, fp.ModTime, fileID,
+	); err != nil {
+		return fmt.Errorf("updating file fingerprint: %w", err)
+	}
+	return nil
+}
+
+// GetFileFingerprint returns the size and mtime recorded when the file at
+// path was last read. The zero value means none is recorded.
+func (d *DB) GetFileFingerprint(path string) (FileFingerprint, error) {
+	var fp FileFingerprint
+	err := d.db.QueryRow(
+		`SELECT seen_size, seen_mtime FROM files WHERE path = ?`, path,
+	).Scan(&fp.Size, &fp.ModTime)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fp, fmt.Errorf("getting file fingerprint: %w", err)
+	}
+	return fp, nil
+}
+
+// ListDirectories returns the distinct parent directories of tracked files,
+// sorted by path. Files in the trash are ignored. When dirPrefixes is
+// non-empty, only files under those directories are considered.
+func (d *DB) ListDirectories(dirPrefixes []string) ([]string, error) {
+	query := `SELECT path FROM files WHERE deleted_at IS NULL`
+	dirFilter, args := buildDirFilter("path", dirPrefixes)
+	if dirFilter != "" {
+		query += " AND " + dirFilter
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing directories: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]struct{})
+	var dirs []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("scanning file path: %w", err)
+		}
+		dir := filepath.Dir(path)
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(dirs)
+	return dirs, nil
+}
+
 // GetFile returns a single file by ID.
 func (d *DB) GetFile(id string) (File, error) {
+	return d.GetFileContext(context.Background(), id)
+}
+
+// GetFileContext is GetFile with a context that aborts the query when
+// cancelled.
+func (d *DB) GetFileContext(ctx context.Context, id string) (File, error) {
 	var f File
-	err := d.db.QueryRow(
-		`SELECT id, path, created, updated FROM files WHERE id = ?`, id,
-	).Scan(&f.ID, &f.Path, &f.Created, &f.Updated)
+	err := d.db.QueryRowContext(ctx,
+		`SELECT id, path, created, updated, watch_set FROM files WHERE id = ?`, id,
+	).Scan(&f.ID, &f.Path, &f.Created, &f.Updated, &f.WatchSet)
 	if err != nil {
 		return File{}, fmt.Errorf("getting file: %w", err)
 	}
 	return f, nil
 }
 
+// GetFileByPath returns the file tracked at path. Returns sql.ErrNoRows
+// (wrapped) if the path is not tracked.
+func (d *DB) GetFileByPath(path string) (File, error) {
+	var f File
+	err := d.db.QueryRow(
+		`SELECT id, path, created, updated, watch_set FROM files WHERE path = ?`, path,
+	).Scan(&f.ID, &f.Path, &f.Created, &f.Updated, &f.WatchSet)
+	if err != nil {
+		return File{}, fmt.Errorf("getting file by path: %w", err)
+	}
+	return f, nil
+}
+
+// SnapshotQuery narrows a snapshot listing. Zero values mean no restriction.
+type SnapshotQuery struct {
+	Limit  int   // maximum number of snapshots (0 = unlimited)
+	Offset int   // number of snapshots to skip
+	From   int64 // inclusive lower timestamp bound (0 = none)
+	To     int64 // inclusive upper timestamp bound (0 = none)
+}
+
 // GetSnapshots returns all snapshots for a file, newest first.
 func (d *DB) GetSnapshots(fileID string) ([]Snapshot, error) {
+	return d.QuerySnapshots(fileID, SnapshotQuery{})
+}
+
+// QuerySnapshots returns snapshots for a file, newest first, filtered by
+// timestamp range and paginated according to q.
+func (d *DB) QuerySnapshots(fileID string, q SnapshotQuery) ([]Snapshot, error) {
+	where := "file_id = ?"
+	args := []any{fileID}
+	if q.From > 0 {
+		where += " AND timestamp >= ?"
+		args = append(args, q.From)
+	}
+	if q.To > 0 {
+		where += " AND timestamp <= ?"
+		args = append(args, q.To)
+	}
+
+	// LIMIT -1 means no limit in SQLite
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit, q.Offset)
+
 	rows, err := d.db.Query(
-		`SELECT id, file_id, size, hash, timestamp FROM snapshots
-		 WHERE file_id = ?
-		 ORDER BY timestamp DESC`,
-		fileID,
+		`SELECT id, file_id, size, hash, timestamp, line_count, binary, mtime, truncated FROM snapshots
+		 WHERE `+where+`
+		 ORDER BY `+d.sortTimeExpr("")+` DESC, id DESC
+		 LIMIT ? OFFSET ?`,
+		args...,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("getting snapshots: %w", err)
@@ -592,7 +1632,7 @@ func (d *DB) GetSnapshots(fileID string) ([]Snapshot, error) {
 	var snapshots []Snapshot
 	for rows.Next() {
 		var s Snapshot
-		if err := rows.Scan(&s.ID, &s.FileID, &s.Size, &s.Hash, &s.Timestamp); err != nil {
+		if err := rows.Scan(&s.ID, &s.FileID, &s.Size, &s.Hash, &s.Timestamp, &s.LineCount, &s.Binary, &s.ModTime, &s.Truncated); err != nil {
 			return nil, fmt.Errorf("scanning snapshot: %w", err)
 		}
 		snapshots = append(snapshots, s)
@@ -602,16 +1642,66 @@ func (d *DB) GetSnapshots(fileID string) ([]Snapshot, error) {
 
 // GetSnapshot returns a single snapshot by ID, including decompressed content.
 func (d *DB) GetSnapshot(id string) (Snapshot, error) {
+	return d.GetSnapshotContext(context.Background(), id)
+}
+
+// GetSnapshotContext is GetSnapshot with a context that aborts the query
+// when cancelled.
+func (d *DB) GetSnapshotContext(ctx context.Context, id string) (Snapshot, error) {
 	var s Snapshot
-	var compressed []byte
-	err := d.db.QueryRow(
-		`SELECT id, file_id, content, size, hash, timestamp FROM snapshots WHERE id = ?`, id,
-	).Scan(&s.ID, &s.FileID, &compressed, &s.Size, &s.Hash, &s.Timestamp)
+	var blob []byte
+	var compression string
+	err := d.db.QueryRowContext(ctx,
+		`SELECT id, file_id, content, size, hash, timestamp, compression, line_count, encoding, binary, truncated FROM snapshots WHERE id = ?`, id,
+	).Scan(&s.ID, &s.FileID, &blob, &s.Size, &s.Hash, &s.Timestamp, &compression, &s.LineCount, &s.Encoding, &s.Binary, &s.Truncated)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("getting snapshot: %w", err)
+	}
+
+	content, err := d.decodeContent(blob, compression)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("decompressing snapshot: %w", err)
+	}
+	s.Content = content
+	return s, nil
+}
+
+// GetSnapshotMeta returns a single snapshot by ID without its content,
+// avoiding decompression when only metadata such as the hash is needed.
+func (d *DB) GetSnapshotMeta(id string) (Snapshot, error) {
+	return d.GetSnapshotMetaContext(context.Background(), id)
+}
+
+// GetSnapshotMetaContext is GetSnapshotMeta with a context that aborts the
+// query when cancelled.
+func (d *DB) GetSnapshotMetaContext(ctx context.Context, id string) (Snapshot, error) {
+	var s Snapshot
+	err := d.db.QueryRowContext(ctx,
+		`SELECT id, file_id, size, hash, timestamp, line_count, binary, truncated FROM snapshots WHERE id = ?`, id,
+	).Scan(&s.ID, &s.FileID, &s.Size, &s.Hash, &s.Timestamp, &s.LineCount, &s.Binary, &s.Truncated)
 	if err != nil {
 		return Snapshot{}, fmt.Errorf("getting snapshot: %w", err)
 	}
+	return s, nil
+}
+
+// GetLatestSnapshot returns the newest snapshot of a file, including
+// decompressed content. Returns sql.ErrNoRows (wrapped) if the file has no snapshots.
+func (d *DB) GetLatestSnapshot(fileID string) (Snapshot, error) {
+	var s Snapshot
+	var blob []byte
+	var compression string
+	err := d.db.QueryRow(
+		`SELECT id, file_id, content, size, hash, timestamp, compression, line_count, encoding, binary, truncated FROM snapshots
+		 WHERE file_id = ?
+		 ORDER BY timestamp DESC, id DESC
+		 LIMIT 1`, fileID,
+	).Scan(&s.ID, &s.FileID, &blob, &s.Size, &s.Hash, &s.Timestamp, &compression, &s.LineCount, &s.Encoding, &s.Binary, &s.Truncated)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("getting latest snapshot: %w", err)
+	}
 
-	content, err := d.decoder.DecodeAll(compressed, nil)
+	content, err := d.decodeContent(blob, compression)
 	if err != nil {
 		return Snapshot{}, fmt.Errorf("decompressing snapshot: %w", err)
 	}
@@ -619,6 +1709,109 @@ func (d *DB) GetSnapshot(id string) (Snapshot, error) {
 	return s, nil
 }
 
+// GetSnapshotAt returns the newest snapshot of the file at path taken at or
+// before at (unix seconds). Returns sql.ErrNoRows (wrapped) if there is none.
+func (d *DB) GetSnapshotAt(path string, at int64) (Snapshot, error) {
+	var s Snapshot
+	var blob []byte
+	var compression string
+	err := d.db.QueryRow(
+		`SELECT s.id, s.file_id, s.content, s.size, s.hash, s.timestamp, s.compression, s.line_count, s.encoding, s.binary, s.truncated
+		 FROM snapshots s JOIN files f ON f.id = s.file_id
+		 WHERE f.path = ? AND s.timestamp <= ?
+		 ORDER BY s.timestamp DESC, s.id DESC
+		 LIMIT 1`, path, at,
+	).Scan(&s.ID, &s.FileID, &blob, &s.Size, &s.Hash, &s.Timestamp, &compression, &s.LineCount, &s.Encoding, &s.Binary, &s.Truncated)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("getting snapshot at %d: %w", at, err)
+	}
+
+	content, err := d.decodeContent(blob, compression)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("decompressing snapshot: %w", err)
+	}
+	s.Content = content
+	return s, nil
+}
+
+// MaxBlameSnapshots caps how many of a file's newest snapshots BlameFile
+// replays. Lines that already existed in the oldest replayed snapshot are
+// attributed to it, so for longer histories the origin is "at or before".
+const MaxBlameSnapshots = 200
+
+// BlameLine attributes one line of a file's latest content to the snapshot
+// that introduced it.
+type BlameLine struct {
+	Line       int    `json:"line"`
+	Text       string `json:"text"`
+	SnapshotID string `json:"snapshotId"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// BlameFile walks the file's snapshots oldest-to-newest (at most
+// MaxBlameSnapshots of them) and attributes each line of the latest content
+// to the snapshot where it first appeared. Returns sql.ErrNoRows (wrapped)
+// if the file has no snapshots.
+func (d *DB) BlameFile(fileID string) ([]BlameLine, error) {
+	history, err := d.QuerySnapshots(fileID, SnapshotQuery{Limit: MaxBlameSnapshots})
+	if err != nil {
+		return nil, fmt.Errorf("blaming file: %w", err)
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("blaming file: %w", sql.ErrNoRows)
+	}
+
+	type origin struct {
+		snapshotID string
+		timestamp  int64
+	}
+	var lines []string
+	var origins []origin
+	prevContent := ""
+
+	for i := len(history) - 1; i >= 0; i-- {
+		// Binary entries carry no lines to attribute
+		if history[i].Binary {
+			continue
+		}
+		snap, err := d.GetSnapshot(history[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("blaming file: %w", err)
+		}
+		current := origin{snapshotID: snap.ID, timestamp: snap.Timestamp}
+
+		var nextLines []string
+		var nextOrigins []origin
+		prev := 0
+		for _, op := range diff.LineDiff(prevContent, string(snap.Content)) {
+			switch op.Op {
+			case diff.OpEqual:
+				nextLines = append(nextLines, op.Text)
+				nextOrigins = append(nextOrigins, origins[prev])
+				prev++
+			case diff.OpDelete:
+				prev++
+			case diff.OpInsert:
+				nextLines = append(nextLines, op.Text)
+				nextOrigins = append(nextOrigins, current)
+			}
+		}
+		lines, origins = nextLines, nextOrigins
+		prevContent = string(snap.Content)
+	}
+
+	result := make([]BlameLine, len(lines))
+	for i, text := range lines {
+		result[i] = BlameLine{
+			Line:       i + 1,
+			Text:       text,
+			SnapshotID: origins[i].snapshotID,
+			Timestamp:  origins[i].timestamp,
+		}
+	}
+	return result, nil
+}
+
 // DeleteFile deletes a file and all its snapshots (CASCADE).
 func (d *DB) DeleteFile(id string) error {
 	result, err := d.db.Exec(`DELETE FROM files WHERE id = ?`, id)
@@ -635,6 +1828,197 @@ func (d *DB) DeleteFile(id string) error {
 	return nil
 }
 
+// TrashFile moves a file to the trash: it is hidden from file listings and
+// purged with its snapshots by PurgeTrash once it has been there long
+// enough. A file already in the trash keeps its original deletion time.
+// Returns sql.ErrNoRows if the file does not exist.
+func (d *DB) TrashFile(id string) error {
+	result, err := d.db.Exec(
+		`UPDATE files SET deleted_at = COALESCE(deleted_at, ?) WHERE id = ?`, time.Now().Unix(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("trashing file: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("checking rows affected: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// recordedDeletedExpr matches a file (aliased f) whose latest history entry
+// is a deletion recorded by SaveDeletion, i.e. one not saved again since.
+const recordedDeletedExpr = `EXISTS (
+	SELECT 1 FROM deletions dl WHERE dl.file_id = f.id AND NOT EXISTS (
+		SELECT 1 FROM snapshots s WHERE s.file_id = f.id AND (s.timestamp, s.id) > (dl.timestamp, dl.id)
+	)
+)`
+
+// SaveDeletion records that the tracked file at path was deleted from disk
+// as a "delete" history entry. The file and its snapshots are kept; saving
+// the path again continues its history. Returns sql.ErrNoRows if no file
+// outside the trash has that path or its deletion is already recorded.
+func (d *DB) SaveDeletion(path string) error {
+	var fileID string
+	err := d.db.QueryRow(
+		`SELECT id FROM files f WHERE path = ? AND deleted_at IS NULL AND NOT `+recordedDeletedExpr, path,
+	).Scan(&fileID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return sql.ErrNoRows
+		}
+		return fmt.Errorf("looking up deleted file: %w", err)
+	}
+	if _, err := d.db.Exec(
+		`INSERT INTO deletions (id, file_id, path, timestamp) VALUES (?, ?, ?, ?)`,
+		d.newID(), fileID, path, time.Now().Unix(),
+	); err != nil {
+		return fmt.Errorf("inserting deletion: %w", err)
+	}
+	return nil
+}
+
+// TrackedPaths returns the paths of the files under dirPrefixes (all files
+// when empty) that are outside the trash and not recorded as deleted,
+// sorted.
+func (d *DB) TrackedPaths(dirPrefixes []string) ([]string, error) {
+	query := `SELECT path FROM files f WHERE deleted_at IS NULL AND NOT ` + recordedDeletedExpr
+	dirFilter, args := buildDirFilter("path", dirPrefixes)
+	if dirFilter != "" {
+		query += " AND " + dirFilter
+	}
+	rows, err := d.db.Query(query+` ORDER BY path`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing tracked paths: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("scanning file path: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// ErrLastSnapshot is returned by DeleteSnapshot for the only remaining
+// snapshot of a file unless force is set.
+var ErrLastSnapshot = errors.New("cannot delete the only snapshot of a file")
+
+// DeleteSnapshot deletes a single snapshot, e.g. a version that captured a
+// secret, and keeps the file and its other snapshots. Snapshot content is
+// stored in the row itself, so nothing else needs cleaning up. The file's
+// updated time falls back to its newest remaining snapshot (its creation
+// time when none is left). The only snapshot of a file is kept with
+// ErrLastSnapshot unless force is set.
+//
+// The content is overwritten in the database file (secure_delete) and the
+// WAL is checkpointed and truncated afterwards. The checkpoint is skipped
+// while other connections are reading, and copies made earlier, such as
+// backups or downloads, still hold the content.
+// Returns sql.ErrNoRows if the snapshot does not exist.
+func (d *DB) DeleteSnapshot(id string, force bool) error {
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA secure_delete = ON"); err != nil {
+		return fmt.Errorf("enabling secure delete: %w", err)
+	}
+	// The setting is per connection; restore it before the pool reuses it.
+	defer conn.ExecContext(ctx, "PRAGMA secure_delete = OFF")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var fileID string
+	var count int
+	err = tx.QueryRow(
+		`SELECT s.file_id, (SELECT COUNT(*) FROM snapshots WHERE file_id = s.file_id) FROM snapshots s WHERE s.id = ?`, id,
+	).Scan(&fileID, &count)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return sql.ErrNoRows
+		}
+		return fmt.Errorf("counting snapshots: %w", err)
+	}
+	if count == 1 && !force {
+		return ErrLastSnapshot
+	}
+	if _, err := tx.Exec(`DELETE FROM snapshots WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("deleting snapshot: %w", err)
+	}
+	if _, err := tx.Exec(
+		`UPDATE files SET updated = COALESCE((SELECT MAX(timestamp) FROM snapshots WHERE file_id = ?), created) WHERE id = ?`,
+		fileID, fileID,
+	); err != nil {
+		return fmt.Errorf("updating file time: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	// The WAL still holds the deleted pages until it is checkpointed.
+	if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("checkpointing WAL: %w", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes files (and their snapshots via CASCADE)
+// that were moved to the trash before cutoff (unix seconds).
+// Returns the number of files purged.
+func (d *DB) PurgeTrash(cutoff int64) (int64, error) {
+	result, err := d.db.Exec(
+		`DELETE FROM files WHERE deleted_at IS NOT NULL AND deleted_at < ?`, cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("purging trash: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("checking rows affected: %w", err)
+	}
+	return n, nil
+}
+
+// PruneRenames deletes rename records older than cutoff (unix seconds) that
+// no longer link any history. A rename is kept regardless of age while its
+// old side, or a file further back along the same chain, still has
+// snapshots, so GetLineage keeps connecting that history to the current
+// path. It returns the number of renames deleted.
+func (d *DB) PruneRenames(cutoff int64) (int64, error) {
+	result, err := d.db.Exec(
+		`WITH RECURSIVE linked(id) AS (
+			SELECT id FROM files f
+			WHERE EXISTS (SELECT 1 FROM snapshots s WHERE s.file_id = f.id)
+			UNION
+			SELECT r.new_file_id FROM renames r JOIN linked l ON r.old_file_id = l.id
+		)
+		DELETE FROM renames
+		WHERE timestamp < ? AND old_file_id NOT IN (SELECT id FROM linked)`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("pruning renames: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("checking rows affected: %w", err)
+	}
+	return n, nil
+}
+
 // GetStats returns aggregate statistics.
 // When dirPrefixes is non-empty, only files under those directories are counted.
 func (d *DB) GetStats(dirPrefixes []string) (Stats, error) {
@@ -654,6 +2038,10 @@ func (d *DB) GetStats(dirPrefixes []string) (Stats, error) {
 		if err != nil {
 			return Stats{}, fmt.Errorf("counting snapshots: %w", err)
 		}
+		err = d.db.QueryRow(`SELECT COUNT(*) FROM renames`).Scan(&stats.TotalRenames)
+		if err != nil {
+			return Stats{}, fmt.Errorf("counting renames: %w", err)
+		}
 	} else {
 		// With dir filter: filter files by path prefix
 		err := d.db.QueryRow(
@@ -673,22 +2061,37 @@ func (d *DB) GetStats(dirPrefixes []string) (Stats, error) {
 		if err != nil {
 			return Stats{}, fmt.Errorf("counting snapshots: %w", err)
 		}
+		// A rename belongs to the directory it moved the file into
+		renameFilter, renameArgs := buildDirFilter("new_path", dirPrefixes)
+		err = d.db.QueryRow(
+			`SELECT COUNT(*) FROM renames WHERE `+renameFilter, renameArgs...,
+		).Scan(&stats.TotalRenames)
+		if err != nil {
+			return Stats{}, fmt.Errorf("counting renames: %w", err)
+		}
 	}
 
 	return stats, nil
 }
 
-// GetRecentSnapshots returns the most recent snapshots and renames across all files,
+// GetRecentSnapshots returns the most recent snapshots, renames and deletions across all files,
 // joined with their file path, ordered by timestamp descending.
-// When query is non-empty, results are filtered to entries whose file path contains the query string.
+// When query is non-empty, results are filtered to entries whose file path contains the query string
+// (ignoring case unless mode is MatchExact).
 // When dirPrefixes is non-empty, results are filtered to files under those directories.
-func (d *DB) GetRecentSnapshots(limit, offset int, query string, dirPrefixes []string) ([]HistoryEntry, error) {
+func (d *DB) GetRecentSnapshots(limit, offset int, query string, dirPrefixes []string, mode ...MatchMode) ([]HistoryEntry, error) {
+	return d.GetRecentSnapshotsContext(context.Background(), limit, offset, query, dirPrefixes, mode...)
+}
+
+// GetRecentSnapshotsContext is GetRecentSnapshots with a context that aborts
+// the query when cancelled.
+func (d *DB) GetRecentSnapshotsContext(ctx context.Context, limit, offset int, query string, dirPrefixes []string, mode ...MatchMode) ([]HistoryEntry, error) {
 	// Build save sub-query
 	saveWhere := ""
 	var saveArgs []any
 
 	if query != "" {
-		saveWhere = "f.path LIKE '%' || ? || '%' COLLATE NOCASE"
+		saveWhere = pathContains("f.path", mode)
 		saveArgs = append(saveArgs, query)
 	}
 
@@ -711,7 +2114,7 @@ func (d *DB) GetRecentSnapshots(limit, offset int, query string, dirPrefixes []s
 	var renameArgs []any
 
 	if query != "" {
-		renameWhere = "(r.new_path LIKE '%' || ? || '%' COLLATE NOCASE OR r.old_path LIKE '%' || ? || '%' COLLATE NOCASE)"
+		renameWhere = "(" + pathContains("r.new_path", mode) + " OR " + pathContains("r.old_path", mode) + ")"
 		renameArgs = append(renameArgs, query, query)
 	}
 
@@ -727,27 +2130,83 @@ func (d *DB) GetRecentSnapshots(limit, offset int, query string, dirPrefixes []s
 		renameArgs = append(renameArgs, oldPathArgs...)
 	}
 
+	// Collapsing rename chains: a rename followed by another rename of its
+	// target within the window is hidden, and the last rename of the chain
+	// reports the chain's first old path.
+	renameOldPath := "r.old_path"
+	var renameSelectArgs []any
+	if d.renameCollapseSec > 0 {
+		if renameWhere != "" {
+			renameWhere += " AND "
+		}
+		renameWhere += `NOT EXISTS (
+			SELECT 1 FROM renames n
+			WHERE n.old_file_id = r.new_file_id AND n.id > r.id AND n.timestamp - r.timestamp <= ?
+		)`
+		renameArgs = append(renameArgs, d.renameCollapseSec)
+
+		renameOldPath = `(
+			WITH RECURSIVE chain(id, file_id, old_path, ts, depth) AS (
+				SELECT r.id, r.old_file_id, r.old_path, r.timestamp, 0
+				UNION ALL
+				SELECT p.id, p.old_file_id, p.old_path, p.timestamp, c.depth + 1
+				FROM chain c JOIN renames p
+					ON p.new_file_id = c.file_id AND p.id < c.id AND c.ts - p.timestamp <= ?
+			)
+			SELECT old_path FROM chain ORDER BY depth DESC LIMIT 1
+		)`
+		renameSelectArgs = append(renameSelectArgs, d.renameCollapseSec)
+	}
+
 	renameWhereClause := ""
 	if renameWhere != "" {
 		renameWhereClause = " WHERE " + renameWhere
 	}
 
-	sql := `SELECT entry_id, entry_type, file_id, file_path, old_path, size, hash, timestamp FROM (
-		SELECT s.id AS entry_id, 'save' AS entry_type, s.file_id, f.path AS file_path, '' AS old_path, s.size, s.hash, s.timestamp
+	// Build deletion sub-query
+	deleteWhere := ""
+	var deleteArgs []any
+	if query != "" {
+		deleteWhere = pathContains("d.path", mode)
+		deleteArgs = append(deleteArgs, query)
+	}
+	if deleteDirFilter, deleteDirArgs := buildDirFilter("d.path", dirPrefixes); deleteDirFilter != "" {
+		if deleteWhere != "" {
+			deleteWhere += " AND "
+		}
+		deleteWhere += deleteDirFilter
+		deleteArgs = append(deleteArgs, deleteDirArgs...)
+	}
+	deleteWhereClause := ""
+	if deleteWhere != "" {
+		deleteWhereClause = " WHERE " + deleteWhere
+	}
+
+	sql := `SELECT entry_id, entry_type, file_id, file_path, old_path, size, hash, timestamp, watch_set, line_count, preview, origin, file_created, is_new_file, became_binary FROM (
+		SELECT s.id AS entry_id, CASE WHEN s.binary THEN 'binary' ELSE 'save' END AS entry_type, s.file_id, f.path AS file_path, '' AS old_path, s.size, s.hash, s.timestamp, f.watch_set, s.line_count, s.preview, s.origin,
+			f.created AS file_created, ` + isNewFileExpr + ` AS is_new_file, s.became_binary,
+			` + d.sortTimeExpr("s.") + ` AS sort_time
 		FROM snapshots s
 		JOIN files f ON s.file_id = f.id` + saveWhereClause + `
 		UNION ALL
-		SELECT r.id AS entry_id, 'rename' AS entry_type, r.new_file_id AS file_id, r.new_path AS file_path, r.old_path, 0 AS size, '' AS hash, r.timestamp
+		SELECT r.id AS entry_id, 'rename' AS entry_type, r.new_file_id AS file_id, r.new_path AS file_path, ` + renameOldPath + ` AS old_path, 0 AS size, '' AS hash, r.timestamp,
+			COALESCE((SELECT watch_set FROM files WHERE id = r.new_file_id), '') AS watch_set, 0 AS line_count, '' AS preview, '' AS origin,
+			COALESCE((SELECT created FROM files WHERE id = r.new_file_id), 0) AS file_created, 0 AS is_new_file, 0 AS became_binary,
+			r.timestamp AS sort_time
 		FROM renames r` + renameWhereClause + `
-	) ORDER BY timestamp DESC, entry_id DESC
+		UNION ALL
+		` + deletionEntrySelect + deleteWhereClause + `
+	) ORDER BY sort_time DESC, entry_id DESC
 	LIMIT ? OFFSET ?`
 
 	var args []any
 	args = append(args, saveArgs...)
+	args = append(args, renameSelectArgs...)
 	args = append(args, renameArgs...)
+	args = append(args, deleteArgs...)
 	args = append(args, limit, offset)
 
-	rows, err := d.db.Query(sql, args...)
+	rows, err := d.db.QueryContext(ctx, sql, args...)
 	if err != nil {
 		return nil, fmt.Errorf("getting recent entries: %w", err)
 	}
@@ -755,11 +2214,302 @@ func (d *DB) GetRecentSnapshots(limit, offset int, query string, dirPrefixes []s
 	return scanHistoryEntries(rows)
 }
 
+// GetRecentFilesContext returns files ordered by most recently updated, one
+// entry per file, each with its latest snapshot. Files without snapshots
+// and files in the trash are left out. When dirPrefixes is non-empty, only
+// files under those directories are returned.
+func (d *DB) GetRecentFilesContext(ctx context.Context, limit, offset int, dirPrefixes []string) ([]RecentFile, error) {
+	where := "f.deleted_at IS NULL"
+	dirFilter, args := buildDirFilter("f.path", dirPrefixes)
+	if dirFilter != "" {
+		where += " AND " + dirFilter
+	}
+	args = append(args, limit, offset)
+
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT f.id, f.path, f.created, f.updated, f.watch_set,
+		        s.id, s.file_id, s.size, s.hash, s.timestamp, s.line_count, s.binary, s.mtime, s.truncated
+		 FROM files f JOIN snapshots s ON s.id = (
+			SELECT id FROM snapshots WHERE file_id = f.id ORDER BY timestamp DESC, id DESC LIMIT 1
+		 )
+		 WHERE `+where+`
+		 ORDER BY f.updated DESC, f.id DESC
+		 LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("getting recent files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []RecentFile
+	for rows.Next() {
+		var rf RecentFile
+		f, s := &rf.File, &rf.LatestSnapshot
+		if err := rows.Scan(&f.ID, &f.Path, &f.Created, &f.Updated, &f.WatchSet,
+			&s.ID, &s.FileID, &s.Size, &s.Hash, &s.Timestamp, &s.LineCount, &s.Binary, &s.ModTime, &s.Truncated); err != nil {
+			return nil, fmt.Errorf("scanning recent file: %w", err)
+		}
+		files = append(files, rf)
+	}
+	return files, rows.Err()
+}
+
+// FindStaleFiles returns files whose updated time is before olderThan (unix
+// seconds), oldest first, with their snapshot counts and sizes. Files in
+// the trash are left out. When dirPrefixes is non-empty, only files under
+// those directories are returned.
+func (d *DB) FindStaleFiles(olderThan int64, limit, offset int, dirPrefixes []string) ([]StaleFile, error) {
+	where := "f.updated < ? AND f.deleted_at IS NULL"
+	args := []any{olderThan}
+	if dirFilter, dirArgs := buildDirFilter("f.path", dirPrefixes); dirFilter != "" {
+		where += " AND " + dirFilter
+		args = append(args, dirArgs...)
+	}
+	args = append(args, limit, offset)
+
+	rows, err := d.db.Query(
+		`SELECT f.id, f.path, f.created, f.updated, f.watch_set,
+		        COUNT(s.id), COALESCE(SUM(s.size), 0)
+		 FROM files f LEFT JOIN snapshots s ON s.file_id = f.id
+		 WHERE `+where+`
+		 GROUP BY f.id
+		 ORDER BY f.updated ASC, f.id ASC
+		 LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("finding stale files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []StaleFile
+	for rows.Next() {
+		var sf StaleFile
+		f := &sf.File
+		if err := rows.Scan(&f.ID, &f.Path, &f.Created, &f.Updated, &f.WatchSet, &sf.Snapshots, &sf.TotalSize); err != nil {
+			return nil, fmt.Errorf("scanning stale file: %w", err)
+		}
+		files = append(files, sf)
+	}
+	return files, rows.Err()
+}
+
+// CompressionStats sums the logical and stored sizes of snapshot content.
+// Binary snapshots store no content and are left out so they do not skew
+// the ratio. When dirPrefixes is non-empty, only files under those
+// directories are counted.
+func (d *DB) CompressionStats(dirPrefixes []string) (CompressionStats, error) {
+	where := "NOT s.binary"
+	dirFilter, args := buildDirFilter("f.path", dirPrefixes)
+	if dirFilter != "" {
+		where += " AND " + dirFilter
+	}
+
+	var stats CompressionStats
+	err := d.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(s.size), 0), COALESCE(SUM(LENGTH(s.content)), 0)
+		 FROM snapshots s JOIN files f ON s.file_id = f.id
+		 WHERE `+where,
+		args...,
+	).Scan(&stats.Snapshots, &stats.LogicalBytes, &stats.StoredBytes)
+	if err != nil {
+		return CompressionStats{}, fmt.Errorf("summing snapshot sizes: %w", err)
+	}
+	if stats.LogicalBytes > 0 {
+		stats.Ratio = float64(stats.StoredBytes) / float64(stats.LogicalBytes)
+	}
+	return stats, nil
+}
+
+// StatsByExtension groups snapshot counts and sizes by the extension of the
+// file path, busiest extension first. SQLite has no function to split off an
+// extension, so the query only sums per file and the grouping is done here
+// with fileExtension. When dirPrefixes is non-empty, only files under those
+// directories are counted.
+func (d *DB) StatsByExtension(dirPrefixes []string) ([]ExtensionStats, error) {
+	where := "1=1"
+	dirFilter, args := buildDirFilter("f.path", dirPrefixes)
+	if dirFilter != "" {
+		where = dirFilter
+	}
+
+	rows, err := d.db.Query(
+		`SELECT f.path, COUNT(*), COALESCE(SUM(s.size), 0)
+		 FROM snapshots s JOIN files f ON s.file_id = f.id
+		 WHERE `+where+`
+		 GROUP BY f.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("summing snapshots per file: %w", err)
+	}
+	defer rows.Close()
+
+	byExt := make(map[string]*ExtensionStats)
+	for rows.Next() {
+		var path string
+		var snapshots int
+		var bytes int64
+		if err := rows.Scan(&path, &snapshots, &bytes); err != nil {
+			return nil, fmt.Errorf("scanning file sums: %w", err)
+		}
+		ext := fileExtension(path)
+		st := byExt[ext]
+		if st == nil {
+			st = &ExtensionStats{Extension: ext}
+			byExt[ext] = st
+		}
+		st.Files++
+		st.Snapshots += snapshots
+		st.Bytes += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating file sums: %w", err)
+	}
+
+	stats := make([]ExtensionStats, 0, len(byExt))
+	for _, st := range byExt {
+		stats = append(stats, *st)
+	}
+	slices.SortFunc(stats, func(a, b ExtensionStats) int {
+		if a.Snapshots != b.Snapshots {
+			return b.Snapshots - a.Snapshots
+		}
+		return strings.Compare(a.Extension, b.Extension)
+	})
+	return stats, nil
+}
+
+// fileExtension returns the lowercased extension of path's base name, or ""
+// when it has none. A leading dot alone (".bashrc") is not an extension.
+func fileExtension(path string) string {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		return ""
+	}
+	return strings.ToLower(ext)
+}
+
+// ActivityHistogram counts snapshots and renames with from <= timestamp < to
+// in buckets of bucketSec seconds aligned to the unix epoch. Every bucket
+// overlapping the range is returned, oldest first, including empty ones.
+// When dirPrefixes is non-empty, only files under those directories are
+// counted; a rename counts if either of its paths is under one.
+func (d *DB) ActivityHistogram(bucketSec int, from, to int64, dirPrefixes []string) ([]ActivityBucket, error) {
+	if bucketSec < 1 {
+		return nil, fmt.Errorf("bucket size must be >= 1, got %d", bucketSec)
+	}
+	size := int64(bucketSec)
+
+	saveWhere := "s.timestamp >= ? AND s.timestamp < ?"
+	saveArgs := []any{size, size, from, to}
+	if dirFilter, dirArgs := buildDirFilter("f.path", dirPrefixes); dirFilter != "" {
+		saveWhere += " AND " + dirFilter
+		saveArgs = append(saveArgs, dirArgs...)
+	}
+	renameWhere := "r.timestamp >= ? AND r.timestamp < ?"
+	renameArgs := []any{size, size, from, to}
+	if newFilter, newArgs := buildDirFilter("r.new_path", dirPrefixes); newFilter != "" {
+		oldFilter, oldArgs := buildDirFilter("r.old_path", dirPrefixes)
+		renameWhere += " AND (" + newFilter + " OR " + oldFilter + ")"
+		renameArgs = append(renameArgs, newArgs...)
+		renameArgs = append(renameArgs, oldArgs...)
+	}
+
+	rows, err := d.db.Query(
+		`SELECT bucket, SUM(saves), SUM(renames) FROM (
+			SELECT (s.timestamp / ?) * ? AS bucket, 1 AS saves, 0 AS renames
+			FROM snapshots s JOIN files f ON s.file_id = f.id
+			WHERE `+saveWhere+`
+			UNION ALL
+			SELECT (r.timestamp / ?) * ? AS bucket, 0 AS saves, 1 AS renames
+			FROM renames r
+			WHERE `+renameWhere+`
+		) GROUP BY bucket`,
+		append(saveArgs, renameArgs...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying activity: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]ActivityBucket)
+	for rows.Next() {
+		var b ActivityBucket
+		if err := rows.Scan(&b.Start, &b.Saves, &b.Renames); err != nil {
+			return nil, fmt.Errorf("scanning activity bucket: %w", err)
+		}
+		counts[b.Start] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var buckets []ActivityBucket
+	for start := from / size * size; start < to; start += size {
+		b := counts[start]
+		b.Start = start
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// isNewFileExpr is true for a snapshot s that is the first of its file,
+// unless the file got its path from a rename.
+const isNewFileExpr = `(NOT EXISTS (
+		SELECT 1 FROM snapshots p
+		WHERE p.file_id = s.file_id AND (p.timestamp < s.timestamp OR (p.timestamp = s.timestamp AND p.id < s.id))
+	) AND NOT EXISTS (SELECT 1 FROM renames n WHERE n.new_file_id = s.file_id))`
+
+// deletionEntrySelect selects the deletions table (aliased d) as "delete"
+// history entries, in the column order of the history queries.
+const deletionEntrySelect = `SELECT d.id AS entry_id, 'delete' AS entry_type, d.file_id, d.path AS file_path, '' AS old_path, 0 AS size, '' AS hash, d.timestamp,
+			f.watch_set, 0 AS line_count, '' AS preview, '' AS origin,
+			f.created AS file_created, 0 AS is_new_file, 0 AS became_binary,
+			d.timestamp AS sort_time
+		FROM deletions d
+		JOIN files f ON d.file_id = f.id`
+
+// GetFileTimeline returns the snapshots of one file together with the
+// renames it took part in (as source or destination) and its recorded
+// deletions, merged into one list of history entries ordered newest first,
+// like GetRecentSnapshots.
+func (d *DB) GetFileTimeline(fileID string) ([]HistoryEntry, error) {
+	rows, err := d.db.Query(
+		`SELECT entry_id, entry_type, file_id, file_path, old_path, size, hash, timestamp, watch_set, line_count, preview, origin, file_created, is_new_file, became_binary FROM (
+			SELECT s.id AS entry_id, CASE WHEN s.binary THEN 'binary' ELSE 'save' END AS entry_type, s.file_id, f.path AS file_path, '' AS old_path, s.size, s.hash, s.timestamp, f.watch_set, s.line_count, s.preview, s.origin,
+				f.created AS file_created, `+isNewFileExpr+` AS is_new_file, s.became_binary,
+				`+d.sortTimeExpr("s.")+` AS sort_time
+			FROM snapshots s
+			JOIN files f ON s.file_id = f.id
+			WHERE s.file_id = ?
+			UNION ALL
+			SELECT r.id AS entry_id, 'rename' AS entry_type, r.new_file_id AS file_id, r.new_path AS file_path, r.old_path, 0 AS size, '' AS hash, r.timestamp,
+				COALESCE((SELECT watch_set FROM files WHERE id = r.new_file_id), '') AS watch_set, 0 AS line_count, '' AS preview, '' AS origin,
+				COALESCE((SELECT created FROM files WHERE id = r.new_file_id), 0) AS file_created, 0 AS is_new_file, 0 AS became_binary,
+				r.timestamp AS sort_time
+			FROM renames r
+			WHERE r.old_file_id = ? OR r.new_file_id = ?
+			UNION ALL
+			`+deletionEntrySelect+`
+			WHERE d.file_id = ?
+		) ORDER BY sort_time DESC, entry_id DESC`,
+		fileID, fileID, fileID, fileID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("getting file timeline: %w", err)
+	}
+	defer rows.Close()
+	return scanHistoryEntries(rows)
+}
+
 func scanHistoryEntries(rows *sql.Rows) ([]HistoryEntry, error) {
 	var entries []HistoryEntry
 	for rows.Next() {
 		var e HistoryEntry
-		if err := rows.Scan(&e.SnapshotID, &e.EntryType, &e.FileID, &e.FilePath, &e.OldFilePath, &e.Size, &e.Hash, &e.Timestamp); err != nil {
+		if err := rows.Scan(&e.SnapshotID, &e.EntryType, &e.FileID, &e.FilePath, &e.OldFilePath, &e.Size, &e.Hash, &e.Timestamp, &e.WatchSet, &e.LineCount, &e.Preview, &e.Origin, &e.FileCreated, &e.IsNewFile, &e.BecameBinary); err != nil {
 			return nil, fmt.Errorf("scanning history entry: %w", err)
 		}
 		entries = append(entries, e)
@@ -779,6 +2529,249 @@ func (d *DB) DatabaseSize() (int64, error) {
 	return pageCount * pageSize, nil
 }
 
+// UsedSize returns the bytes occupied by live pages, excluding pages on the
+// freelist. Unlike DatabaseSize it shrinks as soon as rows are deleted.
+func (d *DB) UsedSize() (int64, error) {
+	var pageCount, freeCount, pageSize int64
+	if err := d.db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, fmt.Errorf("querying page_count: %w", err)
+	}
+	if err := d.db.QueryRow("PRAGMA freelist_count").Scan(&freeCount); err != nil {
+		return 0, fmt.Errorf("querying freelist_count: %w", err)
+	}
+	if err := d.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("querying page_size: %w", err)
+	}
+	return (pageCount - freeCount) * pageSize, nil
+}
+
+// SetSizeLimit caps the database at maxBytes (0 disables the limit). Once the
+// limit is exceeded, saves fail with ErrDatabaseFull, or, when evict is true,
+// the oldest snapshots are deleted until the database fits again.
+func (d *DB) SetSizeLimit(maxBytes int64, evict bool) {
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	d.sizeLimit = maxBytes
+	d.sizeEvict = evict
+	d.sizeCheckedAt = time.Time{}
+	d.sizeExceeded = false
+}
+
+// SizeLimit returns the configured size limit in bytes (0 when unlimited).
+func (d *DB) SizeLimit() int64 {
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	return d.sizeLimit
+}
+
+// checkSizeLimit enforces the size limit before a save. The size is measured
+// at most once per sizeCheckInterval; in between, the last result is reused.
+func (d *DB) checkSizeLimit() error {
+	d.sizeMu.Lock()
+	defer d.sizeMu.Unlock()
+	if d.sizeLimit <= 0 {
+		return nil
+	}
+	if time.Since(d.sizeCheckedAt) < sizeCheckInterval {
+		if d.sizeExceeded {
+			return ErrDatabaseFull
+		}
+		return nil
+	}
+	d.sizeCheckedAt = time.Now()
+
+	used, err := d.UsedSize()
+	if err != nil {
+		return fmt.Errorf("checking database size: %w", err)
+	}
+	if used > d.sizeLimit && d.sizeEvict {
+		n, err := d.evictOldestSnapshots(d.sizeLimit)
+		if err != nil {
+			d.logger.Error("failed to evict snapshots", "err", err)
+		}
+		if n > 0 {
+			d.logger.Info("database size exceeded limit: evicted oldest snapshots", "size", used, "limit", d.sizeLimit, "evicted", n)
+		}
+		if used, err = d.UsedSize(); err != nil {
+			return fmt.Errorf("checking database size: %w", err)
+		}
+	}
+
+	d.sizeExceeded = used > d.sizeLimit
+	if d.sizeExceeded {
+		d.logger.Warn("database size exceeds maxDatabaseSize; new snapshots are not being saved", "size", used, "limit", d.sizeLimit)
+		return ErrDatabaseFull
+	}
+	return nil
+}
+
+// evictOldestSnapshots deletes the globally oldest snapshots until the used
+// size is at most target. The latest snapshot of each file is never evicted,
+// so every tracked file keeps its current content. Returns the number of
+// snapshots deleted.
+func (d *DB) evictOldestSnapshots(target int64) (int, error) {
+	total := 0
+	for {
+		used, err := d.UsedSize()
+		if err != nil {
+			return total, err
+		}
+		if used <= target {
+			return total, nil
+		}
+		result, err := d.db.Exec(`
+			DELETE FROM snapshots WHERE id IN (
+				SELECT s.id FROM snapshots s
+				WHERE s.id != (
+					SELECT l.id FROM snapshots l WHERE l.file_id = s.file_id
+					ORDER BY l.timestamp DESC, l.id DESC LIMIT 1
+				)
+				ORDER BY s.timestamp ASC, s.id ASC
+				LIMIT ?
+			)`, evictBatchSize)
+		if err != nil {
+			return total, fmt.Errorf("evicting snapshots: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("checking rows affected: %w", err)
+		}
+		if n == 0 {
+			return total, nil
+		}
+		total += int(n)
+	}
+}
+
+// SetMaxTrackedFiles keeps at most n files (0 disables the limit). After a
+// save pushes the count over n, the least recently updated files are
+// deleted along with their snapshots.
+func (d *DB) SetMaxTrackedFiles(n int) {
+	d.maxTrackedFiles = n
+}
+
+// enforceFileLimit deletes the least recently updated files beyond
+// maxTrackedFiles, logging each one. Failures are logged, not returned: the
+// save that triggered it has already been committed.
+func (d *DB) enforceFileLimit() {
+	if d.maxTrackedFiles <= 0 {
+		return
+	}
+	rows, err := d.db.Query(
+		`SELECT id, path, updated FROM files
+		 ORDER BY updated DESC, id DESC
+		 LIMIT -1 OFFSET ?`, d.maxTrackedFiles,
+	)
+	if err != nil {
+		d.logger.Error("failed to enforce maxTrackedFiles", "err", err)
+		return
+	}
+	type evicted struct {
+		id, path string
+		updated  int64
+	}
+	var files []evicted
+	for rows.Next() {
+		var f evicted
+		if err := rows.Scan(&f.id, &f.path, &f.updated); err != nil {
+			rows.Close()
+			d.logger.Error("failed to enforce maxTrackedFiles", "err", err)
+			return
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		d.logger.Error("failed to enforce maxTrackedFiles", "err", err)
+		return
+	}
+
+	for _, f := range files {
+		result, err := d.db.Exec(`DELETE FROM files WHERE id = ?`, f.id)
+		if err != nil {
+			d.logger.Error("failed to evict file", "path", f.path, "err", err)
+			continue
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue // already removed by a concurrent save
+		}
+		d.logger.Info("maxTrackedFiles exceeded: evicted least recently updated file",
+			"path", f.path, "fileId", f.id, "updated", f.updated, "limit", d.maxTrackedFiles)
+	}
+}
+
+// SetLogger sets the logger for runtime messages such as size limit
+// warnings. Messages logged while opening the database use slog.Default().
+func (d *DB) SetLogger(logger *slog.Logger) {
+	d.logger = logger
+}
+
+// SetOrderByMtime makes GetSnapshots and GetRecentSnapshots order snapshots
+// by the captured file mtime instead of detection time. Snapshots without a
+// recorded mtime fall back to their detection time.
+func (d *DB) SetOrderByMtime(enabled bool) {
+	d.orderByMtime = enabled
+}
+
+// SetDedupHash selects the hash new snapshots are stored with and compared
+// by to skip unchanged saves: "xxhash" uses the faster non-cryptographic
+// XXH64, anything else SHA-256. XXH64 hashes carry an "xxh64:" prefix, so
+// a stored hash always identifies its algorithm. Hashes of different
+// algorithms never match, so switching records each file once more.
+func (d *DB) SetDedupHash(algo string) {
+	d.xxhashDedup = algo == "xxhash"
+}
+
+// SetDedupWindow makes a save skip content matching any of the file's n
+// latest snapshots instead of only the latest; n < 0 checks all of them.
+// n of 0 or 1 keeps the default. Skipped content leaves an older snapshot
+// as the file's match, so the latest snapshot may then differ from disk
+// until the next change.
+func (d *DB) SetDedupWindow(n int) {
+	d.dedupWindow = n
+}
+
+// contentHash returns the stored hash of content under the configured
+// dedup algorithm.
+func (d *DB) contentHash(content []byte) string {
+	if d.xxhashDedup {
+		return xxh64Prefix + strconv.FormatUint(xxhash.Sum64(content), 16)
+	}
+	return sha256sum(content)
+}
+
+// xxh64Prefix marks hashes computed with XXH64 rather than SHA-256.
+const xxh64Prefix = "xxh64:"
+
+// SetRenameCollapseWindow merges rename chains (A→B followed by B→C within
+// seconds) into a single A→C entry in GetRecentSnapshots. The individual
+// rename rows are kept for GetRenames and lineage queries. 0 disables it.
+func (d *DB) SetRenameCollapseWindow(seconds int) {
+	d.renameCollapseSec = int64(seconds)
+}
+
+// SetCarryOverOnRename makes SaveRename copy the old file's latest snapshot
+// to the new path when the new path has no snapshots yet, so the renamed
+// file has its content right away instead of only once (and if) the new
+// path is snapshotted. The copy has origin "rename" and the rename's time;
+// a later snapshot of unchanged content is deduplicated against it.
+func (d *DB) SetCarryOverOnRename(enabled bool) {
+	d.carryOverOnRename = enabled
+}
+
+// sortTimeExpr returns the SQL expression snapshot lists are ordered by.
+// prefix qualifies the snapshot columns (e.g. "s.").
+func (d *DB) sortTimeExpr(prefix string) string {
+	if d.orderByMtime {
+		return "CASE WHEN " + prefix + "mtime > 0 THEN " + prefix + "mtime ELSE " + prefix + "timestamp END"
+	}
+	return prefix + "timestamp"
+}
+
+// errDiskSpaceUnknown is returned by availableDiskSpace on platforms where
+// free space cannot be queried.
+var errDiskSpaceUnknown = errors.New("disk space unknown on this platform")
+
 // CreateDatabaseSnapshot creates a consistent snapshot of the database using VACUUM INTO.
 // It writes the snapshot to a temporary file and returns the file path.
 // The caller is responsible for removing the file after use.
@@ -788,12 +2781,13 @@ func (d *DB) CreateDatabaseSnapshot(tmpDir string) (string, error) {
 		return "", fmt.Errorf("getting database size: %w", err)
 	}
 
-	var stat unix.Statfs_t
-	if err := unix.Statfs(tmpDir, &stat); err != nil {
+	availableBytes, err := availableDiskSpace(tmpDir)
+	switch {
+	case errors.Is(err, errDiskSpaceUnknown):
+		// No way to check on this platform; VACUUM INTO fails if it runs out.
+	case err != nil:
 		return "", fmt.Errorf("checking disk space: %w", err)
-	}
-	availableBytes := uint64(stat.Bavail) * uint64(stat.Bsize)
-	if dbSize < 0 || uint64(dbSize) > availableBytes {
+	case dbSize < 0 || uint64(dbSize) > availableBytes:
 		return "", fmt.Errorf("insufficient disk space: need %d bytes, available %d bytes", dbSize, availableBytes)
 	}
 
@@ -815,6 +2809,53 @@ func (d *DB) CreateDatabaseSnapshot(tmpDir string) (string, error) {
 	return tmpPath, nil
 }
 
+// backupTimeFormat is the timestamp layout in backup file names; it sorts
+// chronologically as a string.
+const backupTimeFormat = "20060102-150405"
+
+// Backup writes a copy of the database to dir as <prefix><timestamp>.db and
+// then deletes all but the newest keep copies with the same prefix. The
+// disk-space check of CreateDatabaseSnapshot applies.
+func (d *DB) Backup(dir, prefix string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("creating backup directory: %w", err)
+	}
+	tmpPath, err := d.CreateDatabaseSnapshot(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, prefix+time.Now().Format(backupTimeFormat)+".db")
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("renaming backup: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return path, fmt.Errorf("listing backups: %w", err)
+	}
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || !strings.HasSuffix(stamp, ".db") {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ".db")); err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	slices.Sort(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return path, fmt.Errorf("pruning backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return path, nil
+}
+
 // SaveRename records a file rename event. It looks up the old file by path
 // and creates a new file record for the new path if one doesn't exist.
 // Returns the new file's ID. If the old file is not tracked, returns ("", nil)
@@ -827,8 +2868,8 @@ func (d *DB) SaveRename(oldPath, newPath string) (string, error) {
 	defer tx.Rollback()
 
 	// Look up old file — skip if not tracked (temp file rename)
-	var oldFileID string
-	err = tx.QueryRow(`SELECT id FROM files WHERE path = ?`, oldPath).Scan(&oldFileID)
+	var oldFileID, watchSet string
+	err = tx.QueryRow(`SELECT id, watch_set FROM files WHERE path = ?`, oldPath).Scan(&oldFileID, &watchSet)
 	if err == sql.ErrNoRows {
 		return "", nil
 	}
@@ -842,10 +2883,11 @@ func (d *DB) SaveRename(oldPath, newPath string) (string, error) {
 	var newFileID string
 	err = tx.QueryRow(`SELECT id FROM files WHERE path = ?`, newPath).Scan(&newFileID)
 	if err == sql.ErrNoRows {
-		newFileID = newUUIDv7()
+		// The new file inherits the watch set that captured the old one
+		newFileID = d.newID()
 		_, err = tx.Exec(
-			`INSERT INTO files (id, path, created, updated) VALUES (?, ?, ?, ?)`,
-			newFileID, newPath, now, now,
+			`INSERT INTO files (id, path, created, updated, watch_set) VALUES (?, ?, ?, ?, ?)`,
+			newFileID, newPath, now, now, watchSet,
 		)
 		if err != nil {
 			return "", fmt.Errorf("inserting new file: %w", err)
@@ -855,7 +2897,7 @@ func (d *DB) SaveRename(oldPath, newPath string) (string, error) {
 	}
 
 	// Record the rename
-	renameID := newUUIDv7()
+	renameID := d.newID()
 	_, err = tx.Exec(
 		`INSERT INTO renames (id, old_file_id, new_file_id, old_path, new_path, timestamp)
 		 VALUES (?, ?, ?, ?, ?, ?)`,
@@ -865,6 +2907,20 @@ func (d *DB) SaveRename(oldPath, newPath string) (string, error) {
 		return "", fmt.Errorf("inserting rename: %w", err)
 	}
 
+	if d.carryOverOnRename {
+		_, err = tx.Exec(
+			`INSERT INTO snapshots (id, file_id, content, size, hash, dedup_hash, timestamp, compression, line_count, encoding, preview, binary, became_binary, mtime, origin, truncated)
+			 SELECT ?, ?, content, size, hash, dedup_hash, ?, compression, line_count, encoding, preview, binary, became_binary, mtime, 'rename', truncated
+			 FROM snapshots
+			 WHERE file_id = ? AND NOT EXISTS (SELECT 1 FROM snapshots WHERE file_id = ?)
+			 ORDER BY timestamp DESC, id DESC LIMIT 1`,
+			d.newID(), newFileID, now, oldFileID, newFileID,
+		)
+		if err != nil {
+			return "", fmt.Errorf("carrying over snapshot: %w", err)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return "", fmt.Errorf("committing transaction: %w", err)
 	}
@@ -897,6 +2953,100 @@ func (d *DB) GetRenames(fileID string) ([]Rename, error) {
 	return renames, rows.Err()
 }
 
+// GetRenamesPage returns up to limit rename records of the given file ID,
+// either as source or destination, newest first, skipping the first offset.
+func (d *DB) GetRenamesPage(fileID string, limit, offset int) ([]Rename, error) {
+	rows, err := d.db.Query(
+		`SELECT id, old_file_id, new_file_id, old_path, new_path, timestamp
+		 FROM renames
+		 WHERE old_file_id = ? OR new_file_id = ?
+		 ORDER BY timestamp DESC, id DESC
+		 LIMIT ? OFFSET ?`,
+		fileID, fileID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("getting renames: %w", err)
+	}
+	defer rows.Close()
+
+	var renames []Rename
+	for rows.Next() {
+		var r Rename
+		if err := rows.Scan(&r.ID, &r.OldFileID, &r.NewFileID, &r.OldPath, &r.NewPath, &r.Timestamp); err != nil {
+			return nil, fmt.Errorf("scanning rename: %w", err)
+		}
+		renames = append(renames, r)
+	}
+	return renames, rows.Err()
+}
+
+// GetLineage returns every rename record connected to fileID through any
+// chain of renames, in either direction, ordered by timestamp. A file that
+// was never renamed has an empty lineage.
+func (d *DB) GetLineage(fileID string) ([]Rename, error) {
+	rows, err := d.db.Query(
+		`WITH RECURSIVE linked(id) AS (
+			SELECT ?
+			UNION
+			SELECT CASE WHEN r.old_file_id = linked.id THEN r.new_file_id ELSE r.old_file_id END
+			FROM renames r JOIN linked ON r.old_file_id = linked.id OR r.new_file_id = linked.id
+		 )
+		 SELECT id, old_file_id, new_file_id, old_path, new_path, timestamp
+		 FROM renames
+		 WHERE old_file_id IN (SELECT id FROM linked)
+		 ORDER BY timestamp ASC, id ASC`,
+		fileID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("getting lineage: %w", err)
+	}
+	defer rows.Close()
+
+	var renames []Rename
+	for rows.Next() {
+		var r Rename
+		if err := rows.Scan(&r.ID, &r.OldFileID, &r.NewFileID, &r.OldPath, &r.NewPath, &r.Timestamp); err != nil {
+			return nil, fmt.Errorf("scanning rename: %w", err)
+		}
+		renames = append(renames, r)
+	}
+	return renames, rows.Err()
+}
+
+// ResolveLatestPath follows the rename chain starting at fileID and returns
+// the most recent path of the file. If the file was never renamed, its own
+// path is returned.
+func (d *DB) ResolveLatestPath(fileID string) (string, error) {
+	file, err := d.GetFile(fileID)
+	if err != nil {
+		return "", err
+	}
+	path := file.Path
+	seen := map[string]struct{}{fileID: {}}
+	current := fileID
+	for {
+		var nextID, nextPath string
+		err := d.db.QueryRow(
+			`SELECT new_file_id, new_path FROM renames
+			 WHERE old_file_id = ?
+			 ORDER BY timestamp DESC, id DESC LIMIT 1`,
+			current,
+		).Scan(&nextID, &nextPath)
+		if err == sql.ErrNoRows {
+			return path, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("following renames: %w", err)
+		}
+		if _, loop := seen[nextID]; loop {
+			// A -> B -> A: the last hop is the current path
+			return nextPath, nil
+		}
+		seen[nextID] = struct{}{}
+		current, path = nextID, nextPath
+	}
+}
+
 // buildDirFilter generates a SQL WHERE clause fragment for directory prefix filtering.
 // Returns empty string and nil args if prefixes is empty.
 func buildDirFilter(column string, prefixes []string) (string, []any) {
@@ -915,6 +3065,38 @@ func buildDirFilter(column string, prefixes []string) (string, []any) {
 	return "(" + strings.Join(conditions, " OR ") + ")", args
 }
 
+// countLines returns the number of lines in content. A final line without a
+// trailing newline is counted; empty content has zero lines.
+func countLines(content []byte) int {
+	n := bytes.Count(content, []byte{'\n'})
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// previewMaxBytes is the maximum length of a stored snapshot preview.
+const previewMaxBytes = 200
+
+// makePreview returns up to previewMaxBytes of content's leading text, cut
+// at a UTF-8 boundary and trimmed of surrounding newlines.
+func makePreview(content []byte) string {
+	if len(content) > previewMaxBytes {
+		content = content[:previewMaxBytes]
+		// Drop a multi-byte rune split by the cut. Only the tail is looked
+		// at, so invalid bytes earlier in the content do not shorten it.
+		for i := 1; i < utf8.UTFMax && i <= len(content); i++ {
+			if utf8.RuneStart(content[len(content)-i]) {
+				if !utf8.FullRune(content[len(content)-i:]) {
+					content = content[:len(content)-i]
+				}
+				break
+			}
+		}
+	}
+	return strings.Trim(string(content), "\r\n")
+}
+
 func sha256sum(data []byte) string {
 	h := sha256.Sum256(data)
 	return hex.EncodeToString(h[:])
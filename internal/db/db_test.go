@@ -1,12 +1,19 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
@@ -131,6 +138,562 @@ func TestZstdRoundTrip(t *testing.T) {
 	}
 }
 
+func TestZstdRoundTrip_NoCompressExtension(t *testing.T) {
+	d := newTestDB(t)
+	d.SetNoCompressExtensions([]string{".b64.txt"})
+	original := []byte("aGVsbG8gd29ybGQgYmFzZTY0IGJsb2I=")
+
+	if _, err := d.SaveSnapshot("/tmp/blob.B64.txt", original, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/plain.txt", original, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path        string
+		compression string
+	}{
+		{"/tmp/blob.B64.txt", compressionNone},
+		{"/tmp/plain.txt", compressionZstd},
+	} {
+		files, err := d.SearchFiles(tt.path, 10, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots, err := d.GetSnapshots(files[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var compression string
+		var stored []byte
+		if err := d.db.QueryRow(
+			"SELECT compression, content FROM snapshots WHERE id = ?", snapshots[0].ID,
+		).Scan(&compression, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if compression != tt.compression {
+			t.Errorf("%s: compression = %q, want %q", tt.path, compression, tt.compression)
+		}
+		if tt.compression == compressionNone && string(stored) != string(original) {
+			t.Errorf("%s: stored content = %q, want raw %q", tt.path, stored, original)
+		}
+
+		snap, err := d.GetSnapshot(snapshots[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(snap.Content) != string(original) {
+			t.Errorf("%s: content = %q, want %q", tt.path, snap.Content, original)
+		}
+	}
+}
+
+func TestSaveSnapshotRequests_RecordsWatchSet(t *testing.T) {
+	d := newTestDB(t)
+
+	saved, errs := d.SaveSnapshotRequests([]SnapshotRequest{
+		{FilePath: "/a/main.go", Content: []byte("a"), WatchSet: "set-a"},
+		{FilePath: "/b/main.go", Content: []byte("b"), WatchSet: "set-b"},
+	})
+	for i := range saved {
+		if errs[i] != nil || !saved[i] {
+			t.Fatalf("item %d: saved=%v err=%v", i, saved[i], errs[i])
+		}
+	}
+
+	// A later save from another set keeps the original owner
+	if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{
+		{FilePath: "/a/main.go", Content: []byte("a2"), WatchSet: "set-b"},
+	}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+
+	files, err := d.SearchFilesInWatchSet("", 10, 0, "set-a", nil)
+	if err != nil {
+		t.Fatalf("SearchFilesInWatchSet() error: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "/a/main.go" {
+		t.Fatalf("set-a files = %+v, want only /a/main.go", files)
+	}
+	if files[0].WatchSet != "set-a" {
+		t.Errorf("WatchSet = %q, want set-a", files[0].WatchSet)
+	}
+
+	entries, err := d.GetRecentSnapshots(10, 0, "/b/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].WatchSet != "set-b" {
+		t.Errorf("history entries = %+v, want one entry with watchSet set-b", entries)
+	}
+
+	// Rename target inherits the watch set of the source
+	if _, err := d.SaveRename("/a/main.go", "/a/renamed.go"); err != nil {
+		t.Fatal(err)
+	}
+	files, err = d.SearchFilesInWatchSet("renamed", 10, 0, "set-a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("renamed file in set-a: got %d files, want 1", len(files))
+	}
+}
+
+func TestSearchFilesInWatchSet_LegacyRowsUseDirPrefixes(t *testing.T) {
+	d := newTestDB(t)
+
+	// SaveSnapshot records no watch set, like rows written before the column existed
+	if _, err := d.SaveSnapshot("/legacy/a.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/other/b.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := d.SearchFilesInWatchSet("", 10, 0, "legacy", []string{"/legacy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "/legacy/a.go" {
+		t.Errorf("files = %+v, want only /legacy/a.go", files)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	tests := []struct {
+		content string
+		want    int
+	}{
+		{"", 0},
+		{"one", 1},
+		{"one\n", 1},
+		{"one\ntwo", 2},
+		{"one\ntwo\n", 2},
+		{"\n\n", 2},
+	}
+	for _, tt := range tests {
+		if got := countLines([]byte(tt.content)); got != tt.want {
+			t.Errorf("countLines(%q) = %d, want %d", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSaveSnapshotRequests_NormalizeLineEndings(t *testing.T) {
+	d := newTestDB(t)
+
+	save := func(path, content string, normalize bool) bool {
+		t.Helper()
+		saved, errs := d.SaveSnapshotRequests([]SnapshotRequest{
+			{FilePath: path, Content: []byte(content), NormalizeLineEndings: normalize},
+		})
+		if errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		return saved[0]
+	}
+
+	if !save("/tmp/eol.txt", "a\r\nb\r\n", true) {
+		t.Fatal("first save should be recorded")
+	}
+	if save("/tmp/eol.txt", "a\nb\n", true) {
+		t.Error("line-ending-only change should be skipped when normalizing")
+	}
+	if !save("/tmp/eol.txt", "a\nc\n", true) {
+		t.Error("content change should be recorded")
+	}
+
+	// The stored content keeps the original line endings
+	files, _ := d.SearchFiles("eol.txt", 1, 0, nil)
+	snapshots, _ := d.GetSnapshots(files[0].ID)
+	first, err := d.GetSnapshot(snapshots[len(snapshots)-1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Content) != "a\r\nb\r\n" {
+		t.Errorf("content = %q, want original CRLF bytes", first.Content)
+	}
+
+	// The hash stays over the stored bytes, so a later snapshot that only
+	// differs in line endings is not reported as identical
+	if !save("/tmp/eol.txt", "a\nb\n", true) {
+		t.Fatal("content matching an older snapshot should be recorded")
+	}
+	snapshots, _ = d.GetSnapshots(files[0].ID)
+	if latest := snapshots[0]; latest.Hash == first.Hash {
+		t.Errorf("snapshots differing in line endings share hash %s", latest.Hash)
+	}
+	if first.Hash != sha256sum([]byte("a\r\nb\r\n")) {
+		t.Errorf("hash = %s, want the hash of the stored bytes", first.Hash)
+	}
+
+	if !save("/tmp/raw.txt", "a\r\n", false) || !save("/tmp/raw.txt", "a\n", false) {
+		t.Error("line-ending change should be recorded without normalization")
+	}
+}
+
+func TestSetDedupWindow(t *testing.T) {
+	tests := []struct {
+		window   int
+		contents []string
+		want     int
+	}{
+		{1, []string{"A", "B", "A"}, 3},
+		{2, []string{"A", "B", "A"}, 2},
+		{2, []string{"A", "B", "C", "A"}, 4},
+		{-1, []string{"A", "B", "C", "A", "B"}, 3},
+	}
+	for _, tt := range tests {
+		d := newTestDB(t)
+		d.SetDedupWindow(tt.window)
+		for _, c := range tt.contents {
+			if _, err := d.SaveSnapshot("/tmp/flip.txt", []byte(c), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := d.GetFileByPath("/tmp/flip.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots, err := d.GetSnapshots(f.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != tt.want {
+			t.Errorf("window %d, saves %v: got %d snapshots, want %d", tt.window, tt.contents, len(snapshots), tt.want)
+		}
+	}
+}
+
+func TestSetDedupHash_XXHash(t *testing.T) {
+	d := newTestDB(t)
+	d.SetDedupHash("xxhash")
+
+	save := func(content string) bool {
+		t.Helper()
+		saved, err := d.SaveSnapshot("/tmp/xx.go", []byte(content), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+
+	if !save("v1") {
+		t.Fatal("first save should be recorded")
+	}
+	if save("v1") {
+		t.Error("unchanged content should be skipped with xxhash")
+	}
+	files, _ := d.SearchFiles("xx.go", 1, 0, nil)
+	snapshots, _ := d.GetSnapshots(files[0].ID)
+	if !strings.HasPrefix(snapshots[0].Hash, "xxh64:") {
+		t.Errorf("hash = %q, want xxh64: prefix", snapshots[0].Hash)
+	}
+
+	// Switching back records the file once more, then dedups by SHA-256
+	d.SetDedupHash("sha256")
+	if !save("v1") {
+		t.Error("first save after switching algorithms should be recorded")
+	}
+	if save("v1") {
+		t.Error("unchanged content should be skipped with sha256")
+	}
+	snapshots, _ = d.GetSnapshots(files[0].ID)
+	if len(snapshots[0].Hash) != 64 {
+		t.Errorf("hash = %q, want a SHA-256 hex digest", snapshots[0].Hash)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	if _, err := d.TrainDictionary(100); !errors.Is(err, ErrNotEnoughSamples) {
+		t.Fatalf("TrainDictionary() on empty db error = %v, want ErrNotEnoughSamples", err)
+	}
+
+	header := "// Copyright 2024 Example Corp. All rights reserved.\n" +
+		"// Licensed under the Apache License, Version 2.0.\n\n" +
+		"package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"strings\"\n)\n\n"
+	for i := range 50 {
+		content := fmt.Sprintf("%sfunc f%d() { fmt.Println(%d) }\n", header, i, i*7919)
+		if _, err := d.SaveSnapshot(fmt.Sprintf("/tmp/dict/f%d.go", i), []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := d.GetFileByPath("/tmp/dict/f0.go")
+
+	info, err := d.TrainDictionary(100)
+	if err != nil {
+		t.Fatalf("TrainDictionary() error: %v", err)
+	}
+	if info.ID == 0 || info.Size == 0 || info.Samples != 50 {
+		t.Errorf("TrainDictionary() = %+v, want non-zero id and size from 50 samples", info)
+	}
+
+	content := header + "func g() { fmt.Println(\"new\") }\n"
+	if _, err := d.SaveSnapshot("/tmp/dict/new.go", []byte(content), 0); err != nil {
+		t.Fatal(err)
+	}
+	var compression string
+	var stored int
+	if err := d.db.QueryRow(
+		`SELECT s.compression, LENGTH(s.content) FROM snapshots s JOIN files f ON f.id = s.file_id WHERE f.path = ?`,
+		"/tmp/dict/new.go",
+	).Scan(&compression, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if compression != compressionZstdDict {
+		t.Errorf("compression = %q, want %q", compression, compressionZstdDict)
+	}
+	if plain := len(d.encoder.EncodeAll([]byte(content), nil)); stored >= plain {
+		t.Errorf("dictionary blob is %d bytes, not smaller than %d without it", stored, plain)
+	}
+	d.Close()
+
+	// Both pre- and post-dictionary snapshots decode after reopening
+	d, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer d.Close()
+	after, _ := d.GetFileByPath("/tmp/dict/new.go")
+	for _, fileID := range []string{before.ID, after.ID} {
+		snap, err := d.GetLatestSnapshot(fileID)
+		if err != nil {
+			t.Fatalf("GetLatestSnapshot() error: %v", err)
+		}
+		if !strings.HasPrefix(string(snap.Content), header) {
+			t.Errorf("snapshot content = %q, want it to start with the header", snap.Content)
+		}
+	}
+}
+
+func TestSaveSnapshot_StoresLineCount(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/lines.go", []byte("a\nb\nc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := d.SearchFiles("lines.go", 1, 0, nil)
+	snaps, err := d.GetSnapshots(files[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snaps[0].LineCount != 3 {
+		t.Errorf("GetSnapshots LineCount = %d, want 3", snaps[0].LineCount)
+	}
+	snap, err := d.GetSnapshot(snaps[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.LineCount != 3 {
+		t.Errorf("GetSnapshot LineCount = %d, want 3", snap.LineCount)
+	}
+	entries, err := d.GetRecentSnapshots(10, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].LineCount != 3 {
+		t.Errorf("HistoryEntry LineCount = %d, want 3", entries[0].LineCount)
+	}
+}
+
+func TestMakePreview(t *testing.T) {
+	long := strings.Repeat("a", previewMaxBytes-1) + "あいう"
+	invalidEarly := "\xff" + strings.Repeat("a", previewMaxBytes)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"short", "first line\nsecond line\n", "first line\nsecond line"},
+		{"leadingNewlines", "\n\nbody\n", "body"},
+		{"cutAtRuneBoundary", long, strings.Repeat("a", previewMaxBytes-1)},
+		{"invalidBeforeCut", invalidEarly, invalidEarly[:previewMaxBytes]},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := makePreview([]byte(tt.content)); got != tt.want {
+			t.Errorf("%s: makePreview() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetRecentSnapshots_IncludesPreview(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/preview.go", []byte("package main\n\nfunc main() {}\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveRename("/tmp/preview.go", "/tmp/renamed.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.GetRecentSnapshots(10, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		switch e.EntryType {
+		case "save":
+			if e.Preview != "package main\n\nfunc main() {}" {
+				t.Errorf("save preview = %q", e.Preview)
+			}
+		case "rename":
+			if e.Preview != "" {
+				t.Errorf("rename preview = %q, want empty", e.Preview)
+			}
+		}
+	}
+}
+
+func TestGetSnapshotAt(t *testing.T) {
+	d := newTestDB(t)
+
+	for i := range 3 {
+		if _, err := d.SaveSnapshot("/tmp/at.go", []byte(fmt.Sprintf("v%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := d.SearchFiles("at.go", 1, 0, nil)
+	// Timestamps 100, 200, 300 for v0, v1, v2
+	rows, _ := d.GetSnapshots(files[0].ID)
+	for i, s := range rows {
+		if _, err := d.db.Exec(`UPDATE snapshots SET timestamp = ? WHERE id = ?`, 300-i*100, s.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		at   int64
+		want string
+	}{
+		{100, "v0"},
+		{250, "v1"},
+		{300, "v2"},
+		{1000, "v2"},
+	}
+	for _, tt := range tests {
+		s, err := d.GetSnapshotAt("/tmp/at.go", tt.at)
+		if err != nil {
+			t.Fatalf("GetSnapshotAt(%d) error: %v", tt.at, err)
+		}
+		if string(s.Content) != tt.want {
+			t.Errorf("GetSnapshotAt(%d) = %q, want %q", tt.at, s.Content, tt.want)
+		}
+	}
+
+	if _, err := d.GetSnapshotAt("/tmp/at.go", 99); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("before first snapshot: err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := d.GetSnapshotAt("/tmp/missing.go", 1000); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown path: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestQuerySnapshots_RangeAndPagination(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/paged.go", []byte("v0"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := d.SearchFiles("paged.go", 1, 0, nil)
+	fileID := files[0].ID
+	for i := 1; i < 5; i++ {
+		if _, err := d.SaveSnapshot("/tmp/paged.go", []byte(fmt.Sprintf("v%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Spread timestamps 100..500 in insertion order
+	rows, _ := d.GetSnapshots(fileID)
+	for i, s := range rows {
+		if _, err := d.db.Exec(`UPDATE snapshots SET timestamp = ? WHERE id = ?`, 500-i*100, s.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    SnapshotQuery
+		want []int64
+	}{
+		{"all", SnapshotQuery{}, []int64{500, 400, 300, 200, 100}},
+		{"limit", SnapshotQuery{Limit: 2}, []int64{500, 400}},
+		{"offset", SnapshotQuery{Limit: 2, Offset: 2}, []int64{300, 200}},
+		{"range", SnapshotQuery{From: 200, To: 400}, []int64{400, 300, 200}},
+		{"rangeWithLimit", SnapshotQuery{From: 200, Limit: 1, Offset: 1}, []int64{400}},
+	}
+	for _, tt := range tests {
+		got, err := d.QuerySnapshots(fileID, tt.q)
+		if err != nil {
+			t.Fatalf("%s: QuerySnapshots() error: %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d snapshots, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i].Timestamp != tt.want[i] {
+				t.Errorf("%s: [%d].Timestamp = %d, want %d", tt.name, i, got[i].Timestamp, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBlameFile(t *testing.T) {
+	d := newTestDB(t)
+
+	versions := []string{
+		"a\nb\n",
+		"a\nb\nc\n",
+		"a\nB\nc\n",
+	}
+	for _, v := range versions {
+		if _, err := d.SaveSnapshot("/tmp/blame.go", []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := d.SearchFiles("blame.go", 1, 0, nil)
+	snaps, _ := d.GetSnapshots(files[0].ID) // newest first
+
+	lines, err := d.BlameFile(files[0].ID)
+	if err != nil {
+		t.Fatalf("BlameFile() error: %v", err)
+	}
+
+	want := []struct {
+		text       string
+		snapshotID string
+	}{
+		{"a", snaps[2].ID},
+		{"B", snaps[0].ID},
+		{"c", snaps[1].ID},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		if lines[i].Line != i+1 || lines[i].Text != w.text || lines[i].SnapshotID != w.snapshotID {
+			t.Errorf("lines[%d] = %+v, want line %d %q from %s", i, lines[i], i+1, w.text, w.snapshotID)
+		}
+	}
+}
+
+func TestBlameFile_NoSnapshots(t *testing.T) {
+	d := newTestDB(t)
+
+	_, err := d.BlameFile("00000000-0000-7000-8000-000000000000")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("BlameFile() error = %v, want sql.ErrNoRows", err)
+	}
+}
+
 func TestMaxSnapshots(t *testing.T) {
 	d := newTestDB(t)
 
@@ -275,559 +838,1268 @@ func TestDeleteFile_NotFound(t *testing.T) {
 	}
 }
 
-func TestGetStats_Empty(t *testing.T) {
+func TestDeleteSnapshot(t *testing.T) {
 	d := newTestDB(t)
 
-	stats, err := d.GetStats(nil)
-	if err != nil {
-		t.Fatal(err)
+	for _, content := range []string{"v1", "v2"} {
+		if _, err := d.SaveSnapshot("/tmp/delsnap.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if stats.TotalFiles != 0 {
-		t.Errorf("TotalFiles = %d, want 0", stats.TotalFiles)
+	file, _ := d.GetFileByPath("/tmp/delsnap.go")
+	snapshots, _ := d.GetSnapshots(file.ID)
+
+	if err := d.DeleteSnapshot(snapshots[0].ID, false); err != nil {
+		t.Fatalf("DeleteSnapshot() error: %v", err)
 	}
-	if stats.TotalSnapshots != 0 {
-		t.Errorf("TotalSnapshots = %d, want 0", stats.TotalSnapshots)
+	latest, err := d.GetLatestSnapshot(file.ID)
+	if err != nil || latest.ID != snapshots[1].ID {
+		t.Errorf("latest = %s (%v), want %s", latest.ID, err, snapshots[1].ID)
+	}
+	if err := d.DeleteSnapshot(snapshots[0].ID, false); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleting again: err = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := d.DeleteSnapshot(snapshots[1].ID, false); !errors.Is(err, ErrLastSnapshot) {
+		t.Errorf("deleting the only snapshot: err = %v, want ErrLastSnapshot", err)
+	}
+	if err := d.DeleteSnapshot(snapshots[1].ID, true); err != nil {
+		t.Fatalf("DeleteSnapshot(force) error: %v", err)
+	}
+	if remaining, _ := d.GetSnapshots(file.ID); len(remaining) != 0 {
+		t.Errorf("got %d snapshots, want 0", len(remaining))
+	}
+	if _, err := d.GetFile(file.ID); err != nil {
+		t.Errorf("GetFile() error: %v, want the file kept", err)
 	}
 }
 
-func TestGetStats_WithData(t *testing.T) {
+func TestDeleteSnapshot_UpdatesFileTime(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aa"), 0); err != nil {
+	for _, content := range []string{"v1", "v2"} {
+		if _, err := d.SaveSnapshot("/tmp/delsnap.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, _ := d.GetFileByPath("/tmp/delsnap.go")
+	snapshots, _ := d.GetSnapshots(file.ID)
+	if _, err := d.db.Exec(`UPDATE snapshots SET timestamp = 1000 WHERE id = ?`, snapshots[1].ID); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("bbb"), 0); err != nil {
+	if _, err := d.db.Exec(`UPDATE snapshots SET timestamp = 2000 WHERE id = ?`, snapshots[0].ID); err != nil {
 		t.Fatal(err)
 	}
-
-	stats, err := d.GetStats(nil)
-	if err != nil {
+	if _, err := d.db.Exec(`UPDATE files SET created = 500, updated = 2000 WHERE id = ?`, file.ID); err != nil {
 		t.Fatal(err)
 	}
-	if stats.TotalFiles != 2 {
-		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+
+	if err := d.DeleteSnapshot(snapshots[0].ID, false); err != nil {
+		t.Fatalf("DeleteSnapshot() error: %v", err)
 	}
-	if stats.TotalSnapshots != 2 {
-		t.Errorf("TotalSnapshots = %d, want 2", stats.TotalSnapshots)
+	if got, _ := d.GetFile(file.ID); got.Updated != 1000 {
+		t.Errorf("updated = %d, want 1000 from the remaining snapshot", got.Updated)
 	}
-	if stats.TotalSize != 5 {
-		t.Errorf("TotalSize = %d, want 5", stats.TotalSize)
+	if err := d.DeleteSnapshot(snapshots[1].ID, true); err != nil {
+		t.Fatalf("DeleteSnapshot(force) error: %v", err)
+	}
+	if got, _ := d.GetFile(file.ID); got.Updated != 500 {
+		t.Errorf("updated = %d, want the creation time 500", got.Updated)
 	}
 }
 
-func TestGetStats_WithDirPrefixes(t *testing.T) {
+func TestSaveDeletion(t *testing.T) {
 	d := newTestDB(t)
 
-	// Create files in two directories
-	if _, err := d.SaveSnapshot("/projects/a.go", []byte("aa"), 0); err != nil {
-		t.Fatal(err)
+	for _, p := range []string{"/tmp/del/gone.go", "/tmp/del/kept.go", "/tmp/other.go"} {
+		if _, err := d.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if _, err := d.SaveSnapshot("/projects/b.go", []byte("bbb"), 0); err != nil {
+	paths, err := d.TrackedPaths([]string{"/tmp/del"})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/documents/c.txt", []byte("cccc"), 0); err != nil {
-		t.Fatal(err)
+	if !slices.Equal(paths, []string{"/tmp/del/gone.go", "/tmp/del/kept.go"}) {
+		t.Errorf("TrackedPaths() = %v", paths)
 	}
 
-	// Filter by /projects prefix
-	stats, err := d.GetStats([]string{"/projects"})
+	if err := d.SaveDeletion("/tmp/del/gone.go"); err != nil {
+		t.Fatalf("SaveDeletion() error: %v", err)
+	}
+	if err := d.SaveDeletion("/tmp/del/gone.go"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second SaveDeletion() error = %v, want sql.ErrNoRows", err)
+	}
+
+	// No longer tracked on disk, but the file is kept and not trashed
+	if paths, _ := d.TrackedPaths([]string{"/tmp/del"}); !slices.Equal(paths, []string{"/tmp/del/kept.go"}) {
+		t.Errorf("TrackedPaths() after deletion = %v", paths)
+	}
+	if n, err := d.PurgeTrash(time.Now().Unix() + 1); err != nil || n != 0 {
+		t.Errorf("PurgeTrash() = %d, %v; want the deleted file kept", n, err)
+	}
+	if files, _ := d.SearchFiles("gone", 10, 0, nil); len(files) != 1 {
+		t.Errorf("SearchFiles() = %+v, want the deleted file listed", files)
+	}
+	gone, err := d.GetFileByPath("/tmp/del/gone.go")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if stats.TotalFiles != 2 {
-		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+	entries, err := d.GetRecentSnapshots(10, 0, "gone", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if stats.TotalSnapshots != 2 {
-		t.Errorf("TotalSnapshots = %d, want 2", stats.TotalSnapshots)
+	if len(entries) != 2 || entries[0].EntryType != "delete" || entries[0].FileID != gone.ID || entries[1].EntryType != "save" {
+		t.Errorf("history = %+v, want delete then save", entries)
 	}
-	if stats.TotalSize != 5 {
-		t.Errorf("TotalSize = %d, want 5", stats.TotalSize)
+	if timeline, _ := d.GetFileTimeline(gone.ID); len(timeline) != 2 || timeline[0].EntryType != "delete" {
+		t.Errorf("timeline = %+v, want delete then save", timeline)
 	}
 
-	// Filter by /documents prefix
-	stats, err = d.GetStats([]string{"/documents"})
+	// Reappearing with unchanged content is saved, so it can be deleted again
+	saved, err := d.SaveSnapshot("/tmp/del/gone.go", []byte("/tmp/del/gone.go"), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if stats.TotalFiles != 1 {
-		t.Errorf("TotalFiles = %d, want 1", stats.TotalFiles)
+	if !saved {
+		t.Error("unchanged content of a deleted file was skipped")
 	}
-	if stats.TotalSnapshots != 1 {
-		t.Errorf("TotalSnapshots = %d, want 1", stats.TotalSnapshots)
+	if paths, _ := d.TrackedPaths([]string{"/tmp/del"}); !slices.Equal(paths, []string{"/tmp/del/gone.go", "/tmp/del/kept.go"}) {
+		t.Errorf("TrackedPaths() after reappearing = %v", paths)
 	}
-	if stats.TotalSize != 4 {
-		t.Errorf("TotalSize = %d, want 4", stats.TotalSize)
+	if err := d.SaveDeletion("/tmp/del/gone.go"); err != nil {
+		t.Errorf("SaveDeletion() after reappearing error: %v", err)
 	}
+}
 
-	// No filter returns all
-	stats, err = d.GetStats(nil)
-	if err != nil {
+func TestTrashFile(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/trash.go", []byte("content"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if stats.TotalFiles != 3 {
-		t.Errorf("TotalFiles = %d, want 3", stats.TotalFiles)
+	file, _ := d.GetFileByPath("/tmp/trash.go")
+	if err := d.TrashFile(file.ID); err != nil {
+		t.Fatalf("TrashFile() error: %v", err)
+	}
+	if files, _ := d.SearchFiles("trash", 10, 0, nil); len(files) != 0 {
+		t.Errorf("SearchFiles() = %+v, want the trashed file hidden", files)
+	}
+	if _, err := d.GetFile(file.ID); err != nil {
+		t.Errorf("GetFile() error: %v, want the trashed file kept", err)
+	}
+	if n, err := d.PurgeTrash(time.Now().Unix() + 1); err != nil || n != 1 {
+		t.Errorf("PurgeTrash() = %d, %v, want 1 purged", n, err)
+	}
+	if err := d.TrashFile(file.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("TrashFile() on a purged file: err = %v, want sql.ErrNoRows", err)
 	}
 }
 
-func TestSearchFiles_Pagination(t *testing.T) {
+func TestPurgeTrash(t *testing.T) {
 	d := newTestDB(t)
 
-	for i := range 5 {
-		path := fmt.Sprintf("/tmp/search%d.go", i)
-		if _, err := d.SaveSnapshot(path, []byte("content"), 0); err != nil {
+	for _, p := range []string{"/tmp/old.go", "/tmp/recent.go", "/tmp/live.go"} {
+		if _, err := d.SaveSnapshot(p, []byte(p), 0); err != nil {
 			t.Fatal(err)
 		}
 	}
+	if _, err := d.db.Exec(`UPDATE files SET deleted_at = 100 WHERE path = '/tmp/old.go'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec(`UPDATE files SET deleted_at = 300 WHERE path = '/tmp/recent.go'`); err != nil {
+		t.Fatal(err)
+	}
 
-	files, err := d.SearchFiles("search", 2, 0, nil)
+	n, err := d.PurgeTrash(200)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("PurgeTrash() error: %v", err)
 	}
-	if len(files) != 2 {
-		t.Errorf("page 1: got %d files, want 2", len(files))
+	if n != 1 {
+		t.Errorf("PurgeTrash() = %d, want 1", n)
 	}
 
-	files, err = d.SearchFiles("search", 2, 2, nil)
+	// The trashed but recent file is kept, though hidden from searches
+	var paths []string
+	rows, err := d.db.Query(`SELECT path FROM files ORDER BY path`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 2 {
-		t.Errorf("page 2: got %d files, want 2", len(files))
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		paths = append(paths, p)
 	}
-
-	files, err = d.SearchFiles("search", 2, 4, nil)
+	rows.Close()
+	if !slices.Equal(paths, []string{"/tmp/live.go", "/tmp/recent.go"}) {
+		t.Fatalf("files after purge = %v, want live.go and recent.go", paths)
+	}
+	files, err := d.SearchFiles("", 10, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Errorf("page 3: got %d files, want 1", len(files))
+	if len(files) != 1 || files[0].Path != "/tmp/live.go" {
+		t.Errorf("SearchFiles() = %+v, want only /tmp/live.go", files)
+	}
+
+	var snapCount int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM snapshots`).Scan(&snapCount); err != nil {
+		t.Fatal(err)
+	}
+	if snapCount != 2 {
+		t.Errorf("got %d snapshots after purge, want 2 (cascade)", snapCount)
 	}
 }
 
-func TestSearchFiles_WithDirPrefixes(t *testing.T) {
+func TestPruneRenames(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/projects/main.go", []byte("a"), 0); err != nil {
+	for _, p := range []string{"/tmp/kept.go", "/tmp/gone.go", "/tmp/chain.go", "/tmp/recent.go"} {
+		if _, err := d.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range [][2]string{
+		{"/tmp/kept.go", "/tmp/kept2.go"},
+		{"/tmp/gone.go", "/tmp/gone2.go"},
+		{"/tmp/chain.go", "/tmp/chain2.go"},
+		{"/tmp/chain2.go", "/tmp/chain3.go"},
+		{"/tmp/recent.go", "/tmp/recent2.go"},
+	} {
+		if _, err := d.SaveRename(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.db.Exec(`UPDATE renames SET timestamp = 100`); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/projects/util.go", []byte("b"), 0); err != nil {
+	if _, err := d.db.Exec(`UPDATE renames SET timestamp = 300 WHERE old_path = '/tmp/recent.go'`); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/documents/notes.go", []byte("c"), 0); err != nil {
+	// Only gone.go and recent.go lose their history; chain2.go never had any
+	if _, err := d.db.Exec(
+		`DELETE FROM snapshots WHERE file_id IN (SELECT id FROM files WHERE path IN ('/tmp/gone.go', '/tmp/recent.go'))`,
+	); err != nil {
 		t.Fatal(err)
 	}
 
-	// Search with dir prefix filter
-	files, err := d.SearchFiles(".go", 10, 0, []string{"/projects"})
+	n, err := d.PruneRenames(200)
 	if err != nil {
-		t.Fatal(err)
-	}
-	if len(files) != 2 {
-		t.Errorf("got %d files, want 2", len(files))
+		t.Fatalf("PruneRenames() error: %v", err)
 	}
-	for _, f := range files {
-		if f.Path != "/projects/main.go" && f.Path != "/projects/util.go" {
-			t.Errorf("unexpected file: %s", f.Path)
-		}
+	if n != 1 {
+		t.Errorf("PruneRenames() = %d, want 1", n)
 	}
 
-	// Search with no dir prefix returns all
-	files, err = d.SearchFiles(".go", 10, 0, nil)
+	rows, err := d.db.Query(`SELECT old_path FROM renames ORDER BY old_path`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 3 {
-		t.Errorf("got %d files, want 3", len(files))
+	defer rows.Close()
+	var left []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, p)
+	}
+	want := []string{"/tmp/chain.go", "/tmp/chain2.go", "/tmp/kept.go", "/tmp/recent.go"}
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Errorf("renames left = %v, want %v", left, want)
 	}
 
-	// Search with multiple dir prefixes
-	files, err = d.SearchFiles(".go", 10, 0, []string{"/projects", "/documents"})
+	stats, err := d.GetStats(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 3 {
-		t.Errorf("got %d files, want 3", len(files))
+	if stats.TotalRenames != 4 {
+		t.Errorf("TotalRenames = %d, want 4", stats.TotalRenames)
 	}
-}
-
-func TestGetRecentSnapshots_Empty(t *testing.T) {
-	d := newTestDB(t)
-
-	entries, err := d.GetRecentSnapshots(50, 0, "", nil)
+	stats, err = d.GetStats([]string{"/tmp/nowhere"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(entries) != 0 {
-		t.Errorf("got %d entries, want 0", len(entries))
+	if stats.TotalRenames != 0 {
+		t.Errorf("TotalRenames with unrelated dir = %d, want 0", stats.TotalRenames)
 	}
 }
 
-func TestGetRecentSnapshots_WithData(t *testing.T) {
+func TestActivityHistogram(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aaa"), 0); err != nil {
-		t.Fatal(err)
+	for _, p := range []string{"/proj/a.go", "/proj/b.go", "/other/c.go"} {
+		if _, err := d.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("bbb"), 0); err != nil {
+	if _, err := d.SaveRename("/proj/b.go", "/proj/b2.go"); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aaa-v2"), 0); err != nil {
+	for _, u := range []struct {
+		path string
+		ts   int64
+	}{{"/proj/a.go", 105}, {"/proj/b.go", 130}, {"/other/c.go", 310}} {
+		if _, err := d.db.Exec(
+			`UPDATE snapshots SET timestamp = ? WHERE file_id = (SELECT id FROM files WHERE path = ?)`, u.ts, u.path,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.db.Exec(`UPDATE renames SET timestamp = 150`); err != nil {
 		t.Fatal(err)
 	}
 
-	entries, err := d.GetRecentSnapshots(50, 0, "", nil)
+	got, err := d.ActivityHistogram(100, 100, 400, nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatalf("ActivityHistogram() error: %v", err)
 	}
-	if len(entries) != 3 {
-		t.Fatalf("got %d entries, want 3", len(entries))
+	want := []ActivityBucket{
+		{Start: 100, Saves: 2, Renames: 1},
+		{Start: 200},
+		{Start: 300, Saves: 1},
 	}
-
-	// Most recent first: a.go v2, b.go, a.go v1
-	if entries[0].FilePath != "/tmp/a.go" {
-		t.Errorf("entries[0].FilePath = %s, want /tmp/a.go", entries[0].FilePath)
+	if !slices.Equal(got, want) {
+		t.Errorf("ActivityHistogram() = %+v, want %+v", got, want)
 	}
-	if entries[1].FilePath != "/tmp/b.go" {
-		t.Errorf("entries[1].FilePath = %s, want /tmp/b.go", entries[1].FilePath)
+
+	got, err = d.ActivityHistogram(100, 100, 400, []string{"/other"})
+	if err != nil {
+		t.Fatalf("ActivityHistogram(dirs) error: %v", err)
 	}
-	if entries[2].FilePath != "/tmp/a.go" {
-		t.Errorf("entries[2].FilePath = %s, want /tmp/a.go", entries[2].FilePath)
+	want = []ActivityBucket{{Start: 100}, {Start: 200}, {Start: 300, Saves: 1}}
+	if !slices.Equal(got, want) {
+		t.Errorf("ActivityHistogram(dirs) = %+v, want %+v", got, want)
 	}
 
-	// Verify all fields are populated
-	for i, e := range entries {
-		if e.SnapshotID == "" {
-			t.Errorf("entries[%d].SnapshotID is empty", i)
-		}
-		if e.FileID == "" {
-			t.Errorf("entries[%d].FileID is empty", i)
-		}
-		if e.Size == 0 {
-			t.Errorf("entries[%d].Size is 0", i)
-		}
-		if e.Hash == "" {
-			t.Errorf("entries[%d].Hash is empty", i)
-		}
-		if e.Timestamp == 0 {
-			t.Errorf("entries[%d].Timestamp is 0", i)
-		}
+	if _, err := d.ActivityHistogram(0, 100, 400, nil); err == nil {
+		t.Error("ActivityHistogram(bucket=0) error = nil, want error")
 	}
 }
 
-func TestGetRecentSnapshots_Limit(t *testing.T) {
+func TestGetRecentFilesContext(t *testing.T) {
 	d := newTestDB(t)
 
-	for i := range 5 {
-		content := []byte(fmt.Sprintf("content-%d", i))
-		path := fmt.Sprintf("/tmp/limit%d.go", i)
-		if _, err := d.SaveSnapshot(path, content, 0); err != nil {
+	for _, s := range []struct{ path, content string }{
+		{"/proj/a.txt", "a1"},
+		{"/proj/b.txt", "b1"},
+		{"/proj/a.txt", "a2"},
+		{"/proj/a.txt", "a3"},
+		{"/other/c.txt", "c1"},
+	} {
+		if _, err := d.SaveSnapshot(s.path, []byte(s.content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pin the update order; timestamps within one second would tie
+	for path, updated := range map[string]int64{"/proj/a.txt": 300, "/proj/b.txt": 200, "/other/c.txt": 100} {
+		if _, err := d.db.Exec(`UPDATE files SET updated = ? WHERE path = ?`, updated, path); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	entries, err := d.GetRecentSnapshots(3, 0, "", nil)
+	files, err := d.GetRecentFilesContext(context.Background(), 10, 0, nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatalf("GetRecentFilesContext() error: %v", err)
 	}
-	if len(entries) != 3 {
-		t.Errorf("got %d entries, want 3", len(entries))
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.File.Path)
+	}
+	if want := []string{"/proj/a.txt", "/proj/b.txt", "/other/c.txt"}; !slices.Equal(paths, want) {
+		t.Fatalf("paths = %v, want %v (one entry per file)", paths, want)
+	}
+	latest, err := d.GetSnapshot(files[0].LatestSnapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(latest.Content) != "a3" {
+		t.Errorf("latest snapshot of a.txt = %q, want %q", latest.Content, "a3")
+	}
+
+	files, err = d.GetRecentFilesContext(context.Background(), 1, 1, []string{"/proj"})
+	if err != nil {
+		t.Fatalf("GetRecentFilesContext(dirs) error: %v", err)
+	}
+	if len(files) != 1 || files[0].File.Path != "/proj/b.txt" {
+		t.Errorf("second file under /proj = %+v, want /proj/b.txt", files)
 	}
 }
 
-func TestGetRecentSnapshots_Offset(t *testing.T) {
+func TestFindStaleFiles(t *testing.T) {
 	d := newTestDB(t)
 
-	for i := range 5 {
-		content := []byte(fmt.Sprintf("content-%d", i))
-		path := fmt.Sprintf("/tmp/offset%d.go", i)
-		if _, err := d.SaveSnapshot(path, content, 0); err != nil {
+	for _, s := range []struct{ path, content string }{
+		{"/proj/old.txt", "o1"},
+		{"/proj/old.txt", "o22"},
+		{"/proj/older.txt", "x"},
+		{"/proj/fresh.txt", "f"},
+		{"/other/old.txt", "y"},
+	} {
+		if _, err := d.SaveSnapshot(s.path, []byte(s.content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, updated := range map[string]int64{"/proj/old.txt": 200, "/proj/older.txt": 100, "/proj/fresh.txt": 1000, "/other/old.txt": 150} {
+		if _, err := d.db.Exec(`UPDATE files SET updated = ? WHERE path = ?`, updated, path); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	page1, err := d.GetRecentSnapshots(2, 0, "", nil)
+	files, err := d.FindStaleFiles(500, 10, 0, []string{"/proj"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots(2, 0) error: %v", err)
+		t.Fatalf("FindStaleFiles() error: %v", err)
 	}
-	if len(page1) != 2 {
-		t.Errorf("page1: got %d entries, want 2", len(page1))
+	want := []struct {
+		path      string
+		snapshots int
+		size      int64
+	}{
+		{"/proj/older.txt", 1, 1},
+		{"/proj/old.txt", 2, 5},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("FindStaleFiles() = %+v, want %d files", files, len(want))
+	}
+	for i, w := range want {
+		if files[i].File.Path != w.path || files[i].Snapshots != w.snapshots || files[i].TotalSize != w.size {
+			t.Errorf("files[%d] = %+v, want %s with %d snapshots of %d bytes", i, files[i], w.path, w.snapshots, w.size)
+		}
 	}
 
-	page2, err := d.GetRecentSnapshots(2, 2, "", nil)
+	files, err = d.FindStaleFiles(500, 1, 1, nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots(2, 2) error: %v", err)
+		t.Fatalf("FindStaleFiles(page) error: %v", err)
 	}
-	if len(page2) != 2 {
-		t.Errorf("page2: got %d entries, want 2", len(page2))
+	if len(files) != 1 || files[0].File.Path != "/other/old.txt" {
+		t.Errorf("second stale file = %+v, want /other/old.txt", files)
 	}
+}
 
-	// Ensure pages don't overlap
-	if page1[0].SnapshotID == page2[0].SnapshotID {
-		t.Error("page1 and page2 overlap")
+func TestStatsByExtension(t *testing.T) {
+	d := newTestDB(t)
+
+	saves := []struct {
+		path    string
+		content string
+	}{
+		{"/proj/main.go", "package main"},
+		{"/proj/main.go", "package main\n"},
+		{"/proj/util.GO", "package util"},
+		{"/proj/README.md", "# readme"},
+		{"/proj/Makefile", "all:"},
+		{"/proj/.bashrc", "alias l=ls"},
+		{"/proj/archive.tar.gz", "gz"},
+		{"/other/notes.md", "notes"},
+	}
+	for _, s := range saves {
+		if _, err := d.SaveSnapshot(s.path, []byte(s.content), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	page3, err := d.GetRecentSnapshots(2, 4, "", nil)
+	stats, err := d.StatsByExtension(nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots(2, 4) error: %v", err)
+		t.Fatalf("StatsByExtension() error: %v", err)
 	}
-	if len(page3) != 1 {
-		t.Errorf("page3: got %d entries, want 1", len(page3))
+	want := []ExtensionStats{
+		{Extension: ".go", Files: 2, Snapshots: 3, Bytes: int64(len("package main") + len("package main\n") + len("package util"))},
+		{Extension: "", Files: 2, Snapshots: 2, Bytes: int64(len("all:") + len("alias l=ls"))},
+		{Extension: ".md", Files: 2, Snapshots: 2, Bytes: int64(len("# readme") + len("notes"))},
+		{Extension: ".gz", Files: 1, Snapshots: 1, Bytes: 2},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("StatsByExtension() = %+v, want %+v", stats, want)
+	}
+
+	stats, err = d.StatsByExtension([]string{"/other"})
+	if err != nil {
+		t.Fatalf("StatsByExtension(dirs) error: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Extension != ".md" || stats[0].Files != 1 {
+		t.Errorf("StatsByExtension(/other) = %+v, want one .md file", stats)
 	}
 }
 
-func TestGetRecentSnapshots_WithDirPrefixes(t *testing.T) {
+func TestCompressionStats(t *testing.T) {
 	d := newTestDB(t)
 
-	// Create files in different directories
-	if _, err := d.SaveSnapshot("/projects/src/main.go", []byte("a"), 0); err != nil {
-		t.Fatal(err)
+	stats, err := d.CompressionStats(nil)
+	if err != nil {
+		t.Fatalf("CompressionStats() error: %v", err)
 	}
-	if _, err := d.SaveSnapshot("/projects/src/util.go", []byte("b"), 0); err != nil {
-		t.Fatal(err)
+	if stats != (CompressionStats{}) {
+		t.Errorf("CompressionStats() on empty DB = %+v, want zero", stats)
 	}
-	if _, err := d.SaveSnapshot("/documents/notes.txt", []byte("c"), 0); err != nil {
+
+	text := []byte(strings.Repeat("compressible line\n", 1000))
+	if _, err := d.SaveSnapshot("/proj/a.txt", text, 0); err != nil {
 		t.Fatal(err)
 	}
+	if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{
+		{FilePath: "/other/blob.dat", Content: []byte{0x00, 0x01, 0x02}, Binary: true},
+	}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
 
-	// Filter by /projects
-	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+	stats, err = d.CompressionStats(nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatalf("CompressionStats() error: %v", err)
 	}
-	if len(entries) != 2 {
-		t.Fatalf("got %d entries, want 2", len(entries))
+	if stats.Snapshots != 1 || stats.LogicalBytes != int64(len(text)) {
+		t.Errorf("Snapshots, LogicalBytes = %d, %d; want 1, %d (binary snapshots excluded)",
+			stats.Snapshots, stats.LogicalBytes, len(text))
 	}
-	for _, e := range entries {
-		if e.FilePath != "/projects/src/main.go" && e.FilePath != "/projects/src/util.go" {
-			t.Errorf("unexpected entry: %s", e.FilePath)
-		}
+	if stats.StoredBytes <= 0 || stats.StoredBytes >= stats.LogicalBytes {
+		t.Errorf("StoredBytes = %d, want between 0 and %d", stats.StoredBytes, stats.LogicalBytes)
+	}
+	if want := float64(stats.StoredBytes) / float64(stats.LogicalBytes); stats.Ratio != want {
+		t.Errorf("Ratio = %v, want %v", stats.Ratio, want)
 	}
 
-	// Filter by /documents
-	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/documents"})
+	stats, err = d.CompressionStats([]string{"/other"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatalf("CompressionStats(dirs) error: %v", err)
 	}
-	if len(entries) != 1 {
-		t.Fatalf("got %d entries, want 1", len(entries))
-	}
-	if entries[0].FilePath != "/documents/notes.txt" {
-		t.Errorf("FilePath = %s, want /documents/notes.txt", entries[0].FilePath)
+	if stats.Snapshots != 0 {
+		t.Errorf("Snapshots under /other = %d, want 0", stats.Snapshots)
 	}
+}
 
-	// No filter returns all
-	entries, err = d.GetRecentSnapshots(50, 0, "", nil)
+func TestGetStats_Empty(t *testing.T) {
+	d := newTestDB(t)
+
+	stats, err := d.GetStats(nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(entries) != 3 {
-		t.Fatalf("got %d entries, want 3", len(entries))
+	if stats.TotalFiles != 0 {
+		t.Errorf("TotalFiles = %d, want 0", stats.TotalFiles)
+	}
+	if stats.TotalSnapshots != 0 {
+		t.Errorf("TotalSnapshots = %d, want 0", stats.TotalSnapshots)
 	}
 }
 
-func TestGetRecentSnapshots_DirPrefixesWithQuery(t *testing.T) {
+func TestGetStats_WithData(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/projects/main.go", []byte("a"), 0); err != nil {
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aa"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/projects/util.go", []byte("b"), 0); err != nil {
+	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("bbb"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/documents/main.txt", []byte("c"), 0); err != nil {
+
+	stats, err := d.GetStats(nil)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if stats.TotalFiles != 2 {
+		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+	}
+	if stats.TotalSnapshots != 2 {
+		t.Errorf("TotalSnapshots = %d, want 2", stats.TotalSnapshots)
+	}
+	if stats.TotalSize != 5 {
+		t.Errorf("TotalSize = %d, want 5", stats.TotalSize)
+	}
+}
 
-	// Query "main" with dir prefix /projects -> only /projects/main.go
-	entries, err := d.GetRecentSnapshots(50, 0, "main", []string{"/projects"})
-	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+func TestGetFileFingerprint(t *testing.T) {
+	d := newTestDB(t)
+
+	if fp, err := d.GetFileFingerprint("/tmp/fp.go"); err != nil || fp != (FileFingerprint{}) {
+		t.Fatalf("unknown file: fp = %+v, err = %v", fp, err)
 	}
-	if len(entries) != 1 {
-		t.Fatalf("got %d entries, want 1", len(entries))
+
+	first := FileFingerprint{Size: 1, ModTime: 100}
+	if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/fp.go", Content: []byte("x"), Fingerprint: first}}); errs[0] != nil {
+		t.Fatal(errs[0])
 	}
-	if entries[0].FilePath != "/projects/main.go" {
-		t.Errorf("FilePath = %s, want /projects/main.go", entries[0].FilePath)
+	if fp, _ := d.GetFileFingerprint("/tmp/fp.go"); fp != first {
+		t.Errorf("fp = %+v, want %+v", fp, first)
 	}
 
-	// Query "main" without dir prefix -> both main files
-	entries, err = d.GetRecentSnapshots(50, 0, "main", nil)
-	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	// Unchanged content still refreshes the fingerprint (e.g. after touch).
+	touched := FileFingerprint{Size: 1, ModTime: 200}
+	saved, errs := d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/fp.go", Content: []byte("x"), Fingerprint: touched}})
+	if errs[0] != nil {
+		t.Fatal(errs[0])
 	}
-	if len(entries) != 2 {
-		t.Fatalf("got %d entries, want 2", len(entries))
+	if saved[0] {
+		t.Error("unchanged content should not create a snapshot")
+	}
+	if fp, _ := d.GetFileFingerprint("/tmp/fp.go"); fp != touched {
+		t.Errorf("fp after touch = %+v, want %+v", fp, touched)
 	}
 }
 
-func TestGetRecentSnapshots_DirPrefixesWithRenames(t *testing.T) {
+func TestSearchFiles_MatchMode(t *testing.T) {
 	d := newTestDB(t)
 
-	// Create files and a rename
-	if _, err := d.SaveSnapshot("/projects/old.go", []byte("a"), 0); err != nil {
-		t.Fatal(err)
+	for _, path := range []string{"/src/Main.go", "/src/ÜBER.txt", "/src/my_file.go", "/src/myXfile.go"} {
+		if _, err := d.SaveSnapshot(path, []byte(path), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if _, err := d.SaveSnapshot("/documents/doc.txt", []byte("b"), 0); err != nil {
-		t.Fatal(err)
+
+	tests := []struct {
+		query string
+		mode  MatchMode
+		want  int
+	}{
+		{"main", MatchCaseInsensitive, 1},
+		{"über", MatchCaseInsensitive, 1},
+		{"main", MatchExact, 0},
+		{"Main", MatchExact, 1},
+		{"my_file", MatchCaseInsensitive, 1}, // _ is not a wildcard
 	}
-	if _, err := d.SaveRename("/projects/old.go", "/projects/new.go"); err != nil {
-		t.Fatal(err)
+	for _, tt := range tests {
+		files, err := d.SearchFiles(tt.query, 10, 0, nil, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != tt.want {
+			t.Errorf("SearchFiles(%q, mode %d) = %d files, want %d", tt.query, tt.mode, len(files), tt.want)
+		}
+		entries, err := d.GetRecentSnapshots(10, 0, tt.query, nil, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tt.want {
+			t.Errorf("GetRecentSnapshots(%q, mode %d) = %d entries, want %d", tt.query, tt.mode, len(entries), tt.want)
+		}
 	}
+}
 
-	// Filter by /projects should include both the save and the rename
-	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+func TestListDirectories(t *testing.T) {
+	d := newTestDB(t)
+
+	for _, path := range []string{"/projects/b/x.go", "/projects/a.go", "/projects/b.go", "/documents/c.txt"} {
+		if _, err := d.SaveSnapshot(path, []byte(path), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, err := d.ListDirectories(nil)
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(entries) != 2 {
-		t.Fatalf("got %d entries, want 2 (1 save + 1 rename)", len(entries))
+	if want := []string{"/documents", "/projects", "/projects/b"}; !slices.Equal(dirs, want) {
+		t.Errorf("dirs = %v, want %v", dirs, want)
 	}
 
-	// Filter by /documents should only include the doc save
-	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/documents"})
+	dirs, err = d.ListDirectories([]string{"/projects"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
-	}
-	if len(entries) != 1 {
-		t.Fatalf("got %d entries, want 1", len(entries))
+		t.Fatal(err)
 	}
-	if entries[0].FilePath != "/documents/doc.txt" {
-		t.Errorf("FilePath = %s, want /documents/doc.txt", entries[0].FilePath)
+	if want := []string{"/projects", "/projects/b"}; !slices.Equal(dirs, want) {
+		t.Errorf("filtered dirs = %v, want %v", dirs, want)
 	}
 }
 
-func TestGetRecentSnapshots_DirPrefixesWithCrossDirectoryRename(t *testing.T) {
+func TestGetStats_WithDirPrefixes(t *testing.T) {
 	d := newTestDB(t)
 
-	// Create a file in /projects and rename it to /archive (cross-directory)
-	if _, err := d.SaveSnapshot("/projects/old.go", []byte("a"), 0); err != nil {
+	// Create files in two directories
+	if _, err := d.SaveSnapshot("/projects/a.go", []byte("aa"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveRename("/projects/old.go", "/archive/old.go"); err != nil {
+	if _, err := d.SaveSnapshot("/projects/b.go", []byte("bbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/documents/c.txt", []byte("cccc"), 0); err != nil {
 		t.Fatal(err)
 	}
 
-	// Filter by /projects: should include save + rename (old_path is in /projects)
-	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+	// Filter by /projects prefix
+	stats, err := d.GetStats([]string{"/projects"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(entries) != 2 {
-		t.Fatalf("got %d entries, want 2 (1 save + 1 rename with old_path in /projects)", len(entries))
+	if stats.TotalFiles != 2 {
+		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+	}
+	if stats.TotalSnapshots != 2 {
+		t.Errorf("TotalSnapshots = %d, want 2", stats.TotalSnapshots)
+	}
+	if stats.TotalSize != 5 {
+		t.Errorf("TotalSize = %d, want 5", stats.TotalSize)
 	}
 
-	// Filter by /archive: should include rename (new_path is in /archive)
-	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/archive"})
+	// Filter by /documents prefix
+	stats, err = d.GetStats([]string{"/documents"})
 	if err != nil {
-		t.Fatalf("GetRecentSnapshots() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(entries) != 1 {
-		t.Fatalf("got %d entries, want 1 (rename with new_path in /archive)", len(entries))
+	if stats.TotalFiles != 1 {
+		t.Errorf("TotalFiles = %d, want 1", stats.TotalFiles)
 	}
-	if entries[0].EntryType != "rename" {
-		t.Errorf("EntryType = %s, want rename", entries[0].EntryType)
+	if stats.TotalSnapshots != 1 {
+		t.Errorf("TotalSnapshots = %d, want 1", stats.TotalSnapshots)
+	}
+	if stats.TotalSize != 4 {
+		t.Errorf("TotalSize = %d, want 4", stats.TotalSize)
+	}
+
+	// No filter returns all
+	stats, err = d.GetStats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalFiles != 3 {
+		t.Errorf("TotalFiles = %d, want 3", stats.TotalFiles)
 	}
 }
 
-func TestUUIDv7_Generation(t *testing.T) {
+func TestSearchFiles_Pagination(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/tmp/uuid.go", []byte("content"), 0); err != nil {
-		t.Fatal(err)
+	for i := range 5 {
+		path := fmt.Sprintf("/tmp/search%d.go", i)
+		if _, err := d.SaveSnapshot(path, []byte("content"), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	files, err := d.SearchFiles("uuid.go", 10, 0, nil)
+	files, err := d.SearchFiles("search", 2, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Fatalf("got %d files, want 1", len(files))
+	if len(files) != 2 {
+		t.Errorf("page 1: got %d files, want 2", len(files))
 	}
 
-	// Verify file ID is a valid UUID
-	fileID := files[0].ID
-	parsed, err := uuid.Parse(fileID)
+	files, err = d.SearchFiles("search", 2, 2, nil)
 	if err != nil {
-		t.Fatalf("file ID %q is not a valid UUID: %v", fileID, err)
+		t.Fatal(err)
 	}
-	if parsed.Version() != 7 {
-		t.Errorf("file ID UUID version = %d, want 7", parsed.Version())
+	if len(files) != 2 {
+		t.Errorf("page 2: got %d files, want 2", len(files))
 	}
 
-	// Verify snapshot ID is a valid UUIDv7
-	snapshots, err := d.GetSnapshots(fileID)
+	files, err = d.SearchFiles("search", 2, 4, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(snapshots) != 1 {
-		t.Fatalf("got %d snapshots, want 1", len(snapshots))
+	if len(files) != 1 {
+		t.Errorf("page 3: got %d files, want 1", len(files))
 	}
+}
 
-	snapID := snapshots[0].ID
-	parsedSnap, err := uuid.Parse(snapID)
+func TestNonUTF8Path(t *testing.T) {
+	d := newTestDB(t)
+
+	path := "/tmp/caf\xe9.txt" // Latin-1 name, not valid UTF-8
+	if _, err := d.SaveSnapshot(path, []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.GetFileByPath(path)
 	if err != nil {
-		t.Fatalf("snapshot ID %q is not a valid UUID: %v", snapID, err)
+		t.Fatalf("GetFileByPath() error: %v", err)
 	}
-	if parsedSnap.Version() != 7 {
-		t.Errorf("snapshot ID UUID version = %d, want 7", parsedSnap.Version())
+	if f.Path != path {
+		t.Errorf("Path = %q, want %q", f.Path, path)
 	}
 
-	// Verify GetSnapshot also returns valid UUIDv7
-	snap, err := d.GetSnapshot(snapID)
+	data, err := json.Marshal(f)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if snap.ID != snapID {
-		t.Errorf("GetSnapshot ID = %s, want %s", snap.ID, snapID)
+	var got struct {
+		Path    string `json:"path"`
+		PathRaw string `json:"pathRaw"`
 	}
-	if snap.FileID != fileID {
-		t.Errorf("GetSnapshot FileID = %s, want %s", snap.FileID, fileID)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// createOldSchemaDB creates a database with the old INTEGER PRIMARY KEY schema
-// and inserts test data for migration testing.
-func createOldSchemaDB(t *testing.T, dbPath string) {
-	t.Helper()
-	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
-	if err != nil {
-		t.Fatalf("opening old schema DB: %v", err)
+	if got.Path != "/tmp/caf\uFFFD.txt" {
+		t.Errorf("path = %q, want the display-safe form", got.Path)
 	}
-	defer sqlDB.Close()
-
-	oldSchema := `
-	CREATE TABLE files (
-		id       INTEGER PRIMARY KEY AUTOINCREMENT,
-		path     TEXT NOT NULL UNIQUE,
-		created  INTEGER NOT NULL DEFAULT (unixepoch()),
-		updated  INTEGER NOT NULL DEFAULT (unixepoch())
-	);
-	CREATE TABLE snapshots (
-		id        INTEGER PRIMARY KEY AUTOINCREMENT,
-		file_id   INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
-		content   BLOB NOT NULL,
-		size      INTEGER NOT NULL,
-		hash      TEXT NOT NULL,
-		timestamp INTEGER NOT NULL DEFAULT (unixepoch())
-	);
-	CREATE INDEX idx_snapshots_file_ts ON snapshots(file_id, timestamp DESC);
-	CREATE INDEX idx_snapshots_timestamp ON snapshots(timestamp DESC, id DESC);
-	CREATE INDEX idx_files_path ON files(path);
-	`
-	if _, err := sqlDB.Exec(oldSchema); err != nil {
-		t.Fatalf("creating old schema: %v", err)
+	raw, err := base64.StdEncoding.DecodeString(got.PathRaw)
+	if err != nil || string(raw) != path {
+		t.Errorf("pathRaw = %q decodes to %q, %v; want %q", got.PathRaw, raw, err, path)
 	}
 
-	// Insert test files
-	if _, err := sqlDB.Exec(
-		"INSERT INTO files (id, path, created, updated) VALUES (1, '/tmp/old1.go', 1000, 2000)",
-	); err != nil {
-		t.Fatalf("inserting file 1: %v", err)
+	data, err = json.Marshal(File{Path: "/tmp/ok.txt"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := sqlDB.Exec(
-		"INSERT INTO files (id, path, created, updated) VALUES (2, '/tmp/old2.go', 1100, 2100)",
-	); err != nil {
-		t.Fatalf("inserting file 2: %v", err)
+	if strings.Contains(string(data), "pathRaw") {
+		t.Errorf("valid UTF-8 path marshaled with pathRaw: %s", data)
+	}
+}
+
+func TestSearchFiles_Order(t *testing.T) {
+	d := newTestDB(t)
+
+	for _, u := range []struct {
+		path             string
+		created, updated int64
+	}{
+		{"/b/zeta.go", 100, 300},
+		{"/c/alpha.go", 200, 100},
+		{"/a/mid.go", 300, 200},
+	} {
+		if _, err := d.SaveSnapshot(u.path, []byte(u.path), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.db.Exec(`UPDATE files SET created = ?, updated = ? WHERE path = ?`, u.created, u.updated, u.path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		order FileOrder
+		want  []string
+	}{
+		{FileOrder{}, []string{"/b/zeta.go", "/a/mid.go", "/c/alpha.go"}},
+		{FileOrder{Key: SortByUpdated, Ascending: true}, []string{"/c/alpha.go", "/a/mid.go", "/b/zeta.go"}},
+		{FileOrder{Key: SortByCreated}, []string{"/a/mid.go", "/c/alpha.go", "/b/zeta.go"}},
+		{FileOrder{Key: SortByPath, Ascending: true}, []string{"/a/mid.go", "/b/zeta.go", "/c/alpha.go"}},
+		{FileOrder{Key: SortByName, Ascending: true}, []string{"/c/alpha.go", "/a/mid.go", "/b/zeta.go"}},
+		{FileOrder{Key: SortByName}, []string{"/b/zeta.go", "/a/mid.go", "/c/alpha.go"}},
+	}
+	for _, tt := range tests {
+		files, err := d.SearchFilesContext(context.Background(), "", 10, 0, nil, tt.order)
+		if err != nil {
+			t.Fatalf("SearchFilesContext(%+v) error: %v", tt.order, err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Path)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SearchFilesContext(%+v) = %v, want %v", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFiles_WithDirPrefixes(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/projects/main.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/projects/util.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/documents/notes.go", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Search with dir prefix filter
+	files, err := d.SearchFiles(".go", 10, 0, []string{"/projects"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got %d files, want 2", len(files))
+	}
+	for _, f := range files {
+		if f.Path != "/projects/main.go" && f.Path != "/projects/util.go" {
+			t.Errorf("unexpected file: %s", f.Path)
+		}
+	}
+
+	// Search with no dir prefix returns all
+	files, err = d.SearchFiles(".go", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got %d files, want 3", len(files))
+	}
+
+	// Search with multiple dir prefixes
+	files, err = d.SearchFiles(".go", 10, 0, []string{"/projects", "/documents"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got %d files, want 3", len(files))
+	}
+}
+
+func TestGetRecentSnapshots_Empty(t *testing.T) {
+	d := newTestDB(t)
+
+	entries, err := d.GetRecentSnapshots(50, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries, want 0", len(entries))
+	}
+}
+
+func TestGetRecentSnapshots_WithData(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aaa"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("bbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("aaa-v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := d.GetRecentSnapshots(50, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+
+	// Most recent first: a.go v2, b.go, a.go v1
+	if entries[0].FilePath != "/tmp/a.go" {
+		t.Errorf("entries[0].FilePath = %s, want /tmp/a.go", entries[0].FilePath)
+	}
+	if entries[1].FilePath != "/tmp/b.go" {
+		t.Errorf("entries[1].FilePath = %s, want /tmp/b.go", entries[1].FilePath)
+	}
+	if entries[2].FilePath != "/tmp/a.go" {
+		t.Errorf("entries[2].FilePath = %s, want /tmp/a.go", entries[2].FilePath)
+	}
+
+	// Verify all fields are populated
+	for i, e := range entries {
+		if e.SnapshotID == "" {
+			t.Errorf("entries[%d].SnapshotID is empty", i)
+		}
+		if e.FileID == "" {
+			t.Errorf("entries[%d].FileID is empty", i)
+		}
+		if e.Size == 0 {
+			t.Errorf("entries[%d].Size is 0", i)
+		}
+		if e.Hash == "" {
+			t.Errorf("entries[%d].Hash is empty", i)
+		}
+		if e.Timestamp == 0 {
+			t.Errorf("entries[%d].Timestamp is 0", i)
+		}
+	}
+}
+
+func TestGetRecentSnapshots_Limit(t *testing.T) {
+	d := newTestDB(t)
+
+	for i := range 5 {
+		content := []byte(fmt.Sprintf("content-%d", i))
+		path := fmt.Sprintf("/tmp/limit%d.go", i)
+		if _, err := d.SaveSnapshot(path, content, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := d.GetRecentSnapshots(3, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d entries, want 3", len(entries))
+	}
+}
+
+func TestGetRecentSnapshots_Offset(t *testing.T) {
+	d := newTestDB(t)
+
+	for i := range 5 {
+		content := []byte(fmt.Sprintf("content-%d", i))
+		path := fmt.Sprintf("/tmp/offset%d.go", i)
+		if _, err := d.SaveSnapshot(path, content, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page1, err := d.GetRecentSnapshots(2, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots(2, 0) error: %v", err)
+	}
+	if len(page1) != 2 {
+		t.Errorf("page1: got %d entries, want 2", len(page1))
+	}
+
+	page2, err := d.GetRecentSnapshots(2, 2, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots(2, 2) error: %v", err)
+	}
+	if len(page2) != 2 {
+		t.Errorf("page2: got %d entries, want 2", len(page2))
+	}
+
+	// Ensure pages don't overlap
+	if page1[0].SnapshotID == page2[0].SnapshotID {
+		t.Error("page1 and page2 overlap")
+	}
+
+	page3, err := d.GetRecentSnapshots(2, 4, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots(2, 4) error: %v", err)
+	}
+	if len(page3) != 1 {
+		t.Errorf("page3: got %d entries, want 1", len(page3))
+	}
+}
+
+func TestGetRecentSnapshots_WithDirPrefixes(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create files in different directories
+	if _, err := d.SaveSnapshot("/projects/src/main.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/projects/src/util.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/documents/notes.txt", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filter by /projects
+	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if e.FilePath != "/projects/src/main.go" && e.FilePath != "/projects/src/util.go" {
+			t.Errorf("unexpected entry: %s", e.FilePath)
+		}
+	}
+
+	// Filter by /documents
+	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/documents"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].FilePath != "/documents/notes.txt" {
+		t.Errorf("FilePath = %s, want /documents/notes.txt", entries[0].FilePath)
+	}
+
+	// No filter returns all
+	entries, err = d.GetRecentSnapshots(50, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+}
+
+func TestGetRecentSnapshots_DirPrefixesWithQuery(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/projects/main.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/projects/util.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/documents/main.txt", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Query "main" with dir prefix /projects -> only /projects/main.go
+	entries, err := d.GetRecentSnapshots(50, 0, "main", []string{"/projects"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].FilePath != "/projects/main.go" {
+		t.Errorf("FilePath = %s, want /projects/main.go", entries[0].FilePath)
+	}
+
+	// Query "main" without dir prefix -> both main files
+	entries, err = d.GetRecentSnapshots(50, 0, "main", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+}
+
+func TestGetRecentSnapshots_DirPrefixesWithRenames(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create files and a rename
+	if _, err := d.SaveSnapshot("/projects/old.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/documents/doc.txt", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveRename("/projects/old.go", "/projects/new.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filter by /projects should include both the save and the rename
+	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2 (1 save + 1 rename)", len(entries))
+	}
+
+	// Filter by /documents should only include the doc save
+	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/documents"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].FilePath != "/documents/doc.txt" {
+		t.Errorf("FilePath = %s, want /documents/doc.txt", entries[0].FilePath)
+	}
+}
+
+func TestGetRecentSnapshots_DirPrefixesWithCrossDirectoryRename(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create a file in /projects and rename it to /archive (cross-directory)
+	if _, err := d.SaveSnapshot("/projects/old.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveRename("/projects/old.go", "/archive/old.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Filter by /projects: should include save + rename (old_path is in /projects)
+	entries, err := d.GetRecentSnapshots(50, 0, "", []string{"/projects"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2 (1 save + 1 rename with old_path in /projects)", len(entries))
+	}
+
+	// Filter by /archive: should include rename (new_path is in /archive)
+	entries, err = d.GetRecentSnapshots(50, 0, "", []string{"/archive"})
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1 (rename with new_path in /archive)", len(entries))
+	}
+	if entries[0].EntryType != "rename" {
+		t.Errorf("EntryType = %s, want rename", entries[0].EntryType)
+	}
+}
+
+func TestUUIDv7_Generation(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/uuid.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := d.SearchFiles("uuid.go", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+
+	// Verify file ID is a valid UUID
+	fileID := files[0].ID
+	parsed, err := uuid.Parse(fileID)
+	if err != nil {
+		t.Fatalf("file ID %q is not a valid UUID: %v", fileID, err)
+	}
+	if parsed.Version() != 7 {
+		t.Errorf("file ID UUID version = %d, want 7", parsed.Version())
+	}
+
+	// Verify snapshot ID is a valid UUIDv7
+	snapshots, err := d.GetSnapshots(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("got %d snapshots, want 1", len(snapshots))
+	}
+
+	snapID := snapshots[0].ID
+	parsedSnap, err := uuid.Parse(snapID)
+	if err != nil {
+		t.Fatalf("snapshot ID %q is not a valid UUID: %v", snapID, err)
+	}
+	if parsedSnap.Version() != 7 {
+		t.Errorf("snapshot ID UUID version = %d, want 7", parsedSnap.Version())
+	}
+
+	// Verify GetSnapshot also returns valid UUIDv7
+	snap, err := d.GetSnapshot(snapID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ID != snapID {
+		t.Errorf("GetSnapshot ID = %s, want %s", snap.ID, snapID)
+	}
+	if snap.FileID != fileID {
+		t.Errorf("GetSnapshot FileID = %s, want %s", snap.FileID, fileID)
+	}
+}
+
+// createOldSchemaDB creates a database with the old INTEGER PRIMARY KEY schema
+// and inserts test data for migration testing.
+func createOldSchemaDB(t *testing.T, dbPath string) {
+	t.Helper()
+	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("opening old schema DB: %v", err)
+	}
+	defer sqlDB.Close()
+
+	oldSchema := `
+	CREATE TABLE files (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		path     TEXT NOT NULL UNIQUE,
+		created  INTEGER NOT NULL DEFAULT (unixepoch()),
+		updated  INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+	CREATE TABLE snapshots (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id   INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		content   BLOB NOT NULL,
+		size      INTEGER NOT NULL,
+		hash      TEXT NOT NULL,
+		timestamp INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+	CREATE INDEX idx_snapshots_file_ts ON snapshots(file_id, timestamp DESC);
+	CREATE INDEX idx_snapshots_timestamp ON snapshots(timestamp DESC, id DESC);
+	CREATE INDEX idx_files_path ON files(path);
+	`
+	if _, err := sqlDB.Exec(oldSchema); err != nil {
+		t.Fatalf("creating old schema: %v", err)
+	}
+
+	// Insert test files
+	if _, err := sqlDB.Exec(
+		"INSERT INTO files (id, path, created, updated) VALUES (1, '/tmp/old1.go', 1000, 2000)",
+	); err != nil {
+		t.Fatalf("inserting file 1: %v", err)
+	}
+	if _, err := sqlDB.Exec(
+		"INSERT INTO files (id, path, created, updated) VALUES (2, '/tmp/old2.go', 1100, 2100)",
+	); err != nil {
+		t.Fatalf("inserting file 2: %v", err)
 	}
 
 	// Insert test snapshots (content is raw bytes for simplicity since
@@ -837,359 +2109,1074 @@ func createOldSchemaDB(t *testing.T, dbPath string) {
 	); err != nil {
 		t.Fatalf("inserting snapshot 1: %v", err)
 	}
-	if _, err := sqlDB.Exec(
-		"INSERT INTO snapshots (id, file_id, content, size, hash, timestamp) VALUES (2, 1, X'776F726C64', 5, 'hash2', 2000)",
-	); err != nil {
-		t.Fatalf("inserting snapshot 2: %v", err)
+	if _, err := sqlDB.Exec(
+		"INSERT INTO snapshots (id, file_id, content, size, hash, timestamp) VALUES (2, 1, X'776F726C64', 5, 'hash2', 2000)",
+	); err != nil {
+		t.Fatalf("inserting snapshot 2: %v", err)
+	}
+	if _, err := sqlDB.Exec(
+		"INSERT INTO snapshots (id, file_id, content, size, hash, timestamp) VALUES (3, 2, X'746573743131', 6, 'hash3', 1100)",
+	); err != nil {
+		t.Fatalf("inserting snapshot 3: %v", err)
+	}
+}
+
+func TestMigrateIfNeeded_OldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "migrate.db")
+
+	// Create DB with old INTEGER schema and seed data
+	createOldSchemaDB(t, dbPath)
+
+	// Open with New(), which should trigger migration
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() after migration error: %v", err)
+	}
+	defer d.Close()
+
+	// Verify files were migrated with UUIDv7 IDs
+	files1, err := d.SearchFiles("old1.go", 10, 0, nil)
+	if err != nil {
+		t.Fatalf("SearchFiles(old1): %v", err)
+	}
+	if len(files1) != 1 {
+		t.Fatalf("got %d files for old1.go, want 1", len(files1))
+	}
+	parsed1, err := uuid.Parse(files1[0].ID)
+	if err != nil {
+		t.Fatalf("file1 ID %q is not valid UUID: %v", files1[0].ID, err)
+	}
+	if parsed1.Version() != 7 {
+		t.Errorf("file1 UUID version = %d, want 7", parsed1.Version())
+	}
+	if files1[0].Path != "/tmp/old1.go" {
+		t.Errorf("file1 Path = %s, want /tmp/old1.go", files1[0].Path)
+	}
+	if files1[0].Created != 1000 {
+		t.Errorf("file1 Created = %d, want 1000", files1[0].Created)
+	}
+	if files1[0].Updated != 2000 {
+		t.Errorf("file1 Updated = %d, want 2000", files1[0].Updated)
+	}
+
+	files2, err := d.SearchFiles("old2.go", 10, 0, nil)
+	if err != nil {
+		t.Fatalf("SearchFiles(old2): %v", err)
+	}
+	if len(files2) != 1 {
+		t.Fatalf("got %d files for old2.go, want 1", len(files2))
+	}
+	parsed2, err := uuid.Parse(files2[0].ID)
+	if err != nil {
+		t.Fatalf("file2 ID %q is not valid UUID: %v", files2[0].ID, err)
+	}
+	if parsed2.Version() != 7 {
+		t.Errorf("file2 UUID version = %d, want 7", parsed2.Version())
+	}
+
+	// Verify snapshots were migrated with correct file_id references
+	snapshots1, err := d.GetSnapshots(files1[0].ID)
+	if err != nil {
+		t.Fatalf("GetSnapshots(file1): %v", err)
+	}
+	if len(snapshots1) != 2 {
+		t.Fatalf("got %d snapshots for file1, want 2", len(snapshots1))
+	}
+	for _, s := range snapshots1 {
+		parsedSnap, err := uuid.Parse(s.ID)
+		if err != nil {
+			t.Fatalf("snapshot ID %q is not valid UUID: %v", s.ID, err)
+		}
+		if parsedSnap.Version() != 7 {
+			t.Errorf("snapshot UUID version = %d, want 7", parsedSnap.Version())
+		}
+		if s.FileID != files1[0].ID {
+			t.Errorf("snapshot FileID = %s, want %s", s.FileID, files1[0].ID)
+		}
+	}
+
+	snapshots2, err := d.GetSnapshots(files2[0].ID)
+	if err != nil {
+		t.Fatalf("GetSnapshots(file2): %v", err)
+	}
+	if len(snapshots2) != 1 {
+		t.Fatalf("got %d snapshots for file2, want 1", len(snapshots2))
+	}
+	if snapshots2[0].FileID != files2[0].ID {
+		t.Errorf("snapshot FileID = %s, want %s", snapshots2[0].FileID, files2[0].ID)
+	}
+
+	// Verify stats are correct
+	stats, err := d.GetStats(nil)
+	if err != nil {
+		t.Fatalf("GetStats(): %v", err)
+	}
+	if stats.TotalFiles != 2 {
+		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+	}
+	if stats.TotalSnapshots != 3 {
+		t.Errorf("TotalSnapshots = %d, want 3", stats.TotalSnapshots)
+	}
+}
+
+func TestMigrateIfNeeded_LineCountUnknownForOldRows(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "migrate.db")
+	createOldSchemaDB(t, dbPath)
+
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer d.Close()
+
+	files, _ := d.SearchFiles("old1.go", 1, 0, nil)
+	snaps, err := d.GetSnapshots(files[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snaps {
+		if s.LineCount != -1 {
+			t.Errorf("migrated snapshot LineCount = %d, want -1 (unknown)", s.LineCount)
+		}
+	}
+}
+
+func TestRecoverPartialMigration_RollsBackLeftoverTables(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "partial.db")
+	createOldSchemaDB(t, dbPath)
+
+	// Simulate a crash after the _new tables were created and partly filled
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`
+		CREATE TABLE files_new (id TEXT PRIMARY KEY, path TEXT NOT NULL UNIQUE, created INTEGER NOT NULL, updated INTEGER NOT NULL);
+		CREATE TABLE snapshots_new (id TEXT PRIMARY KEY, file_id TEXT NOT NULL, content BLOB NOT NULL, size INTEGER NOT NULL, hash TEXT NOT NULL, timestamp INTEGER NOT NULL);
+		INSERT INTO files_new VALUES ('half-done', '/tmp/old1.go', 1000, 2000);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() with leftover migration tables: %v", err)
+	}
+	defer d.Close()
+
+	for _, table := range []string{"files_new", "snapshots_new"} {
+		exists, err := tableExists(d.db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("table %s should have been removed", table)
+		}
+	}
+
+	files, err := d.SearchFiles("", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	for _, f := range files {
+		if f.ID == "half-done" {
+			t.Error("partially migrated row should not survive rollback")
+		}
+		if _, err := uuid.Parse(f.ID); err != nil {
+			t.Errorf("file ID %q is not a UUID", f.ID)
+		}
+	}
+	stats, err := d.GetStats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalSnapshots != 3 {
+		t.Errorf("TotalSnapshots = %d, want 3", stats.TotalSnapshots)
+	}
+}
+
+func TestRecoverPartialMigration_CompletesAfterOldTablesDropped(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "partial.db")
+
+	// Simulate a crash after the old tables were dropped but before the
+	// _new tables were renamed into place
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`
+		CREATE TABLE files_new (id TEXT PRIMARY KEY, path TEXT NOT NULL UNIQUE,
+			created INTEGER NOT NULL DEFAULT (unixepoch()), updated INTEGER NOT NULL DEFAULT (unixepoch()));
+		CREATE TABLE snapshots_new (id TEXT PRIMARY KEY, file_id TEXT NOT NULL REFERENCES files_new(id) ON DELETE CASCADE,
+			content BLOB NOT NULL, size INTEGER NOT NULL, hash TEXT NOT NULL, timestamp INTEGER NOT NULL DEFAULT (unixepoch()));
+		INSERT INTO files_new VALUES ('01950000-0000-7000-8000-000000000001', '/tmp/kept.go', 1000, 2000);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("New() with leftover migration tables: %v", err)
+	}
+	defer d.Close()
+
+	exists, err := tableExists(d.db, "files_new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("files_new should have been renamed to files")
+	}
+
+	files, err := d.SearchFiles("kept.go", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1 (rolled forward)", len(files))
+	}
+
+	// The recovered schema is fully usable
+	if _, err := d.SaveSnapshot("/tmp/kept.go", []byte("new content"), 0); err != nil {
+		t.Fatalf("SaveSnapshot() after recovery: %v", err)
+	}
+	snaps, err := d.GetSnapshots(files[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 {
+		t.Errorf("got %d snapshots, want 1", len(snaps))
+	}
+}
+
+func TestRecoverPartialMigration_KeepsMigratedFiles(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "partial.db")
+
+	d, err := New(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/live.go", []byte("live"), 0); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// Stale _new tables next to an already migrated, populated schema
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec(`
+		CREATE TABLE files_new (id TEXT PRIMARY KEY, path TEXT NOT NULL UNIQUE, created INTEGER NOT NULL, updated INTEGER NOT NULL);
+		CREATE TABLE snapshots_new (id TEXT PRIMARY KEY, file_id TEXT NOT NULL, content BLOB NOT NULL, size INTEGER NOT NULL, hash TEXT NOT NULL, timestamp INTEGER NOT NULL);
+		INSERT INTO files_new VALUES ('stale', '/tmp/stale.go', 1000, 2000);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	d, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("New() with leftover migration tables: %v", err)
+	}
+	defer d.Close()
+
+	for _, table := range []string{"files_new", "snapshots_new"} {
+		exists, err := tableExists(d.db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("table %s should have been removed", table)
+		}
+	}
+	files, err := d.SearchFiles("", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "/tmp/live.go" {
+		t.Fatalf("files = %+v, want only /tmp/live.go", files)
+	}
+	if snaps, _ := d.GetSnapshots(files[0].ID); len(snaps) != 1 {
+		t.Errorf("got %d snapshots, want 1", len(snaps))
+	}
+}
+
+func TestSaveRename_Basic(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create a file with a snapshot
+	if _, err := d.SaveSnapshot("/tmp/old.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save a rename
+	newFileID, err := d.SaveRename("/tmp/old.go", "/tmp/new.go")
+	if err != nil {
+		t.Fatalf("SaveRename() error: %v", err)
+	}
+	if newFileID == "" {
+		t.Fatal("SaveRename() returned empty newFileID")
+	}
+
+	// Verify new file was created
+	newFile, err := d.GetFile(newFileID)
+	if err != nil {
+		t.Fatalf("GetFile(newFileID) error: %v", err)
+	}
+	if newFile.Path != "/tmp/new.go" {
+		t.Errorf("new file path = %s, want /tmp/new.go", newFile.Path)
+	}
+
+	// Verify rename record
+	oldFiles, err := d.SearchFiles("old.go", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renames, err := d.GetRenames(oldFiles[0].ID)
+	if err != nil {
+		t.Fatalf("GetRenames() error: %v", err)
+	}
+	if len(renames) != 1 {
+		t.Fatalf("got %d renames, want 1", len(renames))
+	}
+	if renames[0].OldPath != "/tmp/old.go" {
+		t.Errorf("OldPath = %s, want /tmp/old.go", renames[0].OldPath)
+	}
+	if renames[0].NewPath != "/tmp/new.go" {
+		t.Errorf("NewPath = %s, want /tmp/new.go", renames[0].NewPath)
+	}
+}
+
+func TestSaveRename_CarryOver(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		d := newTestDB(t)
+		d.SetCarryOverOnRename(enabled)
+
+		for _, c := range []string{"v1", "v2"} {
+			if _, err := d.SaveSnapshot("/tmp/old.go", []byte(c), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		newFileID, err := d.SaveRename("/tmp/old.go", "/tmp/new.go")
+		if err != nil {
+			t.Fatalf("SaveRename() error: %v", err)
+		}
+
+		snap, err := d.GetLatestSnapshot(newFileID)
+		if !enabled {
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("disabled: GetLatestSnapshot() error = %v, want sql.ErrNoRows", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetLatestSnapshot() error: %v", err)
+		}
+		if string(snap.Content) != "v2" {
+			t.Errorf("carried over content = %q, want %q", snap.Content, "v2")
+		}
+		entries, err := d.GetFileTimeline(newFileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].EntryType != "save" || entries[0].Origin != "rename" {
+			t.Errorf("newest timeline entry = %+v, want a save with origin rename", entries[0])
+		}
+
+		// The snapshot of the unchanged new path is a duplicate.
+		saved, err := d.SaveSnapshot("/tmp/new.go", []byte("v2"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved {
+			t.Error("unchanged content after rename was saved again")
+		}
+
+		// A second rename onto a path with snapshots copies nothing.
+		if _, err := d.SaveSnapshot("/tmp/other.go", []byte("other"), 0); err != nil {
+			t.Fatal(err)
+		}
+		otherID, err := d.SaveRename("/tmp/new.go", "/tmp/other.go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps, err := d.GetSnapshots(otherID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snaps) != 1 {
+			t.Errorf("got %d snapshots on an existing target, want 1", len(snaps))
+		}
+	}
+}
+
+func TestSaveRename_CarryOverKeepsDedupHash(t *testing.T) {
+	d := newTestDB(t)
+	d.SetCarryOverOnRename(true)
+
+	save := func(path, content string) bool {
+		t.Helper()
+		saved, errs := d.SaveSnapshotRequests([]SnapshotRequest{
+			{FilePath: path, Content: []byte(content), NormalizeLineEndings: true},
+		})
+		if errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		return saved[0]
+	}
+
+	save("/tmp/crlf.txt", "a\r\nb\r\n")
+	if _, err := d.SaveRename("/tmp/crlf.txt", "/tmp/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// The carried-over snapshot is compared by its normalized hash
+	if save("/tmp/renamed.txt", "a\nb\n") {
+		t.Error("line-ending-only change after rename should be skipped when normalizing")
+	}
+}
+
+func TestSaveRename_ChainedRenames(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create initial file
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A -> B
+	bFileID, err := d.SaveRename("/tmp/a.go", "/tmp/b.go")
+	if err != nil {
+		t.Fatalf("SaveRename(a->b) error: %v", err)
+	}
+
+	// Save snapshot for B so it exists
+	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// B -> C
+	_, err = d.SaveRename("/tmp/b.go", "/tmp/c.go")
+	if err != nil {
+		t.Fatalf("SaveRename(b->c) error: %v", err)
+	}
+
+	// Check renames from B's perspective (should see both A->B and B->C)
+	renames, err := d.GetRenames(bFileID)
+	if err != nil {
+		t.Fatalf("GetRenames(b) error: %v", err)
+	}
+	if len(renames) != 2 {
+		t.Fatalf("got %d renames for B, want 2", len(renames))
+	}
+	// Ordered by timestamp ASC
+	if renames[0].OldPath != "/tmp/a.go" || renames[0].NewPath != "/tmp/b.go" {
+		t.Errorf("renames[0] = %s->%s, want a.go->b.go", renames[0].OldPath, renames[0].NewPath)
+	}
+	if renames[1].OldPath != "/tmp/b.go" || renames[1].NewPath != "/tmp/c.go" {
+		t.Errorf("renames[1] = %s->%s, want b.go->c.go", renames[1].OldPath, renames[1].NewPath)
+	}
+}
+
+func TestGetLineage(t *testing.T) {
+	d := newTestDB(t)
+
+	for _, p := range []string{"/tmp/a.go", "/tmp/other.go"} {
+		if _, err := d.SaveSnapshot(p, []byte("package main"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A -> B -> C, plus an unrelated file
+	bFileID, err := d.SaveRename("/tmp/a.go", "/tmp/b.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cFileID, err := d.SaveRename("/tmp/b.go", "/tmp/c.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := d.GetFileByPath("/tmp/a.go")
+	if err != nil {
+		t.Fatalf("GetFileByPath() error: %v", err)
+	}
+	for _, id := range []string{a.ID, bFileID, cFileID} {
+		lineage, err := d.GetLineage(id)
+		if err != nil {
+			t.Fatalf("GetLineage() error: %v", err)
+		}
+		if len(lineage) != 2 || lineage[0].NewPath != "/tmp/b.go" || lineage[1].NewPath != "/tmp/c.go" {
+			t.Errorf("GetLineage(%s) = %+v, want a->b, b->c", id, lineage)
+		}
+	}
+
+	other, _ := d.GetFileByPath("/tmp/other.go")
+	if lineage, err := d.GetLineage(other.ID); err != nil || len(lineage) != 0 {
+		t.Errorf("GetLineage(other) = %+v, %v; want empty", lineage, err)
 	}
-	if _, err := sqlDB.Exec(
-		"INSERT INTO snapshots (id, file_id, content, size, hash, timestamp) VALUES (3, 2, X'746573743131', 6, 'hash3', 1100)",
-	); err != nil {
-		t.Fatalf("inserting snapshot 3: %v", err)
+	if _, err := d.GetFileByPath("/tmp/missing.go"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetFileByPath(missing) error = %v, want sql.ErrNoRows", err)
 	}
 }
 
-func TestMigrateIfNeeded_OldSchema(t *testing.T) {
-	dbPath := filepath.Join(t.TempDir(), "migrate.db")
-
-	// Create DB with old INTEGER schema and seed data
-	createOldSchemaDB(t, dbPath)
+func TestSaveRename_OldFileNotFound(t *testing.T) {
+	d := newTestDB(t)
 
-	// Open with New(), which should trigger migration
-	d, err := New(dbPath)
+	newFileID, err := d.SaveRename("/tmp/nonexistent.go", "/tmp/new.go")
 	if err != nil {
-		t.Fatalf("New() after migration error: %v", err)
+		t.Fatalf("SaveRename() unexpected error: %v", err)
 	}
-	defer d.Close()
+	if newFileID != "" {
+		t.Errorf("SaveRename() returned %q, want empty string for untracked old file", newFileID)
+	}
+}
 
-	// Verify files were migrated with UUIDv7 IDs
-	files1, err := d.SearchFiles("old1.go", 10, 0, nil)
-	if err != nil {
-		t.Fatalf("SearchFiles(old1): %v", err)
+func TestGetRenames_Empty(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/norenames.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if len(files1) != 1 {
-		t.Fatalf("got %d files for old1.go, want 1", len(files1))
+	files, err := d.SearchFiles("norenames.go", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	parsed1, err := uuid.Parse(files1[0].ID)
+
+	renames, err := d.GetRenames(files[0].ID)
 	if err != nil {
-		t.Fatalf("file1 ID %q is not valid UUID: %v", files1[0].ID, err)
+		t.Fatalf("GetRenames() error: %v", err)
 	}
-	if parsed1.Version() != 7 {
-		t.Errorf("file1 UUID version = %d, want 7", parsed1.Version())
+	if len(renames) != 0 {
+		t.Errorf("got %d renames, want 0", len(renames))
 	}
-	if files1[0].Path != "/tmp/old1.go" {
-		t.Errorf("file1 Path = %s, want /tmp/old1.go", files1[0].Path)
+}
+
+func TestSaveRename_ExistingNewFile(t *testing.T) {
+	d := newTestDB(t)
+
+	// Create both files
+	if _, err := d.SaveSnapshot("/tmp/old2.go", []byte("old"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if files1[0].Created != 1000 {
-		t.Errorf("file1 Created = %d, want 1000", files1[0].Created)
+	if _, err := d.SaveSnapshot("/tmp/existing.go", []byte("existing"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if files1[0].Updated != 2000 {
-		t.Errorf("file1 Updated = %d, want 2000", files1[0].Updated)
+
+	// Rename to existing file path
+	newFileID, err := d.SaveRename("/tmp/old2.go", "/tmp/existing.go")
+	if err != nil {
+		t.Fatalf("SaveRename() error: %v", err)
 	}
 
-	files2, err := d.SearchFiles("old2.go", 10, 0, nil)
+	// Should reuse the existing file ID
+	existingFiles, err := d.SearchFiles("existing.go", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("SearchFiles(old2): %v", err)
+		t.Fatal(err)
 	}
-	if len(files2) != 1 {
-		t.Fatalf("got %d files for old2.go, want 1", len(files2))
+	if newFileID != existingFiles[0].ID {
+		t.Errorf("newFileID = %s, want %s (existing file ID)", newFileID, existingFiles[0].ID)
 	}
-	parsed2, err := uuid.Parse(files2[0].ID)
+}
+
+func TestMigrateIfNeeded_AlreadyNewSchema(t *testing.T) {
+	// New DB already has TEXT schema; migration should be a no-op
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/new.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := d.SearchFiles("new.go", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("file2 ID %q is not valid UUID: %v", files2[0].ID, err)
+		t.Fatal(err)
 	}
-	if parsed2.Version() != 7 {
-		t.Errorf("file2 UUID version = %d, want 7", parsed2.Version())
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
 	}
 
-	// Verify snapshots were migrated with correct file_id references
-	snapshots1, err := d.GetSnapshots(files1[0].ID)
+	// Verify ID is valid UUIDv7 (not affected by migration)
+	parsed, err := uuid.Parse(files[0].ID)
 	if err != nil {
-		t.Fatalf("GetSnapshots(file1): %v", err)
+		t.Fatalf("ID %q is not valid UUID: %v", files[0].ID, err)
 	}
-	if len(snapshots1) != 2 {
-		t.Fatalf("got %d snapshots for file1, want 2", len(snapshots1))
+	if parsed.Version() != 7 {
+		t.Errorf("UUID version = %d, want 7", parsed.Version())
 	}
-	for _, s := range snapshots1 {
-		parsedSnap, err := uuid.Parse(s.ID)
-		if err != nil {
-			t.Fatalf("snapshot ID %q is not valid UUID: %v", s.ID, err)
-		}
-		if parsedSnap.Version() != 7 {
-			t.Errorf("snapshot UUID version = %d, want 7", parsedSnap.Version())
-		}
-		if s.FileID != files1[0].ID {
-			t.Errorf("snapshot FileID = %s, want %s", s.FileID, files1[0].ID)
-		}
+}
+
+func TestMigrateIfNeeded_EmptyOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "empty_old.db")
+
+	// Create old schema DB with no data
+	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("opening DB: %v", err)
+	}
+	oldSchema := `
+	CREATE TABLE files (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		path     TEXT NOT NULL UNIQUE,
+		created  INTEGER NOT NULL DEFAULT (unixepoch()),
+		updated  INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+	CREATE TABLE snapshots (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id   INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		content   BLOB NOT NULL,
+		size      INTEGER NOT NULL,
+		hash      TEXT NOT NULL,
+		timestamp INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+	`
+	if _, err := sqlDB.Exec(oldSchema); err != nil {
+		t.Fatalf("creating old schema: %v", err)
 	}
+	sqlDB.Close()
 
-	snapshots2, err := d.GetSnapshots(files2[0].ID)
+	// Open with New() — migration should succeed with empty tables
+	d, err := New(dbPath)
 	if err != nil {
-		t.Fatalf("GetSnapshots(file2): %v", err)
+		t.Fatalf("New() error: %v", err)
 	}
-	if len(snapshots2) != 1 {
-		t.Fatalf("got %d snapshots for file2, want 1", len(snapshots2))
+	defer d.Close()
+
+	// Should be able to use the DB normally after migration
+	saved, err := d.SaveSnapshot("/tmp/post_migrate.go", []byte("after migration"), 0)
+	if err != nil {
+		t.Fatalf("SaveSnapshot() error: %v", err)
 	}
-	if snapshots2[0].FileID != files2[0].ID {
-		t.Errorf("snapshot FileID = %s, want %s", snapshots2[0].FileID, files2[0].ID)
+	if !saved {
+		t.Error("SaveSnapshot() = false, want true")
 	}
 
-	// Verify stats are correct
-	stats, err := d.GetStats(nil)
+	files, err := d.SearchFiles("post_migrate", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("GetStats(): %v", err)
+		t.Fatal(err)
 	}
-	if stats.TotalFiles != 2 {
-		t.Errorf("TotalFiles = %d, want 2", stats.TotalFiles)
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
 	}
-	if stats.TotalSnapshots != 3 {
-		t.Errorf("TotalSnapshots = %d, want 3", stats.TotalSnapshots)
+	parsed, err := uuid.Parse(files[0].ID)
+	if err != nil {
+		t.Fatalf("ID %q is not valid UUID: %v", files[0].ID, err)
+	}
+	if parsed.Version() != 7 {
+		t.Errorf("UUID version = %d, want 7", parsed.Version())
 	}
 }
 
-func TestSaveRename_Basic(t *testing.T) {
+func TestDatabaseSize(t *testing.T) {
 	d := newTestDB(t)
 
-	// Create a file with a snapshot
-	if _, err := d.SaveSnapshot("/tmp/old.go", []byte("package main"), 0); err != nil {
-		t.Fatal(err)
-	}
-
-	// Save a rename
-	newFileID, err := d.SaveRename("/tmp/old.go", "/tmp/new.go")
+	size, err := d.DatabaseSize()
 	if err != nil {
-		t.Fatalf("SaveRename() error: %v", err)
+		t.Fatalf("DatabaseSize() error: %v", err)
 	}
-	if newFileID == "" {
-		t.Fatal("SaveRename() returned empty newFileID")
+	if size <= 0 {
+		t.Errorf("DatabaseSize() = %d, want > 0", size)
 	}
+}
 
-	// Verify new file was created
-	newFile, err := d.GetFile(newFileID)
-	if err != nil {
-		t.Fatalf("GetFile(newFileID) error: %v", err)
-	}
-	if newFile.Path != "/tmp/new.go" {
-		t.Errorf("new file path = %s, want /tmp/new.go", newFile.Path)
+func TestSaveSnapshotRequests_BinaryMetadataOnly(t *testing.T) {
+	d := newTestDB(t)
+
+	content := []byte{0x00, 0x01, 0x02, 0x03}
+	saved, errs := d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/blob.dat", Content: content, Binary: true}})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved[0], errs[0])
 	}
 
-	// Verify rename record
-	oldFiles, err := d.SearchFiles("old.go", 10, 0, nil)
+	files, err := d.SearchFiles("blob.dat", 10, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	renames, err := d.GetRenames(oldFiles[0].ID)
+	snap, err := d.GetLatestSnapshot(files[0].ID)
 	if err != nil {
-		t.Fatalf("GetRenames() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(renames) != 1 {
-		t.Fatalf("got %d renames, want 1", len(renames))
+	if !snap.Binary {
+		t.Error("Binary = false, want true")
 	}
-	if renames[0].OldPath != "/tmp/old.go" {
-		t.Errorf("OldPath = %s, want /tmp/old.go", renames[0].OldPath)
+	if len(snap.Content) != 0 {
+		t.Errorf("Content = %v, want empty", snap.Content)
 	}
-	if renames[0].NewPath != "/tmp/new.go" {
-		t.Errorf("NewPath = %s, want /tmp/new.go", renames[0].NewPath)
+	if snap.Size != int64(len(content)) || snap.Hash != sha256sum(content) {
+		t.Errorf("Size, Hash = %d, %s; want %d, %s", snap.Size, snap.Hash, len(content), sha256sum(content))
 	}
-}
-
-func TestSaveRename_ChainedRenames(t *testing.T) {
-	d := newTestDB(t)
 
-	// Create initial file
-	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("package main"), 0); err != nil {
-		t.Fatal(err)
+	// Unchanged binary content is deduplicated like text.
+	saved, _ = d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/blob.dat", Content: content, Binary: true}})
+	if saved[0] {
+		t.Error("identical binary content should not be saved again")
 	}
 
-	// A -> B
-	bFileID, err := d.SaveRename("/tmp/a.go", "/tmp/b.go")
+	entries, err := d.GetRecentSnapshots(10, 0, "", nil)
 	if err != nil {
-		t.Fatalf("SaveRename(a->b) error: %v", err)
+		t.Fatal(err)
 	}
+	if len(entries) != 1 || entries[0].EntryType != "binary" {
+		t.Errorf("history = %+v, want one binary entry", entries)
+	}
+}
 
-	// Save snapshot for B so it exists
-	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("package main"), 0); err != nil {
-		t.Fatal(err)
+func TestSaveSnapshotRequests_BecameBinary(t *testing.T) {
+	d := newTestDB(t)
+
+	for _, req := range []SnapshotRequest{
+		{FilePath: "/tmp/doc.txt", Content: []byte("plain text")},
+		{FilePath: "/tmp/doc.txt", Content: []byte{0x00, 0x01}, Binary: true},
+		{FilePath: "/tmp/doc.txt", Content: []byte{0x00, 0x02}, Binary: true},
+	} {
+		if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{req}); errs[0] != nil {
+			t.Fatal(errs[0])
+		}
 	}
 
-	// B -> C
-	_, err = d.SaveRename("/tmp/b.go", "/tmp/c.go")
+	f, err := d.GetFileByPath("/tmp/doc.txt")
 	if err != nil {
-		t.Fatalf("SaveRename(b->c) error: %v", err)
+		t.Fatal(err)
 	}
-
-	// Check renames from B's perspective (should see both A->B and B->C)
-	renames, err := d.GetRenames(bFileID)
+	entries, err := d.GetFileTimeline(f.ID)
 	if err != nil {
-		t.Fatalf("GetRenames(b) error: %v", err)
+		t.Fatal(err)
 	}
-	if len(renames) != 2 {
-		t.Fatalf("got %d renames for B, want 2", len(renames))
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
 	}
-	// Ordered by timestamp ASC
-	if renames[0].OldPath != "/tmp/a.go" || renames[0].NewPath != "/tmp/b.go" {
-		t.Errorf("renames[0] = %s->%s, want a.go->b.go", renames[0].OldPath, renames[0].NewPath)
+	// Newest first: only the first binary snapshot after text is the transition.
+	for i, want := range []bool{false, true, false} {
+		if entries[i].BecameBinary != want {
+			t.Errorf("entries[%d].BecameBinary = %v, want %v", i, entries[i].BecameBinary, want)
+		}
 	}
-	if renames[1].OldPath != "/tmp/b.go" || renames[1].NewPath != "/tmp/c.go" {
-		t.Errorf("renames[1] = %s->%s, want b.go->c.go", renames[1].OldPath, renames[1].NewPath)
+
+	recent, err := d.GetRecentSnapshots(10, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 3 || !recent[1].BecameBinary {
+		t.Errorf("recent history = %+v, want the middle entry marked becameBinary", recent)
 	}
 }
 
-func TestSaveRename_OldFileNotFound(t *testing.T) {
+func TestSetOrderByMtime(t *testing.T) {
 	d := newTestDB(t)
 
-	newFileID, err := d.SaveRename("/tmp/nonexistent.go", "/tmp/new.go")
+	// Saved in one order, but the mtimes say the opposite.
+	for _, req := range []SnapshotRequest{
+		{FilePath: "/tmp/a.go", Content: []byte("a1"), ModTime: 2000},
+		{FilePath: "/tmp/a.go", Content: []byte("a2"), ModTime: 1000},
+	} {
+		if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{req}); errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+	}
+	files, err := d.SearchFiles("a.go", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("SaveRename() unexpected error: %v", err)
+		t.Fatal(err)
 	}
-	if newFileID != "" {
-		t.Errorf("SaveRename() returned %q, want empty string for untracked old file", newFileID)
+
+	firstMtime := func() (int64, int64) {
+		snapshots, err := d.GetSnapshots(files[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := d.GetRecentSnapshots(10, 0, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entryMtime int64
+		for _, s := range snapshots {
+			if s.ID == entries[0].SnapshotID {
+				entryMtime = s.ModTime
+			}
+		}
+		return snapshots[0].ModTime, entryMtime
+	}
+
+	if snap, entry := firstMtime(); snap != 1000 || entry != 1000 {
+		t.Errorf("detected order: newest mtime = %d, %d; want 1000 (last saved)", snap, entry)
+	}
+
+	d.SetOrderByMtime(true)
+	if snap, entry := firstMtime(); snap != 2000 || entry != 2000 {
+		t.Errorf("mtime order: newest mtime = %d, %d; want 2000", snap, entry)
 	}
 }
 
-func TestGetRenames_Empty(t *testing.T) {
+func TestSetIDGenerator_Base32(t *testing.T) {
 	d := newTestDB(t)
+	d.SetIDGenerator(NewBase32ID)
 
-	if _, err := d.SaveSnapshot("/tmp/norenames.go", []byte("content"), 0); err != nil {
+	if _, err := d.SaveSnapshot("/tmp/short.go", []byte("content"), 0); err != nil {
 		t.Fatal(err)
 	}
-	files, err := d.SearchFiles("norenames.go", 10, 0, nil)
+	files, err := d.SearchFiles("short.go", 1, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	renames, err := d.GetRenames(files[0].ID)
+	if len(files[0].ID) != 26 || !ValidID(files[0].ID) {
+		t.Errorf("file ID = %q, want a 26-character base32 ID", files[0].ID)
+	}
+	snapshots, err := d.GetSnapshots(files[0].ID)
 	if err != nil {
-		t.Fatalf("GetRenames() error: %v", err)
+		t.Fatal(err)
 	}
-	if len(renames) != 0 {
-		t.Errorf("got %d renames, want 0", len(renames))
+	if !ValidID(snapshots[0].ID) {
+		t.Errorf("snapshot ID %q is not valid", snapshots[0].ID)
 	}
 }
 
-func TestSaveRename_ExistingNewFile(t *testing.T) {
-	d := newTestDB(t)
+func TestSetIDFormat_RefusesOtherFormat(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	open := func() *DB {
+		t.Helper()
+		d, err := New(dbPath)
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
 
-	// Create both files
-	if _, err := d.SaveSnapshot("/tmp/old2.go", []byte("old"), 0); err != nil {
+	// A database from before the format was stored is checked by its IDs
+	d := open()
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("a"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := d.SaveSnapshot("/tmp/existing.go", []byte("existing"), 0); err != nil {
-		t.Fatal(err)
+	if err := d.SetIDFormat("base32"); !errors.Is(err, ErrIDFormatMismatch) {
+		t.Errorf("base32 on UUIDv7 records: error = %v, want ErrIDFormatMismatch", err)
 	}
+	if err := d.SetIDFormat("uuidv7"); err != nil {
+		t.Fatalf("SetIDFormat(uuidv7) error: %v", err)
+	}
+	d.Close()
 
-	// Rename to existing file path
-	newFileID, err := d.SaveRename("/tmp/old2.go", "/tmp/existing.go")
+	// An empty database keeps the format it is first opened with
+	dbPath = filepath.Join(t.TempDir(), "test.db")
+	d = open()
+	if err := d.SetIDFormat("base32"); err != nil {
+		t.Fatalf("SetIDFormat(base32) error: %v", err)
+	}
+	d.Close()
+	d = open()
+	if err := d.SetIDFormat("uuidv7"); !errors.Is(err, ErrIDFormatMismatch) {
+		t.Errorf("uuidv7 on a base32 database: error = %v, want ErrIDFormatMismatch", err)
+	}
+	if err := d.SetIDFormat("base32"); err != nil {
+		t.Fatalf("SetIDFormat(base32) error: %v", err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	file, err := d.GetFileByPath("/tmp/b.go")
 	if err != nil {
-		t.Fatalf("SaveRename() error: %v", err)
+		t.Fatal(err)
 	}
+	if len(file.ID) != 26 {
+		t.Errorf("file ID = %q, want a 26-character base32 ID", file.ID)
+	}
+}
 
-	// Should reuse the existing file ID
-	existingFiles, err := d.SearchFiles("existing.go", 10, 0, nil)
+func TestNewBase32ID_Sortable(t *testing.T) {
+	prev := NewBase32ID()
+	for range 100 {
+		next := NewBase32ID()
+		if next <= prev {
+			t.Fatalf("NewBase32ID() = %s after %s, want increasing", next, prev)
+		}
+		prev = next
+	}
+}
+
+func TestValidID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{newUUIDv7(), true},
+		{NewBase32ID(), true},
+		{"", false},
+		{"abc", false},
+		{"0123456789abcdefghijklmnow", false}, // 'w' is outside the alphabet
+		{strings.Repeat("0", 27), false},
+	}
+	for _, tt := range tests {
+		if got := ValidID(tt.id); got != tt.want {
+			t.Errorf("ValidID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestGetRecentSnapshots_IncludesOrigin(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, errs := d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/o.go", Content: []byte("x"), Origin: "scan"}}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	entries, err := d.GetRecentSnapshots(10, 0, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if newFileID != existingFiles[0].ID {
-		t.Errorf("newFileID = %s, want %s (existing file ID)", newFileID, existingFiles[0].ID)
+	if len(entries) != 1 || entries[0].Origin != "scan" {
+		t.Errorf("entries = %+v, want one with origin scan", entries)
 	}
 }
 
-func TestMigrateIfNeeded_AlreadyNewSchema(t *testing.T) {
-	// New DB already has TEXT schema; migration should be a no-op
+func TestGetRecentSnapshots_MarksNewFiles(t *testing.T) {
 	d := newTestDB(t)
 
-	if _, err := d.SaveSnapshot("/tmp/new.go", []byte("content"), 0); err != nil {
+	for _, content := range []string{"v1", "v2"} {
+		if _, err := d.SaveSnapshot("/tmp/a.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.SaveRename("/tmp/a.go", "/tmp/b.go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SaveSnapshot("/tmp/b.go", []byte("v3"), 0); err != nil {
 		t.Fatal(err)
 	}
 
-	files, err := d.SearchFiles("new.go", 10, 0, nil)
+	entries, err := d.GetRecentSnapshots(10, 0, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Fatalf("got %d files, want 1", len(files))
+	var newFiles []string
+	for _, e := range entries {
+		if e.FileCreated == 0 {
+			t.Errorf("entry %s of %s has no fileCreated", e.EntryType, e.FilePath)
+		}
+		if e.IsNewFile {
+			newFiles = append(newFiles, e.FilePath+":"+e.SnapshotID)
+		}
 	}
-
-	// Verify ID is valid UUIDv7 (not affected by migration)
-	parsed, err := uuid.Parse(files[0].ID)
+	// Only a.go's first snapshot; b.go got its path from a rename
+	a, err := d.GetFileByPath("/tmp/a.go")
 	if err != nil {
-		t.Fatalf("ID %q is not valid UUID: %v", files[0].ID, err)
+		t.Fatal(err)
 	}
-	if parsed.Version() != 7 {
-		t.Errorf("UUID version = %d, want 7", parsed.Version())
+	snapshots, err := d.GetSnapshots(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := snapshots[len(snapshots)-1]
+	if len(newFiles) != 1 || newFiles[0] != "/tmp/a.go:"+first.ID {
+		t.Errorf("new file entries = %v, want only /tmp/a.go:%s", newFiles, first.ID)
 	}
 }
 
-func TestMigrateIfNeeded_EmptyOldSchema(t *testing.T) {
-	dbPath := filepath.Join(t.TempDir(), "empty_old.db")
+func TestSizeLimit_Reject(t *testing.T) {
+	d := newTestDB(t)
+	d.SetSizeLimit(1, false)
 
-	// Create old schema DB with no data
-	sqlDB, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
-	if err != nil {
-		t.Fatalf("opening DB: %v", err)
+	saved, err := d.SaveSnapshot("/tmp/full.go", []byte("content"), 0)
+	if !errors.Is(err, ErrDatabaseFull) {
+		t.Fatalf("SaveSnapshot() error = %v, want ErrDatabaseFull", err)
 	}
-	oldSchema := `
-	CREATE TABLE files (
-		id       INTEGER PRIMARY KEY AUTOINCREMENT,
-		path     TEXT NOT NULL UNIQUE,
-		created  INTEGER NOT NULL DEFAULT (unixepoch()),
-		updated  INTEGER NOT NULL DEFAULT (unixepoch())
-	);
-	CREATE TABLE snapshots (
-		id        INTEGER PRIMARY KEY AUTOINCREMENT,
-		file_id   INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
-		content   BLOB NOT NULL,
-		size      INTEGER NOT NULL,
-		hash      TEXT NOT NULL,
-		timestamp INTEGER NOT NULL DEFAULT (unixepoch())
-	);
-	`
-	if _, err := sqlDB.Exec(oldSchema); err != nil {
-		t.Fatalf("creating old schema: %v", err)
+	if saved {
+		t.Error("SaveSnapshot() = true, want false")
 	}
-	sqlDB.Close()
 
-	// Open with New() — migration should succeed with empty tables
-	d, err := New(dbPath)
-	if err != nil {
-		t.Fatalf("New() error: %v", err)
+	_, errs := d.SaveSnapshotRequests([]SnapshotRequest{{FilePath: "/tmp/full.go", Content: []byte("content")}})
+	if !errors.Is(errs[0], ErrDatabaseFull) {
+		t.Errorf("SaveSnapshotRequests() error = %v, want ErrDatabaseFull", errs[0])
 	}
-	defer d.Close()
+}
 
-	// Should be able to use the DB normally after migration
-	saved, err := d.SaveSnapshot("/tmp/post_migrate.go", []byte("after migration"), 0)
-	if err != nil {
-		t.Fatalf("SaveSnapshot() error: %v", err)
+func TestSizeLimit_Evict(t *testing.T) {
+	d := newTestDB(t)
+
+	// Incompressible content so every snapshot occupies real pages.
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomContent := func() []byte {
+		b := make([]byte, 16*1024)
+		for i := range b {
+			b[i] = byte(rng.IntN(256))
+		}
+		return b
 	}
-	if !saved {
-		t.Error("SaveSnapshot() = false, want true")
+	for range 20 {
+		if _, err := d.SaveSnapshot("/tmp/big.bin", randomContent(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.SaveSnapshot("/tmp/small.go", []byte("small"), 0); err != nil {
+		t.Fatal(err)
 	}
 
-	files, err := d.SearchFiles("post_migrate", 10, 0, nil)
+	used, err := d.UsedSize()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Fatalf("got %d files, want 1", len(files))
+	d.SetSizeLimit(used/2, true)
+
+	saved, err := d.SaveSnapshot("/tmp/new.go", []byte("new"), 0)
+	if err != nil || !saved {
+		t.Fatalf("SaveSnapshot() = %v, %v, want true, nil", saved, err)
 	}
-	parsed, err := uuid.Parse(files[0].ID)
+	if after, _ := d.UsedSize(); after > used/2 {
+		t.Errorf("UsedSize() after eviction = %d, want <= %d", after, used/2)
+	}
+
+	files, err := d.SearchFiles("", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("ID %q is not valid UUID: %v", files[0].ID, err)
+		t.Fatal(err)
 	}
-	if parsed.Version() != 7 {
-		t.Errorf("UUID version = %d, want 7", parsed.Version())
+	for _, f := range files {
+		snapshots, err := d.GetSnapshots(f.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) == 0 {
+			t.Errorf("%s has no snapshots, want the latest kept", f.Path)
+		}
+		if f.Path == "/tmp/big.bin" && len(snapshots) >= 20 {
+			t.Errorf("%s has %d snapshots, want some evicted", f.Path, len(snapshots))
+		}
 	}
 }
 
-func TestDatabaseSize(t *testing.T) {
+func TestMaxTrackedFiles(t *testing.T) {
 	d := newTestDB(t)
+	d.SetMaxTrackedFiles(2)
 
-	size, err := d.DatabaseSize()
+	for _, p := range []string{"/tmp/a.go", "/tmp/b.go"} {
+		if _, err := d.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a.go is older than b.go even though both were saved this second
+	if _, err := d.db.Exec(`UPDATE files SET updated = 100 WHERE path = '/tmp/a.go'`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.SaveSnapshot("/tmp/c.go", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, err := d.SearchFiles("", 10, 0, nil)
 	if err != nil {
-		t.Fatalf("DatabaseSize() error: %v", err)
+		t.Fatal(err)
 	}
-	if size <= 0 {
-		t.Errorf("DatabaseSize() = %d, want > 0", size)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	slices.Sort(paths)
+	if want := []string{"/tmp/b.go", "/tmp/c.go"}; !slices.Equal(paths, want) {
+		t.Errorf("files after eviction = %v, want %v", paths, want)
+	}
+	var snapshots int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM snapshots`).Scan(&snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots != 2 {
+		t.Errorf("snapshots after eviction = %d, want 2", snapshots)
 	}
 }
 
@@ -1244,6 +3231,54 @@ func TestCreateDatabaseSnapshot(t *testing.T) {
 	}
 }
 
+func TestNew_InMemory(t *testing.T) {
+	d, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New(:memory:) error: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if _, err := d.SaveSnapshot("/tmp/mem.go", []byte("package mem"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Queries after the save must see the same database, not a fresh one
+	files, err := d.SearchFiles("mem", 10, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("SearchFiles() = %d files, want 1", len(files))
+	}
+
+	snapshotPath, err := d.CreateDatabaseSnapshot(t.TempDir())
+	if err != nil {
+		t.Fatalf("CreateDatabaseSnapshot() error: %v", err)
+	}
+	snapDB, err := New(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapDB.Close()
+	if _, err := snapDB.GetFileByPath("/tmp/mem.go"); err != nil {
+		t.Errorf("snapshot GetFileByPath() error: %v, want the saved file", err)
+	}
+}
+
+func TestIsMemoryPath(t *testing.T) {
+	tests := map[string]bool{
+		":memory:":                           true,
+		"file::memory:?cache=shared":         true,
+		"file:demo?mode=memory&cache=shared": true,
+		"/tmp/history.db":                    false,
+		"file:/tmp/history.db?mode=ro":       false,
+	}
+	for path, want := range tests {
+		if got := IsMemoryPath(path); got != want {
+			t.Errorf("IsMemoryPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
 func TestCreateDatabaseSnapshot_EmptyDB(t *testing.T) {
 	d := newTestDB(t)
 
@@ -1263,6 +3298,49 @@ func TestCreateDatabaseSnapshot_EmptyDB(t *testing.T) {
 	}
 }
 
+func TestBackup_KeepsNewestCopies(t *testing.T) {
+	d := newTestDB(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+
+	// Older backups of this database, one of another database, and an
+	// unrelated file sharing the prefix.
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"history-20200101-000000.db",
+		"history-20200102-000000.db",
+		"history-docs-20200101-000000.db",
+		"history-notes.db",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := d.Backup(dir, "history-", 2)
+	if err != nil {
+		t.Fatalf("Backup() error: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Fatalf("backup %s missing or empty: %v", path, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"history-20200102-000000.db", filepath.Base(path), "history-docs-20200101-000000.db", "history-notes.db"}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("backup dir = %v, want %v", names, want)
+	}
+}
+
 func TestMigrateIfNeeded_PostMigrationOperations(t *testing.T) {
 	dbPath := filepath.Join(t.TempDir(), "migrate_ops.db")
 	createOldSchemaDB(t, dbPath)
@@ -1506,6 +3584,59 @@ func TestGetRecentSnapshots_IncludesRenames(t *testing.T) {
 	}
 }
 
+func TestGetRecentSnapshots_CollapsesRenameChains(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.SaveSnapshot("/tmp/a.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, mv := range [][2]string{{"/tmp/a.go", "/tmp/b.go"}, {"/tmp/b.go", "/tmp/c.go"}} {
+		if _, err := d.SaveRename(mv[0], mv[1]); err != nil {
+			t.Fatalf("SaveRename(%s, %s) error: %v", mv[0], mv[1], err)
+		}
+	}
+
+	renameEntries := func() []HistoryEntry {
+		entries, err := d.GetRecentSnapshots(10, 0, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var renames []HistoryEntry
+		for _, e := range entries {
+			if e.EntryType == "rename" {
+				renames = append(renames, e)
+			}
+		}
+		return renames
+	}
+
+	if got := renameEntries(); len(got) != 2 {
+		t.Fatalf("without collapsing got %d rename entries, want 2", len(got))
+	}
+
+	d.SetRenameCollapseWindow(5)
+	got := renameEntries()
+	if len(got) != 1 {
+		t.Fatalf("with collapsing got %d rename entries, want 1", len(got))
+	}
+	if got[0].OldFilePath != "/tmp/a.go" || got[0].FilePath != "/tmp/c.go" {
+		t.Errorf("collapsed rename = %s -> %s, want /tmp/a.go -> /tmp/c.go", got[0].OldFilePath, got[0].FilePath)
+	}
+
+	// The intermediate rows remain for lineage queries.
+	files, err := d.SearchFiles("b.go", 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renames, err := d.GetRenames(files[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renames) != 2 {
+		t.Errorf("GetRenames(b) = %d rows, want 2", len(renames))
+	}
+}
+
 func TestGetRecentSnapshots_RenamesPagination(t *testing.T) {
 	d := newTestDB(t)
 
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package db
+
+// availableDiskSpace cannot query free space on this platform; the
+// caller skips its disk-space check.
+func availableDiskSpace(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnknown
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package db
+
+import "golang.org/x/sys/unix"
+
+// availableDiskSpace returns the bytes available to this process on the
+// filesystem holding dir.
+func availableDiskSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
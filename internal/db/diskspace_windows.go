@@ -0,0 +1,19 @@
+//go:build windows
+
+package db
+
+import "golang.org/x/sys/windows"
+
+// availableDiskSpace returns the bytes available to this process on the
+// volume holding dir, honoring per-user quotas.
+func availableDiskSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -2,6 +2,7 @@ package diff
 
 import (
 	"fmt"
+	"html"
 	"strings"
 
 	difflib "github.com/sergi/go-diff/diffmatchpatch"
@@ -18,6 +19,17 @@ func UnifiedDiff(fromText, toText, fromLabel, toLabel string) string {
 	return formatUnifiedDiff(diffs, fromLabel, toLabel)
 }
 
+// UnifiedLineDiff is a cheaper UnifiedDiff for large inputs: it skips the
+// semantic cleanup pass, so hunks may be less tidy but are still correct.
+func UnifiedLineDiff(fromText, toText, fromLabel, toLabel string) string {
+	dmp := difflib.New()
+	a, b, c := dmp.DiffLinesToChars(fromText, toText)
+	diffs := dmp.DiffMain(a, b, false)
+	diffs = dmp.DiffCharsToLines(diffs, c)
+
+	return formatUnifiedDiff(diffs, fromLabel, toLabel)
+}
+
 func formatUnifiedDiff(diffs []difflib.Diff, fromLabel, toLabel string) string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("--- %s\n", fromLabel))
@@ -154,3 +166,73 @@ func formatUnifiedDiff(diffs []difflib.Diff, fromLabel, toLabel string) string {
 
 	return sb.String()
 }
+
+// HTMLFragment renders a diff produced by UnifiedDiff as an HTML fragment:
+// a <pre class="diff"> with one span per line, classed "file" for the two
+// header lines, "hunk" for @@ lines, and "add", "del" or "ctx" for content.
+// All text is HTML-escaped. An empty diff renders as an empty <pre>.
+func HTMLFragment(unified string) string {
+	if unified == "" {
+		return "<pre class=\"diff\"></pre>\n"
+	}
+	var sb strings.Builder
+	sb.WriteString(`<pre class="diff">`)
+	for i, l := range strings.Split(strings.TrimSuffix(unified, "\n"), "\n") {
+		class := "ctx"
+		switch {
+		case i < 2:
+			class = "file"
+		case strings.HasPrefix(l, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(l, "+"):
+			class = "add"
+		case strings.HasPrefix(l, "-"):
+			class = "del"
+		}
+		fmt.Fprintf(&sb, "<span class=\"%s\">%s</span>\n", class, html.EscapeString(l))
+	}
+	sb.WriteString("</pre>\n")
+	return sb.String()
+}
+
+// Op is the kind of change a LineOp represents.
+type Op int
+
+const (
+	OpEqual Op = iota
+	OpInsert
+	OpDelete
+)
+
+// LineOp is a single line of a line-level diff.
+type LineOp struct {
+	Op   Op
+	Text string // line content without the trailing newline
+}
+
+// LineDiff computes a line-by-line diff between two texts. Unlike
+// UnifiedDiff, no semantic cleanup is applied, so every op is a whole line.
+func LineDiff(fromText, toText string) []LineOp {
+	dmp := difflib.New()
+	a, b, c := dmp.DiffLinesToChars(fromText, toText)
+	diffs := dmp.DiffMain(a, b, false)
+	diffs = dmp.DiffCharsToLines(diffs, c)
+
+	var ops []LineOp
+	for _, d := range diffs {
+		op := OpEqual
+		switch d.Type {
+		case difflib.DiffInsert:
+			op = OpInsert
+		case difflib.DiffDelete:
+			op = OpDelete
+		}
+		for _, l := range strings.SplitAfter(d.Text, "\n") {
+			if l == "" {
+				continue
+			}
+			ops = append(ops, LineOp{Op: op, Text: strings.TrimSuffix(l, "\n")})
+		}
+	}
+	return ops
+}
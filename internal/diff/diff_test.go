@@ -28,6 +28,19 @@ func TestUnifiedDiff_BasicChange(t *testing.T) {
 	}
 }
 
+func TestUnifiedLineDiff_MatchesUnifiedDiffForLineChanges(t *testing.T) {
+	from := "line1\nline2\nline3\n"
+	to := "line1\nmodified\nline3\n"
+
+	got := UnifiedLineDiff(from, to, "a", "b")
+	if want := UnifiedDiff(from, to, "a", "b"); got != want {
+		t.Errorf("UnifiedLineDiff() = %q, want %q", got, want)
+	}
+	if UnifiedLineDiff(from, from, "a", "b") != "" {
+		t.Error("identical inputs should produce an empty diff")
+	}
+}
+
 func TestUnifiedDiff_NoChanges(t *testing.T) {
 	text := "line1\nline2\nline3\n"
 
@@ -107,3 +120,48 @@ func TestUnifiedDiff_MultipleHunks(t *testing.T) {
 		t.Errorf("expected at least 2 hunk headers, got %d:\n%s", hunkCount, result)
 	}
 }
+
+func TestHTMLFragment(t *testing.T) {
+	got := HTMLFragment(UnifiedDiff("keep\n<b>old</b>\n", "keep\n<script>new</script>\n", "a.html", "a.html"))
+
+	for _, want := range []string{
+		`<span class="file">--- a.html</span>`,
+		`<span class="hunk">@@ -1,2 +1,2 @@</span>`,
+		`<span class="ctx"> keep</span>`,
+		`<span class="del">-&lt;b&gt;old&lt;/b&gt;</span>`,
+		`<span class="add">+&lt;script&gt;new&lt;/script&gt;</span>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("HTMLFragment() missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "<script>") {
+		t.Error("HTMLFragment() left content unescaped")
+	}
+
+	if got := HTMLFragment(""); got != "<pre class=\"diff\"></pre>\n" {
+		t.Errorf("HTMLFragment(\"\") = %q", got)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	from := "keep\nold\ntail"
+	to := "keep\nnew\ntail"
+
+	ops := LineDiff(from, to)
+
+	want := []LineOp{
+		{Op: OpEqual, Text: "keep"},
+		{Op: OpDelete, Text: "old"},
+		{Op: OpInsert, Text: "new"},
+		{Op: OpEqual, Text: "tail"},
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("got %d ops, want %d: %+v", len(ops), len(want), ops)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Errorf("ops[%d] = %+v, want %+v", i, ops[i], want[i])
+		}
+	}
+}
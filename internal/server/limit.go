@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// busyRetryAfter is the Retry-After value (seconds) sent when the
+// concurrent request limit is reached.
+const busyRetryAfter = "1"
+
+// inFlightMiddleware counts the requests being served for /api/health and,
+// with MaxConcurrentRequests set, answers 503 to those beyond the limit
+// instead of queueing them. Event streams are capped by MaxSSEClients and
+// are neither counted nor limited here.
+func (s *Server) inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.requestSlots != nil {
+			select {
+			case s.requestSlots <- struct{}{}:
+				defer func() { <-s.requestSlots }()
+			default:
+				w.Header().Set("Retry-After", busyRetryAfter)
+				writeError(w, http.StatusServiceUnavailable, fmt.Errorf("too many concurrent requests"))
+				return
+			}
+		}
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/unok/local-text-history/internal/config"
+	"github.com/unok/local-text-history/internal/db"
+)
+
+// redactMask replaces content matched by a WatchSet's redactPatterns.
+const redactMask = "***"
+
+// redactRules holds the compiled redactPatterns of one WatchSet.
+type redactRules struct {
+	name     string
+	dirs     []string
+	patterns []*regexp.Regexp
+}
+
+// compileRedactRules compiles the redactPatterns of watchSets. Patterns are
+// validated with the config, so one failing here is logged and skipped.
+func compileRedactRules(watchSets []config.WatchSet, logger *slog.Logger) []redactRules {
+	var rules []redactRules
+	for _, ws := range watchSets {
+		var patterns []*regexp.Regexp
+		for _, p := range ws.RedactPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				logger.Error("ignoring invalid redact pattern", "watchSet", ws.Name, "pattern", p, "err", err)
+				continue
+			}
+			patterns = append(patterns, re)
+		}
+		if len(patterns) > 0 {
+			rules = append(rules, redactRules{name: ws.Name, dirs: ws.Dirs, patterns: patterns})
+		}
+	}
+	return rules
+}
+
+// redactPatternsFor returns the patterns applying to a file: those of the
+// WatchSet recorded for it or, for files recorded before the set name was
+// stored, of the set with the longest dir containing path.
+func (s *Server) redactPatternsFor(watchSet, path string) []*regexp.Regexp {
+	if len(s.redactors) == 0 {
+		return nil
+	}
+	if watchSet != "" {
+		for _, rr := range s.redactors {
+			if rr.name == watchSet {
+				return rr.patterns
+			}
+		}
+		return nil
+	}
+	var best []*regexp.Regexp
+	bestLen := 0
+	for _, rr := range s.redactors {
+		for _, dir := range rr.dirs {
+			dir = filepath.Clean(dir)
+			if (path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))) && len(dir) > bestLen {
+				best, bestLen = rr.patterns, len(dir)
+			}
+		}
+	}
+	return best
+}
+
+// redact returns content with every match of patterns replaced by
+// redactMask. When a pattern has capture groups only the groups are
+// masked, so "(?m)^API_KEY=(.*)$" keeps the key name visible. content is
+// returned unchanged when nothing matches.
+func redact(content []byte, patterns []*regexp.Regexp) []byte {
+	for _, re := range patterns {
+		matches := re.FindAllSubmatchIndex(content, -1)
+		if matches == nil {
+			continue
+		}
+		var out []byte
+		last := 0
+		for _, m := range matches {
+			spans := [][2]int{{m[0], m[1]}}
+			if n := re.NumSubexp(); n > 0 {
+				spans = spans[:0]
+				for g := 1; g <= n; g++ {
+					if m[2*g] >= 0 {
+						spans = append(spans, [2]int{m[2*g], m[2*g+1]})
+					}
+				}
+			}
+			for _, sp := range spans {
+				// Skip empty matches and groups nested in one already masked
+				if sp[0] == sp[1] || sp[0] < last {
+					continue
+				}
+				out = append(out, content[last:sp[0]]...)
+				out = append(out, redactMask...)
+				last = sp[1]
+			}
+		}
+		if out != nil {
+			content = append(out, content[last:]...)
+		}
+	}
+	return content
+}
+
+// redactString is redact for string content.
+func redactString(content string, patterns []*regexp.Regexp) string {
+	if len(patterns) == 0 {
+		return content
+	}
+	return string(redact([]byte(content), patterns))
+}
+
+// redactSnapshot masks snapshot.Content with the patterns of its file. The
+// file is only looked up when some WatchSet has redactPatterns.
+func (s *Server) redactSnapshot(database *db.DB, snapshot *db.Snapshot) error {
+	if len(s.redactors) == 0 || len(snapshot.Content) == 0 {
+		return nil
+	}
+	file, err := database.GetFile(snapshot.FileID)
+	if err != nil {
+		return err
+	}
+	snapshot.Content = redact(snapshot.Content, s.redactPatternsFor(file.WatchSet, file.Path))
+	return nil
+}
+
+// redactEntries masks the previews of history entries in place.
+func (s *Server) redactEntries(entries []db.HistoryEntry) {
+	for i := range entries {
+		if entries[i].Preview == "" {
+			continue
+		}
+		patterns := s.redactPatternsFor(entries[i].WatchSet, entries[i].FilePath)
+		entries[i].Preview = redactString(entries[i].Preview, patterns)
+	}
+}
+
+// errRevealWithoutAuth is returned with 403 for ?reveal=1 on a server
+// without basic auth, where anyone reaching the UI could use it.
+var errRevealWithoutAuth = errors.New("reveal requires basicAuth to be configured")
+
+// revealRequested reports whether r asks for unmasked content with
+// ?reveal=1. Reveal is only honoured behind basic auth; otherwise 403 is
+// written and ok is false.
+func (s *Server) revealRequested(w http.ResponseWriter, r *http.Request) (reveal, ok bool) {
+	if !queryFlag(r, "reveal") {
+		return false, true
+	}
+	if s.basicAuth == nil {
+		writeError(w, http.StatusForbidden, errRevealWithoutAuth)
+		return false, false
+	}
+	return true, true
+}
@@ -1,25 +1,37 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/subtle"
 	"database/sql"
+	_ "embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/google/uuid"
 	"github.com/unok/local-text-history/internal/config"
 	"github.com/unok/local-text-history/internal/db"
 	"github.com/unok/local-text-history/internal/diff"
+	"github.com/unok/local-text-history/internal/textenc"
 )
 
 // Server handles HTTP requests for the file history API.
@@ -29,13 +41,118 @@ type Server struct {
 	watchDirs  []string
 	watchSets  []config.WatchSet
 	basicAuth  *config.BasicAuthConfig
+	redactors  []redactRules // WatchSets with redactPatterns
+	opts       Options
 	mux        *http.ServeMux
-	sseClients map[chan string]struct{}
+	sseClients map[chan sseMessage]struct{}
+	sseBuffer  []sseMessage // recent events for Last-Event-ID replay, oldest first
+	sseLastID  uint64
 	sseMu      sync.Mutex
+	statsTimer *time.Timer            // pending stats broadcast; guarded by sseMu
+	lastStats  db.Stats               // last broadcast stats; guarded by sseMu
+	downloads  map[*db.DB]*dbDownload // in-progress database copies, by source
+	downloadMu sync.Mutex
+	configErr  error     // last rejected config reload; guarded by configMu
+	configAt   time.Time // when configErr was recorded
+	configMu   sync.Mutex
+
+	requestSlots chan struct{} // one per request in flight; nil when unlimited
+	inFlight     atomic.Int64  // requests being served, excluding event streams
 }
 
-// New creates a new Server with the given database, static file system, watch sets, and optional basic auth config.
-func New(database *db.DB, staticFS fs.FS, watchSets []config.WatchSet, basicAuth *config.BasicAuthConfig) *Server {
+// Options holds tunable server settings. Zero values fall back to defaults.
+type Options struct {
+	HistoryDefaultLimit int
+	HistoryMaxLimit     int
+	SearchDefaultLimit  int
+	SearchMaxLimit      int
+	// WatchSetDBs maps a WatchSet name to the database holding its history
+	// when it is stored separately from the main database.
+	WatchSetDBs map[string]*db.DB
+	// WatchStats reports the watcher's directory watch state for /api/stats.
+	WatchStats func() WatchStats
+	// Rescan starts a background re-import of the named WatchSet (all sets
+	// when empty). Nil disables POST /api/rescan.
+	Rescan func(watchSet string) error
+	// MaxSSEClients caps concurrent /api/events connections (0 = unlimited).
+	MaxSSEClients int
+	// MaxConcurrentRequests caps the requests served at once, excluding
+	// /api/events streams; requests beyond it are answered 503
+	// (0 = unlimited).
+	MaxConcurrentRequests int
+	// SSEStatsInterval throttles "stats" events: after a change, updated
+	// totals are broadcast at most once per interval. Default 2s.
+	SSEStatsInterval time.Duration
+	// MaxDiffBytes switches /api/diff, /api/compare and diff-live to a
+	// cheaper line-only diff when either side is larger (0 = unlimited).
+	MaxDiffBytes int64
+	// MaxInitialDiffBytes makes /api/diff without 'from' return only a
+	// summary with suppressed set when the snapshot is larger (0 = unlimited).
+	MaxInitialDiffBytes int64
+	// Logger receives the server's log output. Nil means slog.Default().
+	Logger *slog.Logger
+	// RequestTimeout bounds the database queries of the search, history and
+	// diff endpoints; a query still running at the deadline is aborted and
+	// the request answered 504 (0 = no deadline).
+	RequestTimeout time.Duration
+	// RejectConcurrentDownloads answers 429 to a database download while
+	// another is in progress instead of sharing its copy.
+	RejectConcurrentDownloads bool
+	// TrashFiles makes DELETE /api/files/{id} move the file to the trash,
+	// from which it is purged later, instead of deleting it at once.
+	TrashFiles bool
+	// SnapshotTmpDir is where database downloads write their VACUUM copy.
+	// A WatchSet's own SnapshotTmpDir takes precedence for its database.
+	// Empty means os.TempDir().
+	SnapshotTmpDir string
+	// AccessLog logs every request (except the /api/events stream) with its
+	// status, response size, duration and remote address.
+	AccessLog bool
+	// BasePath prefixes every route (e.g. "/history", no trailing slash)
+	// and is set as the <base href> of the served index.html. Empty serves
+	// at the root.
+	BasePath string
+	// HeavyOpCheck is consulted before a database download or dictionary
+	// training; a non-nil error refuses the request with 503 and is sent as
+	// the hint. Nil always allows them.
+	HeavyOpCheck func() error
+}
+
+// WatchStats describes the directory watches held by the file watcher.
+type WatchStats struct {
+	Watches      int  `json:"watches"`
+	LimitReached bool `json:"limitReached"`
+	// UnavailableDirs lists watch dirs that are missing or inaccessible.
+	UnavailableDirs []string `json:"unavailableDirs"`
+}
+
+// withDefaults returns a copy of o with zero fields replaced by defaults.
+func (o Options) withDefaults() Options {
+	if o.HistoryDefaultLimit <= 0 {
+		o.HistoryDefaultLimit = 50
+	}
+	if o.HistoryMaxLimit <= 0 {
+		o.HistoryMaxLimit = 200
+	}
+	if o.SearchDefaultLimit <= 0 {
+		o.SearchDefaultLimit = 20
+	}
+	if o.SearchMaxLimit <= 0 {
+		o.SearchMaxLimit = 100
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.SSEStatsInterval <= 0 {
+		o.SSEStatsInterval = 2 * time.Second
+	}
+	o.BasePath = strings.TrimSuffix(o.BasePath, "/")
+	return o
+}
+
+// New creates a new Server with the given database, static file system, watch sets,
+// optional basic auth config, and tunable options.
+func New(database *db.DB, staticFS fs.FS, watchSets []config.WatchSet, basicAuth *config.BasicAuthConfig, opts Options) *Server {
 	var allDirs []string
 	for _, ws := range watchSets {
 		allDirs = append(allDirs, ws.Dirs...)
@@ -46,8 +163,14 @@ func New(database *db.DB, staticFS fs.FS, watchSets []config.WatchSet, basicAuth
 		watchDirs:  allDirs,
 		watchSets:  watchSets,
 		basicAuth:  basicAuth,
+		opts:       opts.withDefaults(),
 		mux:        http.NewServeMux(),
-		sseClients: make(map[chan string]struct{}),
+		sseClients: make(map[chan sseMessage]struct{}),
+		downloads:  make(map[*db.DB]*dbDownload),
+	}
+	s.redactors = compileRedactRules(watchSets, s.opts.Logger)
+	if s.opts.MaxConcurrentRequests > 0 {
+		s.requestSlots = make(chan struct{}, s.opts.MaxConcurrentRequests)
 	}
 	s.registerRoutes()
 	return s
@@ -55,27 +178,112 @@ func New(database *db.DB, staticFS fs.FS, watchSets []config.WatchSet, basicAuth
 
 // sseEvent represents an SSE notification payload.
 type sseEvent struct {
-	Type      string `json:"type"`
-	FilePath  string `json:"filePath"`
-	Timestamp int64  `json:"timestamp"`
+	Type        string `json:"type"`
+	FilePath    string `json:"filePath"`
+	FilePathRaw string `json:"filePathRaw,omitempty"` // see db.RawPath
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// sseBufferSize is how many recent events are kept for reconnecting clients.
+const sseBufferSize = 256
+
+// heavyOpRetryAfter is the Retry-After value (seconds) sent when
+// Options.HeavyOpCheck refuses a request.
+const heavyOpRetryAfter = "60"
+
+// refuseHeavyOp answers 503 and returns true if Options.HeavyOpCheck does
+// not allow a heavy database operation now.
+func (s *Server) refuseHeavyOp(w http.ResponseWriter) bool {
+	if s.opts.HeavyOpCheck == nil {
+		return false
+	}
+	err := s.opts.HeavyOpCheck()
+	if err == nil {
+		return false
+	}
+	// The hint is meant for the client, so it is not hidden like the
+	// messages of other 5xx errors.
+	w.Header().Set("Retry-After", heavyOpRetryAfter)
+	writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+	return true
+}
+
+// sseRetryAfter is the Retry-After value (seconds) sent when the SSE client
+// limit is reached.
+const sseRetryAfter = "5"
+
+// sseMessage is a serialized SSE event with its stream ID.
+type sseMessage struct {
+	id   uint64
+	data string
+}
+
+// sseRefreshEvent tells a reconnecting client that events it missed are no
+// longer buffered and it should reload its data.
+const sseRefreshEvent = `{"type":"refresh"}`
+
+// sseStatsEvent is pushed when the main database's totals change, so
+// dashboards need not poll /api/stats.
+type sseStatsEvent struct {
+	Type string `json:"type"`
+	db.Stats
 }
 
-// Notify sends an SSE event to all connected clients.
+// Notify sends an SSE event to all connected clients and schedules a
+// "stats" event.
 func (s *Server) Notify(filePath string) {
 	data, err := json.Marshal(sseEvent{
-		Type:      "snapshot",
-		FilePath:  filePath,
-		Timestamp: time.Now().Unix(),
+		Type:        "snapshot",
+		FilePath:    filePath,
+		FilePathRaw: db.RawPath(filePath),
+		Timestamp:   time.Now().Unix(),
 	})
 	if err != nil {
-		log.Printf("error marshaling SSE event: %v", err)
+		s.opts.Logger.Error("error marshaling SSE event", "err", err)
 		return
 	}
-	event := string(data)
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+
+	s.sseLastID++
+	event := sseMessage{id: s.sseLastID, data: string(data)}
+	s.sseBuffer = append(s.sseBuffer, event)
+	if len(s.sseBuffer) > sseBufferSize {
+		s.sseBuffer = s.sseBuffer[len(s.sseBuffer)-sseBufferSize:]
+	}
+	s.broadcast(event)
+
+	if s.statsTimer == nil {
+		s.statsTimer = time.AfterFunc(s.opts.SSEStatsInterval, s.broadcastStats)
+	}
+}
+
+// broadcastStats sends a "stats" event if the totals changed since the
+// last one. Stats events carry no ID and are not replayed on reconnect.
+func (s *Server) broadcastStats() {
+	stats, err := s.db.GetStats(nil)
 
 	s.sseMu.Lock()
 	defer s.sseMu.Unlock()
+	s.statsTimer = nil
+	if err != nil {
+		s.opts.Logger.Error("error computing stats for SSE", "err", err)
+		return
+	}
+	if stats == s.lastStats {
+		return
+	}
+	s.lastStats = stats
+	data, err := json.Marshal(sseStatsEvent{Type: "stats", Stats: stats})
+	if err != nil {
+		s.opts.Logger.Error("error marshaling SSE event", "err", err)
+		return
+	}
+	s.broadcast(sseMessage{data: string(data)})
+}
 
+// broadcast delivers event to every client. The caller must hold sseMu.
+func (s *Server) broadcast(event sseMessage) {
 	for ch := range s.sseClients {
 		// Non-blocking send: skip slow clients
 		select {
@@ -87,10 +295,81 @@ func (s *Server) Notify(filePath string) {
 
 // Handler returns the HTTP handler for this server.
 func (s *Server) Handler() http.Handler {
-	if s.basicAuth == nil {
-		return s.mux
+	var h http.Handler = s.mux
+	if s.basicAuth != nil {
+		h = s.basicAuthMiddleware(h)
+	}
+	h = s.inFlightMiddleware(h)
+	if s.opts.AccessLog {
+		h = s.accessLogMiddleware(h)
+	}
+	return h
+}
+
+// statusRecorder captures the status code and body size written through it
+// for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
 	}
-	return s.basicAuthMiddleware(s.mux)
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// isEventStream reports whether r is for the long-lived /api/events stream.
+func (s *Server) isEventStream(r *http.Request) bool {
+	return r.URL.Path == s.opts.BasePath+"/api/events"
+}
+
+// accessLogMiddleware logs one line per request with its status, response
+// size and duration. The long-lived /api/events stream is not logged.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.opts.Logger.Info("http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
 }
 
 func (s *Server) basicAuthMiddleware(next http.Handler) http.Handler {
@@ -107,29 +386,84 @@ func (s *Server) basicAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// route pairs a ServeMux pattern with its handler.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// apiRoutes returns all API routes in registration order.
+func (s *Server) apiRoutes() []route {
+	return []route{
+		{"GET /api/history", s.handleHistory},
+		{"GET /api/recent-files", s.handleRecentFiles},
+		{"GET /api/files/stale", s.handleStaleFiles},
+		{"GET /api/events", s.handleSSE},
+		{"GET /api/files", s.handleSearchFiles},
+		{"GET /api/directories", s.handleListDirectories},
+		{"GET /api/files/{id}", s.handleGetFile},
+		{"GET /api/files/{id}/snapshots", s.handleGetSnapshots},
+		{"GET /api/files/{id}/renames", s.handleGetRenames},
+		{"GET /api/files/{id}/timeline", s.handleGetTimeline},
+		{"GET /api/files/{id}/diff-live", s.handleDiffLive},
+		{"GET /api/files/{id}/diff", s.handleDiffBack},
+		{"GET /api/files/{id}/latest", s.handleGetLatestSnapshot},
+		{"GET /api/files/{id}/blame", s.handleBlame},
+		{"GET /api/files/{id}/export.json", s.handleExportFile},
+		{"GET /api/snapshots/{id}", s.handleGetSnapshot},
+		{"GET /api/snapshot-at", s.handleGetSnapshotAt},
+		{"GET /api/snapshots/{id}/download", s.handleDownloadSnapshot},
+		{"GET /api/diff", s.handleDiff},
+		{"GET /api/compare", s.handleCompare},
+		{"GET /api/stats", s.handleStats},
+		{"GET /api/stats/compression", s.handleCompressionStats},
+		{"GET /api/stats/extensions", s.handleExtensionStats},
+		{"GET /api/activity", s.handleActivity},
+		{"GET /api/health", s.handleHealth},
+		{"GET /api/database/download", s.handleDatabaseDownload},
+		{"DELETE /api/files/{id}", s.handleDeleteFile},
+		{"DELETE /api/snapshots/{id}", s.handleDeleteSnapshot},
+		{"POST /api/files/{id}/link-rename", s.handleLinkRename},
+		{"POST /api/snapshots/{id}/promote", s.handlePromoteSnapshot},
+		{"POST /api/rescan", s.handleRescan},
+		{"POST /api/database/dictionary", s.handleTrainDictionary},
+		{"GET /api/openapi.json", s.handleOpenAPI},
+	}
+}
+
+// openAPISpec is the hand-maintained OpenAPI 3 description of apiRoutes,
+// served at /api/openapi.json. Update it together with the routes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI serves openAPISpec.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
 func (s *Server) registerRoutes() {
-	s.mux.HandleFunc("GET /api/history", s.handleHistory)
-	s.mux.HandleFunc("GET /api/events", s.handleSSE)
-	s.mux.HandleFunc("GET /api/files", s.handleSearchFiles)
-	s.mux.HandleFunc("GET /api/files/{id}", s.handleGetFile)
-	s.mux.HandleFunc("GET /api/files/{id}/snapshots", s.handleGetSnapshots)
-	s.mux.HandleFunc("GET /api/files/{id}/renames", s.handleGetRenames)
-	s.mux.HandleFunc("GET /api/snapshots/{id}", s.handleGetSnapshot)
-	s.mux.HandleFunc("GET /api/snapshots/{id}/download", s.handleDownloadSnapshot)
-	s.mux.HandleFunc("GET /api/diff", s.handleDiff)
-	s.mux.HandleFunc("GET /api/stats", s.handleStats)
-	s.mux.HandleFunc("GET /api/database/download", s.handleDatabaseDownload)
-	s.mux.HandleFunc("DELETE /api/files/{id}", s.handleDeleteFile)
-	s.mux.HandleFunc("/", s.handleSPA)
+	for _, rt := range s.apiRoutes() {
+		s.mux.HandleFunc(s.withBasePath(rt.pattern), rt.handler)
+	}
+	s.mux.HandleFunc(s.opts.BasePath+"/", s.handleSPA)
+}
+
+// withBasePath inserts Options.BasePath before the path of a "METHOD /path"
+// route pattern.
+func (s *Server) withBasePath(pattern string) string {
+	method, path, _ := strings.Cut(pattern, " ")
+	return method + " " + s.opts.BasePath + path
 }
 
 func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	if limit <= 0 {
-		limit = 50
+		limit = s.opts.HistoryDefaultLimit
 	}
-	if limit > 200 {
-		limit = 200
+	if limit > s.opts.HistoryMaxLimit {
+		limit = s.opts.HistoryMaxLimit
 	}
 
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
@@ -141,9 +475,11 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 	watchSetName := r.URL.Query().Get("watchSet")
 	dirPrefixes := s.resolveDirPrefixes(watchSetName)
 
-	entries, err := s.db.GetRecentSnapshots(limit+1, offset, query, dirPrefixes)
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	entries, err := s.dbFor(r).GetRecentSnapshotsContext(ctx, limit+1, offset, query, dirPrefixes, matchMode(r))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeQueryError(ctx, w, err)
 		return
 	}
 
@@ -154,10 +490,20 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 	if entries == nil {
 		entries = []db.HistoryEntry{}
 	}
+	s.redactEntries(entries)
+
+	w.Header().Set("Vary", "Accept")
+	if acceptsNDJSON(r) {
+		// One entry per line, so clients can parse incrementally; hasMore
+		// moves to a header as there is no enclosing object.
+		w.Header().Set("X-Has-More", strconv.FormatBool(hasMore))
+		writeNDJSON(w, entries)
+		return
+	}
 
 	type historyResponse struct {
 		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+		HasMore bool              `json:"hasMore"`
 	}
 	writeJSON(w, http.StatusOK, historyResponse{
 		Entries: entries,
@@ -165,6 +511,102 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleRecentFiles lists recently updated files, one entry per file with
+// its latest snapshot, using the same limits as handleHistory.
+func (s *Server) handleRecentFiles(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = s.opts.HistoryDefaultLimit
+	}
+	if limit > s.opts.HistoryMaxLimit {
+		limit = s.opts.HistoryMaxLimit
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	dirPrefixes := s.resolveDirPrefixes(r.URL.Query().Get("watchSet"))
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	files, err := s.dbFor(r).GetRecentFilesContext(ctx, limit+1, offset, dirPrefixes)
+	if err != nil {
+		writeQueryError(ctx, w, err)
+		return
+	}
+
+	hasMore := len(files) > limit
+	if hasMore {
+		files = files[:limit]
+	}
+	if files == nil {
+		files = []db.RecentFile{}
+	}
+
+	type recentFilesResponse struct {
+		Files   []db.RecentFile `json:"files"`
+		HasMore bool            `json:"hasMore"`
+	}
+	writeJSON(w, http.StatusOK, recentFilesResponse{
+		Files:   files,
+		HasMore: hasMore,
+	})
+}
+
+// defaultStaleDays is the inactivity period handleStaleFiles uses when no
+// days parameter is given.
+const defaultStaleDays = 90
+
+// handleStaleFiles lists files not updated in the last 'days' days (default
+// defaultStaleDays), oldest first, for deciding what to delete or archive.
+func (s *Server) handleStaleFiles(w http.ResponseWriter, r *http.Request) {
+	days := defaultStaleDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'days' parameter: must be a positive integer"))
+			return
+		}
+		days = n
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = s.opts.HistoryDefaultLimit
+	}
+	if limit > s.opts.HistoryMaxLimit {
+		limit = s.opts.HistoryMaxLimit
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	dirPrefixes := s.resolveDirPrefixes(r.URL.Query().Get("watchSet"))
+
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	files, err := s.dbFor(r).FindStaleFiles(cutoff, limit+1, offset, dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	hasMore := len(files) > limit
+	if hasMore {
+		files = files[:limit]
+	}
+	if files == nil {
+		files = []db.StaleFile{}
+	}
+
+	type staleFilesResponse struct {
+		Files   []db.StaleFile `json:"files"`
+		HasMore bool           `json:"hasMore"`
+	}
+	writeJSON(w, http.StatusOK, staleFilesResponse{
+		Files:   files,
+		HasMore: hasMore,
+	})
+}
+
 func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -172,15 +614,22 @@ func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(http.StatusOK)
-	flusher.Flush()
-
-	ch := make(chan string, 16)
+	// Registering and collecting the replay under one lock ensures no event
+	// is both replayed and delivered live, or missed in between.
+	ch := make(chan sseMessage, 16)
 	s.sseMu.Lock()
+	if s.opts.MaxSSEClients > 0 && len(s.sseClients) >= s.opts.MaxSSEClients {
+		s.sseMu.Unlock()
+		w.Header().Set("Retry-After", sseRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("too many event stream clients"))
+		return
+	}
 	s.sseClients[ch] = struct{}{}
+	var replay []sseMessage
+	refresh := false
+	if lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		replay, refresh = s.eventsSince(lastID)
+	}
 	s.sseMu.Unlock()
 
 	defer func() {
@@ -189,37 +638,87 @@ func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
 		s.sseMu.Unlock()
 	}()
 
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if refresh {
+		fmt.Fprintf(w, "data: %s\n\n", sseRefreshEvent)
+	}
+	for _, event := range replay {
+		writeSSEMessage(w, event)
+	}
+	flusher.Flush()
+
 	for {
 		select {
 		case <-r.Context().Done():
 			return
 		case event := <-ch:
-			fmt.Fprintf(w, "data: %s\n\n", event)
+			writeSSEMessage(w, event)
 			flusher.Flush()
 		}
 	}
 }
 
+// writeSSEMessage writes one event, with an id line unless it has none.
+func writeSSEMessage(w io.Writer, event sseMessage) {
+	if event.id == 0 {
+		fmt.Fprintf(w, "data: %s\n\n", event.data)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.id, event.data)
+}
+
+// eventsSince returns the buffered events after lastID, and whether some
+// events after lastID were already evicted (or lastID is from before a
+// restart) so the client should refresh. The caller must hold sseMu.
+func (s *Server) eventsSince(lastID uint64) ([]sseMessage, bool) {
+	if lastID > s.sseLastID {
+		return nil, true
+	}
+	if lastID == s.sseLastID {
+		return nil, false
+	}
+	oldest := s.sseBuffer[0].id
+	if lastID+1 < oldest {
+		return append([]sseMessage(nil), s.sseBuffer...), true
+	}
+	return append([]sseMessage(nil), s.sseBuffer[lastID+1-oldest:]...), false
+}
+
 func (s *Server) handleSearchFiles(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("q")
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
 	if limit <= 0 {
-		limit = 20
+		limit = s.opts.SearchDefaultLimit
 	}
-	if limit > 100 {
-		limit = 100
+	if limit > s.opts.SearchMaxLimit {
+		limit = s.opts.SearchMaxLimit
 	}
 	if offset < 0 {
 		offset = 0
 	}
+	order, err := fileOrder(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-	watchSetName := r.URL.Query().Get("watchSet")
-	dirPrefixes := s.resolveDirPrefixes(watchSetName)
-
-	files, err := s.db.SearchFiles(query, limit, offset, dirPrefixes)
+	// Filter by the watch set recorded at capture time; files saved before
+	// that was recorded fall back to the set's configured dir prefixes.
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	var files []db.File
+	if watchSetName := r.URL.Query().Get("watchSet"); watchSetName != "" {
+		files, err = s.dbFor(r).SearchFilesInWatchSetContext(ctx, query, limit, offset, watchSetName, s.resolveDirPrefixes(watchSetName), order, matchMode(r))
+	} else {
+		files, err = s.dbFor(r).SearchFilesContext(ctx, query, limit, offset, nil, order, matchMode(r))
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeQueryError(ctx, w, err)
 		return
 	}
 	if files == nil {
@@ -228,6 +727,19 @@ func (s *Server) handleSearchFiles(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, files)
 }
 
+func (s *Server) handleListDirectories(w http.ResponseWriter, r *http.Request) {
+	dirPrefixes := s.resolveDirPrefixes(r.URL.Query().Get("watchSet"))
+	dirs, err := s.dbFor(r).ListDirectories(dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if dirs == nil {
+		dirs = []string{}
+	}
+	writeJSON(w, http.StatusOK, dirs)
+}
+
 func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
 	id, err := parseUUID(r, "id")
 	if err != nil {
@@ -235,7 +747,7 @@ func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := s.db.GetFile(id)
+	file, err := s.dbFor(r).GetFile(id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
@@ -254,15 +766,51 @@ func (s *Server) handleGetSnapshots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	snapshots, err := s.db.GetSnapshots(id)
+	// Without any paging parameters the full list is returned as a plain
+	// array, as before; otherwise the response is wrapped with hasMore.
+	q := r.URL.Query()
+	paged := q.Has("limit") || q.Has("offset") || q.Has("from") || q.Has("to")
+
+	var sq db.SnapshotQuery
+	sq.Limit, _ = strconv.Atoi(q.Get("limit"))
+	sq.Offset, _ = strconv.Atoi(q.Get("offset"))
+	if sq.Offset < 0 {
+		sq.Offset = 0
+	}
+	sq.From, _ = strconv.ParseInt(q.Get("from"), 10, 64)
+	sq.To, _ = strconv.ParseInt(q.Get("to"), 10, 64)
+
+	limit := sq.Limit
+	if limit > 0 {
+		sq.Limit = limit + 1
+	}
+
+	snapshots, err := s.dbFor(r).QuerySnapshots(id, sq)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	hasMore := limit > 0 && len(snapshots) > limit
+	if hasMore {
+		snapshots = snapshots[:limit]
+	}
 	if snapshots == nil {
 		snapshots = []db.Snapshot{}
 	}
-	writeJSON(w, http.StatusOK, snapshots)
+
+	if !paged {
+		writeJSONFor(w, r, http.StatusOK, snapshots)
+		return
+	}
+
+	type snapshotsResponse struct {
+		Snapshots []db.Snapshot `json:"snapshots"`
+		HasMore   bool          `json:"hasMore"`
+	}
+	writeJSONFor(w, r, http.StatusOK, snapshotsResponse{
+		Snapshots: snapshots,
+		HasMore:   hasMore,
+	})
 }
 
 func (s *Server) handleGetRenames(w http.ResponseWriter, r *http.Request) {
@@ -272,110 +820,716 @@ func (s *Server) handleGetRenames(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	renames, err := s.db.GetRenames(id)
+	database := s.dbFor(r)
+	if _, err := database.GetFile(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = s.opts.HistoryDefaultLimit
+	}
+	if limit > s.opts.HistoryMaxLimit {
+		limit = s.opts.HistoryMaxLimit
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	renames, err := database.GetRenamesPage(id, limit+1, offset)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	hasMore := len(renames) > limit
+	if hasMore {
+		renames = renames[:limit]
+	}
 	if renames == nil {
 		renames = []db.Rename{}
 	}
-	writeJSON(w, http.StatusOK, renames)
+
+	type renamesResponse struct {
+		Renames []db.Rename `json:"renames"`
+		HasMore bool        `json:"hasMore"`
+	}
+	writeJSON(w, http.StatusOK, renamesResponse{Renames: renames, HasMore: hasMore})
 }
 
-func (s *Server) handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+// handleGetTimeline returns a file's snapshots and renames merged into one
+// list, newest first, in the same entry shape as /api/history.
+func (s *Server) handleGetTimeline(w http.ResponseWriter, r *http.Request) {
 	id, err := parseUUID(r, "id")
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	snapshot, err := s.db.GetSnapshot(id)
-	if err != nil {
+	database := s.dbFor(r)
+	if _, err := database.GetFile(id); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	type snapshotResponse struct {
-		ID        string `json:"id"`
-		FileID    string `json:"fileId"`
-		Content   string `json:"content"`
-		Size      int64  `json:"size"`
-		Hash      string `json:"hash"`
-		Timestamp int64  `json:"timestamp"`
+	entries, err := database.GetFileTimeline(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	writeJSON(w, http.StatusOK, snapshotResponse{
-		ID:        snapshot.ID,
-		FileID:    snapshot.FileID,
-		Content:   string(snapshot.Content),
-		Size:      snapshot.Size,
-		Hash:      snapshot.Hash,
-		Timestamp: snapshot.Timestamp,
-	})
+	s.redactEntries(entries)
+	if entries == nil {
+		entries = []db.HistoryEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
 }
 
-func (s *Server) handleDownloadSnapshot(w http.ResponseWriter, r *http.Request) {
+// handleLinkRename records a rename from file {id} to another tracked file,
+// given by toFileId or newPath, linking histories whose rename happened
+// while the daemon was not watching. It responds with the resulting lineage.
+func (s *Server) handleLinkRename(w http.ResponseWriter, r *http.Request) {
 	id, err := parseUUID(r, "id")
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	snapshot, err := s.db.GetSnapshot(id)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
+	var body struct {
+		ToFileID string `json:"toFileId"`
+		NewPath  string `json:"newPath"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
 		return
 	}
-
-	// Get the file to use its path for the filename
-	file, err := s.db.GetFile(snapshot.FileID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	if (body.ToFileID == "") == (body.NewPath == "") {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("exactly one of 'toFileId' or 'newPath' is required"))
 		return
 	}
 
-	filename := filepath.Base(file.Path)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(snapshot.Size, 10))
-	w.Write(snapshot.Content)
-}
-
-func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
-	toID, err := parseUUIDParam(r.URL.Query().Get("to"), "to")
+	database := s.dbFor(r)
+	from, err := database.GetFile(id)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	toSnap, err := s.db.GetSnapshot(toID)
+	var to db.File
+	if body.ToFileID != "" {
+		if !db.ValidID(body.ToFileID) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'toFileId': not a valid ID"))
+			return
+		}
+		to, err = database.GetFile(body.ToFileID)
+	} else {
+		to, err = database.GetFileByPath(body.NewPath)
+	}
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, fmt.Errorf("'to' snapshot not found"))
+			writeError(w, http.StatusNotFound, fmt.Errorf("target file not found"))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if to.ID == from.ID {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("cannot link a file to itself"))
+		return
+	}
 
-	file, err := s.db.GetFile(toSnap.FileID)
+	lineage, err := database.GetLineage(from.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	label := file.Path
-
+	if slices.ContainsFunc(lineage, func(rn db.Rename) bool {
+		return rn.OldFileID == to.ID || rn.NewFileID == to.ID
+	}) {
+		writeError(w, http.StatusConflict, fmt.Errorf("files are already linked"))
+		return
+	}
+
+	if _, err := database.SaveRename(from.Path, to.Path); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if lineage, err = database.GetLineage(from.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Notify(to.Path)
+
+	type linkRenameResponse struct {
+		FileID  string      `json:"fileId"`
+		Lineage []db.Rename `json:"lineage"`
+	}
+	writeJSON(w, http.StatusOK, linkRenameResponse{FileID: to.ID, Lineage: lineage})
+}
+
+// errAlreadyLatest is returned with 409 when a promoted snapshot's content
+// is already that of the file's latest snapshot.
+var errAlreadyLatest = errors.New("snapshot content is already the latest")
+
+// handlePromoteSnapshot saves the content of an older snapshot again as the
+// newest snapshot of its file, e.g. after restoring it on disk by hand. The
+// files on disk are not touched.
+func (s *Server) handlePromoteSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	database := s.dbFor(r)
+	snapshot, err := database.GetSnapshot(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if snapshot.Binary {
+		writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+		return
+	}
+	file, err := database.GetFile(snapshot.FileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	maxSnapshots := 0
+	for _, ws := range s.watchSets {
+		if ws.Name == file.WatchSet {
+			maxSnapshots = ws.MaxSnapshots
+			break
+		}
+	}
+	saved, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{{
+		FilePath:          file.Path,
+		Content:           snapshot.Content,
+		MaxSnapshots:      maxSnapshots,
+		WatchSet:          file.WatchSet,
+		Encoding:          snapshot.Encoding,
+		Origin:            "promote",
+		Truncated:         snapshot.Truncated,
+		IgnoreDedupWindow: true,
+	}})
+	if errs[0] != nil {
+		writeError(w, http.StatusInternalServerError, errs[0])
+		return
+	}
+	if !saved[0] {
+		writeError(w, http.StatusConflict, errAlreadyLatest)
+		return
+	}
+
+	latest, err := database.GetLatestSnapshot(file.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.Notify(file.Path)
+	writeJSON(w, http.StatusCreated, newSnapshotResponse(latest, false))
+}
+
+func (s *Server) handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	reveal, ok := s.revealRequested(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Has("offset") || q.Has("length") {
+		s.serveSnapshotRange(w, r, id, reveal)
+		return
+	}
+
+	// ?meta=1 skips loading and decompressing the content
+	meta := queryFlag(r, "meta")
+	var snapshot db.Snapshot
+	if meta {
+		snapshot, err = s.dbFor(r).GetSnapshotMeta(id)
+	} else {
+		snapshot, err = s.dbFor(r).GetSnapshot(id)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !reveal {
+		if err := s.redactSnapshot(s.dbFor(r), &snapshot); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSONFor(w, r, http.StatusOK, newSnapshotResponse(snapshot, !meta))
+}
+
+func (s *Server) handleGetLatestSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snapshot, err := s.dbFor(r).GetLatestSnapshot(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no snapshots for file"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.redactSnapshot(s.dbFor(r), &snapshot); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSONFor(w, r, http.StatusOK, newSnapshotResponse(snapshot, !queryFlag(r, "meta")))
+}
+
+// handleGetSnapshotAt returns the snapshot of ?path= that was current at
+// ?at= (unix seconds), for callers that know a path rather than an ID.
+// ?pathRaw= takes the path base64-encoded instead, for paths that are not
+// valid UTF-8.
+func (s *Server) handleGetSnapshotAt(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if raw := r.URL.Query().Get("pathRaw"); raw != "" {
+		b, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'pathRaw' parameter: must be base64"))
+			return
+		}
+		path = string(b)
+	}
+	if path == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing 'path' parameter"))
+		return
+	}
+	at, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'at' parameter: must be unix seconds"))
+		return
+	}
+
+	snapshot, err := s.dbFor(r).GetSnapshotAt(path, at)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no snapshot of file at or before that time"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.redactSnapshot(s.dbFor(r), &snapshot); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSONFor(w, r, http.StatusOK, newSnapshotResponse(snapshot, !queryFlag(r, "meta")))
+}
+
+func (s *Server) handleBlame(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	lines, err := s.dbFor(r).BlameFile(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no snapshots for file"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(s.redactors) > 0 && len(lines) > 0 {
+		file, err := s.dbFor(r).GetFile(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		redactPatterns := s.redactPatternsFor(file.WatchSet, file.Path)
+		for i := range lines {
+			lines[i].Text = redactString(lines[i].Text, redactPatterns)
+		}
+	}
+	if lines == nil {
+		lines = []db.BlameLine{}
+	}
+	writeJSON(w, http.StatusOK, lines)
+}
+
+// exportSnapshot is one snapshot in a file history export. Content that is
+// not valid UTF-8 is base64-encoded and marked with ContentEncoding.
+type exportSnapshot struct {
+	ID              string `json:"id"`
+	Timestamp       int64  `json:"timestamp"`
+	Size            int64  `json:"size"`
+	Hash            string `json:"hash"`
+	Content         string `json:"content"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Binary          bool   `json:"binary,omitempty"`
+	Truncated       bool   `json:"truncated,omitempty"`
+}
+
+// handleExportFile streams a file's complete history as one JSON document:
+// {file, renames, snapshots}, with snapshots oldest first and their content
+// inlined. Snapshots are loaded and written one at a time so memory use does
+// not grow with the number of versions. Errors after the response has
+// started can only be logged; the truncated document signals the failure.
+func (s *Server) handleExportFile(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	database := s.dbFor(r)
+	file, err := database.GetFile(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	redactPatterns := s.redactPatternsFor(file.WatchSet, file.Path)
+	snapshots, err := database.GetSnapshots(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renames, err := database.GetRenames(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if renames == nil {
+		renames = []db.Rename{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", contentDisposition(filepath.Base(file.Path)+".history.json"))
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	write := func(v any) bool {
+		if err := enc.Encode(v); err != nil {
+			s.opts.Logger.Error("error streaming export", "id", id, "err", err)
+			return false
+		}
+		return true
+	}
+
+	io.WriteString(w, `{"file":`)
+	if !write(file) {
+		return
+	}
+	io.WriteString(w, `,"renames":`)
+	if !write(renames) {
+		return
+	}
+	io.WriteString(w, `,"snapshots":[`)
+	flusher, _ := w.(http.Flusher)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snap, err := database.GetSnapshot(snapshots[i].ID)
+		if err != nil {
+			s.opts.Logger.Error("error streaming export", "id", id, "err", err)
+			return
+		}
+		snap.Content = redact(snap.Content, redactPatterns)
+		entry := exportSnapshot{
+			ID:        snap.ID,
+			Timestamp: snap.Timestamp,
+			Size:      snap.Size,
+			Hash:      snap.Hash,
+			Binary:    snap.Binary,
+			Truncated: snap.Truncated,
+		}
+		if utf8.Valid(snap.Content) {
+			entry.Content = string(snap.Content)
+		} else {
+			entry.Content = base64.StdEncoding.EncodeToString(snap.Content)
+			entry.ContentEncoding = "base64"
+		}
+		if i < len(snapshots)-1 {
+			io.WriteString(w, ",")
+		}
+		if !write(entry) {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	io.WriteString(w, "]}\n")
+}
+
+// snapshotResponse is a snapshot with its content as a string. Content is
+// nil (and omitted) for metadata-only responses.
+type snapshotResponse struct {
+	ID        string  `json:"id"`
+	FileID    string  `json:"fileId"`
+	Content   *string `json:"content,omitempty"`
+	Size      int64   `json:"size"`
+	Hash      string  `json:"hash"`
+	Timestamp int64   `json:"timestamp"`
+	LineCount int     `json:"lineCount"`
+	Binary    bool    `json:"binary"`
+	Truncated bool    `json:"truncated"` // content is only part of the file
+}
+
+// snapshotRangeResponse is a snapshot with only part of its content.
+type snapshotRangeResponse struct {
+	snapshotResponse
+	Offset    int `json:"offset"`
+	Length    int `json:"length"`    // bytes of content returned
+	TotalSize int `json:"totalSize"` // bytes of the whole stored content
+}
+
+// serveSnapshotRange answers /api/snapshots/{id}?offset=&length= with
+// length bytes of the content starting at offset (to the end when length
+// is omitted). The end is moved back to a UTF-8 character boundary when
+// that leaves something to return, so paging by offset+length never splits
+// a character. An offset past the content is answered 416. Offsets refer to
+// the redacted content unless reveal is set.
+func (s *Server) serveSnapshotRange(w http.ResponseWriter, r *http.Request, id string, reveal bool) {
+	q := r.URL.Query()
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'offset' parameter: must be a non-negative integer"))
+			return
+		}
+		offset = n
+	}
+	length := -1
+	if v := q.Get("length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'length' parameter: must be a positive integer"))
+			return
+		}
+		length = n
+	}
+
+	snapshot, err := s.dbFor(r).GetSnapshot(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !reveal {
+		if err := s.redactSnapshot(s.dbFor(r), &snapshot); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	total := len(snapshot.Content)
+	if offset > total || offset == total && total > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("offset %d is beyond the content size %d", offset, total))
+		return
+	}
+	end := total
+	if length >= 0 && length < total-offset {
+		end = alignRuneEnd(snapshot.Content, offset, offset+length)
+	}
+	snapshot.Content = snapshot.Content[offset:end]
+
+	writeJSONFor(w, r, http.StatusOK, snapshotRangeResponse{
+		snapshotResponse: newSnapshotResponse(snapshot, true),
+		Offset:           offset,
+		Length:           end - offset,
+		TotalSize:        total,
+	})
+}
+
+// alignRuneEnd returns end moved back to the start of a UTF-8 character
+// that content[start:end] would cut, or end unchanged if it is already on a
+// boundary or moving it would leave nothing after start.
+func alignRuneEnd(content []byte, start, end int) int {
+	for i := end; i > start && end-i < utf8.UTFMax; i-- {
+		if utf8.RuneStart(content[i]) {
+			return i
+		}
+	}
+	return end
+}
+
+func newSnapshotResponse(snapshot db.Snapshot, withContent bool) snapshotResponse {
+	var content *string
+	if withContent {
+		s := string(snapshot.Content)
+		content = &s
+	}
+	return snapshotResponse{
+		ID:        snapshot.ID,
+		FileID:    snapshot.FileID,
+		Content:   content,
+		Size:      snapshot.Size,
+		Hash:      snapshot.Hash,
+		Timestamp: snapshot.Timestamp,
+		LineCount: snapshot.LineCount,
+		Binary:    snapshot.Binary,
+		Truncated: snapshot.Truncated,
+	}
+}
+
+// errBinarySnapshot is returned with 422 when text is requested from a
+// metadata-only binary snapshot.
+var errBinarySnapshot = errors.New("binary snapshot has no text content")
+
+// errBinaryLiveFile is returned with 422 when a live diff finds binary
+// content on disk.
+var errBinaryLiveFile = errors.New("live file is binary")
+
+func (s *Server) handleDownloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	reveal, ok := s.revealRequested(w, r)
+	if !ok {
+		return
+	}
+
+	snapshot, err := s.dbFor(r).GetSnapshot(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if snapshot.Binary {
+		writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+		return
+	}
+
+	// Get the file to use its path for the filename
+	file, err := s.dbFor(r).GetFile(snapshot.FileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !reveal {
+		snapshot.Content = redact(snapshot.Content, s.redactPatternsFor(file.WatchSet, file.Path))
+	}
+
+	// Restore the original bytes of files stored transcoded to UTF-8
+	content, err := textenc.FromUTF8(snapshot.Encoding, snapshot.Content)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", contentDisposition(filepath.Base(file.Path)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if snapshot.Truncated {
+		w.Header().Set("X-Content-Truncated", "true")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Write(content)
+}
+
+func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
+	toID, err := parseUUIDParam(r.URL.Query().Get("to"), "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// format=html returns the diff as an HTML fragment instead of JSON
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "html" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	type diffResponse struct {
+		Diff      string `json:"diff"`
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Identical bool   `json:"identical"`
+		Truncated bool   `json:"truncated,omitempty"` // computed without semantic cleanup
+		// ContentTruncated is set when either side stores only part of
+		// its file (maxStoredBytes).
+		ContentTruncated bool `json:"contentTruncated,omitempty"`
+		// Suppressed is set instead of Diff when an initial diff would be
+		// larger than MaxInitialDiffBytes; AddedLines and Size describe it.
+		Suppressed bool  `json:"suppressed,omitempty"`
+		AddedLines int   `json:"addedLines,omitempty"`
+		Size       int64 `json:"size,omitempty"`
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	database := s.dbFor(r)
+
+	toMeta, err := database.GetSnapshotMetaContext(ctx, toID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("'to' snapshot not found"))
+			return
+		}
+		writeQueryError(ctx, w, err)
+		return
+	}
+	if toMeta.Binary {
+		writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+		return
+	}
+
+	file, err := database.GetFileContext(ctx, toMeta.FileID)
+	if err != nil {
+		writeQueryError(ctx, w, err)
+		return
+	}
+	toLabel, fromLabel := file.Path, file.Path
+	contentTruncated := toMeta.Truncated
+
 	// 'from' is optional: when omitted, compare against empty content (initial snapshot)
 	var fromContent string
 	var fromID string
+	large := s.opts.MaxDiffBytes > 0 && toMeta.Size > s.opts.MaxDiffBytes
 	fromParam := r.URL.Query().Get("from")
 	if fromParam != "" {
 		var parseErr error
@@ -385,53 +1539,498 @@ func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		fromSnap, snapErr := s.db.GetSnapshot(fromID)
-		if snapErr != nil {
-			if errors.Is(snapErr, sql.ErrNoRows) {
-				writeError(w, http.StatusNotFound, fmt.Errorf("'from' snapshot not found"))
-				return
-			}
-			writeError(w, http.StatusInternalServerError, snapErr)
+		fromMeta, snapErr := database.GetSnapshotMetaContext(ctx, fromID)
+		if snapErr != nil {
+			if errors.Is(snapErr, sql.ErrNoRows) {
+				writeError(w, http.StatusNotFound, fmt.Errorf("'from' snapshot not found"))
+				return
+			}
+			writeQueryError(ctx, w, snapErr)
+			return
+		}
+		if fromMeta.Binary {
+			writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+			return
+		}
+		large = large || (s.opts.MaxDiffBytes > 0 && fromMeta.Size > s.opts.MaxDiffBytes)
+		contentTruncated = contentTruncated || fromMeta.Truncated
+		// Label and redact each side by its own file, so a diff across a
+		// rename or between watch sets shows and hides the right things
+		fromFile, snapErr := snapshotFile(ctx, database, fromMeta, file)
+		if snapErr != nil {
+			writeQueryError(ctx, w, snapErr)
+			return
+		}
+		fromLabel = fromFile.Path
+		// Same content hash: skip decompressing both blobs
+		if fromMeta.Hash == toMeta.Hash {
+			if format == "html" {
+				writeHTMLDiff(w, "")
+				return
+			}
+			writeJSON(w, http.StatusOK, diffResponse{From: fromID, To: toID, Identical: true, ContentTruncated: contentTruncated})
+			return
+		}
+
+		fromSnap, snapErr := database.GetSnapshotContext(ctx, fromID)
+		if snapErr != nil {
+			writeQueryError(ctx, w, snapErr)
+			return
+		}
+		fromContent = redactString(string(fromSnap.Content), s.redactPatternsFor(fromFile.WatchSet, fromFile.Path))
+	}
+
+	// An initial diff repeats the whole file as additions; past the limit
+	// only its size is reported and the client downloads the content.
+	suppress := fromParam == "" && s.opts.MaxInitialDiffBytes > 0 && toMeta.Size > s.opts.MaxInitialDiffBytes
+	if suppress && format == "html" {
+		w.Header().Set("X-Diff-Suppressed", "true")
+		writeHTMLDiff(w, "")
+		return
+	}
+	if suppress && toMeta.LineCount >= 0 {
+		writeJSON(w, http.StatusOK, diffResponse{
+			To: toID, Suppressed: true, AddedLines: toMeta.LineCount, Size: toMeta.Size, ContentTruncated: contentTruncated,
+		})
+		return
+	}
+
+	toSnap, err := database.GetSnapshotContext(ctx, toID)
+	if err != nil {
+		writeQueryError(ctx, w, err)
+		return
+	}
+	if suppress {
+		// Recorded before line counts were stored
+		addedLines := bytes.Count(toSnap.Content, []byte{'\n'})
+		if len(toSnap.Content) > 0 && toSnap.Content[len(toSnap.Content)-1] != '\n' {
+			addedLines++
+		}
+		writeJSON(w, http.StatusOK, diffResponse{
+			To: toID, Suppressed: true, AddedLines: addedLines, Size: toMeta.Size, ContentTruncated: contentTruncated,
+		})
+		return
+	}
+
+	diffFunc := diff.UnifiedDiff
+	if large {
+		diffFunc = diff.UnifiedLineDiff
+	}
+	unifiedDiff := diffFunc(fromContent, redactString(string(toSnap.Content), s.redactPatternsFor(file.WatchSet, file.Path)), fromLabel, toLabel)
+	if format == "html" {
+		if large {
+			w.Header().Set("X-Diff-Truncated", "true")
+		}
+		if contentTruncated {
+			w.Header().Set("X-Content-Truncated", "true")
+		}
+		writeHTMLDiff(w, unifiedDiff)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diffResponse{
+		Diff:             unifiedDiff,
+		From:             fromID,
+		To:               toID,
+		Identical:        unifiedDiff == "",
+		Truncated:        large,
+		ContentTruncated: contentTruncated,
+	})
+}
+
+// handleDiffBack diffs a file's latest snapshot against the one 'back'
+// versions earlier (default 1). 'back' is clamped to the available history
+// and the offset actually used is reported in the response.
+func (s *Server) handleDiffBack(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	back := 1
+	if v := r.URL.Query().Get("back"); v != "" {
+		back, err = strconv.Atoi(v)
+		if err != nil || back < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'back' parameter: must be a positive integer"))
+			return
+		}
+	}
+
+	database := s.dbFor(r)
+	file, err := database.GetFile(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Newest first, so index i is i versions before the latest
+	snapshots, err := database.QuerySnapshots(id, db.SnapshotQuery{Limit: back + 1})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(snapshots) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file has no snapshots"))
+		return
+	}
+	back = min(back, len(snapshots)-1)
+
+	toSnap, ok := s.fetchSnapshot(w, r, snapshots[0].ID, "'to' snapshot not found")
+	if !ok {
+		return
+	}
+	fromSnap, ok := s.fetchSnapshot(w, r, snapshots[back].ID, "'from' snapshot not found")
+	if !ok {
+		return
+	}
+
+	diffFunc := diff.UnifiedDiff
+	large := s.opts.MaxDiffBytes > 0 && (fromSnap.Size > s.opts.MaxDiffBytes || toSnap.Size > s.opts.MaxDiffBytes)
+	if large {
+		diffFunc = diff.UnifiedLineDiff
+	}
+	redactPatterns := s.redactPatternsFor(file.WatchSet, file.Path)
+	unifiedDiff := diffFunc(redactString(string(fromSnap.Content), redactPatterns), redactString(string(toSnap.Content), redactPatterns), file.Path, file.Path)
+
+	type diffBackResponse struct {
+		Diff      string `json:"diff"`
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Back      int    `json:"back"` // offset used after clamping
+		Identical bool   `json:"identical"`
+		Truncated bool   `json:"truncated,omitempty"`
+		// ContentTruncated is set when either side stores only part of its
+		// file (maxStoredBytes).
+		ContentTruncated bool `json:"contentTruncated,omitempty"`
+	}
+	writeJSON(w, http.StatusOK, diffBackResponse{
+		Diff:             unifiedDiff,
+		From:             fromSnap.ID,
+		To:               toSnap.ID,
+		Back:             back,
+		Identical:        unifiedDiff == "",
+		Truncated:        large,
+		ContentTruncated: fromSnap.Truncated || toSnap.Truncated,
+	})
+}
+
+// snapshotFile returns the file record snapshot belongs to. A rename creates
+// a new file record for the new path and records never change path, so its
+// Path is the path the file had when snapshot was taken; known is reused
+// when it is that record.
+func snapshotFile(ctx context.Context, database *db.DB, snapshot db.Snapshot, known db.File) (db.File, error) {
+	if snapshot.FileID == known.ID {
+		return known, nil
+	}
+	return database.GetFileContext(ctx, snapshot.FileID)
+}
+
+// writeHTMLDiff writes a unified diff as an escaped HTML fragment.
+func writeHTMLDiff(w http.ResponseWriter, unifiedDiff string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, diff.HTMLFragment(unifiedDiff))
+}
+
+// handleCompare returns both snapshot contents, their metadata, and the
+// unified diff in one response. As with handleDiff, 'from' is optional and
+// an omitted 'from' compares against empty content.
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	toID, err := parseUUIDParam(r.URL.Query().Get("to"), "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	toSnap, ok := s.fetchSnapshot(w, r, toID, "'to' snapshot not found")
+	if !ok {
+		return
+	}
+
+	var fromMeta *db.Snapshot
+	var fromContent string
+	if fromParam := r.URL.Query().Get("from"); fromParam != "" {
+		fromID, err := parseUUIDParam(fromParam, "from")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		fromSnap, ok := s.fetchSnapshot(w, r, fromID, "'from' snapshot not found")
+		if !ok {
+			return
+		}
+		fromMeta = &fromSnap
+		fromContent = string(fromSnap.Content)
+	}
+
+	file, err := s.dbFor(r).GetFile(toSnap.FileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fromFile := file
+	if fromMeta != nil {
+		if fromFile, err = snapshotFile(r.Context(), s.dbFor(r), *fromMeta, file); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	fromContent = redactString(fromContent, s.redactPatternsFor(fromFile.WatchSet, fromFile.Path))
+	toContent := redactString(string(toSnap.Content), s.redactPatternsFor(file.WatchSet, file.Path))
+
+	diffFunc := diff.UnifiedDiff
+	large := s.opts.MaxDiffBytes > 0 && (toSnap.Size > s.opts.MaxDiffBytes || fromMeta != nil && fromMeta.Size > s.opts.MaxDiffBytes)
+	if large {
+		diffFunc = diff.UnifiedLineDiff
+	}
+
+	type compareResponse struct {
+		FromContent string       `json:"fromContent"`
+		ToContent   string       `json:"toContent"`
+		Diff        string       `json:"diff"`
+		Truncated   bool         `json:"truncated,omitempty"` // computed without semantic cleanup
+		FromMeta    *db.Snapshot `json:"fromMeta"`
+		ToMeta      db.Snapshot  `json:"toMeta"`
+	}
+	writeJSON(w, http.StatusOK, compareResponse{
+		FromContent: fromContent,
+		ToContent:   toContent,
+		Diff:        diffFunc(fromContent, toContent, fromFile.Path, file.Path),
+		Truncated:   large,
+		FromMeta:    fromMeta,
+		ToMeta:      toSnap,
+	})
+}
+
+// fetchSnapshot loads a snapshot with content, writing a 404 with notFoundMsg,
+// a 422 for binary snapshots, or a 500 to w on failure. It reports whether the
+// snapshot was loaded.
+func (s *Server) fetchSnapshot(w http.ResponseWriter, r *http.Request, id, notFoundMsg string) (db.Snapshot, bool) {
+	snapshot, err := s.dbFor(r).GetSnapshot(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New(notFoundMsg))
+			return db.Snapshot{}, false
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return db.Snapshot{}, false
+	}
+	if snapshot.Binary {
+		writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+		return db.Snapshot{}, false
+	}
+	return snapshot, true
+}
+
+// handleDiffLive diffs a snapshot against the file's current on-disk content.
+// The live side is read from the latest path of the file (following renames);
+// if it no longer exists, the live side is treated as empty.
+func (s *Server) handleDiffLive(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	fromID, err := parseUUIDParam(r.URL.Query().Get("from"), "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	file, err := s.dbFor(r).GetFile(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	fromSnap, err := s.dbFor(r).GetSnapshot(fromID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("'from' snapshot not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if fromSnap.Binary {
+		writeError(w, http.StatusUnprocessableEntity, errBinarySnapshot)
+		return
+	}
+	// 'from' must be a version of this file, possibly under an earlier or
+	// later name
+	if fromSnap.FileID != id {
+		lineage, err := s.dbFor(r).GetLineage(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !slices.ContainsFunc(lineage, func(rn db.Rename) bool {
+			return rn.OldFileID == fromSnap.FileID || rn.NewFileID == fromSnap.FileID
+		}) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("'from' snapshot not found"))
 			return
 		}
-		fromContent = string(fromSnap.Content)
 	}
 
-	unifiedDiff := diff.UnifiedDiff(fromContent, string(toSnap.Content), label, label)
+	livePath, err := s.dbFor(r).ResolveLatestPath(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	type diffResponse struct {
-		Diff string `json:"diff"`
-		From string `json:"from"`
-		To   string `json:"to"`
+	// Each side is redacted by the rules of its own file: the snapshot's
+	// record and the record at the latest path
+	fromFile, err := snapshotFile(r.Context(), s.dbFor(r), fromSnap, file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	writeJSON(w, http.StatusOK, diffResponse{
-		Diff: unifiedDiff,
-		From: fromID,
-		To:   toID,
+	liveFile := file
+	if livePath != file.Path {
+		if liveFile, err = s.dbFor(r).GetFileByPath(livePath); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// The live file is read within the limits its WatchSet applies when
+	// taking snapshots
+	ws, _ := s.watchSetFor(liveFile.WatchSet, livePath)
+	if ws.MaxFileSize <= 0 {
+		ws.MaxFileSize = config.DefaultMaxFileSize
+	}
+	deleted := false
+	var liveContent []byte
+	info, err := os.Stat(livePath)
+	if err == nil && info.Size() > ws.MaxFileSize {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("live file is larger than maxFileSize (%d bytes)", ws.MaxFileSize))
+		return
+	}
+	if err == nil {
+		liveContent, err = os.ReadFile(livePath)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("reading live file: %w", err))
+			return
+		}
+		deleted = true
+	}
+	// BOM-prefixed UTF-16 is compared as the UTF-8 it is stored as
+	if ws.DetectEncoding || fromSnap.Encoding != "" {
+		if enc := textenc.Detect(liveContent); enc != "" {
+			if liveContent, err = textenc.ToUTF8(enc, liveContent); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("decoding live file: %w", err))
+				return
+			}
+		}
+	}
+	if textenc.IsBinary(liveContent) {
+		writeError(w, http.StatusUnprocessableEntity, errBinaryLiveFile)
+		return
+	}
+	diffFunc := diff.UnifiedDiff
+	large := s.opts.MaxDiffBytes > 0 && (fromSnap.Size > s.opts.MaxDiffBytes || int64(len(liveContent)) > s.opts.MaxDiffBytes)
+	if large {
+		diffFunc = diff.UnifiedLineDiff
+	}
+	unifiedDiff := diffFunc(
+		redactString(string(fromSnap.Content), s.redactPatternsFor(fromFile.WatchSet, fromFile.Path)),
+		redactString(string(liveContent), s.redactPatternsFor(liveFile.WatchSet, liveFile.Path)),
+		fromFile.Path, livePath)
+
+	type diffLiveResponse struct {
+		Diff      string `json:"diff"`
+		From      string `json:"from"`
+		LivePath  string `json:"livePath"`
+		Deleted   bool   `json:"deleted"`
+		Truncated bool   `json:"truncated,omitempty"` // computed without semantic cleanup
+	}
+	writeJSON(w, http.StatusOK, diffLiveResponse{
+		Diff:      unifiedDiff,
+		From:      fromID,
+		LivePath:  livePath,
+		Deleted:   deleted,
+		Truncated: large,
 	})
 }
 
-// watchSetInfo represents a WatchSet in the stats API response.
+// watchSetInfo represents a WatchSet in the stats API response,
+// including the storage used by files under its dirs.
 type watchSetInfo struct {
-	Name string   `json:"name"`
-	Dirs []string `json:"dirs"`
+	Name           string   `json:"name"`
+	Dirs           []string `json:"dirs"`
+	TotalFiles     int      `json:"totalFiles"`
+	TotalSnapshots int      `json:"totalSnapshots"`
+	TotalSize      int64    `json:"totalSize"`
+}
+
+// SetConfigError records the result of a config reload for /api/health.
+// A non-nil err means the reload was rejected and the previous config is
+// still in effect; nil clears an earlier error.
+func (s *Server) SetConfigError(err error) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.configErr = err
+	s.configAt = time.Now()
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	type healthResponse struct {
+		Status        string `json:"status"`
+		ConfigError   string `json:"configError,omitempty"`
+		ConfigErrorAt int64  `json:"configErrorAt,omitempty"`
+		// InFlightRequests includes this request; SSEClients counts the
+		// open /api/events streams, which are not part of it.
+		InFlightRequests int64 `json:"inFlightRequests"`
+		SSEClients       int   `json:"sseClients"`
+	}
+	resp := healthResponse{Status: "ok", InFlightRequests: s.inFlight.Load()}
+	s.sseMu.Lock()
+	resp.SSEClients = len(s.sseClients)
+	s.sseMu.Unlock()
+	s.configMu.Lock()
+	if s.configErr != nil {
+		resp.ConfigError = s.configErr.Error()
+		resp.ConfigErrorAt = s.configAt.Unix()
+	}
+	s.configMu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	watchSetName := r.URL.Query().Get("watchSet")
 	dirPrefixes := s.resolveDirPrefixes(watchSetName)
 
-	stats, err := s.db.GetStats(dirPrefixes)
+	database := s.dbFor(r)
+	stats, err := database.GetStats(dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	dbSize, err := database.UsedSize()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 	type statsResponse struct {
-		TotalFiles     int            `json:"totalFiles"`
-		TotalSnapshots int            `json:"totalSnapshots"`
-		TotalSize      int64          `json:"totalSize"`
-		WatchDirs      []string       `json:"watchDirs"`
-		WatchSets      []watchSetInfo `json:"watchSets"`
+		TotalFiles      int            `json:"totalFiles"`
+		TotalSnapshots  int            `json:"totalSnapshots"`
+		TotalSize       int64          `json:"totalSize"`
+		TotalRenames    int            `json:"totalRenames"`
+		DatabaseSize    int64          `json:"databaseSize"`
+		MaxDatabaseSize int64          `json:"maxDatabaseSize"`
+		WatchDirs       []string       `json:"watchDirs"`
+		WatchSets       []watchSetInfo `json:"watchSets"`
+		Watcher         *WatchStats    `json:"watcher,omitempty"`
 	}
 	dirs := s.watchDirs
 	if dirs == nil {
@@ -439,17 +2038,163 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	}
 	wsInfos := make([]watchSetInfo, len(s.watchSets))
 	for i, ws := range s.watchSets {
-		wsInfos[i] = watchSetInfo{Name: ws.Name, Dirs: ws.Dirs}
+		wsStats, err := s.watchSetDB(ws.Name).GetStats(ws.Dirs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		wsInfos[i] = watchSetInfo{
+			Name:           ws.Name,
+			Dirs:           ws.Dirs,
+			TotalFiles:     wsStats.TotalFiles,
+			TotalSnapshots: wsStats.TotalSnapshots,
+			TotalSize:      wsStats.TotalSize,
+		}
+	}
+	var watchStats *WatchStats
+	if s.opts.WatchStats != nil {
+		ws := s.opts.WatchStats()
+		watchStats = &ws
 	}
 	writeJSON(w, http.StatusOK, statsResponse{
-		TotalFiles:     stats.TotalFiles,
-		TotalSnapshots: stats.TotalSnapshots,
-		TotalSize:      stats.TotalSize,
-		WatchDirs:      dirs,
-		WatchSets:      wsInfos,
+		TotalFiles:      stats.TotalFiles,
+		TotalSnapshots:  stats.TotalSnapshots,
+		TotalSize:       stats.TotalSize,
+		TotalRenames:    stats.TotalRenames,
+		DatabaseSize:    dbSize,
+		MaxDatabaseSize: database.SizeLimit(),
+		WatchDirs:       dirs,
+		WatchSets:       wsInfos,
+		Watcher:         watchStats,
 	})
 }
 
+// handleCompressionStats reports how much space compression saves for the
+// stored snapshot content.
+func (s *Server) handleCompressionStats(w http.ResponseWriter, r *http.Request) {
+	dirPrefixes := s.resolveDirPrefixes(r.URL.Query().Get("watchSet"))
+	stats, err := s.dbFor(r).CompressionStats(dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleExtensionStats reports snapshot counts and sizes per file extension.
+func (s *Server) handleExtensionStats(w http.ResponseWriter, r *http.Request) {
+	dirPrefixes := s.resolveDirPrefixes(r.URL.Query().Get("watchSet"))
+	stats, err := s.dbFor(r).StatsByExtension(dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// maxActivityBuckets caps how many buckets one /api/activity request may
+// span, so a tiny bucket over a long range cannot build a huge response.
+const maxActivityBuckets = 10000
+
+// handleActivity returns snapshot and rename counts per time bucket over
+// [from, to). bucket defaults to one day, to to just after now and from to
+// 30 buckets before to.
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bucket := 86400
+	if v := q.Get("bucket"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'bucket' parameter: must be a positive number of seconds"))
+			return
+		}
+		bucket = n
+	}
+	to := time.Now().Unix() + 1
+	if v := q.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'to' parameter: must be a unix timestamp"))
+			return
+		}
+		to = n
+	}
+	from := max(to-30*int64(bucket), 0)
+	if v := q.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'from' parameter: must be a unix timestamp"))
+			return
+		}
+		from = n
+	}
+	if from >= to {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("'from' must be before 'to'"))
+		return
+	}
+	if (to-from)/int64(bucket) >= maxActivityBuckets {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("range spans more than %d buckets", maxActivityBuckets))
+		return
+	}
+
+	dirPrefixes := s.resolveDirPrefixes(q.Get("watchSet"))
+	buckets, err := s.dbFor(r).ActivityHistogram(bucket, from, to, dirPrefixes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if buckets == nil {
+		buckets = []db.ActivityBucket{}
+	}
+
+	type activityResponse struct {
+		Bucket  int                 `json:"bucket"`
+		From    int64               `json:"from"`
+		To      int64               `json:"to"`
+		Buckets []db.ActivityBucket `json:"buckets"`
+	}
+	writeJSON(w, http.StatusOK, activityResponse{Bucket: bucket, From: from, To: to, Buckets: buckets})
+}
+
+// watchSetDB returns the database holding the named WatchSet's history.
+func (s *Server) watchSetDB(watchSetName string) *db.DB {
+	if database, ok := s.opts.WatchSetDBs[watchSetName]; ok {
+		return database
+	}
+	return s.db
+}
+
+// dbFor returns the database a request is scoped to: the database of the
+// WatchSet given by the watchSet query parameter, or the main database.
+// Requests for sets with their own database must pass watchSet, including
+// lookups by file or snapshot ID.
+func (s *Server) dbFor(r *http.Request) *db.DB {
+	return s.watchSetDB(r.URL.Query().Get("watchSet"))
+}
+
+// watchSetFor returns the configured WatchSet of a file recorded with the
+// named set, or for files recorded without one, the set with the longest
+// dir containing path. It reports false when no set matches.
+func (s *Server) watchSetFor(watchSet, path string) (config.WatchSet, bool) {
+	var best config.WatchSet
+	bestLen := -1
+	for _, ws := range s.watchSets {
+		if watchSet != "" {
+			if ws.Name == watchSet {
+				return ws, true
+			}
+			continue
+		}
+		for _, dir := range ws.Dirs {
+			dir = filepath.Clean(dir)
+			if (path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))) && len(dir) > bestLen {
+				best, bestLen = ws, len(dir)
+			}
+		}
+	}
+	return best, bestLen >= 0
+}
+
 // resolveDirPrefixes returns the dir prefixes for a given watchSet name.
 // Returns nil (no filter) if name is empty.
 // Returns the matching WatchSet's dirs if found.
@@ -465,10 +2210,83 @@ func (s *Server) resolveDirPrefixes(watchSetName string) []string {
 	return nil
 }
 
+// dbDownload is a database copy shared by concurrent download requests.
+// The copy is removed once the last request using it has finished.
+type dbDownload struct {
+	done chan struct{} // closed once path/err are set
+	path string
+	err  error
+	refs int
+}
+
+// acquireDownload returns the in-progress copy of database, starting one in
+// tmpDir if none exists. ok is false when another download is running and
+// concurrent downloads are rejected. Callers must releaseDownload after use.
+func (s *Server) acquireDownload(database *db.DB, tmpDir string) (dl *dbDownload, ok bool) {
+	s.downloadMu.Lock()
+	dl, running := s.downloads[database]
+	if running {
+		if s.opts.RejectConcurrentDownloads {
+			s.downloadMu.Unlock()
+			return nil, false
+		}
+		dl.refs++
+		s.downloadMu.Unlock()
+		<-dl.done
+		return dl, true
+	}
+	dl = &dbDownload{done: make(chan struct{}), refs: 1}
+	s.downloads[database] = dl
+	s.downloadMu.Unlock()
+
+	dl.path, dl.err = database.CreateDatabaseSnapshot(tmpDir)
+	close(dl.done)
+	return dl, true
+}
+
+// releaseDownload drops a reference to dl, deleting the copy when unused.
+func (s *Server) releaseDownload(database *db.DB, dl *dbDownload) {
+	s.downloadMu.Lock()
+	defer s.downloadMu.Unlock()
+	dl.refs--
+	if dl.refs > 0 {
+		return
+	}
+	delete(s.downloads, database)
+	if dl.path != "" {
+		os.Remove(dl.path)
+	}
+}
+
+// snapshotTmpDir returns the directory for the download copy of the
+// database behind watchSetName.
+func (s *Server) snapshotTmpDir(watchSetName string) string {
+	if watchSetName != "" {
+		for _, ws := range s.watchSets {
+			if ws.Name == watchSetName && ws.SnapshotTmpDir != "" {
+				return ws.SnapshotTmpDir
+			}
+		}
+	}
+	if s.opts.SnapshotTmpDir != "" {
+		return s.opts.SnapshotTmpDir
+	}
+	return os.TempDir()
+}
+
 func (s *Server) handleDatabaseDownload(w http.ResponseWriter, r *http.Request) {
-	tmpDir := os.TempDir()
-	snapshotPath, err := s.db.CreateDatabaseSnapshot(tmpDir)
-	if err != nil {
+	if s.refuseHeavyOp(w) {
+		return
+	}
+	database := s.dbFor(r)
+	dl, ok := s.acquireDownload(database, s.snapshotTmpDir(r.URL.Query().Get("watchSet")))
+	if !ok {
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("a database download is already in progress"))
+		return
+	}
+	defer s.releaseDownload(database, dl)
+
+	if err := dl.err; err != nil {
 		if strings.Contains(err.Error(), "insufficient disk space") {
 			writeError(w, http.StatusInsufficientStorage, err)
 			return
@@ -476,9 +2294,8 @@ func (s *Server) handleDatabaseDownload(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer os.Remove(snapshotPath)
 
-	f, err := os.Open(snapshotPath)
+	f, err := os.Open(dl.path)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("open snapshot file: %w", err))
 		return
@@ -492,12 +2309,35 @@ func (s *Server) handleDatabaseDownload(w http.ResponseWriter, r *http.Request)
 	}
 
 	filename := fmt.Sprintf("history-%s.db", time.Now().Format("20060102-150405"))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if queryFlag(r, "gzip") {
+		s.serveGzipped(w, filename+".gz", f)
+		return
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(filename))
 	w.Header().Set("Content-Type", "application/x-sqlite3")
 
 	http.ServeContent(w, r, filename, fi.ModTime(), f)
 }
 
+// serveGzipped streams src to w through gzip as an attachment named
+// filename. The compressed size is unknown up front, so the response is
+// chunked and ranges are not supported.
+func (s *Server) serveGzipped(w http.ResponseWriter, filename string, src io.Reader) {
+	w.Header().Set("Content-Disposition", contentDisposition(filename))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, src); err != nil {
+		// Headers are already sent; the client sees a truncated stream.
+		s.opts.Logger.Warn("gzip database download failed", "err", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		s.opts.Logger.Warn("gzip database download failed", "err", err)
+	}
+}
+
 func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	id, err := parseUUID(r, "id")
 	if err != nil {
@@ -505,7 +2345,11 @@ func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.DeleteFile(id); err != nil {
+	remove := s.dbFor(r).DeleteFile
+	if s.opts.TrashFiles {
+		remove = s.dbFor(r).TrashFile
+	}
+	if err := remove(id); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, fmt.Errorf("file not found"))
 			return
@@ -516,52 +2360,177 @@ func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleDeleteSnapshot deletes one snapshot. The only snapshot of a file
+// is refused with 409 unless ?force=true.
+func (s *Server) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.dbFor(r).DeleteSnapshot(id, queryFlag(r, "force")); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeError(w, http.StatusNotFound, fmt.Errorf("snapshot not found"))
+		case errors.Is(err, db.ErrLastSnapshot):
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRescan triggers a background rescan through the watcher and returns
+// 202 immediately.
+func (s *Server) handleRescan(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Rescan == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("rescan not available"))
+		return
+	}
+
+	watchSetName := r.URL.Query().Get("watchSet")
+	if watchSetName != "" && !slices.ContainsFunc(s.watchSets, func(ws config.WatchSet) bool {
+		return ws.Name == watchSetName
+	}) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("watch set %q not found", watchSetName))
+		return
+	}
+
+	if err := s.opts.Rescan(watchSetName); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// defaultDictionarySamples is how many snapshots a dictionary is trained on
+// unless ?samples= says otherwise.
+const defaultDictionarySamples = 1000
+
+// handleTrainDictionary trains a zstd dictionary on a sample of existing
+// snapshots; snapshots saved afterwards are compressed with it.
+func (s *Server) handleTrainDictionary(w http.ResponseWriter, r *http.Request) {
+	samples := defaultDictionarySamples
+	if v := r.URL.Query().Get("samples"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid 'samples' parameter: must be a positive integer"))
+			return
+		}
+		samples = n
+	}
+	if s.refuseHeavyOp(w) {
+		return
+	}
+
+	info, err := s.dbFor(r).TrainDictionary(samples)
+	if err != nil {
+		if errors.Is(err, db.ErrNotEnoughSamples) {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
 func (s *Server) handleSPA(w http.ResponseWriter, r *http.Request) {
+	urlPath := strings.TrimPrefix(r.URL.Path, s.opts.BasePath)
 	// Serve API paths that don't match will get 404
-	if strings.HasPrefix(r.URL.Path, "/api/") {
+	if strings.HasPrefix(urlPath, "/api/") {
 		writeError(w, http.StatusNotFound, fmt.Errorf("endpoint not found"))
 		return
 	}
 
 	if s.staticFS == nil {
-		writeError(w, http.StatusNotFound, fmt.Errorf("static files not available"))
+		s.serveFallbackPage(w)
 		return
 	}
 
 	// embed.FS rejects paths with ".." so path traversal is safe here
-	path := strings.TrimPrefix(r.URL.Path, "/")
-	if path == "" {
-		path = "index.html"
+	path := strings.TrimPrefix(urlPath, "/")
+	if path == "" || path == "index.html" {
+		s.serveIndex(w)
+		return
 	}
 
 	if _, err := fs.Stat(s.staticFS, path); err != nil {
 		// SPA fallback: serve index.html for non-file paths
-		path = "index.html"
-		if _, err := fs.Stat(s.staticFS, path); err != nil {
-			writeError(w, http.StatusNotFound, fmt.Errorf("index.html not found"))
-			return
-		}
+		s.serveIndex(w)
+		return
 	}
 
 	http.ServeFileFS(w, r, s.staticFS, path)
 }
 
-// parseUUID extracts a UUID path parameter from the request and validates it.
+// baseHrefPattern matches the <base> element of index.html.
+var baseHrefPattern = regexp.MustCompile(`<base\s+href="[^"]*"\s*/?>`)
+
+// serveIndex serves index.html with its <base href> set to BasePath, so the
+// SPA's relative asset and API URLs resolve under the prefix. A page
+// without a <base> element gets one at the start of <head>.
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	page, err := fs.ReadFile(s.staticFS, "index.html")
+	if err != nil {
+		s.serveFallbackPage(w)
+		return
+	}
+	base := `<base href="` + html.EscapeString(s.opts.BasePath+"/") + `" />`
+	out := string(page)
+	if baseHrefPattern.MatchString(out) {
+		out = baseHrefPattern.ReplaceAllLiteralString(out, base)
+	} else {
+		out = strings.Replace(out, "<head>", "<head>\n    "+base, 1)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, out)
+}
+
+// serveFallbackPage renders a minimal HTML page listing the API endpoints.
+// It is used when the binary was built without the web UI bundle.
+func (s *Server) serveFallbackPage(w http.ResponseWriter) {
+	var sb strings.Builder
+	sb.WriteString(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>File History</title></head>
+<body>
+<h1>File History</h1>
+<p>The web UI was not bundled into this binary (build it with <code>make build</code>). The API is available:</p>
+<ul>
+`)
+	for _, rt := range s.apiRoutes() {
+		sb.WriteString("<li><code>" + html.EscapeString(s.withBasePath(rt.pattern)) + "</code></li>\n")
+	}
+	sb.WriteString("</ul>\n</body>\n</html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, sb.String())
+}
+
+// parseUUID extracts an ID path parameter from the request and validates it
+// (UUID or base32 form; see db.ValidID).
 func parseUUID(r *http.Request, name string) (string, error) {
 	idStr := r.PathValue(name)
-	if _, err := uuid.Parse(idStr); err != nil {
-		return "", fmt.Errorf("invalid %s parameter: not a valid UUID", name)
+	if !db.ValidID(idStr) {
+		return "", fmt.Errorf("invalid %s parameter: not a valid ID", name)
 	}
 	return idStr, nil
 }
 
-// parseUUIDParam validates a UUID string from a query parameter.
+// parseUUIDParam validates an ID string from a query parameter.
 func parseUUIDParam(value string, name string) (string, error) {
 	if value == "" {
 		return "", fmt.Errorf("missing '%s' parameter", name)
 	}
-	if _, err := uuid.Parse(value); err != nil {
-		return "", fmt.Errorf("invalid '%s' parameter: not a valid UUID", name)
+	if !db.ValidID(value) {
+		return "", fmt.Errorf("invalid '%s' parameter: not a valid ID", name)
 	}
 	return value, nil
 }
@@ -574,14 +2543,163 @@ func writeJSON(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("error encoding JSON response: %v", err)
+		slog.Error("error encoding JSON response", "err", err)
+	}
+}
+
+// writeJSONFor is writeJSON with the output indented when the request has
+// ?pretty=1.
+func writeJSONFor(w http.ResponseWriter, r *http.Request, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if queryFlag(r, "pretty") {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(data); err != nil {
+		slog.Error("error encoding JSON response", "err", err)
+	}
+}
+
+// ndjsonContentType is the newline-delimited JSON media type.
+const ndjsonContentType = "application/x-ndjson"
+
+// acceptsNDJSON reports whether the Accept header asks for newline-delimited
+// JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == ndjsonContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeNDJSON writes each entry as one JSON object per line.
+func writeNDJSON[T any](w http.ResponseWriter, entries []T) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			slog.Error("error encoding NDJSON response", "err", err)
+			return
+		}
+	}
+}
+
+// matchMode returns the path search mode for ?caseInsensitive=; searches
+// ignore case unless it is set to a false value such as "0".
+func matchMode(r *http.Request) db.MatchMode {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("caseInsensitive")); err == nil && !v {
+		return db.MatchExact
+	}
+	return db.MatchCaseInsensitive
+}
+
+// contentDisposition returns an attachment Content-Disposition header for
+// name. A name that is not plain printable ASCII, including one that is not
+// valid UTF-8, gets an ASCII filename with "_" in place of the other
+// characters plus an RFC 5987 filename* carrying its exact bytes.
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	plain := true
+	for _, c := range name {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			fallback.WriteByte('_')
+			plain = false
+			continue
+		}
+		fallback.WriteRune(c)
+	}
+	v := `attachment; filename="` + fallback.String() + `"`
+	if plain {
+		return v
+	}
+
+	var enc strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			enc.WriteByte(c)
+		} else {
+			fmt.Fprintf(&enc, "%%%02X", c)
+		}
+	}
+	return v + "; filename*=UTF-8''" + enc.String()
+}
+
+// fileSortKeys maps the ?sort= values accepted by file search to sort keys.
+var fileSortKeys = map[string]db.FileSortKey{
+	"updated": db.SortByUpdated,
+	"created": db.SortByCreated,
+	"path":    db.SortByPath,
+	"name":    db.SortByName,
+}
+
+// fileOrder returns the file search order for ?sort= and ?order=. sort
+// defaults to "updated"; order defaults to "desc" for the timestamps and
+// "asc" for path and name.
+func fileOrder(r *http.Request) (db.FileOrder, error) {
+	q := r.URL.Query()
+	var order db.FileOrder
+	if v := q.Get("sort"); v != "" {
+		key, ok := fileSortKeys[v]
+		if !ok {
+			return db.FileOrder{}, fmt.Errorf("invalid 'sort' parameter: must be updated, created, path or name")
+		}
+		order.Key = key
+	}
+	order.Ascending = order.Key == db.SortByPath || order.Key == db.SortByName
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		order.Ascending = true
+	case "desc":
+		order.Ascending = false
+	default:
+		return db.FileOrder{}, fmt.Errorf("invalid 'order' parameter: must be asc or desc")
+	}
+	return order, nil
+}
+
+// queryFlag reports whether the boolean query parameter name is set to a
+// true value such as "1" or "true".
+func queryFlag(r *http.Request, name string) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return v
+}
+
+// queryContext returns the context for a request's database queries: the
+// request context, which ends when the client goes away, bounded by
+// RequestTimeout when set.
+func (s *Server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.opts.RequestTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), s.opts.RequestTimeout)
+}
+
+// writeQueryError reports a failed database query. A query aborted by the
+// request deadline is answered 504; one aborted because the client went
+// away gets no response, as nobody is reading it.
+func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		slog.Warn("query timed out", "err", err)
+		writeJSON(w, http.StatusGatewayTimeout, errorResponse{Error: "query timed out"})
+	case errors.Is(ctx.Err(), context.Canceled):
+	default:
+		writeError(w, http.StatusInternalServerError, err)
 	}
 }
 
 func writeError(w http.ResponseWriter, status int, err error) {
 	msg := err.Error()
 	if status >= 500 {
-		log.Printf("internal error: %v", err)
+		slog.Error("internal error", "err", err)
 		msg = "internal server error"
 	}
 	writeJSON(w, status, errorResponse{Error: msg})
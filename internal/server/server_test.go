@@ -2,18 +2,29 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/unok/local-text-history/internal/config"
 	"github.com/unok/local-text-history/internal/db"
+	"github.com/unok/local-text-history/internal/textenc"
 )
 
 func newTestServer(t *testing.T) (*Server, *db.DB) {
@@ -25,7 +36,7 @@ func newTestServer(t *testing.T) (*Server, *db.DB) {
 	}
 	t.Cleanup(func() { database.Close() })
 
-	srv := New(database, nil, nil, nil)
+	srv := New(database, nil, nil, nil, Options{})
 	return srv, database
 }
 
@@ -101,6 +112,24 @@ func TestGetFile(t *testing.T) {
 	}
 }
 
+func TestGetFile_AcceptsBase32ID(t *testing.T) {
+	srv, database := newTestServer(t)
+	database.SetIDGenerator(db.NewBase32ID)
+
+	if _, err := database.SaveSnapshot("/tmp/short.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("short.go", 1, 0, nil)
+
+	req := httptest.NewRequest("GET", "/api/files/"+files[0].ID, nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
 func TestGetFile_NotFound(t *testing.T) {
 	srv, _ := newTestServer(t)
 
@@ -153,6 +182,47 @@ func TestGetSnapshots(t *testing.T) {
 	}
 }
 
+func TestGetSnapshots_Paginated(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for i := range 3 {
+		database.SaveSnapshot("/tmp/paged.go", []byte(fmt.Sprintf("v%d", i)), 0)
+	}
+	files, _ := database.SearchFiles("paged.go", 1, 0, nil)
+
+	type pagedResponse struct {
+		Snapshots []db.Snapshot `json:"snapshots"`
+		HasMore   bool          `json:"hasMore"`
+	}
+	tests := []struct {
+		query       string
+		wantCount   int
+		wantHasMore bool
+	}{
+		{"?limit=2", 2, true},
+		{"?limit=2&offset=2", 1, false},
+		{"?limit=5", 3, false},
+		{"?from=1", 3, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/snapshots%s", files[0].ID, tt.query), nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", tt.query, w.Code)
+		}
+		var result pagedResponse
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if len(result.Snapshots) != tt.wantCount || result.HasMore != tt.wantHasMore {
+			t.Errorf("%s: got %d snapshots, hasMore=%v; want %d, %v",
+				tt.query, len(result.Snapshots), result.HasMore, tt.wantCount, tt.wantHasMore)
+		}
+	}
+}
+
 func TestGetSnapshot_WithContent(t *testing.T) {
 	srv, database := newTestServer(t)
 
@@ -181,6 +251,106 @@ func TestGetSnapshot_WithContent(t *testing.T) {
 	}
 }
 
+func TestGetSnapshot_Range(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	content := "hello, 世界!" // 世 and 界 are 3 bytes each
+	if _, err := database.SaveSnapshot("/tmp/range.txt", []byte(content), 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := database.GetFileByPath("/tmp/range.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, _ := database.GetSnapshots(f.ID)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"offset=0&length=5", http.StatusOK, "hello"},
+		{"offset=7", http.StatusOK, "世界!"},
+		{"offset=7&length=4", http.StatusOK, "世"},            // cut inside 界: ends before it
+		{"offset=7&length=2", http.StatusOK, "\ufffd\ufffd"}, // shorter than one character: returned as is
+		{"offset=0&length=1000", http.StatusOK, content},
+		{"offset=14", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"offset=100&length=1", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"offset=-1", http.StatusBadRequest, ""},
+		{"length=0", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/snapshots/%s?%s", snapshots[0].ID, tt.query), nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusRequestedRangeNotSatisfiable {
+			if cr := w.Header().Get("Content-Range"); cr != "bytes */14" {
+				t.Errorf("%s: Content-Range = %q, want %q", tt.query, cr, "bytes */14")
+			}
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var result struct {
+			Content   string `json:"content"`
+			Offset    int    `json:"offset"`
+			Length    int    `json:"length"`
+			TotalSize int    `json:"totalSize"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Content != tt.want {
+			t.Errorf("%s: content = %q, want %q", tt.query, result.Content, tt.want)
+		}
+		if result.TotalSize != len(content) {
+			t.Errorf("%s: totalSize = %d, want %d", tt.query, result.TotalSize, len(content))
+		}
+	}
+}
+
+func TestGetSnapshot_MetaAndPretty(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/meta.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("meta.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+
+	get := func(query string) map[string]any {
+		req := httptest.NewRequest("GET", "/api/snapshots/"+snapshots[0].ID+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", query, w.Code, http.StatusOK)
+		}
+		if pretty := strings.Contains(w.Body.String(), "\n  \""); pretty != strings.Contains(query, "pretty") {
+			t.Errorf("GET %s indented = %v", query, pretty)
+		}
+		var result map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := get(""); result["content"] != "package main" {
+		t.Errorf("content = %v, want package main", result["content"])
+	}
+	result := get("?meta=1&pretty=1")
+	if _, ok := result["content"]; ok {
+		t.Error("content should be omitted with meta=1")
+	}
+	if result["hash"] != snapshots[0].Hash {
+		t.Errorf("hash = %v, want %s", result["hash"], snapshots[0].Hash)
+	}
+}
+
 func TestGetSnapshot_NotFound(t *testing.T) {
 	srv, _ := newTestServer(t)
 
@@ -193,6 +363,95 @@ func TestGetSnapshot_NotFound(t *testing.T) {
 	}
 }
 
+func TestGetLatestSnapshot(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/latest.go", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveSnapshot("/tmp/latest.go", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("latest.go", 1, 0, nil)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/latest", files[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		FileID  string `json:"fileId"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "v2" {
+		t.Errorf("content = %q, want %q", result.Content, "v2")
+	}
+	if result.FileID != files[0].ID {
+		t.Errorf("fileId = %q, want %q", result.FileID, files[0].ID)
+	}
+}
+
+func TestGetSnapshotAt(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/at.go", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{fmt.Sprintf("path=/tmp/at.go&at=%d", now+10), http.StatusOK},
+		{"path=/tmp/at.go&at=1", http.StatusNotFound},
+		{fmt.Sprintf("path=/tmp/other.go&at=%d", now+10), http.StatusNotFound},
+		{"at=1", http.StatusBadRequest},
+		{"path=/tmp/at.go&at=yesterday", http.StatusBadRequest},
+		{fmt.Sprintf("pathRaw=%s&at=%d", base64.StdEncoding.EncodeToString([]byte("/tmp/at.go")), now+10), http.StatusOK},
+		{"pathRaw=not-base64!&at=1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/snapshot-at?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.query, w.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var result struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Content != "v1" {
+			t.Errorf("content = %q, want %q", result.Content, "v1")
+		}
+	}
+}
+
+func TestGetLatestSnapshot_NoSnapshots(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/files/00000000-0000-7000-8000-000000000000/latest", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
 func TestDownloadSnapshot(t *testing.T) {
 	srv, database := newTestServer(t)
 
@@ -220,410 +479,716 @@ func TestDownloadSnapshot(t *testing.T) {
 	}
 }
 
-func TestDiff(t *testing.T) {
+func TestDownloadSnapshot_NonUTF8Name(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/diff.go", []byte("line1\nline2\n"), 0); err != nil {
+	path := "/tmp/caf\xe9 notes.txt"
+	if _, err := database.SaveSnapshot(path, []byte("x"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := database.SaveSnapshot("/tmp/diff.go", []byte("line1\nmodified\n"), 0); err != nil {
+	f, err := database.GetFileByPath(path)
+	if err != nil {
 		t.Fatal(err)
 	}
-	files, _ := database.SearchFiles("diff.go", 1, 0, nil)
-	snapshots, _ := database.GetSnapshots(files[0].ID)
-
-	// snapshots are newest first
-	fromID := snapshots[1].ID
-	toID := snapshots[0].ID
+	snapshots, _ := database.GetSnapshots(f.ID)
 
-	req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?from=%s&to=%s", fromID, toID), nil)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/snapshots/%s/download", snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	want := `attachment; filename="caf_ notes.txt"; filename*=UTF-8''caf%E9%20notes.txt`
+	if cd := w.Header().Get("Content-Disposition"); cd != want {
+		t.Errorf("Content-Disposition = %s, want %s", cd, want)
 	}
 
-	var result struct {
-		Diff string `json:"diff"`
-		From string `json:"from"`
-		To   string `json:"to"`
+	req = httptest.NewRequest("GET", "/api/files?q=notes", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	var files []struct {
+		PathRaw string `json:"pathRaw"`
 	}
-	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+	if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
 		t.Fatal(err)
 	}
-	if result.Diff == "" {
-		t.Error("diff should not be empty")
+	if len(files) != 1 || files[0].PathRaw != base64.StdEncoding.EncodeToString([]byte(path)) {
+		t.Errorf("files = %+v, want pathRaw with the original bytes", files)
 	}
 }
 
-func TestDiff_MissingTo(t *testing.T) {
-	srv, _ := newTestServer(t)
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"main.go", `attachment; filename="main.go"`},
+		{`a"b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{"メモ.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E3%83%A1%E3%83%A2.txt`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
 
-	req := httptest.NewRequest("GET", "/api/diff", nil)
+func TestDownloadSnapshot_RestoresOriginalEncoding(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	saved, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/tmp/win.txt", Content: []byte("hi"), Encoding: textenc.UTF16LE},
+	})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved, errs)
+	}
+	files, _ := database.SearchFiles("win.txt", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/snapshots/%s/download", snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	want := []byte{0xFF, 0xFE, 'h', 0, 'i', 0}
+	if !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("body = %v, want %v", w.Body.Bytes(), want)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "6" {
+		t.Errorf("Content-Length = %s, want 6", cl)
 	}
 }
 
-func TestDiff_InitialSnapshot(t *testing.T) {
+func TestExportFile(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/initial.go", []byte("package main\n"), 0); err != nil {
-		t.Fatal(err)
+	saved, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{{FilePath: "/tmp/export.go", Content: []byte("v1")}})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved, errs)
 	}
-	files, _ := database.SearchFiles("initial.go", 1, 0, nil)
-	snapshots, _ := database.GetSnapshots(files[0].ID)
+	saved, errs = database.SaveSnapshotRequests([]db.SnapshotRequest{{FilePath: "/tmp/export.go", Content: []byte{0xff, 0xfe}}})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved, errs)
+	}
+	files, _ := database.SearchFiles("export.go", 1, 0, nil)
 
-	// Only 'to' parameter, no 'from' — should compare against empty content
-	req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?to=%s", snapshots[0].ID), nil)
+	req := httptest.NewRequest("GET", "/api/files/"+files[0].ID+"/export.json", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
 	}
-
 	var result struct {
-		Diff string `json:"diff"`
-		From string `json:"from"`
-		To   string `json:"to"`
+		File      db.File     `json:"file"`
+		Renames   []db.Rename `json:"renames"`
+		Snapshots []struct {
+			Content         string `json:"content"`
+			ContentEncoding string `json:"contentEncoding"`
+		} `json:"snapshots"`
 	}
 	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
-		t.Fatal(err)
+		t.Fatalf("decoding export: %v", err)
 	}
-	if result.Diff == "" {
-		t.Error("diff should not be empty for initial snapshot")
+	if result.File.Path != "/tmp/export.go" {
+		t.Errorf("file.path = %q, want /tmp/export.go", result.File.Path)
 	}
-	if result.From != "" {
-		t.Errorf("from = %q, want empty string", result.From)
+	if result.Renames == nil {
+		t.Error("renames should be an empty array, not null")
 	}
-	if result.To != snapshots[0].ID {
-		t.Errorf("to = %s, want %s", result.To, snapshots[0].ID)
+	if len(result.Snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(result.Snapshots))
 	}
-	if !strings.Contains(result.Diff, "+package main") {
-		t.Errorf("diff should show content as additions, got: %s", result.Diff)
+	// Oldest first; invalid UTF-8 is base64-encoded
+	if result.Snapshots[0].Content != "v1" || result.Snapshots[0].ContentEncoding != "" {
+		t.Errorf("snapshots[0] = %+v, want plain v1", result.Snapshots[0])
+	}
+	if result.Snapshots[1].Content != "//4=" || result.Snapshots[1].ContentEncoding != "base64" {
+		t.Errorf("snapshots[1] = %+v, want base64 //4=", result.Snapshots[1])
+	}
+
+	req = httptest.NewRequest("GET", "/api/files/00000000-0000-7000-8000-000000000000/export.json", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown file status = %d, want %d", w.Code, http.StatusNotFound)
 	}
 }
 
-func TestStats(t *testing.T) {
+func TestBinarySnapshot_NotDiffableOrDownloadable(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/stats.go", []byte("content"), 0); err != nil {
+	saved, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/tmp/blob.dat", Content: []byte{0x00, 0x01}, Binary: true},
+	})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved, errs)
+	}
+	files, _ := database.SearchFiles("blob.dat", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+	id := snapshots[0].ID
+
+	for _, path := range []string{
+		"/api/snapshots/" + id + "/download",
+		"/api/diff?to=" + id,
+		"/api/compare?to=" + id,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("GET %s status = %d, want %d", path, w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/snapshots/"+id, nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	var result struct {
+		Binary bool  `json:"binary"`
+		Size   int64 `json:"size"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
+	if !result.Binary || result.Size != 2 {
+		t.Errorf("snapshot = %+v, want binary with size 2", result)
+	}
+}
 
-	req := httptest.NewRequest("GET", "/api/stats", nil)
+func TestDiff_HTMLFormat(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/page.html", []byte("<p>one</p>\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveSnapshot("/tmp/page.html", []byte("<p>two</p>\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("page.html", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?from=%s&to=%s&format=html", snapshots[1].ID, snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
 	}
-
-	var result struct {
-		TotalFiles     int            `json:"totalFiles"`
-		TotalSnapshots int            `json:"totalSnapshots"`
-		WatchSets      []watchSetInfo `json:"watchSets"`
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %s, want text/html", ct)
 	}
-	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
-		t.Fatal(err)
+	body := w.Body.String()
+	if !strings.Contains(body, `<span class="add">+&lt;p&gt;two&lt;/p&gt;</span>`) {
+		t.Errorf("body missing escaped added line:\n%s", body)
 	}
-	if result.TotalFiles != 1 {
-		t.Errorf("TotalFiles = %d, want 1", result.TotalFiles)
+	if strings.Contains(body, "<p>") {
+		t.Error("file content was not escaped")
 	}
-	if result.TotalSnapshots != 1 {
-		t.Errorf("TotalSnapshots = %d, want 1", result.TotalSnapshots)
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/diff?to=%s&format=xml", snapshots[0].ID), nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format status = %d, want %d", w.Code, http.StatusBadRequest)
 	}
 }
 
-func TestStats_IncludesWatchSets(t *testing.T) {
-	dbPath := filepath.Join(t.TempDir(), "test.db")
-	database, err := db.New(dbPath)
+func TestRequestTimeout_AbortsQueries(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
 		t.Fatalf("db.New() error: %v", err)
 	}
 	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{RequestTimeout: time.Nanosecond})
 
-	watchSets := []config.WatchSet{
-		{Name: "Projects", Dirs: []string{"/home/user/projects"}},
-		{Name: "Docs", Dirs: []string{"/home/user/docs"}},
+	if _, err := database.SaveSnapshot("/tmp/a.go", []byte("a\n"), 0); err != nil {
+		t.Fatal(err)
 	}
-	srv := New(database, nil, watchSets, nil)
+	files, _ := database.SearchFiles("/tmp/a.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("GET", "/api/stats", nil)
+	for _, path := range []string{"/api/files?q=a", "/api/history", "/api/diff?to=" + snapshots[0].ID} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("GET %s status = %d, want %d; body: %s", path, w.Code, http.StatusGatewayTimeout, w.Body.String())
+		}
+	}
+
+	// A client that went away gets no response at all
+	srv = New(database, nil, nil, nil, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/api/files?q=a", nil).WithContext(ctx)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
+	if w.Body.Len() != 0 {
+		t.Errorf("cancelled request body = %q, want empty", w.Body.String())
+	}
+}
 
-	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+func TestDiff_MaxDiffBytes(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
 	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{MaxDiffBytes: 16})
 
-	var result struct {
-		TotalFiles     int            `json:"totalFiles"`
-		TotalSnapshots int            `json:"totalSnapshots"`
-		TotalSize      int64          `json:"totalSize"`
-		WatchDirs      []string       `json:"watchDirs"`
-		WatchSets      []watchSetInfo `json:"watchSets"`
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.go")
+	large := filepath.Join(dir, "large.go")
+	if _, err := database.SaveSnapshot(small, []byte("a\n"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+	if _, err := database.SaveSnapshot(large, []byte("a\n"), 0); err != nil {
 		t.Fatal(err)
 	}
-	// Check watchDirs (backward compatible)
-	if len(result.WatchDirs) != 2 {
-		t.Fatalf("got %d watchDirs, want 2", len(result.WatchDirs))
+	if _, err := database.SaveSnapshot(large, []byte(strings.Repeat("line\n", 10)), 0); err != nil {
+		t.Fatal(err)
 	}
-	if result.WatchDirs[0] != "/home/user/projects" {
-		t.Errorf("watchDirs[0] = %s, want /home/user/projects", result.WatchDirs[0])
+	if err := os.WriteFile(small, []byte("a\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
 	}
-	if result.WatchDirs[1] != "/home/user/docs" {
-		t.Errorf("watchDirs[1] = %s, want /home/user/docs", result.WatchDirs[1])
+	if err := os.WriteFile(large, []byte(strings.Repeat("line\n", 10)), 0o644); err != nil {
+		t.Fatal(err)
 	}
-	// Check watchSets
-	if len(result.WatchSets) != 2 {
-		t.Fatalf("got %d watchSets, want 2", len(result.WatchSets))
-	}
-	if result.WatchSets[0].Name != "Projects" {
-		t.Errorf("watchSets[0].Name = %s, want Projects", result.WatchSets[0].Name)
-	}
-	if result.WatchSets[1].Name != "Docs" {
-		t.Errorf("watchSets[1].Name = %s, want Docs", result.WatchSets[1].Name)
+
+	type diffResult struct {
+		Diff      string `json:"diff"`
+		Truncated bool   `json:"truncated"`
+	}
+	check := func(path string, wantTruncated bool) {
+		t.Helper()
+		file, _ := database.GetFileByPath(path)
+		snapshots, _ := database.GetSnapshots(file.ID)
+		oldest := snapshots[len(snapshots)-1].ID
+		for _, target := range []string{
+			"/api/diff?to=" + snapshots[0].ID,
+			"/api/compare?to=" + snapshots[0].ID,
+			"/api/files/" + file.ID + "/diff-live?from=" + oldest,
+		} {
+			req := httptest.NewRequest("GET", target, nil)
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d, want %d", target, w.Code, http.StatusOK)
+			}
+			var resp diffResult
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Truncated != wantTruncated {
+				t.Errorf("%s: truncated = %v, want %v", target, resp.Truncated, wantTruncated)
+			}
+			if resp.Diff == "" {
+				t.Errorf("%s: diff is empty", target)
+			}
+		}
 	}
+	check(small, false)
+	check(large, true)
 }
 
-func TestDeleteFile(t *testing.T) {
+func TestDiff(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/delete.go", []byte("content"), 0); err != nil {
+	if _, err := database.SaveSnapshot("/tmp/diff.go", []byte("line1\nline2\n"), 0); err != nil {
 		t.Fatal(err)
 	}
-	files, _ := database.SearchFiles("delete.go", 1, 0, nil)
+	if _, err := database.SaveSnapshot("/tmp/diff.go", []byte("line1\nmodified\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("diff.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/files/%s", files[0].ID), nil)
+	// snapshots are newest first
+	fromID := snapshots[1].ID
+	toID := snapshots[0].ID
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?from=%s&to=%s", fromID, toID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	if w.Code != http.StatusNoContent {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
 	}
 
-	// Verify deletion
-	_, err := database.GetFile(files[0].ID)
-	if err == nil {
-		t.Error("file should be deleted")
+	var result struct {
+		Diff string `json:"diff"`
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Diff == "" {
+		t.Error("diff should not be empty")
 	}
 }
 
-func TestDeleteFile_NotFound(t *testing.T) {
+func TestOpenAPI_CoversRoutes(t *testing.T) {
 	srv, _ := newTestServer(t)
 
-	req := httptest.NewRequest("DELETE", "/api/files/00000000-0000-7000-8000-000000000000", nil)
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+	}
 
-	if w.Code != http.StatusNotFound {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	documented := 0
+	for _, ops := range spec.Paths {
+		documented += len(ops)
+	}
+	routes := srv.apiRoutes()
+	for _, rt := range routes {
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("route %q is missing from openapi.json", rt.pattern)
+		}
+	}
+	if documented != len(routes) {
+		t.Errorf("openapi.json documents %d operations, want %d (one per route)", documented, len(routes))
 	}
 }
 
-func TestSPA_APINotFound(t *testing.T) {
+func TestHealth_ReportsConfigError(t *testing.T) {
 	srv, _ := newTestServer(t)
 
-	req := httptest.NewRequest("GET", "/api/nonexistent", nil)
-	w := httptest.NewRecorder()
-	srv.Handler().ServeHTTP(w, req)
+	get := func() map[string]any {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/health", nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
 
-	if w.Code != http.StatusNotFound {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	if resp := get(); resp["status"] != "ok" || resp["configError"] != nil {
+		t.Errorf("initial health = %v, want ok without configError", resp)
+	}
+
+	srv.SetConfigError(errors.New("port must be between 1 and 65535"))
+	if resp := get(); resp["configError"] != "port must be between 1 and 65535" || resp["configErrorAt"] == nil {
+		t.Errorf("health after rejected reload = %v", resp)
+	}
+
+	srv.SetConfigError(nil)
+	if resp := get(); resp["configError"] != nil {
+		t.Errorf("health after successful reload = %v, want configError cleared", resp)
 	}
 }
 
-func TestSearchFiles_Pagination(t *testing.T) {
-	srv, database := newTestServer(t)
+func TestMaxConcurrentRequests(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{MaxConcurrentRequests: 1})
 
-	for i := range 5 {
-		path := fmt.Sprintf("/tmp/page%d.go", i)
-		if _, err := database.SaveSnapshot(path, []byte("content"), 0); err != nil {
-			t.Fatal(err)
+	started, release := make(chan struct{}), make(chan struct{})
+	h := srv.inFlightMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
 		}
-	}
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	<-started
 
-	req := httptest.NewRequest("GET", "/api/files?q=page&limit=2&offset=0", nil)
 	w := httptest.NewRecorder()
-	srv.Handler().ServeHTTP(w, req)
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit: status = %d, Retry-After = %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Event streams do not take a slot
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/events", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("event stream: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := srv.inFlight.Load(); got != 1 {
+		t.Errorf("inFlight = %d, want 1", got)
+	}
 
-	var files []db.File
-	if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+	close(release)
+	<-done
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("health: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var health struct {
+		InFlightRequests int64 `json:"inFlightRequests"`
+		SSEClients       int   `json:"sseClients"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 2 {
-		t.Errorf("got %d files, want 2", len(files))
+	if health.InFlightRequests != 1 || health.SSEClients != 0 {
+		t.Errorf("health = %+v, want only the health request in flight", health)
 	}
 }
 
-func TestHandleHistory_Empty(t *testing.T) {
-	srv, _ := newTestServer(t)
-
-	req := httptest.NewRequest("GET", "/api/history", nil)
-	w := httptest.NewRecorder()
-	srv.Handler().ServeHTTP(w, req)
+func TestDiffBack(t *testing.T) {
+	srv, database := newTestServer(t)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	for _, content := range []string{"v1\n", "v2\n", "v3\n"} {
+		if _, err := database.SaveSnapshot("/tmp/back.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
+	files, _ := database.SearchFiles("back.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	var result struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+	tests := []struct {
+		query    string
+		wantBack int
+		wantFrom string
+	}{
+		{"", 1, snapshots[1].ID},
+		{"?back=2", 2, snapshots[2].ID},
+		{"?back=5", 2, snapshots[2].ID}, // clamped to the oldest snapshot
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/files/"+files[0].ID+"/diff"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want %d", tt.query, w.Code, http.StatusOK)
+		}
+		var result struct {
+			Diff string `json:"diff"`
+			From string `json:"from"`
+			To   string `json:"to"`
+			Back int    `json:"back"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Back != tt.wantBack || result.From != tt.wantFrom || result.To != snapshots[0].ID {
+			t.Errorf("%q: back=%d from=%s to=%s, want back=%d from=%s to=%s",
+				tt.query, result.Back, result.From, result.To, tt.wantBack, tt.wantFrom, snapshots[0].ID)
+		}
+		if !strings.Contains(result.Diff, "+v3") {
+			t.Errorf("%q: diff = %q, want it to add v3", tt.query, result.Diff)
+		}
 	}
-	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
-		t.Fatal(err)
+
+	for _, query := range []string{"?back=0", "?back=x"} {
+		req := httptest.NewRequest("GET", "/api/files/"+files[0].ID+"/diff"+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
 	}
-	if len(result.Entries) != 0 {
-		t.Errorf("got %d entries, want 0", len(result.Entries))
+}
+
+func TestDiff_IdenticalSnapshots(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	// A copy of a file has snapshots with the same hash as the original
+	for _, s := range []struct{ path, content string }{
+		{"/tmp/orig.go", "v1\n"},
+		{"/tmp/orig.go", "v2\n"},
+		{"/tmp/copy.go", "v2\n"},
+	} {
+		if _, err := database.SaveSnapshot(s.path, []byte(s.content), 0); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if result.HasMore {
-		t.Error("hasMore = true, want false")
+	origFiles, _ := database.SearchFiles("orig.go", 1, 0, nil)
+	origSnaps, _ := database.GetSnapshots(origFiles[0].ID)
+	copyFiles, _ := database.SearchFiles("copy.go", 1, 0, nil)
+	copySnaps, _ := database.GetSnapshots(copyFiles[0].ID)
+
+	tests := []struct {
+		name          string
+		from, to      string
+		wantIdentical bool
+	}{
+		{"sameHash", origSnaps[0].ID, copySnaps[0].ID, true},
+		{"different", origSnaps[1].ID, copySnaps[0].ID, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?from=%s&to=%s", tt.from, tt.to), nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tt.name, w.Code, http.StatusOK)
+		}
+		var result struct {
+			Diff      string `json:"diff"`
+			Identical bool   `json:"identical"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Identical != tt.wantIdentical {
+			t.Errorf("%s: identical = %v, want %v", tt.name, result.Identical, tt.wantIdentical)
+		}
+		if tt.wantIdentical && result.Diff != "" {
+			t.Errorf("%s: diff = %q, want empty", tt.name, result.Diff)
+		}
 	}
 }
 
-func TestHandleHistory_WithData(t *testing.T) {
+func TestCompare(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/hist1.go", []byte("content1"), 0); err != nil {
+	if _, err := database.SaveSnapshot("/tmp/compare.go", []byte("line1\nline2\n"), 0); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := database.SaveSnapshot("/tmp/hist2.go", []byte("content2"), 0); err != nil {
+	if _, err := database.SaveSnapshot("/tmp/compare.go", []byte("line1\nmodified\n"), 0); err != nil {
 		t.Fatal(err)
 	}
+	files, _ := database.SearchFiles("compare.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("GET", "/api/history", nil)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/compare?from=%s&to=%s", snapshots[1].ID, snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
 	}
 
 	var result struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+		FromContent string       `json:"fromContent"`
+		ToContent   string       `json:"toContent"`
+		Diff        string       `json:"diff"`
+		FromMeta    *db.Snapshot `json:"fromMeta"`
+		ToMeta      db.Snapshot  `json:"toMeta"`
 	}
 	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	if len(result.Entries) != 2 {
-		t.Errorf("got %d entries, want 2", len(result.Entries))
+	if result.FromContent != "line1\nline2\n" || result.ToContent != "line1\nmodified\n" {
+		t.Errorf("contents = %q / %q", result.FromContent, result.ToContent)
 	}
-	if result.HasMore {
-		t.Error("hasMore = true, want false")
+	if !strings.Contains(result.Diff, "+modified") {
+		t.Errorf("diff missing change, got: %s", result.Diff)
 	}
-
-	// Verify newest first
-	if result.Entries[0].FilePath != "/tmp/hist2.go" {
-		t.Errorf("entries[0].FilePath = %s, want /tmp/hist2.go", result.Entries[0].FilePath)
+	if result.FromMeta == nil || result.FromMeta.ID != snapshots[1].ID {
+		t.Errorf("fromMeta = %+v, want id %s", result.FromMeta, snapshots[1].ID)
 	}
-	if result.Entries[1].FilePath != "/tmp/hist1.go" {
-		t.Errorf("entries[1].FilePath = %s, want /tmp/hist1.go", result.Entries[1].FilePath)
+	if result.ToMeta.ID != snapshots[0].ID {
+		t.Errorf("toMeta.id = %s, want %s", result.ToMeta.ID, snapshots[0].ID)
 	}
 }
 
-func TestHandleHistory_CustomLimit(t *testing.T) {
+func TestCompare_WithoutFrom(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	for i := range 5 {
-		path := fmt.Sprintf("/tmp/hlimit%d.go", i)
-		if _, err := database.SaveSnapshot(path, []byte(fmt.Sprintf("content%d", i)), 0); err != nil {
-			t.Fatal(err)
-		}
+	if _, err := database.SaveSnapshot("/tmp/compare.go", []byte("package main\n"), 0); err != nil {
+		t.Fatal(err)
 	}
+	files, _ := database.SearchFiles("compare.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("GET", "/api/history?limit=3", nil)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/compare?to=%s", snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
-	}
-
 	var result struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+		FromContent string          `json:"fromContent"`
+		Diff        string          `json:"diff"`
+		FromMeta    json.RawMessage `json:"fromMeta"`
 	}
 	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	if len(result.Entries) != 3 {
-		t.Errorf("got %d entries, want 3", len(result.Entries))
+	if result.FromContent != "" || string(result.FromMeta) != "null" {
+		t.Errorf("fromContent = %q fromMeta = %s, want empty and null", result.FromContent, result.FromMeta)
 	}
-	if !result.HasMore {
-		t.Error("hasMore = false, want true (5 items with limit=3)")
+	if !strings.Contains(result.Diff, "+package main") {
+		t.Errorf("diff should show content as additions, got: %s", result.Diff)
 	}
 }
 
-func TestHandleHistory_Pagination(t *testing.T) {
-	srv, database := newTestServer(t)
-
-	for i := range 5 {
-		path := fmt.Sprintf("/tmp/hpage%d.go", i)
-		if _, err := database.SaveSnapshot(path, []byte(fmt.Sprintf("content%d", i)), 0); err != nil {
-			t.Fatal(err)
-		}
-	}
+func TestDiff_MissingTo(t *testing.T) {
+	srv, _ := newTestServer(t)
 
-	// Page 1: offset=0, limit=2
-	req := httptest.NewRequest("GET", "/api/history?limit=2&offset=0", nil)
+	req := httptest.NewRequest("GET", "/api/diff", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	var page1 struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
-	}
-	if err := json.NewDecoder(w.Body).Decode(&page1); err != nil {
-		t.Fatal(err)
-	}
-	if len(page1.Entries) != 2 {
-		t.Errorf("page1: got %d entries, want 2", len(page1.Entries))
-	}
-	if !page1.HasMore {
-		t.Error("page1: hasMore = false, want true")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
 	}
+}
 
-	// Page 3: offset=4, limit=2
-	req = httptest.NewRequest("GET", "/api/history?limit=2&offset=4", nil)
-	w = httptest.NewRecorder()
-	srv.Handler().ServeHTTP(w, req)
+func TestDiff_LabelsEachSideAcrossRename(t *testing.T) {
+	srv, database := newTestServer(t)
 
-	var page3 struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+	if _, err := database.SaveSnapshot("/tmp/old-name.go", []byte("v1\n"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if err := json.NewDecoder(w.Body).Decode(&page3); err != nil {
+	if _, err := database.SaveRename("/tmp/old-name.go", "/tmp/new-name.go"); err != nil {
 		t.Fatal(err)
 	}
-	if len(page3.Entries) != 1 {
-		t.Errorf("page3: got %d entries, want 1", len(page3.Entries))
+	if _, err := database.SaveSnapshot("/tmp/new-name.go", []byte("v2\n"), 0); err != nil {
+		t.Fatal(err)
 	}
-	if page3.HasMore {
-		t.Error("page3: hasMore = true, want false")
+	oldFile, _ := database.GetFileByPath("/tmp/old-name.go")
+	newFile, _ := database.GetFileByPath("/tmp/new-name.go")
+	from, _ := database.GetLatestSnapshot(oldFile.ID)
+	to, _ := database.GetLatestSnapshot(newFile.ID)
+
+	for _, endpoint := range []string{"/api/diff", "/api/compare"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?from=%s&to=%s", endpoint, from.ID, to.ID), nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", endpoint, w.Code, http.StatusOK)
+		}
+		var result struct {
+			Diff string `json:"diff"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(result.Diff, "--- /tmp/old-name.go") || !strings.Contains(result.Diff, "+++ /tmp/new-name.go") {
+			t.Errorf("%s: diff headers do not show the rename:\n%s", endpoint, result.Diff)
+		}
 	}
 }
 
-func TestHandleHistory_IncludesRenames(t *testing.T) {
+func TestDiff_InitialSnapshot(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/hren1.go", []byte("content"), 0); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := database.SaveRename("/tmp/hren1.go", "/tmp/hren2.go"); err != nil {
+	if _, err := database.SaveSnapshot("/tmp/initial.go", []byte("package main\n"), 0); err != nil {
 		t.Fatal(err)
 	}
+	files, _ := database.SearchFiles("initial.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("GET", "/api/history", nil)
+	// Only 'to' parameter, no 'from' — should compare against empty content
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/diff?to=%s", snapshots[0].ID), nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
@@ -632,40 +1197,296 @@ func TestHandleHistory_IncludesRenames(t *testing.T) {
 	}
 
 	var result struct {
-		Entries []db.HistoryEntry `json:"entries"`
-		HasMore bool             `json:"hasMore"`
+		Diff string `json:"diff"`
+		From string `json:"from"`
+		To   string `json:"to"`
 	}
 	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	if len(result.Entries) != 2 {
-		t.Fatalf("got %d entries, want 2 (1 save + 1 rename)", len(result.Entries))
+	if result.Diff == "" {
+		t.Error("diff should not be empty for initial snapshot")
 	}
-
-	// Most recent first: rename, then save
-	if result.Entries[0].EntryType != "rename" {
-		t.Errorf("entries[0].EntryType = %s, want rename", result.Entries[0].EntryType)
+	if result.From != "" {
+		t.Errorf("from = %q, want empty string", result.From)
 	}
-	if result.Entries[0].FilePath != "/tmp/hren2.go" {
-		t.Errorf("entries[0].FilePath = %s, want /tmp/hren2.go", result.Entries[0].FilePath)
+	if result.To != snapshots[0].ID {
+		t.Errorf("to = %s, want %s", result.To, snapshots[0].ID)
 	}
-	if result.Entries[0].OldFilePath != "/tmp/hren1.go" {
-		t.Errorf("entries[0].OldFilePath = %s, want /tmp/hren1.go", result.Entries[0].OldFilePath)
+	if !strings.Contains(result.Diff, "+package main") {
+		t.Errorf("diff should show content as additions, got: %s", result.Diff)
 	}
-	if result.Entries[1].EntryType != "save" {
-		t.Errorf("entries[1].EntryType = %s, want save", result.Entries[1].EntryType)
+}
+
+func TestDiff_MaxInitialDiffBytes(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{MaxInitialDiffBytes: 16})
+
+	content := strings.Repeat("line\n", 10)
+	if _, err := database.SaveSnapshot("/tmp/big.go", []byte("a\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveSnapshot("/tmp/big.go", []byte(content), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("big.go", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+
+	type diffResult struct {
+		Diff       string `json:"diff"`
+		Suppressed bool   `json:"suppressed"`
+		AddedLines int    `json:"addedLines"`
+		Size       int64  `json:"size"`
+	}
+	get := func(query string) diffResult {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/diff?"+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", query, w.Code, http.StatusOK)
+		}
+		var resp diffResult
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("to=" + snapshots[0].ID)
+	if !resp.Suppressed || resp.Diff != "" {
+		t.Errorf("initial diff of large snapshot: suppressed = %v, diff = %q; want suppressed summary", resp.Suppressed, resp.Diff)
+	}
+	if resp.AddedLines != 10 || resp.Size != int64(len(content)) {
+		t.Errorf("addedLines, size = %d, %d; want 10, %d", resp.AddedLines, resp.Size, len(content))
+	}
+
+	// A diff against an earlier snapshot is not affected
+	resp = get("from=" + snapshots[1].ID + "&to=" + snapshots[0].ID)
+	if resp.Suppressed || resp.Diff == "" {
+		t.Errorf("diff with from: suppressed = %v, diff empty = %v; want full diff", resp.Suppressed, resp.Diff == "")
+	}
+
+	// A small initial snapshot is diffed as before
+	resp = get("to=" + snapshots[1].ID)
+	if resp.Suppressed || !strings.Contains(resp.Diff, "+a") {
+		t.Errorf("small initial diff: suppressed = %v, diff = %q", resp.Suppressed, resp.Diff)
+	}
+
+	req := httptest.NewRequest("GET", "/api/diff?format=html&to="+snapshots[0].ID, nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if got := w.Header().Get("X-Diff-Suppressed"); got != "true" {
+		t.Errorf("X-Diff-Suppressed = %q, want true", got)
 	}
 }
 
-func TestGetRenames_Empty(t *testing.T) {
+func TestDiffLive(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/norename.go", []byte("content"), 0); err != nil {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "live.go")
+	if _, err := database.SaveSnapshot(path, []byte("line1\nline2\n"), 0); err != nil {
 		t.Fatal(err)
 	}
-	files, _ := database.SearchFiles("norename.go", 1, 0, nil)
+	if err := os.WriteFile(path, []byte("line1\nchanged\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("live.go", 1, 0, nil)
+	snaps, _ := database.GetSnapshots(files[0].ID)
 
-	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/renames", files[0].ID), nil)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/diff-live?from=%s", files[0].ID, snaps[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var result struct {
+		Diff     string `json:"diff"`
+		LivePath string `json:"livePath"`
+		Deleted  bool   `json:"deleted"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Diff, "-line2") || !strings.Contains(result.Diff, "+changed") {
+		t.Errorf("diff missing expected changes:\n%s", result.Diff)
+	}
+	if result.Deleted {
+		t.Error("deleted = true, want false")
+	}
+	if result.LivePath != path {
+		t.Errorf("livePath = %s, want %s", result.LivePath, path)
+	}
+}
+
+func TestDiffLive_FollowsRenameAndHandlesDeletedFile(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.go")
+	newPath := filepath.Join(dir, "new.go")
+	if _, err := database.SaveSnapshot(oldPath, []byte("content\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveRename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("old.go", 1, 0, nil)
+	snaps, _ := database.GetSnapshots(files[0].ID)
+	url := fmt.Sprintf("/api/files/%s/diff-live?from=%s", files[0].ID, snaps[0].ID)
+
+	// Renamed file exists on disk under its new path
+	if err := os.WriteFile(newPath, []byte("content\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var result struct {
+		Diff     string `json:"diff"`
+		LivePath string `json:"livePath"`
+		Deleted  bool   `json:"deleted"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.LivePath != newPath {
+		t.Errorf("livePath = %s, want %s", result.LivePath, newPath)
+	}
+	if result.Diff != "" || result.Deleted {
+		t.Errorf("unchanged live file: diff = %q, deleted = %v", result.Diff, result.Deleted)
+	}
+
+	// Once removed from disk, the live side is empty
+	if err := os.Remove(newPath); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", url, nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Deleted {
+		t.Error("deleted = false, want true")
+	}
+	if !strings.Contains(result.Diff, "-content") {
+		t.Errorf("diff should show all lines removed:\n%s", result.Diff)
+	}
+}
+
+func TestDiffLive_MissingFrom(t *testing.T) {
+	srv, database := newTestServer(t)
+	database.SaveSnapshot("/tmp/x.go", []byte("x"), 0)
+	files, _ := database.SearchFiles("x.go", 1, 0, nil)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/diff-live", files[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDiffLive_RejectsSnapshotOfAnotherFile(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.go")
+	other := filepath.Join(dir, "b.go")
+	database.SaveSnapshot(path, []byte("a\n"), 0)
+	database.SaveSnapshot(other, []byte("b\n"), 0)
+	file, _ := database.GetFileByPath(path)
+	otherFile, _ := database.GetFileByPath(other)
+	otherSnaps, _ := database.GetSnapshots(otherFile.ID)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/diff-live?from=%s", file.ID, otherSnaps[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body.String())
+	}
+}
+
+func TestDiffLive_ReadsLiveFileWithWatchSetLimits(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	dir := t.TempDir()
+	srv := New(database, nil, []config.WatchSet{
+		{Name: "docs", Dirs: []string{dir}, MaxFileSize: 64, DetectEncoding: true},
+	}, nil, Options{})
+
+	path := filepath.Join(dir, "notes.txt")
+	if _, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: path, Content: []byte("line1\n"), WatchSet: "docs", Encoding: textenc.UTF16LE},
+	}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	file, _ := database.GetFileByPath(path)
+	snaps, _ := database.GetSnapshots(file.ID)
+	diffLive := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/diff-live?from=%s", file.ID, snaps[0].ID), nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	// UTF-16 on disk is compared as UTF-8
+	utf16, err := textenc.FromUTF8(textenc.UTF16LE, []byte("line1\nline2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, utf16, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := diffLive()
+	var result struct {
+		Diff string `json:"diff"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !strings.Contains(result.Diff, "+line2") || strings.Contains(result.Diff, "-line1") {
+		t.Errorf("UTF-16 live file: status = %d, diff =\n%s", w.Code, result.Diff)
+	}
+
+	for name, content := range map[string][]byte{
+		"binary":    []byte("line1\x00\n"),
+		"oversized": bytes.Repeat([]byte("x"), 65),
+	} {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if w := diffLive(); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s live file: status = %d, want %d", name, w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/stats.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/stats", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
@@ -673,30 +1494,95 @@ func TestGetRenames_Empty(t *testing.T) {
 		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
 	}
 
-	var renames []db.Rename
-	if err := json.NewDecoder(w.Body).Decode(&renames); err != nil {
+	var result struct {
+		TotalFiles     int            `json:"totalFiles"`
+		TotalSnapshots int            `json:"totalSnapshots"`
+		WatchSets      []watchSetInfo `json:"watchSets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	if len(renames) != 0 {
-		t.Errorf("got %d renames, want 0", len(renames))
+	if result.TotalFiles != 1 {
+		t.Errorf("TotalFiles = %d, want 1", result.TotalFiles)
+	}
+	if result.TotalSnapshots != 1 {
+		t.Errorf("TotalSnapshots = %d, want 1", result.TotalSnapshots)
 	}
 }
 
-func TestGetRenames_WithData(t *testing.T) {
+func TestStats_DatabaseSize(t *testing.T) {
 	srv, database := newTestServer(t)
+	database.SetSizeLimit(10<<20, false)
 
-	if _, err := database.SaveSnapshot("/tmp/renold.go", []byte("content"), 0); err != nil {
+	req := httptest.NewRequest("GET", "/api/stats", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var result struct {
+		DatabaseSize    int64 `json:"databaseSize"`
+		MaxDatabaseSize int64 `json:"maxDatabaseSize"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
+	if result.DatabaseSize <= 0 {
+		t.Errorf("DatabaseSize = %d, want > 0", result.DatabaseSize)
+	}
+	if result.MaxDatabaseSize != 10<<20 {
+		t.Errorf("MaxDatabaseSize = %d, want %d", result.MaxDatabaseSize, 10<<20)
+	}
+}
 
-	_, err := database.SaveRename("/tmp/renold.go", "/tmp/rennew.go")
+func TestStats_IncludesWatchStats(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
-		t.Fatalf("SaveRename() error: %v", err)
+		t.Fatalf("db.New() error: %v", err)
 	}
+	t.Cleanup(func() { database.Close() })
 
-	files, _ := database.SearchFiles("renold.go", 1, 0, nil)
+	srv := New(database, nil, nil, nil, Options{
+		WatchStats: func() WatchStats {
+			return WatchStats{Watches: 42, LimitReached: true, UnavailableDirs: []string{"/mnt/gone"}}
+		},
+	})
 
-	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/renames", files[0].ID), nil)
+	req := httptest.NewRequest("GET", "/api/stats", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var result struct {
+		Watcher *WatchStats `json:"watcher"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Watcher == nil {
+		t.Fatal("watcher stats missing from response")
+	}
+	if result.Watcher.Watches != 42 || !result.Watcher.LimitReached ||
+		len(result.Watcher.UnavailableDirs) != 1 || result.Watcher.UnavailableDirs[0] != "/mnt/gone" {
+		t.Errorf("watcher = %+v, want {Watches:42 LimitReached:true UnavailableDirs:[/mnt/gone]}", *result.Watcher)
+	}
+}
+
+func TestStats_IncludesWatchSets(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	watchSets := []config.WatchSet{
+		{Name: "Projects", Dirs: []string{"/home/user/projects"}},
+		{Name: "Docs", Dirs: []string{"/home/user/docs"}},
+	}
+	srv := New(database, nil, watchSets, nil, Options{})
+
+	req := httptest.NewRequest("GET", "/api/stats", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
@@ -704,83 +1590,1610 @@ func TestGetRenames_WithData(t *testing.T) {
 		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
 	}
 
-	var renames []db.Rename
-	if err := json.NewDecoder(w.Body).Decode(&renames); err != nil {
+	var result struct {
+		TotalFiles     int            `json:"totalFiles"`
+		TotalSnapshots int            `json:"totalSnapshots"`
+		TotalSize      int64          `json:"totalSize"`
+		WatchDirs      []string       `json:"watchDirs"`
+		WatchSets      []watchSetInfo `json:"watchSets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	if len(renames) != 1 {
-		t.Fatalf("got %d renames, want 1", len(renames))
+	// Check watchDirs (backward compatible)
+	if len(result.WatchDirs) != 2 {
+		t.Fatalf("got %d watchDirs, want 2", len(result.WatchDirs))
 	}
-	if renames[0].OldPath != "/tmp/renold.go" {
-		t.Errorf("OldPath = %s, want /tmp/renold.go", renames[0].OldPath)
+	if result.WatchDirs[0] != "/home/user/projects" {
+		t.Errorf("watchDirs[0] = %s, want /home/user/projects", result.WatchDirs[0])
 	}
-	if renames[0].NewPath != "/tmp/rennew.go" {
-		t.Errorf("NewPath = %s, want /tmp/rennew.go", renames[0].NewPath)
+	if result.WatchDirs[1] != "/home/user/docs" {
+		t.Errorf("watchDirs[1] = %s, want /home/user/docs", result.WatchDirs[1])
+	}
+	// Check watchSets
+	if len(result.WatchSets) != 2 {
+		t.Fatalf("got %d watchSets, want 2", len(result.WatchSets))
+	}
+	if result.WatchSets[0].Name != "Projects" {
+		t.Errorf("watchSets[0].Name = %s, want Projects", result.WatchSets[0].Name)
+	}
+	if result.WatchSets[1].Name != "Docs" {
+		t.Errorf("watchSets[1].Name = %s, want Docs", result.WatchSets[1].Name)
 	}
 }
 
-func TestGetRenames_InvalidID(t *testing.T) {
-	srv, _ := newTestServer(t)
+func TestStats_WatchSetBreakdown(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
 
-	req := httptest.NewRequest("GET", "/api/files/abc/renames", nil)
+	watchSets := []config.WatchSet{
+		{Name: "Projects", Dirs: []string{"/home/user/projects"}},
+		{Name: "Docs", Dirs: []string{"/home/user/docs"}},
+	}
+	srv := New(database, nil, watchSets, nil, Options{})
+
+	database.SaveSnapshot("/home/user/projects/a.go", []byte("v1"), 0)
+	database.SaveSnapshot("/home/user/projects/a.go", []byte("v2-longer"), 0)
+	database.SaveSnapshot("/home/user/projects/b.go", []byte("b"), 0)
+	database.SaveSnapshot("/home/user/docs/readme.md", []byte("readme"), 0)
+
+	req := httptest.NewRequest("GET", "/api/stats", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		TotalFiles int            `json:"totalFiles"`
+		WatchSets  []watchSetInfo `json:"watchSets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalFiles != 3 {
+		t.Errorf("totalFiles = %d, want 3", result.TotalFiles)
+	}
+	if len(result.WatchSets) != 2 {
+		t.Fatalf("got %d watchSets, want 2", len(result.WatchSets))
+	}
+
+	projects := result.WatchSets[0]
+	if projects.TotalFiles != 2 || projects.TotalSnapshots != 3 || projects.TotalSize != 12 {
+		t.Errorf("Projects stats = %d files / %d snapshots / %d bytes, want 2 / 3 / 12",
+			projects.TotalFiles, projects.TotalSnapshots, projects.TotalSize)
+	}
+	docs := result.WatchSets[1]
+	if docs.TotalFiles != 1 || docs.TotalSnapshots != 1 || docs.TotalSize != 6 {
+		t.Errorf("Docs stats = %d files / %d snapshots / %d bytes, want 1 / 1 / 6",
+			docs.TotalFiles, docs.TotalSnapshots, docs.TotalSize)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/delete.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("delete.go", 1, 0, nil)
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/files/%s", files[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// Verify deletion
+	_, err := database.GetFile(files[0].ID)
+	if err == nil {
+		t.Error("file should be deleted")
+	}
+}
+
+func TestDeleteFile_NotFound(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("DELETE", "/api/files/00000000-0000-7000-8000-000000000000", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeleteFile_TrashFiles(t *testing.T) {
+	srv, database := newTestServer(t)
+	srv.opts.TrashFiles = true
+
+	if _, err := database.SaveSnapshot("/tmp/trash.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := database.GetFileByPath("/tmp/trash.go")
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/files/%s", file.ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := database.GetFile(file.ID); err != nil {
+		t.Errorf("trashed file should be kept until purged: %v", err)
+	}
+	if files, _ := database.SearchFiles("trash.go", 10, 0, nil); len(files) != 0 {
+		t.Errorf("trashed file should be hidden from search, got %d files", len(files))
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for _, content := range []string{"v1", "secret"} {
+		if _, err := database.SaveSnapshot("/tmp/delsnap.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, _ := database.GetFileByPath("/tmp/delsnap.go")
+	snapshots, _ := database.GetSnapshots(file.ID)
+
+	del := func(target string) int {
+		req := httptest.NewRequest("DELETE", target, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"newest", "/api/snapshots/" + snapshots[0].ID, http.StatusNoContent},
+		{"already deleted", "/api/snapshots/" + snapshots[0].ID, http.StatusNotFound},
+		{"only snapshot", "/api/snapshots/" + snapshots[1].ID, http.StatusConflict},
+		{"only snapshot forced", "/api/snapshots/" + snapshots[1].ID + "?force=true", http.StatusNoContent},
+		{"invalid id", "/api/snapshots/nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := del(tt.target); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// The file itself is kept
+	if _, err := database.GetFile(file.ID); err != nil {
+		t.Errorf("GetFile() error: %v, want the file kept", err)
+	}
+}
+
+func TestSPA_APINotFound(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/nonexistent", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSPA_FallbackPageWithoutStaticFiles(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"not bundled", "GET /api/history", "DELETE /api/files/{id}"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("fallback page missing %q", want)
+		}
+	}
+
+	// API routes keep working
+	req = httptest.NewRequest("GET", "/api/stats", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("/api/stats status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSPA_FallbackPageWhenIndexMissing(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	// Mirrors a build with only the dist placeholder embedded
+	staticFS := fstest.MapFS{".gitkeep": &fstest.MapFile{}}
+	srv := New(database, staticFS, nil, nil, Options{})
+
+	req := httptest.NewRequest("GET", "/some/page", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "GET /api/stats") {
+		t.Error("fallback page should list API endpoints")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	staticFS := fstest.MapFS{
+		"index.html":    &fstest.MapFile{Data: []byte(`<html><head><base href="/" /><script src="./assets/app.js"></script></head></html>`)},
+		"assets/app.js": &fstest.MapFile{Data: []byte("console.log(1)")},
+	}
+	srv := New(database, staticFS, nil, nil, Options{BasePath: "/history/"})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/history/api/stats"); w.Code != http.StatusOK {
+		t.Errorf("/history/api/stats status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("/api/stats"); w.Code != http.StatusNotFound {
+		t.Errorf("/api/stats without prefix status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get("/history/api/nonexistent"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown API route status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get("/history/assets/app.js"); w.Code != http.StatusOK || w.Body.String() != "console.log(1)" {
+		t.Errorf("asset: status = %d, body = %q", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/history/", "/history/files/abc"} {
+		w := get(path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", path, w.Code, http.StatusOK)
+			continue
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, `<base href="/history/" />`) || strings.Contains(body, `<base href="/" />`) {
+			t.Errorf("%s: index.html base not rewritten: %s", path, body)
+		}
+	}
+
+	// A page without a <base> element gets one
+	staticFS["index.html"] = &fstest.MapFile{Data: []byte("<html><head><title>x</title></head></html>")}
+	if body := get("/history/").Body.String(); !strings.Contains(body, `<head>`+"\n"+`    <base href="/history/" />`) {
+		t.Errorf("base not injected: %s", body)
+	}
+}
+
+func TestSearchFiles_Pagination(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for i := range 5 {
+		path := fmt.Sprintf("/tmp/page%d.go", i)
+		if _, err := database.SaveSnapshot(path, []byte("content"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/files?q=page&limit=2&offset=0", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var files []db.File
+	if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got %d files, want 2", len(files))
+	}
+}
+
+func TestHandleHistory_Empty(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/history", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 0 {
+		t.Errorf("got %d entries, want 0", len(result.Entries))
+	}
+	if result.HasMore {
+		t.Error("hasMore = true, want false")
+	}
+}
+
+func TestHandleHistory_WithData(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/hist1.go", []byte("content1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveSnapshot("/tmp/hist2.go", []byte("content2"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/history", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(result.Entries))
+	}
+	if result.HasMore {
+		t.Error("hasMore = true, want false")
+	}
+
+	// Verify newest first
+	if result.Entries[0].FilePath != "/tmp/hist2.go" {
+		t.Errorf("entries[0].FilePath = %s, want /tmp/hist2.go", result.Entries[0].FilePath)
+	}
+	if result.Entries[1].FilePath != "/tmp/hist1.go" {
+		t.Errorf("entries[1].FilePath = %s, want /tmp/hist1.go", result.Entries[1].FilePath)
+	}
+}
+
+func TestHandleHistory_CustomLimit(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for i := range 5 {
+		path := fmt.Sprintf("/tmp/hlimit%d.go", i)
+		if _, err := database.SaveSnapshot(path, []byte(fmt.Sprintf("content%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/history?limit=3", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 3 {
+		t.Errorf("got %d entries, want 3", len(result.Entries))
+	}
+	if !result.HasMore {
+		t.Error("hasMore = false, want true (5 items with limit=3)")
+	}
+}
+
+func TestHandleHistory_NDJSON(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for i := range 3 {
+		path := fmt.Sprintf("/tmp/ndjson%d.go", i)
+		if _, err := database.SaveSnapshot(path, []byte(fmt.Sprintf("content%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/history?limit=2", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	if got := w.Header().Get("X-Has-More"); got != "true" {
+		t.Errorf("X-Has-More = %q, want true", got)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), w.Body.String())
+	}
+	for _, line := range lines {
+		var e db.HistoryEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q is not a history entry: %v", line, err)
+		}
+		if !strings.HasPrefix(e.FilePath, "/tmp/ndjson") {
+			t.Errorf("FilePath = %q, want /tmp/ndjson*", e.FilePath)
+		}
+	}
+}
+
+func TestHandleHistory_ConfiguredLimits(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	srv := New(database, nil, nil, nil, Options{HistoryDefaultLimit: 2, HistoryMaxLimit: 3})
+
+	for i := range 5 {
+		database.SaveSnapshot(fmt.Sprintf("/tmp/limit%d.go", i), []byte(fmt.Sprintf("v%d", i)), 0)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"?limit=3", 3},
+		{"?limit=100", 3},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/history"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		var result struct {
+			Entries []db.HistoryEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Entries) != tt.want {
+			t.Errorf("history%s: got %d entries, want %d", tt.query, len(result.Entries), tt.want)
+		}
+	}
+}
+
+func TestHandleHistory_Pagination(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for i := range 5 {
+		path := fmt.Sprintf("/tmp/hpage%d.go", i)
+		if _, err := database.SaveSnapshot(path, []byte(fmt.Sprintf("content%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Page 1: offset=0, limit=2
+	req := httptest.NewRequest("GET", "/api/history?limit=2&offset=0", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var page1 struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&page1); err != nil {
+		t.Fatal(err)
+	}
+	if len(page1.Entries) != 2 {
+		t.Errorf("page1: got %d entries, want 2", len(page1.Entries))
+	}
+	if !page1.HasMore {
+		t.Error("page1: hasMore = false, want true")
+	}
+
+	// Page 3: offset=4, limit=2
+	req = httptest.NewRequest("GET", "/api/history?limit=2&offset=4", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var page3 struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&page3); err != nil {
+		t.Fatal(err)
+	}
+	if len(page3.Entries) != 1 {
+		t.Errorf("page3: got %d entries, want 1", len(page3.Entries))
+	}
+	if page3.HasMore {
+		t.Error("page3: hasMore = true, want false")
+	}
+}
+
+func TestHandleHistory_IncludesRenames(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/hren1.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveRename("/tmp/hren1.go", "/tmp/hren2.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/history", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var result struct {
+		Entries []db.HistoryEntry `json:"entries"`
+		HasMore bool             `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2 (1 save + 1 rename)", len(result.Entries))
+	}
+
+	// Most recent first: rename, then save
+	if result.Entries[0].EntryType != "rename" {
+		t.Errorf("entries[0].EntryType = %s, want rename", result.Entries[0].EntryType)
+	}
+	if result.Entries[0].FilePath != "/tmp/hren2.go" {
+		t.Errorf("entries[0].FilePath = %s, want /tmp/hren2.go", result.Entries[0].FilePath)
+	}
+	if result.Entries[0].OldFilePath != "/tmp/hren1.go" {
+		t.Errorf("entries[0].OldFilePath = %s, want /tmp/hren1.go", result.Entries[0].OldFilePath)
+	}
+	if result.Entries[1].EntryType != "save" {
+		t.Errorf("entries[1].EntryType = %s, want save", result.Entries[1].EntryType)
+	}
+}
+
+func TestGetRenames_Empty(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/norename.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("norename.go", 1, 0, nil)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/renames", files[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Renames []db.Rename `json:"renames"`
+		HasMore bool        `json:"hasMore"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Renames == nil || len(resp.Renames) != 0 || resp.HasMore {
+		t.Errorf("got %+v, want an empty renames array without more", resp)
+	}
+}
+
+func TestGetRenames_WithData(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/renold.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := database.SaveRename("/tmp/renold.go", "/tmp/rennew.go")
+	if err != nil {
+		t.Fatalf("SaveRename() error: %v", err)
+	}
+
+	files, _ := database.SearchFiles("renold.go", 1, 0, nil)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/files/%s/renames", files[0].ID), nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Renames []db.Rename `json:"renames"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	renames := resp.Renames
+	if len(renames) != 1 {
+		t.Fatalf("got %d renames, want 1", len(renames))
+	}
+	if renames[0].OldPath != "/tmp/renold.go" {
+		t.Errorf("OldPath = %s, want /tmp/renold.go", renames[0].OldPath)
+	}
+	if renames[0].NewPath != "/tmp/rennew.go" {
+		t.Errorf("NewPath = %s, want /tmp/rennew.go", renames[0].NewPath)
+	}
+}
+
+func TestGetRenames_Pagination(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/pg0.go", []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// pg0 -> pg1 -> pg0 -> pg1: the same file ID is renamed back and forth
+	paths := []string{"/tmp/pg0.go", "/tmp/pg1.go", "/tmp/pg0.go", "/tmp/pg1.go"}
+	var fileID string
+	for i := 1; i < len(paths); i++ {
+		id, err := database.SaveRename(paths[i-1], paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			fileID = id
+		}
+	}
+
+	get := func(query string) (renames []db.Rename, hasMore bool) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/files/"+fileID+"/renames"+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		var resp struct {
+			Renames []db.Rename `json:"renames"`
+			HasMore bool        `json:"hasMore"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Renames, resp.HasMore
+	}
+
+	all, _ := get("")
+	if len(all) != 3 {
+		t.Fatalf("got %d renames, want 3", len(all))
+	}
+	page, hasMore := get("?limit=2")
+	if len(page) != 2 || !hasMore || page[0].ID != all[0].ID {
+		t.Errorf("first page = %d renames, hasMore %v, want the newest 2 with more", len(page), hasMore)
+	}
+	page, hasMore = get("?limit=2&offset=2")
+	if len(page) != 1 || hasMore || page[0].ID != all[2].ID {
+		t.Errorf("second page = %d renames, hasMore %v, want the oldest one without more", len(page), hasMore)
+	}
+}
+
+func TestLinkRename(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for _, p := range []string{"/tmp/before.go", "/tmp/after.go"} {
+		if _, err := database.SaveSnapshot(p, []byte("content"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := database.GetFileByPath("/tmp/before.go")
+	after, _ := database.GetFileByPath("/tmp/after.go")
+
+	post := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/files/"+id+"/link-rename", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(before.ID, fmt.Sprintf(`{"toFileId": %q}`, after.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp struct {
+		FileID  string      `json:"fileId"`
+		Lineage []db.Rename `json:"lineage"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.FileID != after.ID || len(resp.Lineage) != 1 ||
+		resp.Lineage[0].OldFileID != before.ID || resp.Lineage[0].NewFileID != after.ID {
+		t.Errorf("response = %+v, want one rename before -> after", resp)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		body string
+		want int
+	}{
+		{"already linked", before.ID, `{"newPath": "/tmp/after.go"}`, http.StatusConflict},
+		{"already linked reverse", after.ID, fmt.Sprintf(`{"toFileId": %q}`, before.ID), http.StatusConflict},
+		{"self", before.ID, fmt.Sprintf(`{"toFileId": %q}`, before.ID), http.StatusBadRequest},
+		{"unknown target", before.ID, `{"newPath": "/tmp/missing.go"}`, http.StatusNotFound},
+		{"unknown source", "00000000-0000-7000-8000-000000000000", `{"newPath": "/tmp/after.go"}`, http.StatusNotFound},
+		{"no target", before.ID, `{}`, http.StatusBadRequest},
+		{"both targets", before.ID, fmt.Sprintf(`{"toFileId": %q, "newPath": "/tmp/after.go"}`, after.ID), http.StatusBadRequest},
+		{"bad json", before.ID, `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := post(tt.id, tt.body); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestPromoteSnapshot(t *testing.T) {
+	srv, database := newTestServer(t)
+	// Promotion must not be skipped by a dedup window covering the old content
+	database.SetDedupWindow(-1)
+
+	for _, content := range []string{"v1", "v2"} {
+		if _, err := database.SaveSnapshot("/tmp/promote.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, _ := database.GetFileByPath("/tmp/promote.go")
+	snapshots, _ := database.GetSnapshots(file.ID)
+	v1 := snapshots[1].ID
+
+	post := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/snapshots/"+id+"/promote", nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(v1)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	var resp snapshotResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := database.GetLatestSnapshot(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != latest.ID || resp.ID == v1 || string(latest.Content) != "v1" {
+		t.Errorf("promoted = %+v, latest = %s %q, want a new latest snapshot with v1", resp, latest.ID, latest.Content)
+	}
+	if snapshots, _ := database.GetSnapshots(file.ID); len(snapshots) != 3 {
+		t.Errorf("got %d snapshots, want 3", len(snapshots))
+	}
+
+	// Promoting the same content again changes nothing
+	if w := post(v1); w.Code != http.StatusConflict {
+		t.Errorf("repeat: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if _, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{{FilePath: "/tmp/promote.png", Content: []byte{0, 1}, Binary: true}}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	binFile, _ := database.GetFileByPath("/tmp/promote.png")
+	binSnapshots, _ := database.GetSnapshots(binFile.ID)
+
+	tests := []struct {
+		name string
+		id   string
+		want int
+	}{
+		{"binary", binSnapshots[0].ID, http.StatusUnprocessableEntity},
+		{"unknown", "00000000-0000-7000-8000-000000000000", http.StatusNotFound},
+		{"invalid id", "nope", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := post(tt.id); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestGetTimeline(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for _, content := range []string{"v1", "v2"} {
+		if _, err := database.SaveSnapshot("/tmp/tlold.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newID, err := database.SaveRename("/tmp/tlold.go", "/tmp/tlnew.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SaveSnapshot("/tmp/tlnew.go", []byte("v3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	oldFile, _ := database.GetFileByPath("/tmp/tlold.go")
+
+	get := func(id string) []db.HistoryEntry {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/files/"+id+"/timeline", nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		var entries []db.HistoryEntry
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	types := func(entries []db.HistoryEntry) string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, e.EntryType)
+		}
+		return strings.Join(s, ",")
+	}
+
+	// Newest first; the rename appears on both sides
+	if got := get(newID); types(got) != "save,rename" || got[1].OldFilePath != "/tmp/tlold.go" {
+		t.Errorf("new file timeline = %+v, want save then rename from /tmp/tlold.go", got)
+	}
+	if got := get(oldFile.ID); types(got) != "rename,save,save" || !got[2].IsNewFile {
+		t.Errorf("old file timeline = %+v, want rename then two saves, the first new", got)
+	}
+
+	req := httptest.NewRequest("GET", "/api/files/00000000-0000-7000-8000-000000000000/timeline", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown file status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleCompressionStats(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	content := []byte(strings.Repeat("package main\n", 500))
+	if _, err := database.SaveSnapshot("/home/user/project-a/main.go", content, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/stats/compression", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var stats db.CompressionStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Snapshots != 1 || stats.LogicalBytes != int64(len(content)) {
+		t.Errorf("stats = %+v, want 1 snapshot of %d bytes", stats, len(content))
+	}
+	if stats.Ratio <= 0 || stats.Ratio >= 1 {
+		t.Errorf("Ratio = %v, want between 0 and 1", stats.Ratio)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		content  string
+		want     string
+	}{
+		{"whole match", []string{`sk-[a-z0-9]+`}, "key sk-abc123 here", "key *** here"},
+		{"groups only", []string{`(?m)^(?:API_KEY|TOKEN)=(.*)$`}, "API_KEY=abc\nDEBUG=1\nTOKEN=xyz\n", "API_KEY=***\nDEBUG=1\nTOKEN=***\n"},
+		{"nested groups", []string{`pw=((\w)\w*)`}, "pw=hunter2;", "pw=***;"},
+		{"several patterns", []string{`a+`, `b+`}, "xaaybbz", "x***y***z"},
+		{"no match", []string{`secret`}, "nothing to see", "nothing to see"},
+		{"empty match ignored", []string{`x*`}, "abc", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patterns []*regexp.Regexp
+			for _, p := range tt.patterns {
+				patterns = append(patterns, regexp.MustCompile(p))
+			}
+			if got := string(redact([]byte(tt.content), patterns)); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactPatterns_MaskContentAndReveal(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	watchSets := []config.WatchSet{
+		{Name: "secrets", Dirs: []string{"/home/user/secrets"}, RedactPatterns: []string{`(?m)^SECRET=(.*)$`}},
+		{Name: "code", Dirs: []string{"/home/user/code"}},
+	}
+
+	if _, err := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/home/user/secrets/.env", Content: []byte("SECRET=old\n"), WatchSet: "secrets"},
+	}); err[0] != nil {
+		t.Fatal(err[0])
+	}
+	if _, err := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/home/user/secrets/.env", Content: []byte("SECRET=hunter2\nNAME=app\n"), WatchSet: "secrets"},
+		{FilePath: "/home/user/code/.env", Content: []byte("SECRET=visible\n"), WatchSet: "code"},
+	}); err[0] != nil || err[1] != nil {
+		t.Fatal(err)
+	}
+	files, _ := database.SearchFiles("secrets/.env", 1, 0, nil)
+	snapshots, _ := database.GetSnapshots(files[0].ID)
+	latest, first := snapshots[0].ID, snapshots[1].ID
+
+	get := func(srv *Server, target string, auth bool) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	srv := New(database, nil, watchSets, nil, Options{})
+	for _, target := range []string{
+		"/api/snapshots/" + latest,
+		"/api/snapshots/" + latest + "/download",
+		"/api/snapshots/" + latest + "?offset=0&length=100",
+		"/api/diff?from=" + first + "&to=" + latest,
+		"/api/compare?from=" + first + "&to=" + latest,
+		"/api/files/" + files[0].ID + "/latest",
+		"/api/files/" + files[0].ID + "/export.json",
+		"/api/history",
+	} {
+		w := get(srv, target, false)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, http.StatusOK)
+			continue
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "hunter2") || strings.Contains(body, "SECRET=old") {
+			t.Errorf("%s: secret not masked: %s", target, body)
+		}
+		if !strings.Contains(body, "SECRET=***") {
+			t.Errorf("%s: masked value missing: %s", target, body)
+		}
+	}
+
+	// Files of sets without patterns are shown as stored
+	codeFiles, _ := database.SearchFiles("code/.env", 1, 0, nil)
+	if w := get(srv, "/api/files/"+codeFiles[0].ID+"/latest", false); !strings.Contains(w.Body.String(), "SECRET=visible") {
+		t.Errorf("unredacted set: body = %s", w.Body.String())
+	}
+
+	if w := get(srv, "/api/snapshots/"+latest+"?reveal=1", false); w.Code != http.StatusForbidden {
+		t.Errorf("reveal without basicAuth: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	authed := New(database, nil, watchSets, &config.BasicAuthConfig{Username: "admin", Password: "secret"}, Options{})
+	for _, target := range []string{
+		"/api/snapshots/" + latest + "?reveal=1",
+		"/api/snapshots/" + latest + "/download?reveal=1",
+	} {
+		w := get(authed, target, true)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "SECRET=hunter2") {
+			t.Errorf("%s: status = %d, body = %s; want revealed content", target, w.Code, w.Body.String())
+		}
+	}
+	if w := get(authed, "/api/snapshots/"+latest, true); strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("without reveal behind basicAuth: secret not masked: %s", w.Body.String())
+	}
+}
+
+func TestRedactPatterns_EachSideByItsOwnWatchSet(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	dir := t.TempDir()
+	secretsPath := filepath.Join(dir, "secrets", ".env")
+	codePath := filepath.Join(dir, "code", ".env")
+	watchSets := []config.WatchSet{
+		{Name: "secrets", Dirs: []string{filepath.Join(dir, "secrets")}, RedactPatterns: []string{`(?m)^SECRET=(.*)$`}},
+		{Name: "code", Dirs: []string{filepath.Join(dir, "code")}, RedactPatterns: []string{`(?m)^TOKEN=(.*)$`}},
+	}
+
+	if _, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: secretsPath, Content: []byte("SECRET=hunter2\nTOKEN=plain\n"), WatchSet: "secrets"},
+		{FilePath: codePath, Content: []byte("SECRET=visible\nTOKEN=abc123\n"), WatchSet: "code"},
+	}); errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	// The secrets file moved onto the code file, linking the two histories
+	if _, err := database.SaveRename(secretsPath, codePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(codePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(codePath, []byte("SECRET=visible\nTOKEN=abc123\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	secretsFile, _ := database.GetFileByPath(secretsPath)
+	codeFile, _ := database.GetFileByPath(codePath)
+	secretsSnaps, _ := database.GetSnapshots(secretsFile.ID)
+	codeSnaps, _ := database.GetSnapshots(codeFile.ID)
+	from, to := secretsSnaps[0].ID, codeSnaps[0].ID
+
+	srv := New(database, nil, watchSets, nil, Options{})
+	for _, target := range []string{
+		"/api/diff?from=" + from + "&to=" + to,
+		"/api/compare?from=" + from + "&to=" + to,
+		"/api/files/" + codeFile.ID + "/diff-live?from=" + from,
+	} {
+		req := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d: %s", target, w.Code, http.StatusOK, w.Body.String())
+			continue
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "hunter2") || strings.Contains(body, "abc123") {
+			t.Errorf("%s: secret not masked: %s", target, body)
+		}
+		// Rules of one set are not applied to the other side
+		if !strings.Contains(body, "SECRET=visible") || !strings.Contains(body, "TOKEN=plain") {
+			t.Errorf("%s: content masked by the other set's rules: %s", target, body)
+		}
+	}
+}
+
+func TestHandleRecentFiles(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, []config.WatchSet{
+		{Name: "project-a", Dirs: []string{"/home/user/project-a"}},
+	}, nil, Options{})
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if _, err := database.SaveSnapshot("/home/user/project-a/main.go", []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.SaveSnapshot("/home/user/project-b/other.go", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Files   []db.RecentFile `json:"files"`
+		HasMore bool            `json:"hasMore"`
+	}
+	req := httptest.NewRequest("GET", "/api/recent-files?watchSet=project-a", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Files) != 1 || resp.HasMore {
+		t.Fatalf("files = %+v, hasMore = %v; want one entry for main.go", resp.Files, resp.HasMore)
+	}
+	if got := resp.Files[0]; got.File.Path != "/home/user/project-a/main.go" || got.LatestSnapshot.Size != 2 {
+		t.Errorf("entry = %+v, want main.go with its latest snapshot", got)
+	}
+
+	req = httptest.NewRequest("GET", "/api/recent-files?limit=1", nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	resp.Files = nil
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Files) != 1 || !resp.HasMore {
+		t.Errorf("limit=1: %d files, hasMore = %v; want 1, true", len(resp.Files), resp.HasMore)
+	}
+}
+
+func TestHandleStaleFiles(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/fresh.txt", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (int, []db.StaleFile) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/files/stale"+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		var resp struct {
+			Files []db.StaleFile `json:"files"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Files
+	}
+
+	if code, files := get(""); code != http.StatusOK || len(files) != 0 {
+		t.Errorf("default days: status %d, files %+v; want 200 and none", code, files)
+	}
+	for _, bad := range []string{"?days=0", "?days=abc"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", bad, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHandleExtensionStats(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for _, path := range []string{"/home/user/project-a/main.go", "/home/user/project-a/util.go", "/home/user/project-a/notes.txt"} {
+		if _, err := database.SaveSnapshot(path, []byte("x"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/stats/extensions", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var stats []db.ExtensionStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Extension != ".go" || stats[0].Files != 2 || stats[1].Extension != ".txt" {
+		t.Errorf("stats = %+v, want .go (2 files) then .txt", stats)
+	}
+}
+
+func TestHandleActivity(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	watchSets := []config.WatchSet{{Name: "project-a", Dirs: []string{"/home/user/project-a"}}}
+	srv := New(database, nil, watchSets, nil, Options{})
+
+	for _, p := range []string{"/home/user/project-a/main.go", "/home/user/project-b/main.go"} {
+		if _, err := database.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.SaveRename("/home/user/project-a/main.go", "/home/user/project-a/app.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (int, []db.ActivityBucket) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/activity"+query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		var resp struct {
+			Buckets []db.ActivityBucket `json:"buckets"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Buckets
+	}
+	total := func(buckets []db.ActivityBucket) (saves, renames int) {
+		for _, b := range buckets {
+			saves += b.Saves
+			renames += b.Renames
+		}
+		return saves, renames
+	}
+
+	code, buckets := get("?bucket=86400")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(buckets) < 30 {
+		t.Errorf("got %d buckets, want at least 30 for the default range", len(buckets))
+	}
+	if saves, renames := total(buckets); saves != 2 || renames != 1 {
+		t.Errorf("totals = %d saves, %d renames, want 2, 1", saves, renames)
+	}
+
+	_, buckets = get("?bucket=3600&watchSet=project-a")
+	if saves, renames := total(buckets); saves != 1 || renames != 1 {
+		t.Errorf("project-a totals = %d saves, %d renames, want 1, 1", saves, renames)
+	}
+
+	for _, q := range []string{"?bucket=0", "?bucket=x", "?from=200&to=100", "?bucket=1&from=0&to=100000"} {
+		if code, _ := get(q); code != http.StatusBadRequest {
+			t.Errorf("GET /api/activity%s status = %d, want %d", q, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTruncatedSnapshot_Flags(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	saved, errs := database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/tmp/app.log", Content: []byte("tail of log\n"), Truncated: true},
+	})
+	if errs[0] != nil || !saved[0] {
+		t.Fatalf("SaveSnapshotRequests() = %v, %v", saved, errs)
+	}
+	file, _ := database.GetFileByPath("/tmp/app.log")
+	snaps, _ := database.GetSnapshots(file.ID)
+	if len(snaps) != 1 || !snaps[0].Truncated {
+		t.Fatalf("GetSnapshots() = %+v, want one truncated snapshot", snaps)
+	}
+
+	req := httptest.NewRequest("GET", "/api/snapshots/"+snaps[0].ID+"/download", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Content-Truncated") != "true" {
+		t.Errorf("download status = %d X-Content-Truncated = %q, want 200 true", w.Code, w.Header().Get("X-Content-Truncated"))
+	}
+
+	req = httptest.NewRequest("GET", "/api/diff?to="+snaps[0].ID, nil)
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	var diffResp struct {
+		ContentTruncated bool `json:"contentTruncated"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&diffResp); err != nil {
+		t.Fatal(err)
+	}
+	if !diffResp.ContentTruncated {
+		t.Error("diff contentTruncated = false, want true")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	srv := New(database, nil, nil, nil, Options{AccessLog: true, Logger: logger})
+
+	req := httptest.NewRequest("GET", "/api/files/not-a-uuid", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	var entry struct {
+		Msg    string `json:"msg"`
+		Method string `json:"method"`
+		Path   string `json:"path"`
+		Status int    `json:"status"`
+		Bytes  int64  `json:"bytes"`
+		Remote string `json:"remote"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log %q: %v", buf.String(), err)
+	}
+	if entry.Msg != "http request" || entry.Method != "GET" || entry.Path != "/api/files/not-a-uuid" ||
+		entry.Status != http.StatusBadRequest || entry.Bytes != int64(w.Body.Len()) || entry.Remote != "192.0.2.1:1234" {
+		t.Errorf("access log entry = %+v", entry)
+	}
+
+	// The event stream is never logged
+	buf.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req = httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx)
+	srv.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if buf.Len() != 0 {
+		t.Errorf("/api/events was logged: %s", buf.String())
+	}
+
+	// Also under a basePath
+	srv = New(database, nil, nil, nil, Options{AccessLog: true, Logger: logger, BasePath: "/history"})
+	req = httptest.NewRequest("GET", "/history/api/events", nil).WithContext(ctx)
+	srv.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if buf.Len() != 0 {
+		t.Errorf("/history/api/events was logged: %s", buf.String())
+	}
+}
+
+func TestGetRenames_NotFound(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/files/00000000-0000-7000-8000-000000000000/renames", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestGetRenames_InvalidID(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/files/abc/renames", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/database/dictionary?samples=100", nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("empty database: status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	for i := range 20 {
+		content := fmt.Sprintf("package main\n\nimport \"fmt\"\n\nfunc f%d() { fmt.Println(%d) }\n", i, i)
+		if _, err := database.SaveSnapshot(fmt.Sprintf("/tmp/dict%d.go", i), []byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := post()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var info db.DictionaryInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Samples != 20 || info.Size == 0 {
+		t.Errorf("info = %+v, want 20 samples and a non-empty dictionary", info)
+	}
+}
+
+func TestDatabaseDownload(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/dbdl.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/database/download", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "application/x-sqlite3") {
+		t.Errorf("content-type = %s, want application/x-sqlite3", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd == "" {
+		t.Error("missing Content-Disposition header")
+	} else if !strings.Contains(cd, "history-") || !strings.Contains(cd, ".db") {
+		t.Errorf("Content-Disposition = %s, want to contain history-*.db", cd)
+	}
+	if w.Body.Len() == 0 {
+		t.Error("response body is empty")
+	}
+
+	// Verify the downloaded content is a valid SQLite database
+	// SQLite magic bytes: "SQLite format 3\000"
+	body := w.Body.Bytes()
+	if len(body) < 16 {
+		t.Fatal("response body too short for SQLite header")
+	}
+	magic := string(body[:16])
+	if magic != "SQLite format 3\000" {
+		t.Errorf("not a valid SQLite file, magic = %q", magic)
+	}
+}
+
+func TestHeavyOpCheck(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	var busy error
+	srv := New(database, nil, nil, nil, Options{HeavyOpCheck: func() error { return busy }})
+
+	busy = errors.New("database is busy")
+	for _, rt := range []struct{ method, path string }{
+		{"GET", "/api/database/download"},
+		{"POST", "/api/database/dictionary"},
+	} {
+		req := httptest.NewRequest(rt.method, rt.path, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s status = %d, want %d", rt.method, rt.path, w.Code, http.StatusServiceUnavailable)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s: missing Retry-After header", rt.method, rt.path)
+		}
+		if !strings.Contains(w.Body.String(), "database is busy") {
+			t.Errorf("%s %s body = %s, want the hint", rt.method, rt.path, w.Body.String())
+		}
+	}
+
+	busy = nil
+	req := httptest.NewRequest("GET", "/api/database/download", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("allowed download status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestDatabaseDownload_Gzip(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/dbdl.go", []byte("package main"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/database/download?gzip=1", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Errorf("content-type = %s, want application/gzip", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasSuffix(cd, `.db.gz"`) {
+		t.Errorf("Content-Disposition = %s, want a .db.gz filename", cd)
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress error: %v", err)
+	}
+	if len(body) < 16 || string(body[:16]) != "SQLite format 3\000" {
+		t.Error("decompressed body is not a SQLite database")
+	}
+}
+
+func TestSnapshotTmpDir(t *testing.T) {
+	srv := New(nil, nil, []config.WatchSet{
+		{Name: "own", SnapshotTmpDir: "/mnt/big/own"},
+		{Name: "shared"},
+	}, nil, Options{SnapshotTmpDir: "/mnt/big"})
+
+	for name, want := range map[string]string{"": "/mnt/big", "shared": "/mnt/big", "own": "/mnt/big/own"} {
+		if got := srv.snapshotTmpDir(name); got != want {
+			t.Errorf("snapshotTmpDir(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := New(nil, nil, nil, nil, Options{}).snapshotTmpDir(""); got != os.TempDir() {
+		t.Errorf("default snapshotTmpDir = %q, want %q", got, os.TempDir())
+	}
+}
+
+func TestDatabaseDownload_EmptyDB(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/database/download", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Body.Len() == 0 {
+		t.Error("response body is empty even for empty database")
 	}
 }
 
-func TestDatabaseDownload(t *testing.T) {
+func TestDatabaseDownload_SharesInProgressCopy(t *testing.T) {
 	srv, database := newTestServer(t)
 
-	if _, err := database.SaveSnapshot("/tmp/dbdl.go", []byte("package main"), 0); err != nil {
-		t.Fatal(err)
+	first, _ := srv.acquireDownload(database, t.TempDir())
+	second, _ := srv.acquireDownload(database, t.TempDir())
+	if first != second {
+		t.Fatal("concurrent downloads should share one copy")
+	}
+	if first.err != nil {
+		t.Fatalf("CreateDatabaseSnapshot() error: %v", first.err)
 	}
 
+	// The shared copy survives until the last request releases it.
 	req := httptest.NewRequest("GET", "/api/database/download", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
-
 	if w.Code != http.StatusOK {
 		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
 	}
-	if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "application/x-sqlite3") {
-		t.Errorf("content-type = %s, want application/x-sqlite3", ct)
-	}
-	if cd := w.Header().Get("Content-Disposition"); cd == "" {
-		t.Error("missing Content-Disposition header")
-	} else if !strings.Contains(cd, "history-") || !strings.Contains(cd, ".db") {
-		t.Errorf("Content-Disposition = %s, want to contain history-*.db", cd)
-	}
-	if w.Body.Len() == 0 {
-		t.Error("response body is empty")
-	}
-
-	// Verify the downloaded content is a valid SQLite database
-	// SQLite magic bytes: "SQLite format 3\000"
-	body := w.Body.Bytes()
-	if len(body) < 16 {
-		t.Fatal("response body too short for SQLite header")
+	srv.releaseDownload(database, first)
+	if _, err := os.Stat(first.path); err != nil {
+		t.Errorf("copy removed while still in use: %v", err)
 	}
-	magic := string(body[:16])
-	if magic != "SQLite format 3\000" {
-		t.Errorf("not a valid SQLite file, magic = %q", magic)
+	srv.releaseDownload(database, second)
+	if _, err := os.Stat(first.path); !os.IsNotExist(err) {
+		t.Errorf("copy not removed after last release: %v", err)
 	}
 }
 
-func TestDatabaseDownload_EmptyDB(t *testing.T) {
-	srv, _ := newTestServer(t)
+func TestDatabaseDownload_RejectConcurrent(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{RejectConcurrentDownloads: true})
 
+	dl, _ := srv.acquireDownload(database, t.TempDir())
 	req := httptest.NewRequest("GET", "/api/database/download", nil)
 	w := httptest.NewRecorder()
 	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	srv.releaseDownload(database, dl)
 
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
 	if w.Code != http.StatusOK {
-		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
-	}
-	if w.Body.Len() == 0 {
-		t.Error("response body is empty even for empty database")
+		t.Errorf("status after release = %d, want %d", w.Code, http.StatusOK)
 	}
 }
 
@@ -815,6 +3228,70 @@ func TestHandleSSE_Connection(t *testing.T) {
 	}
 }
 
+func TestHandleSSE_ClientLimit(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{MaxSSEClients: 1})
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	connect := func(ctx context.Context) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	firstCtx, closeFirst := context.WithCancel(ctx)
+	first := connect(firstCtx)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first status = %d, want %d", first.StatusCode, http.StatusOK)
+	}
+
+	second := connect(ctx)
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second status = %d, want %d", second.StatusCode, http.StatusServiceUnavailable)
+	}
+	if second.Header.Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	// Disconnecting frees the slot.
+	closeFirst()
+	first.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.sseMu.Lock()
+		n := len(srv.sseClients)
+		srv.sseMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client was not unregistered after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := connect(ctx)
+	defer third.Body.Close()
+	if third.StatusCode != http.StatusOK {
+		t.Errorf("third status = %d, want %d", third.StatusCode, http.StatusOK)
+	}
+}
+
 func TestHandleSSE_ReceivesNotification(t *testing.T) {
 	srv, _ := newTestServer(t)
 
@@ -861,6 +3338,138 @@ func TestHandleSSE_ReceivesNotification(t *testing.T) {
 	}
 }
 
+func TestHandleSSE_StatsEvent(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	srv := New(database, nil, nil, nil, Options{SSEStatsInterval: 10 * time.Millisecond})
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := database.SaveSnapshot("/tmp/counted.go", []byte("abc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	srv.Notify("/tmp/counted.go")
+
+	scanner := bufio.NewScanner(resp.Body)
+	var prev string
+	for scanner.Scan() {
+		line := scanner.Text()
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || !strings.Contains(data, `"type":"stats"`) {
+			prev = line
+			continue
+		}
+		if strings.HasPrefix(prev, "id: ") {
+			t.Error("stats event should not carry an id")
+		}
+		var stats struct {
+			TotalFiles     int   `json:"totalFiles"`
+			TotalSnapshots int   `json:"totalSnapshots"`
+			TotalSize      int64 `json:"totalSize"`
+		}
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalFiles != 1 || stats.TotalSnapshots != 1 || stats.TotalSize != 3 {
+			t.Errorf("stats = %+v, want 1 file, 1 snapshot, 3 bytes", stats)
+		}
+		return
+	}
+	t.Fatal("timed out waiting for stats event")
+}
+
+func TestHandleSSE_ReplaysAfterLastEventID(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, p := range []string{"/tmp/one.go", "/tmp/two.go", "/tmp/three.go"} {
+		srv.Notify(p)
+	}
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var ids, data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(data) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+		if d, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, d)
+		}
+	}
+	if len(data) != 2 {
+		t.Fatalf("got %d replayed events, want 2", len(data))
+	}
+	if ids[0] != "2" || ids[1] != "3" {
+		t.Errorf("replayed ids = %v, want [2 3]", ids)
+	}
+	if !strings.Contains(data[0], "/tmp/two.go") || !strings.Contains(data[1], "/tmp/three.go") {
+		t.Errorf("replayed data = %v", data)
+	}
+}
+
+func TestEventsSince(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for i := range sseBufferSize + 10 {
+		srv.Notify(fmt.Sprintf("/tmp/f%d.go", i))
+	}
+	last := uint64(sseBufferSize + 10)
+
+	tests := []struct {
+		name        string
+		lastID      uint64
+		wantCount   int
+		wantRefresh bool
+	}{
+		{"upToDate", last, 0, false},
+		{"inBuffer", last - 5, 5, false},
+		{"evicted", 1, sseBufferSize, true},
+		{"fromBeforeRestart", last + 100, 0, true},
+	}
+	for _, tt := range tests {
+		srv.sseMu.Lock()
+		events, refresh := srv.eventsSince(tt.lastID)
+		srv.sseMu.Unlock()
+		if len(events) != tt.wantCount || refresh != tt.wantRefresh {
+			t.Errorf("%s: got %d events refresh=%v, want %d refresh=%v", tt.name, len(events), refresh, tt.wantCount, tt.wantRefresh)
+		}
+	}
+}
+
 func TestBasicAuth_RejectsWithoutCredentials(t *testing.T) {
 	dbPath := filepath.Join(t.TempDir(), "test.db")
 	database, err := db.New(dbPath)
@@ -870,7 +3479,7 @@ func TestBasicAuth_RejectsWithoutCredentials(t *testing.T) {
 	t.Cleanup(func() { database.Close() })
 
 	auth := &config.BasicAuthConfig{Username: "admin", Password: "secret"}
-	srv := New(database, nil, nil, auth)
+	srv := New(database, nil, nil, auth, Options{})
 
 	req := httptest.NewRequest("GET", "/api/stats", nil)
 	w := httptest.NewRecorder()
@@ -893,7 +3502,7 @@ func TestBasicAuth_RejectsWrongCredentials(t *testing.T) {
 	t.Cleanup(func() { database.Close() })
 
 	auth := &config.BasicAuthConfig{Username: "admin", Password: "secret"}
-	srv := New(database, nil, nil, auth)
+	srv := New(database, nil, nil, auth, Options{})
 
 	req := httptest.NewRequest("GET", "/api/stats", nil)
 	req.SetBasicAuth("admin", "wrong")
@@ -914,7 +3523,7 @@ func TestBasicAuth_AcceptsValidCredentials(t *testing.T) {
 	t.Cleanup(func() { database.Close() })
 
 	auth := &config.BasicAuthConfig{Username: "admin", Password: "secret"}
-	srv := New(database, nil, nil, auth)
+	srv := New(database, nil, nil, auth, Options{})
 
 	req := httptest.NewRequest("GET", "/api/stats", nil)
 	req.SetBasicAuth("admin", "secret")
@@ -1060,7 +3669,7 @@ func TestBasicAuth_NilConfigSkipsAuth(t *testing.T) {
 	}
 	t.Cleanup(func() { database.Close() })
 
-	srv := New(database, nil, nil, nil)
+	srv := New(database, nil, nil, nil, Options{})
 
 	req := httptest.NewRequest("GET", "/api/stats", nil)
 	w := httptest.NewRecorder()
@@ -1085,7 +3694,7 @@ func TestHandleHistory_WatchSetFilter(t *testing.T) {
 		{Name: "project-a", Dirs: []string{"/home/user/project-a"}},
 		{Name: "project-b", Dirs: []string{"/home/user/project-b"}},
 	}
-	srv := New(database, nil, watchSets, nil)
+	srv := New(database, nil, watchSets, nil, Options{})
 
 	// Save snapshots in different dirs
 	if _, err := database.SaveSnapshot("/home/user/project-a/main.go", []byte("a"), 0); err != nil {
@@ -1129,7 +3738,7 @@ func TestHandleHistory_UnknownWatchSetReturnsAll(t *testing.T) {
 	watchSets := []config.WatchSet{
 		{Name: "project-a", Dirs: []string{"/home/user/project-a"}},
 	}
-	srv := New(database, nil, watchSets, nil)
+	srv := New(database, nil, watchSets, nil, Options{})
 
 	if _, err := database.SaveSnapshot("/home/user/project-a/main.go", []byte("a"), 0); err != nil {
 		t.Fatal(err)
@@ -1166,7 +3775,7 @@ func TestSearchFiles_WatchSetFilter(t *testing.T) {
 		{Name: "project-a", Dirs: []string{"/home/user/project-a"}},
 		{Name: "project-b", Dirs: []string{"/home/user/project-b"}},
 	}
-	srv := New(database, nil, watchSets, nil)
+	srv := New(database, nil, watchSets, nil, Options{})
 
 	if _, err := database.SaveSnapshot("/home/user/project-a/main.go", []byte("a"), 0); err != nil {
 		t.Fatal(err)
@@ -1196,12 +3805,176 @@ func TestSearchFiles_WatchSetFilter(t *testing.T) {
 	}
 }
 
+func TestSearchFiles_SortParam(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	for _, p := range []string{"/tmp/b.go", "/tmp/c.go", "/tmp/a.go"} {
+		if _, err := database.SaveSnapshot(p, []byte(p), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?sort=name", []string{"/tmp/a.go", "/tmp/b.go", "/tmp/c.go"}},
+		{"?sort=path&order=desc", []string{"/tmp/c.go", "/tmp/b.go", "/tmp/a.go"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/files"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tt.query, w.Code, http.StatusOK)
+		}
+		var files []db.File
+		if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Path)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, q := range []string{"?sort=size", "?sort=path%20desc", "?order=up"} {
+		req := httptest.NewRequest("GET", "/api/files"+q, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/files%s status = %d, want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSearchFiles_CaseInsensitiveParam(t *testing.T) {
+	srv, database := newTestServer(t)
+
+	if _, err := database.SaveSnapshot("/tmp/Main.go", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/files?q=main", 1},
+		{"/api/files?q=main&caseInsensitive=0", 0},
+		{"/api/files?q=Main&caseInsensitive=false", 1},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		var files []db.File
+		if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != tt.want {
+			t.Errorf("%s: got %d files, want %d", tt.path, len(files), tt.want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/history?q=MAIN", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	var history struct {
+		Entries []db.HistoryEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Entries) != 1 {
+		t.Errorf("history: got %d entries, want 1", len(history.Entries))
+	}
+}
+
+func TestListDirectories_WatchSetFilter(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	watchSets := []config.WatchSet{
+		{Name: "project-a", Dirs: []string{"/home/user/project-a"}},
+		{Name: "project-b", Dirs: []string{"/home/user/project-b"}},
+	}
+	srv := New(database, nil, watchSets, nil, Options{})
+
+	for _, path := range []string{"/home/user/project-a/main.go", "/home/user/project-b/cmd/app.go"} {
+		if _, err := database.SaveSnapshot(path, []byte("x"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/directories?watchSet=project-b", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var dirs []string
+	if err := json.NewDecoder(w.Body).Decode(&dirs); err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0] != "/home/user/project-b/cmd" {
+		t.Errorf("dirs = %v, want [/home/user/project-b/cmd]", dirs)
+	}
+}
+
+func TestSearchFiles_WatchSetFilterUsesStoredName(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.New(dbPath)
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	// project-a's dir was later reorganized under project-b's tree
+	watchSets := []config.WatchSet{
+		{Name: "project-b", Dirs: []string{"/home/user/work"}},
+	}
+	srv := New(database, nil, watchSets, nil, Options{})
+
+	database.SaveSnapshotRequests([]db.SnapshotRequest{
+		{FilePath: "/home/user/work/a/main.go", Content: []byte("a"), WatchSet: "project-a"},
+		{FilePath: "/home/user/work/b/app.go", Content: []byte("b"), WatchSet: "project-b"},
+	})
+
+	for _, tt := range []struct {
+		watchSet string
+		wantPath string
+	}{
+		{"project-a", "/home/user/work/a/main.go"},
+		{"project-b", "/home/user/work/b/app.go"},
+	} {
+		req := httptest.NewRequest("GET", "/api/files?watchSet="+tt.watchSet, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		var files []db.File
+		if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Path != tt.wantPath {
+			t.Errorf("watchSet=%s: files = %+v, want only %s", tt.watchSet, files, tt.wantPath)
+		}
+	}
+}
+
 func TestResolveDirPrefixes(t *testing.T) {
 	watchSets := []config.WatchSet{
 		{Name: "proj-a", Dirs: []string{"/a", "/b"}},
 		{Name: "proj-b", Dirs: []string{"/c"}},
 	}
-	srv := New(nil, nil, watchSets, nil)
+	srv := New(nil, nil, watchSets, nil, Options{})
 
 	// Empty name returns nil
 	if got := srv.resolveDirPrefixes(""); got != nil {
@@ -1219,3 +3992,104 @@ func TestResolveDirPrefixes(t *testing.T) {
 		t.Errorf("resolveDirPrefixes(\"unknown\") = %v, want nil", got)
 	}
 }
+
+func TestWatchSetDB_ScopesRequests(t *testing.T) {
+	mainDB, err := db.New(filepath.Join(t.TempDir(), "main.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { mainDB.Close() })
+	ownDB, err := db.New(filepath.Join(t.TempDir(), "own.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { ownDB.Close() })
+
+	if _, err := mainDB.SaveSnapshot("/main/a.go", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ownDB.SaveSnapshot("/own/b.go", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	watchSets := []config.WatchSet{
+		{Name: "main", Dirs: []string{"/main"}},
+		{Name: "own", Dirs: []string{"/own"}, DBPath: "own.db"},
+	}
+	srv := New(mainDB, nil, watchSets, nil, Options{WatchSetDBs: map[string]*db.DB{"own": ownDB}})
+
+	tests := []struct {
+		query    string
+		wantPath string
+	}{
+		{"", "/main/a.go"},
+		{"?watchSet=main", "/main/a.go"},
+		{"?watchSet=own", "/own/b.go"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/files"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+
+		var files []db.File
+		if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Path != tt.wantPath {
+			t.Errorf("%q: got %+v, want only %s", tt.query, files, tt.wantPath)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/stats", nil)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	var stats struct {
+		WatchSets []watchSetInfo `json:"watchSets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range stats.WatchSets {
+		if ws.TotalFiles != 1 {
+			t.Errorf("watch set %s totalFiles = %d, want 1", ws.Name, ws.TotalFiles)
+		}
+	}
+}
+
+func TestRescan(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	var requested []string
+	watchSets := []config.WatchSet{{Name: "proj", Dirs: []string{"/proj"}}}
+	srv := New(database, nil, watchSets, nil, Options{
+		Rescan: func(watchSet string) error {
+			requested = append(requested, watchSet)
+			return nil
+		},
+	})
+
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"", http.StatusAccepted},
+		{"?watchSet=proj", http.StatusAccepted},
+		{"?watchSet=missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/rescan"+tt.query, nil)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: status = %d, want %d", tt.query, w.Code, tt.wantStatus)
+		}
+	}
+
+	if len(requested) != 2 || requested[0] != "" || requested[1] != "proj" {
+		t.Errorf("rescan requests = %q, want [\"\" \"proj\"]", requested)
+	}
+}
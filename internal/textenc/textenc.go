@@ -0,0 +1,85 @@
+// Package textenc detects and converts non-UTF-8 text encodings so such
+// files can be stored and diffed as UTF-8 and restored byte-for-byte, and
+// tells text from binary content.
+package textenc
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Encoding names recorded alongside converted snapshots.
+const (
+	UTF16LE = "utf-16le"
+	UTF16BE = "utf-16be"
+)
+
+var (
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// Detect reports the encoding of content based on its byte order mark.
+// Only BOM-prefixed UTF-16 is recognized; anything else returns "".
+func Detect(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, bomUTF16LE):
+		return UTF16LE
+	case bytes.HasPrefix(content, bomUTF16BE):
+		return UTF16BE
+	}
+	return ""
+}
+
+// BinaryCheckSize is the number of leading bytes IsBinary inspects.
+const BinaryCheckSize = 8192
+
+// IsBinary reports whether content has a NUL byte (0x00) in its first
+// BinaryCheckSize bytes (same heuristic as Git). UTF-16 text has NUL bytes,
+// so it must be converted with ToUTF8 first.
+func IsBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), BinaryCheckSize)], 0) >= 0
+}
+
+// ToUTF8 converts content in the named encoding to UTF-8, dropping the BOM.
+func ToUTF8(name string, content []byte) ([]byte, error) {
+	enc, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return out, nil
+}
+
+// FromUTF8 converts UTF-8 content back to the named encoding, including
+// its BOM. An empty name returns content unchanged.
+func FromUTF8(name string, content []byte) ([]byte, error) {
+	if name == "" {
+		return content, nil
+	}
+	enc, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := enc.NewEncoder().Bytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", name, err)
+	}
+	return out, nil
+}
+
+func lookup(name string) (encoding.Encoding, error) {
+	switch name {
+	case UTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case UTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", name)
+}
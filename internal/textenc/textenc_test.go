@@ -0,0 +1,44 @@
+package textenc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"utf16le", []byte{0xFF, 0xFE, 'a', 0}, UTF16LE},
+		{"utf16be", []byte{0xFE, 0xFF, 0, 'a'}, UTF16BE},
+		{"utf8", []byte("plain text"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := Detect(tt.content); got != tt.want {
+			t.Errorf("%s: Detect() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	original := []byte{0xFF, 0xFE, 'h', 0, 'i', 0, '\n', 0, 0x42, 0x30} // BOM "hi\nあ"
+
+	utf8, err := ToUTF8(UTF16LE, original)
+	if err != nil {
+		t.Fatalf("ToUTF8() error: %v", err)
+	}
+	if string(utf8) != "hi\nあ" {
+		t.Errorf("ToUTF8() = %q, want %q", utf8, "hi\nあ")
+	}
+
+	restored, err := FromUTF8(UTF16LE, utf8)
+	if err != nil {
+		t.Fatalf("FromUTF8() error: %v", err)
+	}
+	if !bytes.Equal(restored, original) {
+		t.Errorf("FromUTF8() = %v, want %v", restored, original)
+	}
+}
@@ -1,11 +1,16 @@
 package watcher
 
 import (
-	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/bmatcuk/doublestar/v4"
+	"github.com/unok/local-text-history/internal/config"
+	"github.com/unok/local-text-history/internal/textenc"
 )
 
 // shouldTrack returns true if the file should be tracked based on
@@ -21,7 +26,7 @@ func (w *Watcher) shouldTrack(filePath string) bool {
 			return false
 		}
 	}
-	return !w.isExcludedBy(filePath, ws.excludePatterns)
+	return !w.isExcludedBy(filePath, ws.excludePatterns) && !w.isIgnoredByFile(filePath, false)
 }
 
 // isExcluded checks if a path matches any exclude pattern of its owning WatchSet.
@@ -32,7 +37,7 @@ func (w *Watcher) isExcluded(dirPath string) bool {
 	if ws == nil {
 		return true
 	}
-	return w.isExcludedBy(dirPath, ws.excludePatterns)
+	return w.isExcludedBy(dirPath, ws.excludePatterns) || w.isIgnoredByFile(dirPath, true)
 }
 
 // isExcludedBy returns true if the path matches any of the given exclude patterns.
@@ -63,17 +68,107 @@ func (w *Watcher) isExcludedBy(filePath string, patterns []string) bool {
 }
 
 // binaryCheckSize is the number of bytes to inspect for NUL bytes.
-const binaryCheckSize = 8192
+const binaryCheckSize = textenc.BinaryCheckSize
 
 // isBinary returns true if the data contains a NUL byte (0x00) in
 // the first 8KB, indicating a binary file (same heuristic as Git).
 func isBinary(data []byte) bool {
-	if len(data) == 0 {
+	return textenc.IsBinary(data)
+}
+
+const (
+	// oversizedDirSample is how many files of a directory are inspected by
+	// isOversizedDir; oversizedDirMinFiles is the fewest needed to decide.
+	oversizedDirSample   = 20
+	oversizedDirMinFiles = 5
+	// oversizedDirRatio is the share of sampled files that must be
+	// oversized or binary for the directory to be left unwatched.
+	oversizedDirRatio = 0.9
+)
+
+// isOversizedDir reports whether dirPath should not be watched because
+// nearly all of its immediate files are larger than its WatchSet's
+// maxFileSize or binary. Only applies to sets with skipOversizedDirs, and
+// never to a WatchSet's root directories.
+func (w *Watcher) isOversizedDir(dirPath string) bool {
+	ws := w.findWatchSet(dirPath)
+	if ws == nil || !ws.skipOversized {
+		return false
+	}
+	for _, dir := range ws.dirs {
+		if dirPath+string(filepath.Separator) == dir {
+			return false
+		}
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false
+	}
+	sampled, untrackable := 0, 0
+	for _, entry := range entries {
+		if sampled == oversizedDirSample {
+			break
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sampled++
+		if info.Size() > ws.maxFileSize || hasBinaryPrefix(filepath.Join(dirPath, entry.Name())) {
+			untrackable++
+		}
+	}
+	return sampled >= oversizedDirMinFiles && float64(untrackable) >= oversizedDirRatio*float64(sampled)
+}
+
+// hasBinaryPrefix reads the start of a file and applies isBinary to it.
+func hasBinaryPrefix(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
 		return false
 	}
-	checkLen := len(data)
-	if checkLen > binaryCheckSize {
-		checkLen = binaryCheckSize
+	defer f.Close()
+	buf := make([]byte, binaryCheckSize)
+	n, _ := io.ReadFull(f, buf)
+	return isBinary(buf[:n])
+}
+
+// CountTrackableFiles returns how many files directly inside each of ws's
+// dirs would be tracked, applying the set's extension, exclude, ignore-file
+// and size filters. Subdirectories are not descended into, so the result is
+// a quick estimate rather than the number a full scan would import.
+func CountTrackableFiles(ws config.WatchSet) (int, error) {
+	w := &Watcher{
+		watchSets:   []watchSetRuntime{newWatchSetRuntime(ws)},
+		logger:      slog.Default(),
+		ignoreRules: make(map[string][]ignoreRule),
+	}
+
+	count := 0
+	for _, dir := range ws.Dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, fmt.Errorf("reading %s: %w", dir, err)
+		}
+		w.loadIgnoreFile(filepath.Join(dir, ignoreFileName))
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if !w.shouldTrack(path) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.Size() == 0 || info.Size() < ws.MinFileSize || info.Size() > ws.MaxFileSize {
+				continue
+			}
+			count++
+		}
 	}
-	return bytes.IndexByte(data[:checkLen], 0) >= 0
+	return count, nil
 }
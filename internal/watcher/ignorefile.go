@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreFileName is the per-directory exclusion file. Its patterns use
+// gitignore syntax and apply to paths under the directory containing it.
+const ignoreFileName = ".texthistory-ignore"
+
+// ignoreRule is a single parsed line of an ignore file.
+type ignoreRule struct {
+	pattern  string // slash-separated doublestar pattern
+	negate   bool   // "!pattern" re-includes a path
+	dirOnly  bool   // "pattern/" matches directories only
+	anchored bool   // pattern contains a slash: match the relative path, not just the name
+}
+
+// parseIgnoreRules parses gitignore-syntax lines. Blank lines and # comments
+// are skipped.
+func parseIgnoreRules(data string) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matches reports whether the rule applies to rel, a slash-separated path
+// relative to the ignore file's directory.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	name := rel
+	if !r.anchored {
+		name = rel[strings.LastIndex(rel, "/")+1:]
+	}
+	matched, err := doublestar.Match(r.pattern, name)
+	return err == nil && matched
+}
+
+// loadIgnoreFile (re)reads the ignore file at path. A missing file removes
+// the rules previously loaded for its directory.
+func (w *Watcher) loadIgnoreFile(path string) {
+	dir := filepath.Dir(path)
+	data, err := os.ReadFile(path)
+
+	w.ignoreMu.Lock()
+	defer w.ignoreMu.Unlock()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			w.logger.Warn("failed to read ignore file", "path", path, "err", err)
+		}
+		delete(w.ignoreRules, dir)
+		return
+	}
+	w.ignoreRules[dir] = parseIgnoreRules(string(data))
+}
+
+// isIgnoredByFile reports whether path is excluded by ignore files in its
+// ancestor directories. Outer files are applied first and the last matching
+// rule wins; a path inside an ignored directory is always ignored.
+func (w *Watcher) isIgnoredByFile(path string, isDir bool) bool {
+	w.ignoreMu.RLock()
+	defer w.ignoreMu.RUnlock()
+	if len(w.ignoreRules) == 0 {
+		return false
+	}
+
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules := w.ignoreRules[dirs[i]]
+		if len(rules) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for j := 1; j <= len(parts); j++ {
+			candidate := strings.Join(parts[:j], "/")
+			candidateIsDir := j < len(parts) || isDir
+			matched, excluded := false, false
+			for _, r := range rules {
+				if r.matches(candidate, candidateIsDir) {
+					matched, excluded = true, !r.negate
+				}
+			}
+			if !matched {
+				continue
+			}
+			if j < len(parts) {
+				if excluded {
+					return true
+				}
+				continue
+			}
+			ignored = excluded
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,68 @@
+package watcher
+
+import "time"
+
+// snapshotRateWindow is the window over which a WatchSet's
+// maxSnapshotsPerMinute is counted.
+const snapshotRateWindow = time.Minute
+
+// pathRate records the recent debounced snapshots of one path.
+type pathRate struct {
+	times     []time.Time // snapshot times within the window, oldest first
+	throttled bool        // a warning was logged for the current burst
+}
+
+// prune drops the snapshot times that fell out of the window ending at now.
+func (r *pathRate) prune(now time.Time) {
+	i := 0
+	for i < len(r.times) && now.Sub(r.times[i]) >= snapshotRateWindow {
+		i++
+	}
+	r.times = r.times[i:]
+}
+
+// rateDelayLocked returns how long filePath must wait before its next
+// snapshot to stay within limit snapshots per window, or 0 if it may be
+// taken now. A warning is logged when a path first hits the limit. The
+// caller must hold mu.
+func (w *Watcher) rateDelayLocked(filePath string, limit int, now time.Time) time.Duration {
+	r := w.rates[filePath]
+	if r == nil {
+		return 0
+	}
+	r.prune(now)
+	if len(r.times) < limit {
+		r.throttled = false
+		return 0
+	}
+	delay := r.times[len(r.times)-limit].Add(snapshotRateWindow).Sub(now)
+	if !r.throttled {
+		r.throttled = true
+		w.logger.Warn("snapshot rate limit reached, coalescing changes",
+			"path", filePath, "limit", limit, "delay", delay)
+	}
+	return delay
+}
+
+// recordSnapshotLocked notes a snapshot of filePath taken at now. Once per
+// window, paths without a snapshot left in it are forgotten so idle files
+// do not accumulate. The caller must hold mu.
+func (w *Watcher) recordSnapshotLocked(filePath string, now time.Time) {
+	r := w.rates[filePath]
+	if r == nil {
+		r = &pathRate{}
+		w.rates[filePath] = r
+	}
+	r.times = append(r.times, now)
+
+	if now.Sub(w.ratesSweptAt) < snapshotRateWindow {
+		return
+	}
+	for path, pr := range w.rates {
+		pr.prune(now)
+		if len(pr.times) == 0 {
+			delete(w.rates, path)
+		}
+	}
+	w.ratesSweptAt = now
+}
@@ -0,0 +1,137 @@
+package watcher
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// rootCheckInterval is how often the WatchSet roots are checked for having
+// disappeared or come back.
+const rootCheckInterval = 30 * time.Second
+
+// roots returns the cleaned dirs of every WatchSet.
+func (w *Watcher) roots() []string {
+	var roots []string
+	for _, ws := range w.watchSets {
+		for _, dir := range ws.dirs {
+			roots = append(roots, filepath.Clean(dir))
+		}
+	}
+	return roots
+}
+
+// monitorRoots runs checkRoots every rootCheckInterval until done is closed
+// or the watcher is closed.
+func (w *Watcher) monitorRoots(done <-chan struct{}) {
+	ticker := time.NewTicker(rootCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-w.closeCh:
+			return
+		case <-ticker.C:
+			w.checkRoots()
+		}
+	}
+}
+
+// checkRoots notices WatchSet roots that became inaccessible, which
+// fsnotify does not report once the watch is gone, and re-watches and
+// rescans roots that are back. A root recreated between two checks is
+// found by having dropped out of the watch list since the last check; a
+// root that was never in it, e.g. because adding its watch hit the inotify
+// limit, is not retried on every check.
+func (w *Watcher) checkRoots() {
+	watched := make(map[string]struct{})
+	for _, path := range w.fsWatcher.WatchList() {
+		watched[filepath.Clean(path)] = struct{}{}
+	}
+	wasWatched := w.watchedRoots
+	w.watchedRoots = make(map[string]struct{})
+
+	for _, root := range w.roots() {
+		info, err := os.Stat(root)
+		available := err == nil && info.IsDir()
+
+		w.rootMu.Lock()
+		_, wasUnavailable := w.unavailableRoots[root]
+		if !available {
+			w.unavailableRoots[root] = struct{}{}
+		}
+		w.rootMu.Unlock()
+
+		if !available {
+			if !wasUnavailable {
+				w.logger.Error("watch directory is unavailable", "dir", root, "err", err)
+			}
+			continue
+		}
+		_, inList := watched[root]
+		if inList {
+			w.watchedRoots[root] = struct{}{}
+			if !wasUnavailable {
+				continue
+			}
+		}
+		if _, dropped := wasWatched[root]; !inList && !dropped && !wasUnavailable {
+			continue
+		}
+		// An unfollowed symlink root is never watched; nothing to restore.
+		if linfo, err := os.Lstat(root); err == nil && linfo.Mode()&fs.ModeSymlink != 0 && !w.followsSymlinks(root) {
+			continue
+		}
+		if w.restoreRoot(root) {
+			w.watchedRoots[root] = struct{}{}
+		}
+	}
+}
+
+// restoreRoot re-adds the watches under root and rescans it for changes
+// made while it was not watched. It reports whether the watches were added.
+func (w *Watcher) restoreRoot(root string) bool {
+	if err := w.addDirRecursive(root); err != nil {
+		w.logger.Error("failed to re-watch directory", "dir", root, "err", err)
+		return false
+	}
+	w.rootMu.Lock()
+	delete(w.unavailableRoots, root)
+	w.rootMu.Unlock()
+	w.logger.Info("watch directory is available again", "dir", root)
+
+	select {
+	case <-w.closeCh:
+		return true
+	default:
+	}
+	w.scanWg.Add(1)
+	go func() {
+		defer w.scanWg.Done()
+		w.scanExistingFiles(root)
+	}()
+	return true
+}
+
+// markRootUnavailable records a root that was missing at startup so
+// checkRoots watches it once it appears.
+func (w *Watcher) markRootUnavailable(root string) {
+	w.rootMu.Lock()
+	defer w.rootMu.Unlock()
+	w.unavailableRoots[filepath.Clean(root)] = struct{}{}
+}
+
+// unavailableRootList returns the roots currently unavailable, sorted.
+func (w *Watcher) unavailableRootList() []string {
+	w.rootMu.Lock()
+	defer w.rootMu.Unlock()
+	var roots []string
+	for root := range w.unavailableRoots {
+		roots = append(roots, root)
+	}
+	slices.Sort(roots)
+	return roots
+}
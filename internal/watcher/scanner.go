@@ -1,9 +1,15 @@
 package watcher
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"io/fs"
-	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // tryStartScan attempts to register root for scanning. Returns true if scanning
@@ -34,15 +40,97 @@ func (w *Watcher) finishScan(root string) {
 // It is designed to be called asynchronously after a new directory is detected,
 // to pick up files that may have been missed by fsnotify event-driven model.
 func (w *Watcher) scanExistingFiles(root string) {
+	w.scanDir(root, true)
+}
+
+// Rescan re-imports existing files of the named WatchSet's dirs, or of all
+// WatchSets when name is empty, in the background. Dirs already being
+// scanned are skipped. Manual rescans ignore the initial scan limits.
+func (w *Watcher) Rescan(name string) error {
+	var roots []string
+	found := name == ""
+	for _, ws := range w.watchSets {
+		if name != "" && ws.name != name {
+			continue
+		}
+		found = true
+		for _, dir := range ws.dirs {
+			roots = append(roots, filepath.Clean(dir))
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown watch set %q", name)
+	}
+
+	select {
+	case <-w.closeCh:
+		return errors.New("watcher is closed")
+	default:
+	}
+	for _, root := range roots {
+		w.scanWg.Add(1)
+		go func() {
+			defer w.scanWg.Done()
+			w.scanDir(root, false)
+		}()
+	}
+	return nil
+}
+
+// scanDir walks root and queues snapshots of trackable files. With
+// applyLimits, the owning WatchSet's initial scan limits are honored.
+func (w *Watcher) scanDir(root string, applyLimits bool) {
 	if !w.tryStartScan(root) {
 		return
 	}
 	defer w.finishScan(root)
 
-	var scannedCount int
+	// Bulk import limits come from the WatchSet owning the scanned root;
+	// later changes to skipped files are still captured via events.
+	var maxFiles int
+	ws := w.findWatchSet(root)
+	if ws != nil && applyLimits {
+		if ws.skipScan {
+			w.logger.Info("scan skipped (skipInitialScan)", "root", root)
+			return
+		}
+		maxFiles = ws.maxScanFiles
+	}
+
+	// Every file the walk sees is noted to find tracked files that are gone.
+	// A root that cannot be read is not taken as all of its files deleted.
+	var found map[string]struct{}
+	if ws != nil && ws.trackDeletions {
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			found = make(map[string]struct{})
+		}
+	}
+	aborted := false
+
+	// Files are read and hashed by a bounded pool of workers that feed saveCh,
+	// so a large tree is not limited by a single reader.
+	// Files whose size and mtime match the last read are not read again.
+	paths := make(chan string)
+	var workers sync.WaitGroup
+	var unchangedCount atomic.Int64
+	for range w.scanConcurrency {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range paths {
+				if w.unchangedSinceLastRead(path) {
+					unchangedCount.Add(1)
+					continue
+				}
+				w.takeSnapshot(path, originScan)
+			}
+		}()
+	}
+
+	var scannedCount, skippedCount int
 	if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Printf("scan: skipping %s: %v", path, err)
+			w.logger.Warn("scan: skipping path", "path", path, "err", err)
 			if d != nil && d.IsDir() {
 				return fs.SkipDir
 			}
@@ -51,6 +139,7 @@ func (w *Watcher) scanExistingFiles(root string) {
 
 		select {
 		case <-w.closeCh:
+			aborted = true
 			return fs.SkipAll
 		default:
 		}
@@ -61,17 +150,121 @@ func (w *Watcher) scanExistingFiles(root string) {
 			}
 			return nil
 		}
+		if found != nil {
+			found[path] = struct{}{}
+		}
 
 		if w.shouldTrack(path) {
-			w.takeSnapshot(path)
-			scannedCount++
+			if maxFiles > 0 && scannedCount >= maxFiles {
+				skippedCount++
+				return nil
+			}
+			select {
+			case paths <- path:
+				scannedCount++
+			case <-w.closeCh:
+				aborted = true
+				return fs.SkipAll
+			}
 		}
 		return nil
 	}); err != nil {
-		log.Printf("scan walk error for %s: %v", root, err)
+		w.logger.Error("scan walk error", "root", root, "err", err)
 	}
+	close(paths)
+	workers.Wait()
 
 	if scannedCount > 0 {
-		log.Printf("scan completed: %s (%d files scanned)", root, scannedCount)
+		w.logger.Info("scan completed", "root", root, "scanned", scannedCount, "unchanged", unchangedCount.Load())
+	}
+	if skippedCount > 0 {
+		w.logger.Info("scan limit reached", "root", root, "skipped", skippedCount, "maxInitialScanFiles", maxFiles)
+	}
+	if found != nil && !aborted {
+		w.recordDeletions(ws, root, found)
+	}
+}
+
+// recordDeletions records the tracked files under root that a completed
+// walk did not find and that no longer exist. Files still on disk, e.g.
+// excluded since or in a directory the walk could not read, are kept, as
+// are files of a nested WatchSet, which its own scans handle.
+func (w *Watcher) recordDeletions(ws *watchSetRuntime, root string, found map[string]struct{}) {
+	list, save := w.trackedPaths, w.saveDeletion
+	if ws.trackedPaths != nil {
+		list, save = ws.trackedPaths, ws.saveDeletion
+	}
+	if list == nil || save == nil {
+		return
+	}
+	tracked, err := list([]string{root})
+	if err != nil {
+		w.logger.Error("scan: listing tracked files failed", "root", root, "err", err)
+		return
+	}
+
+	prefix := root + string(filepath.Separator)
+	for _, path := range tracked {
+		if _, ok := found[path]; ok || !strings.HasPrefix(path, prefix) || w.findWatchSet(path) != ws {
+			continue
+		}
+		if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := save(path); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				w.logger.Error("scan: recording deletion failed", "path", path, "err", err)
+			}
+			continue
+		}
+		w.logger.Info("deletion recorded", "path", path, "set", ws.name)
+		if w.OnDelete != nil {
+			w.OnDelete(path)
+		}
+	}
+}
+
+// SetDeletionTracker sets the functions scans of WatchSets with
+// trackDeletions use to list tracked files and record deleted ones.
+func (w *Watcher) SetDeletionTracker(list TrackedLister, save DeletionSaver) {
+	w.trackedPaths = list
+	w.saveDeletion = save
+}
+
+// SetWatchSetDeletionTracker sets the deletion tracker for the named
+// WatchSet, e.g. when its history is kept in a separate database.
+func (w *Watcher) SetWatchSetDeletionTracker(name string, list TrackedLister, save DeletionSaver) error {
+	for i := range w.watchSets {
+		if w.watchSets[i].name == name {
+			w.watchSets[i].trackedPaths = list
+			w.watchSets[i].saveDeletion = save
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown watch set %q", name)
+}
+
+// unchangedSinceLastRead reports whether path's size and mtime match the
+// fingerprint recorded when it was last read.
+func (w *Watcher) unchangedSinceLastRead(path string) bool {
+	lookup := w.fingerprints
+	if ws := w.findWatchSet(path); ws != nil && ws.fingerprints != nil {
+		lookup = ws.fingerprints
+	}
+	if lookup == nil {
+		return false
+	}
+	fp, err := lookup(path)
+	if err != nil {
+		w.logger.Warn("scan: fingerprint lookup failed", "path", path, "err", err)
+		return false
+	}
+	if fp.ModTime == 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
 	}
+	return info.Size() == fp.Size && info.ModTime().UnixNano() == fp.ModTime
 }
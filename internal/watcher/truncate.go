@@ -0,0 +1,74 @@
+package watcher
+
+import (
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// readLimited reads the file at path, or only limit bytes of it when it is
+// larger: the leading bytes when keepHead is set, else the trailing ones.
+// truncated reports whether part of the file was left out.
+func readLimited(path string, limit int64, keepHead bool) (content []byte, truncated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() <= limit {
+		content, err = io.ReadAll(f)
+		return content, false, err
+	}
+	offset := info.Size() - limit
+	if keepHead {
+		offset = 0
+	}
+	content = make([]byte, limit)
+	n, err := f.ReadAt(content, offset)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return trimPartialRune(content[:n], keepHead), true, nil
+}
+
+// truncateContent keeps at most limit bytes of content, from the start when
+// keepHead is set, else from the end. truncated reports whether anything
+// was cut.
+func truncateContent(content []byte, limit int64, keepHead bool) (kept []byte, truncated bool) {
+	if int64(len(content)) <= limit {
+		return content, false
+	}
+	if keepHead {
+		return trimPartialRune(content[:limit], true), true
+	}
+	return trimPartialRune(content[int64(len(content))-limit:], false), true
+}
+
+// trimPartialRune drops the UTF-8 sequence cut in half at the truncated end
+// of b: the trailing incomplete rune when the head was kept, or the leading
+// continuation bytes when the tail was kept. Text stays valid UTF-8 so it is
+// not mistaken for binary.
+func trimPartialRune(b []byte, keepHead bool) []byte {
+	if keepHead {
+		for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+			if utf8.RuneStart(b[len(b)-i]) {
+				if !utf8.FullRune(b[len(b)-i:]) {
+					return b[:len(b)-i]
+				}
+				break
+			}
+		}
+		return b
+	}
+	for i := 0; i < utf8.UTFMax-1 && i < len(b); i++ {
+		if utf8.RuneStart(b[i]) {
+			return b[i:]
+		}
+	}
+	return b
+}
@@ -1,23 +1,40 @@
 package watcher
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/unok/local-text-history/internal/config"
+	"github.com/unok/local-text-history/internal/db"
+	"github.com/unok/local-text-history/internal/textenc"
 )
 
 const (
 	saveRetryCount = 3
 	saveRetryDelay = 1 * time.Second
 	saveQueueSize  = 10000
+
+	// Snapshot origins recorded with each save for diagnostics.
+	originWrite  = "write"
+	originCreate = "create"
+	originScan   = "scan"
+	originRename = "rename" // snapshot of a file's new path after a detected move
+
+	// immediateFlushInterval is the delay used for ImmediateExtensions.
+	// Unlike the debounce, further writes do not push it back, so a file
+	// written continuously is still captured at most once per interval.
+	immediateFlushInterval = 1 * time.Second
 )
 
 // SnapshotSaver is called when a file change should be persisted.
@@ -25,16 +42,34 @@ type SnapshotSaver func(filePath string, content []byte, maxSnapshots int) (bool
 
 // SnapshotBatchSaver saves multiple snapshots in a single transaction.
 // Returns a saved flag and error for each input item.
-type SnapshotBatchSaver func(filePaths []string, contents [][]byte, maxSnapshots []int) ([]bool, []error)
+type SnapshotBatchSaver func(reqs []db.SnapshotRequest) ([]bool, []error)
 
 // RenameSaver is called when a file rename is detected.
 type RenameSaver func(oldPath, newPath string) (string, error)
 
+// FingerprintLookup returns the size and mtime recorded when a file was
+// last read (zero if unknown). Scans skip files that still match.
+type FingerprintLookup func(filePath string) (db.FileFingerprint, error)
+
+// TrackedLister returns the paths of the tracked files under dirPrefixes.
+type TrackedLister func(dirPrefixes []string) ([]string, error)
+
+// DeletionSaver records that a tracked file was deleted from disk.
+type DeletionSaver func(filePath string) error
+
 // saveJob represents a queued DB write operation.
 type saveJob struct {
 	filePath     string
 	content      []byte
 	maxSnapshots int    // per-WatchSet maxSnapshots
+	watchSet     string // name of the owning WatchSet
+	encoding     string // original encoding if content was transcoded to UTF-8
+	binary       bool   // metadata-only entry; content is hashed but not stored
+	modTime      int64  // file mtime in unix seconds
+	fingerprint  db.FileFingerprint
+	normalizeEOL bool   // hash with CRLF converted to LF
+	origin       string // what triggered the snapshot (origin* constants)
+	truncated    bool   // content is only part of the file (maxStoredBytes)
 	oldPath      string // rename only
 	newPath      string // rename only
 	rename       bool
@@ -43,6 +78,26 @@ type saveJob struct {
 // Config holds watcher configuration.
 type Config struct {
 	WatchSets []config.WatchSet
+	// ScanConcurrency is the number of files read in parallel while scanning
+	// existing files. Values < 1 mean 1.
+	ScanConcurrency int
+	// MaxPendingTimers caps the number of debounce timers. When a new path
+	// would exceed it, the oldest pending paths are snapshotted right away.
+	// 0 means unlimited.
+	MaxPendingTimers int
+	// MaxBatchSnapshots and MaxBatchBytes bound a single save transaction:
+	// a drained batch exceeding either is saved in several transactions.
+	// 0 means unlimited.
+	MaxBatchSnapshots int
+	MaxBatchBytes     int64
+	// AllowMissingDirs lets New start with WatchSet dirs that do not exist
+	// yet; they are watched once they appear.
+	AllowMissingDirs bool
+	// RenameTimeout is how long a Rename event waits for the Create that
+	// pairs with it. 0 means defaultRenameTimeout.
+	RenameTimeout time.Duration
+	// Logger receives the watcher's log output. Nil means slog.Default().
+	Logger *slog.Logger
 }
 
 // watchSetRuntime holds pre-computed runtime data for a WatchSet.
@@ -50,10 +105,35 @@ type watchSetRuntime struct {
 	name            string
 	dirs            []string // normalized paths (with trailing separator)
 	extSet          map[string]struct{}
+	immediateExts   map[string]struct{}
 	excludePatterns []string
 	debounceSec     int
 	maxFileSize     int64
+	minFileSize     int64
 	maxSnapshots    int
+	stabilize       bool
+	detectEncoding  bool
+	trackBinary     bool
+	maxScanFiles    int                // 0 = unlimited
+	skipScan        bool               // do not import existing files of new directories
+	skipOversized   bool               // leave directories of mostly untrackable files unwatched
+	followSymlinks  bool               // watch directories reached through symlinks
+	normalizeEOL    bool               // hash content with CRLF converted to LF
+	trackDeletions  bool               // scans record tracked files gone from disk
+	maxPerMinute    int                // snapshots per path per minute; 0 = unlimited
+	maxStoredBytes  int64              // store only this many bytes of larger files; 0 = whole files
+	keepHead        bool               // truncation keeps the start of the file instead of the end
+	saveBatch       SnapshotBatchSaver // overrides Watcher.saveBatch when non-nil
+	saveRename      RenameSaver        // overrides Watcher.saveRename when non-nil
+	fingerprints    FingerprintLookup  // overrides Watcher.fingerprints when non-nil
+	trackedPaths    TrackedLister      // with saveDeletion, overrides the Watcher's when non-nil
+	saveDeletion    DeletionSaver
+}
+
+// fileState is the size and mtime observed by a stabilization check.
+type fileState struct {
+	size    int64
+	modTime time.Time
 }
 
 // pendingRename tracks a Rename event waiting for a matching Create.
@@ -64,21 +144,59 @@ type pendingRename struct {
 
 // Watcher monitors directories for file changes and triggers snapshots.
 type Watcher struct {
-	fsWatcher      *fsnotify.Watcher
-	watchSets      []watchSetRuntime
-	save           SnapshotSaver
-	saveBatch      SnapshotBatchSaver
-	saveRename     RenameSaver
-	timers         map[string]*time.Timer
-	mu             sync.Mutex
-	OnSnapshot     func(filePath string)
-	OnRename       func(oldPath, newPath string)
-	pendingRenames map[string]pendingRename
-	saveCh         chan saveJob
-	closeCh        chan struct{}
-	scanningDirs   map[string]struct{}
-	scanMu         sync.Mutex
-	scanWg         sync.WaitGroup
+	fsWatcher       *fsnotify.Watcher
+	watchSets       []watchSetRuntime
+	save            SnapshotSaver
+	saveBatch       SnapshotBatchSaver
+	saveRename      RenameSaver
+	fingerprints    FingerprintLookup
+	trackedPaths    TrackedLister
+	saveDeletion    DeletionSaver
+	logger          *slog.Logger
+	timers          map[string]*time.Timer
+	timerOrder      *list.List               // pending paths, oldest first; guarded by mu
+	timerElems      map[string]*list.Element // position of each path in timerOrder
+	timerOrigins    map[string]string        // origin each pending timer will snapshot with
+	maxTimers       int
+	maxBatchCount   int                  // snapshots per save transaction; 0 = unlimited
+	maxBatchBytes   int64                // content bytes per save transaction; 0 = unlimited
+	stableChecks    map[string]fileState // last observation per path, for stabilizing sets
+	rates           map[string]*pathRate // recent snapshots per path, for rate-limited sets
+	ratesSweptAt    time.Time
+	mu              sync.Mutex
+	OnSnapshot      func(filePath string)
+	OnRename        func(oldPath, newPath string)
+	OnDelete        func(filePath string)
+	pendingRenames  map[string]pendingRename
+	renameTimeout   time.Duration
+	saveCh          chan saveJob
+	closeCh         chan struct{}
+	scanningDirs    map[string]struct{}
+	scanMu          sync.Mutex
+	scanWg          sync.WaitGroup
+	scanConcurrency int
+	// watchLimitHit is set once adding a directory watch failed with ENOSPC.
+	watchLimitHit atomic.Bool
+	// savingJobs counts the jobs of the batch the save worker is writing.
+	savingJobs atomic.Int64
+	// unavailableRoots holds WatchSet dirs that are missing or inaccessible.
+	unavailableRoots map[string]struct{}
+	rootMu           sync.Mutex
+	// watchedRoots holds the roots that were in the watch list at the last
+	// root check; only checkRoots uses it.
+	watchedRoots map[string]struct{}
+	// ignoreRules holds parsed .texthistory-ignore files keyed by directory.
+	ignoreRules map[string][]ignoreRule
+	ignoreMu    sync.RWMutex
+}
+
+// WatchStats reports the state of the directory watches.
+type WatchStats struct {
+	Watches      int  // number of directories currently watched
+	LimitReached bool // a watch could not be added because the OS limit was hit
+	// UnavailableDirs are WatchSet dirs that are currently missing or
+	// inaccessible, and so not watched.
+	UnavailableDirs []string
 }
 
 // New creates a Watcher with the given configuration and save function.
@@ -90,57 +208,124 @@ func New(cfg Config, save SnapshotSaver) (*Watcher, error) {
 
 	runtimes := make([]watchSetRuntime, len(cfg.WatchSets))
 	for i, ws := range cfg.WatchSets {
-		extSet := make(map[string]struct{}, len(ws.Extensions))
-		for _, ext := range ws.Extensions {
-			extSet[ext] = struct{}{}
-		}
-		normalizedDirs := make([]string, len(ws.Dirs))
-		for j, dir := range ws.Dirs {
-			if !strings.HasSuffix(dir, string(filepath.Separator)) {
-				normalizedDirs[j] = dir + string(filepath.Separator)
-			} else {
-				normalizedDirs[j] = dir
-			}
-		}
-		runtimes[i] = watchSetRuntime{
-			name:            ws.Name,
-			dirs:            normalizedDirs,
-			extSet:          extSet,
-			excludePatterns: ws.ExcludePatterns,
-			debounceSec:     ws.DebounceSec,
-			maxFileSize:     ws.MaxFileSize,
-			maxSnapshots:    ws.MaxSnapshots,
-		}
+		runtimes[i] = newWatchSetRuntime(ws)
+	}
+
+	scanConcurrency := cfg.ScanConcurrency
+	if scanConcurrency < 1 {
+		scanConcurrency = 1
+	}
+	renameTimeout := cfg.RenameTimeout
+	if renameTimeout <= 0 {
+		renameTimeout = defaultRenameTimeout
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
 	}
 
 	w := &Watcher{
-		fsWatcher:      fsw,
-		watchSets:      runtimes,
-		save:           save,
-		timers:         make(map[string]*time.Timer),
-		pendingRenames: make(map[string]pendingRename),
-		saveCh:         make(chan saveJob, saveQueueSize),
-		closeCh:        make(chan struct{}),
-		scanningDirs:   make(map[string]struct{}),
+		fsWatcher:        fsw,
+		watchSets:        runtimes,
+		save:             save,
+		logger:           logger,
+		timers:           make(map[string]*time.Timer),
+		timerOrder:       list.New(),
+		timerElems:       make(map[string]*list.Element),
+		timerOrigins:     make(map[string]string),
+		maxTimers:        cfg.MaxPendingTimers,
+		maxBatchCount:    cfg.MaxBatchSnapshots,
+		maxBatchBytes:    cfg.MaxBatchBytes,
+		stableChecks:     make(map[string]fileState),
+		rates:            make(map[string]*pathRate),
+		pendingRenames:   make(map[string]pendingRename),
+		renameTimeout:    renameTimeout,
+		saveCh:           make(chan saveJob, saveQueueSize),
+		closeCh:          make(chan struct{}),
+		scanningDirs:     make(map[string]struct{}),
+		scanConcurrency:  scanConcurrency,
+		ignoreRules:      make(map[string][]ignoreRule),
+		unavailableRoots: make(map[string]struct{}),
 	}
 
 	for _, ws := range cfg.WatchSets {
 		for _, dir := range ws.Dirs {
+			if _, err := os.Stat(dir); cfg.AllowMissingDirs && errors.Is(err, fs.ErrNotExist) {
+				logger.Warn("watch directory does not exist, waiting for it", "dir", dir)
+				w.markRootUnavailable(dir)
+				continue
+			}
 			if err := w.addDirRecursive(dir); err != nil {
 				fsw.Close()
 				return nil, fmt.Errorf("adding watch directory %q: %w", dir, err)
 			}
 		}
 	}
+	watched := make(map[string]struct{})
+	for _, path := range fsw.WatchList() {
+		watched[filepath.Clean(path)] = struct{}{}
+	}
+	w.watchedRoots = make(map[string]struct{})
+	for _, root := range w.roots() {
+		if _, ok := watched[root]; ok {
+			w.watchedRoots[root] = struct{}{}
+		}
+	}
 
 	return w, nil
 }
 
+// newWatchSetRuntime pre-computes the lookup tables for ws.
+func newWatchSetRuntime(ws config.WatchSet) watchSetRuntime {
+	extSet := make(map[string]struct{}, len(ws.Extensions))
+	for _, ext := range ws.Extensions {
+		extSet[ext] = struct{}{}
+	}
+	immediateExts := make(map[string]struct{}, len(ws.ImmediateExtensions))
+	for _, ext := range ws.ImmediateExtensions {
+		immediateExts[ext] = struct{}{}
+	}
+	normalizedDirs := make([]string, len(ws.Dirs))
+	for j, dir := range ws.Dirs {
+		dir = filepath.Clean(dir)
+		if !strings.HasSuffix(dir, string(filepath.Separator)) {
+			dir += string(filepath.Separator)
+		}
+		normalizedDirs[j] = dir
+	}
+	return watchSetRuntime{
+		name:            ws.Name,
+		dirs:            normalizedDirs,
+		extSet:          extSet,
+		immediateExts:   immediateExts,
+		excludePatterns: ws.ExcludePatterns,
+		debounceSec:     ws.DebounceSec,
+		maxFileSize:     ws.MaxFileSize,
+		minFileSize:     ws.MinFileSize,
+		maxSnapshots:    ws.MaxSnapshots,
+		stabilize:       ws.Stabilize,
+		detectEncoding:  ws.DetectEncoding,
+		trackBinary:     ws.TrackBinaryMetadata,
+		maxScanFiles:    ws.MaxInitialScanFiles,
+		skipScan:        ws.SkipInitialScan,
+		skipOversized:   ws.SkipOversizedDirs,
+		followSymlinks:  ws.FollowSymlinks,
+		normalizeEOL:    ws.NormalizeLineEndings,
+		trackDeletions:  ws.TrackDeletions,
+		maxPerMinute:    ws.MaxSnapshotsPerMinute,
+		maxStoredBytes:  ws.MaxStoredBytes,
+		keepHead:        ws.TruncateKeep == config.TruncateKeepHead,
+	}
+}
+
 // findWatchSet returns the WatchSet whose dir is a prefix of the given file path.
 // Uses longest-prefix match. Returns nil if no match is found.
 // Dirs in watchSetRuntime are normalized with trailing separator (e.g. "/home/user/projects/").
 // This also matches the exact directory path without the trailing separator.
+// filePath is cleaned first, so redundant or (on Windows) mixed separators
+// do not affect the match.
 func (w *Watcher) findWatchSet(filePath string) *watchSetRuntime {
+	filePath = filepath.Clean(filePath)
 	var best *watchSetRuntime
 	bestLen := 0
 	for i := range w.watchSets {
@@ -169,9 +354,59 @@ func (w *Watcher) SetBatchSaver(saver SnapshotBatchSaver) {
 	w.saveBatch = saver
 }
 
+// SetFingerprintLookup sets the function scans use to skip files
+// unchanged since they were last read. Nil disables skipping.
+func (w *Watcher) SetFingerprintLookup(lookup FingerprintLookup) {
+	w.fingerprints = lookup
+}
+
+// SetWatchSetFingerprintLookup sets the fingerprint lookup for the named
+// WatchSet, e.g. when its history is kept in a separate database.
+func (w *Watcher) SetWatchSetFingerprintLookup(name string, lookup FingerprintLookup) error {
+	for i := range w.watchSets {
+		if w.watchSets[i].name == name {
+			w.watchSets[i].fingerprints = lookup
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown watch set %q", name)
+}
+
+// SetWatchSetSavers routes the named WatchSet's snapshots and renames to
+// dedicated savers (e.g. a per-set database) instead of the defaults.
+func (w *Watcher) SetWatchSetSavers(name string, batch SnapshotBatchSaver, rename RenameSaver) error {
+	for i := range w.watchSets {
+		if w.watchSets[i].name == name {
+			w.watchSets[i].saveBatch = batch
+			w.watchSets[i].saveRename = rename
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown watch set %q", name)
+}
+
+// batchSaverFor returns the batch saver for the named WatchSet.
+func (w *Watcher) batchSaverFor(watchSet string) SnapshotBatchSaver {
+	for i := range w.watchSets {
+		if w.watchSets[i].name == watchSet && w.watchSets[i].saveBatch != nil {
+			return w.watchSets[i].saveBatch
+		}
+	}
+	return w.saveBatch
+}
+
+// renameSaverFor returns the rename saver for the WatchSet containing newPath.
+func (w *Watcher) renameSaverFor(newPath string) RenameSaver {
+	if ws := w.findWatchSet(newPath); ws != nil && ws.saveRename != nil {
+		return ws.saveRename
+	}
+	return w.saveRename
+}
+
 // Run starts the event loop. It blocks until the done channel is closed.
 func (w *Watcher) Run(done <-chan struct{}) {
 	go w.saveWorker(done)
+	go w.monitorRoots(done)
 	for {
 		select {
 		case <-done:
@@ -185,7 +420,7 @@ func (w *Watcher) Run(done <-chan struct{}) {
 			if !ok {
 				return
 			}
-			log.Printf("watcher error: %v", err)
+			w.logger.Error("watcher error", "err", err)
 		}
 	}
 }
@@ -198,11 +433,21 @@ func (w *Watcher) saveWorker(done <-chan struct{}) {
 			w.processBatch(w.drainAll())
 			return
 		case job := <-w.saveCh:
-			w.processBatch(w.drainBatch(job))
+			batch := w.drainBatch(job)
+			w.savingJobs.Store(int64(len(batch)))
+			w.processBatch(batch)
+			w.savingJobs.Store(0)
 		}
 	}
 }
 
+// QueuedSaves returns how many snapshot and rename jobs are waiting to be
+// written or being written. Changes still in their debounce delay are not
+// counted.
+func (w *Watcher) QueuedSaves() int {
+	return len(w.saveCh) + int(w.savingJobs.Load())
+}
+
 // drainBatch collects the first job plus any additional queued jobs without blocking.
 func (w *Watcher) drainBatch(first saveJob) []saveJob {
 	batch := []saveJob{first}
@@ -236,46 +481,86 @@ func (w *Watcher) processBatch(batch []saveJob) {
 		return
 	}
 
-	var snapshots []saveJob
+	// Snapshots are grouped by WatchSet so each group goes to its own saver.
+	snapshots := make(map[string][]saveJob)
+	var setOrder []string
 	var renames []saveJob
 	for _, j := range batch {
 		if j.rename {
 			renames = append(renames, j)
-		} else {
-			snapshots = append(snapshots, j)
+			continue
 		}
+		if _, ok := snapshots[j.watchSet]; !ok {
+			setOrder = append(setOrder, j.watchSet)
+		}
+		snapshots[j.watchSet] = append(snapshots[j.watchSet], j)
 	}
 
-	if len(snapshots) > 0 {
-		w.processSnapshotBatch(snapshots)
+	for _, name := range setOrder {
+		saver := w.batchSaverFor(name)
+		for _, chunk := range splitBatch(snapshots[name], w.maxBatchCount, w.maxBatchBytes) {
+			w.processSnapshotBatch(chunk, saver)
+		}
 	}
 	for _, r := range renames {
 		w.processSingleRename(r.oldPath, r.newPath)
 	}
 }
 
+// splitBatch divides jobs into consecutive chunks of at most maxCount jobs
+// and maxBytes of content, so each is saved in a bounded transaction. A job
+// larger than maxBytes gets a chunk of its own. Zero limits are ignored.
+func splitBatch(jobs []saveJob, maxCount int, maxBytes int64) [][]saveJob {
+	var chunks [][]saveJob
+	start := 0
+	var size int64
+	for i, j := range jobs {
+		n := int64(len(j.content))
+		full := maxCount > 0 && i-start >= maxCount
+		if maxBytes > 0 && i > start && size+n > maxBytes {
+			full = true
+		}
+		if full {
+			chunks = append(chunks, jobs[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	if start < len(jobs) {
+		chunks = append(chunks, jobs[start:])
+	}
+	return chunks
+}
+
 // processSnapshotBatch saves snapshots using bulk insert with retry fallback.
-func (w *Watcher) processSnapshotBatch(snapshots []saveJob) {
-	filePaths := make([]string, len(snapshots))
-	contents := make([][]byte, len(snapshots))
-	maxSnapshotsSlice := make([]int, len(snapshots))
+func (w *Watcher) processSnapshotBatch(snapshots []saveJob, saver SnapshotBatchSaver) {
+	reqs := make([]db.SnapshotRequest, len(snapshots))
 	for i, s := range snapshots {
-		filePaths[i] = s.filePath
-		contents[i] = s.content
-		maxSnapshotsSlice[i] = s.maxSnapshots
+		reqs[i] = db.SnapshotRequest{
+			FilePath:             s.filePath,
+			Content:              s.content,
+			MaxSnapshots:         s.maxSnapshots,
+			WatchSet:             s.watchSet,
+			Encoding:             s.encoding,
+			Binary:               s.binary,
+			ModTime:              s.modTime,
+			Origin:               s.origin,
+			Fingerprint:          s.fingerprint,
+			NormalizeLineEndings: s.normalizeEOL,
+			Truncated:            s.truncated,
+		}
 	}
 
 	var savedSlice []bool
 	var errSlice []error
 
-	saver := w.saveBatch
 	if saver == nil {
 		// Fallback: save individually with retry
 		savedSlice = make([]bool, len(snapshots))
 		errSlice = make([]error, len(snapshots))
 		for i := range snapshots {
 			for attempt := range saveRetryCount {
-				savedSlice[i], errSlice[i] = w.save(filePaths[i], contents[i], maxSnapshotsSlice[i])
+				savedSlice[i], errSlice[i] = w.save(reqs[i].FilePath, reqs[i].Content, reqs[i].MaxSnapshots)
 				if errSlice[i] == nil {
 					break
 				}
@@ -289,7 +574,7 @@ func (w *Watcher) processSnapshotBatch(snapshots []saveJob) {
 		}
 	} else {
 		for attempt := range saveRetryCount {
-			savedSlice, errSlice = saver(filePaths, contents, maxSnapshotsSlice)
+			savedSlice, errSlice = saver(reqs)
 			if !w.hasDatabaseLockedError(errSlice) {
 				break
 			}
@@ -301,11 +586,11 @@ func (w *Watcher) processSnapshotBatch(snapshots []saveJob) {
 
 	for i, s := range snapshots {
 		if errSlice[i] != nil {
-			log.Printf("failed to save snapshot for %s: %v", s.filePath, errSlice[i])
+			w.logger.Error("failed to save snapshot", "path", s.filePath, "set", s.watchSet, "err", errSlice[i])
 			continue
 		}
 		if savedSlice[i] {
-			log.Printf("snapshot saved: %s", s.filePath)
+			w.logger.Info("snapshot saved", "path", s.filePath, "set", s.watchSet, "size", len(s.content), "origin", s.origin)
 			if w.OnSnapshot != nil {
 				go w.OnSnapshot(s.filePath)
 			}
@@ -324,10 +609,11 @@ func (w *Watcher) hasDatabaseLockedError(errs []error) bool {
 
 // processSingleRename saves a single rename record with retry.
 func (w *Watcher) processSingleRename(oldPath, newPath string) {
+	saveRename := w.renameSaverFor(newPath)
 	var newFileID string
 	var err error
 	for attempt := range saveRetryCount {
-		newFileID, err = w.saveRename(oldPath, newPath)
+		newFileID, err = saveRename(oldPath, newPath)
 		if err == nil {
 			break
 		}
@@ -339,40 +625,71 @@ func (w *Watcher) processSingleRename(oldPath, newPath string) {
 		}
 	}
 	if err != nil {
-		log.Printf("failed to save rename %s -> %s: %v", oldPath, newPath, err)
+		w.logger.Error("failed to save rename", "from", oldPath, "to", newPath, "err", err)
 		return
 	}
 	if newFileID == "" {
 		// Old file not tracked (e.g. temp file renamed to real file) — skip silently
 		return
 	}
-	log.Printf("rename recorded: %s -> %s", oldPath, newPath)
+	w.logger.Info("rename recorded", "from", oldPath, "to", newPath)
 	if w.OnRename != nil {
 		w.OnRename(oldPath, newPath)
 	}
 }
 
-// Close stops the watcher and cancels all pending timers.
+// Close stops the watcher. Paths still waiting for their debounce are
+// snapshotted and saved before it returns, so a clean shutdown does not
+// drop recent edits.
 func (w *Watcher) Close() error {
 	close(w.closeCh)
 	w.scanWg.Wait()
 	w.mu.Lock()
-	for _, timer := range w.timers {
-		timer.Stop()
+	var pending []saveJob // paths, in the order they became pending
+	for elem := w.timerOrder.Front(); elem != nil; elem = elem.Next() {
+		path := elem.Value.(string)
+		// A timer that already fired is taking its own snapshot
+		if w.timers[path].Stop() {
+			pending = append(pending, saveJob{filePath: path, origin: w.timerOrigins[path]})
+		}
 	}
 	w.timers = nil
+	w.timerOrder.Init()
+	w.timerElems = nil
+	w.timerOrigins = nil
+	w.stableChecks = nil
+	w.rates = nil
 	w.pendingRenames = nil
 	w.mu.Unlock()
 	w.scanMu.Lock()
 	w.scanningDirs = nil
 	w.scanMu.Unlock()
+
+	// Saved here rather than queued: the save worker may already have
+	// exited if Run's done channel was closed first.
+	var batch []saveJob
+	for _, p := range pending {
+		if job, ok := w.readSnapshot(p.filePath, p.origin); ok {
+			batch = append(batch, job)
+		}
+	}
+	if len(batch) > 0 {
+		w.logger.Info("flushing pending snapshots", "count", len(batch))
+		w.processBatch(batch)
+	}
 	return w.fsWatcher.Close()
 }
 
-// renameTimeout is how long to wait for a Create event after a Rename event.
-const renameTimeout = 500 * time.Millisecond
+// defaultRenameTimeout is how long to wait for a Create event after a Rename
+// event when Config.RenameTimeout is not set.
+const defaultRenameTimeout = 500 * time.Millisecond
 
 func (w *Watcher) handleEvent(event fsnotify.Event) {
+	// Keep per-directory ignore rules in sync with their files
+	if filepath.Base(event.Name) == ignoreFileName {
+		w.loadIgnoreFile(event.Name)
+	}
+
 	// Handle Rename events: track pending renames
 	if event.Has(fsnotify.Rename) {
 		w.mu.Lock()
@@ -383,10 +700,10 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 		w.mu.Unlock()
 
 		// Schedule cleanup of stale pending renames
-		time.AfterFunc(renameTimeout, func() {
+		time.AfterFunc(w.renameTimeout, func() {
 			w.mu.Lock()
 			if pr, ok := w.pendingRenames[event.Name]; ok {
-				if time.Since(pr.timestamp) >= renameTimeout {
+				if time.Since(pr.timestamp) >= w.renameTimeout {
 					delete(w.pendingRenames, event.Name)
 				}
 			}
@@ -401,7 +718,7 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 		if err == nil && info.IsDir() {
 			if !w.isExcluded(event.Name) {
 				if err := w.addDirRecursive(event.Name); err != nil {
-					log.Printf("failed to watch new directory %s: %v", event.Name, err)
+					w.logger.Error("failed to watch new directory", "path", event.Name, "err", err)
 				}
 				w.scanWg.Add(1)
 				go func() {
@@ -415,7 +732,7 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 		// Check if this Create follows a Rename (file was moved)
 		if w.tryMatchRename(event.Name) {
 			// Rename matched and processed; still take a snapshot of the new file
-			w.scheduleSnapshotIfTrackable(event.Name)
+			w.scheduleSnapshotIfTrackable(event.Name, originRename)
 			return
 		}
 	}
@@ -429,7 +746,11 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 		return
 	}
 
-	w.scheduleSnapshot(event.Name)
+	origin := originWrite
+	if event.Has(fsnotify.Create) {
+		origin = originCreate
+	}
+	w.scheduleSnapshot(event.Name, origin)
 }
 
 // tryMatchRename checks if a Create event at newPath matches any pending Rename.
@@ -444,7 +765,7 @@ func (w *Watcher) tryMatchRename(newPath string) bool {
 	defer w.mu.Unlock()
 
 	for oldPath, pr := range w.pendingRenames {
-		if time.Since(pr.timestamp) > renameTimeout {
+		if time.Since(pr.timestamp) > w.renameTimeout {
 			delete(w.pendingRenames, oldPath)
 			continue
 		}
@@ -473,19 +794,25 @@ func (w *Watcher) processRename(oldPath, newPath string) {
 }
 
 // scheduleSnapshotIfTrackable schedules a snapshot only if the file should be tracked.
-func (w *Watcher) scheduleSnapshotIfTrackable(filePath string) {
+func (w *Watcher) scheduleSnapshotIfTrackable(filePath, origin string) {
 	if !w.shouldTrack(filePath) {
 		return
 	}
-	w.scheduleSnapshot(filePath)
+	w.scheduleSnapshot(filePath, origin)
 }
 
-func (w *Watcher) scheduleSnapshot(filePath string) {
+// scheduleSnapshot (re)starts the debounce timer for filePath. origin is the
+// event that triggered it; when events are coalesced the latest one wins.
+func (w *Watcher) scheduleSnapshot(filePath, origin string) {
 	ws := w.findWatchSet(filePath)
 	if ws == nil {
 		return
 	}
 	debounce := time.Duration(ws.debounceSec) * time.Second
+	_, immediate := ws.immediateExts[filepath.Ext(filePath)]
+	if immediate {
+		debounce = immediateFlushInterval
+	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -495,62 +822,299 @@ func (w *Watcher) scheduleSnapshot(filePath string) {
 	}
 
 	if timer, exists := w.timers[filePath]; exists {
+		// Immediate paths keep the pending flush so that constant writes
+		// (e.g. logs) still coalesce into one snapshot per interval.
+		if immediate {
+			return
+		}
 		timer.Stop()
+	} else {
+		w.flushOldestTimersLocked()
+	}
+
+	// A path over its rate limit waits until it may be snapshotted again,
+	// coalescing every change in between.
+	delay := debounce
+	if ws.maxPerMinute > 0 {
+		delay = max(delay, w.rateDelayLocked(filePath, ws.maxPerMinute, time.Now()))
 	}
 
-	w.timers[filePath] = time.AfterFunc(debounce, func() {
-		w.takeSnapshot(filePath)
+	w.startTimerLocked(filePath, origin, delay, debounce)
+}
+
+// startTimerLocked arms the debounce timer for filePath and stores it. The
+// callback is handed its own timer so it can tell whether a newer timer
+// has replaced it meanwhile. The caller must hold mu.
+func (w *Watcher) startTimerLocked(filePath, origin string, delay, debounce time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		// timer is assigned while mu is held
 		w.mu.Lock()
-		delete(w.timers, filePath)
+		self := timer
 		w.mu.Unlock()
+		w.onDebounceFired(filePath, origin, debounce, self)
 	})
+	w.setTimerLocked(filePath, origin, timer)
 }
 
-func (w *Watcher) takeSnapshot(filePath string) {
+// setTimerLocked stores the pending timer for filePath. A path that is
+// already pending keeps its place in the insertion order. The caller must
+// hold mu.
+func (w *Watcher) setTimerLocked(filePath, origin string, timer *time.Timer) {
+	w.timers[filePath] = timer
+	w.timerOrigins[filePath] = origin
+	if _, ok := w.timerElems[filePath]; !ok {
+		w.timerElems[filePath] = w.timerOrder.PushBack(filePath)
+	}
+}
+
+// deleteTimerLocked forgets the pending timer for filePath. The caller must
+// hold mu.
+func (w *Watcher) deleteTimerLocked(filePath string) {
+	delete(w.timers, filePath)
+	delete(w.timerOrigins, filePath)
+	if elem, ok := w.timerElems[filePath]; ok {
+		w.timerOrder.Remove(elem)
+		delete(w.timerElems, filePath)
+	}
+}
+
+// flushOldestTimersLocked makes room for one more pending timer when
+// maxTimers is set, firing the oldest pending timers immediately instead
+// of waiting for their debounce. The caller must hold mu.
+func (w *Watcher) flushOldestTimersLocked() {
+	if w.maxTimers <= 0 {
+		return
+	}
+	for len(w.timers) >= w.maxTimers {
+		front := w.timerOrder.Front()
+		if front == nil {
+			return
+		}
+		path := front.Value.(string)
+		timer := w.timers[path]
+		// The entry goes now so the limit holds; the callback sees it is no
+		// longer pending and leaves any newer timer for path alone.
+		w.deleteTimerLocked(path)
+		// A timer that already fired is taking its snapshot now
+		if timer != nil && timer.Stop() {
+			timer.Reset(0)
+		}
+		w.logger.Debug("pending timer limit reached, flushing oldest", "path", path, "limit", w.maxTimers)
+	}
+}
+
+// onDebounceFired takes the snapshot once the debounce timer expires.
+// For stabilizing WatchSets, the snapshot is postponed by another debounce
+// period until the file's size and mtime are unchanged between two checks,
+// so files that are still being written (e.g. downloads) are not captured
+// half-way. timer is the timer that fired; the pending entry for filePath
+// is only touched while it is still that timer, as an event during the
+// snapshot may have scheduled a newer one.
+func (w *Watcher) onDebounceFired(filePath, origin string, debounce time.Duration, timer *time.Timer) {
 	ws := w.findWatchSet(filePath)
-	if ws == nil {
+	if ws != nil && ws.stabilize && !w.checkStable(filePath) {
+		w.mu.Lock()
+		if current, ok := w.timers[filePath]; w.timers != nil && (!ok || current == timer) {
+			// A flushed timer is no longer counted; make room again
+			if !ok {
+				w.flushOldestTimersLocked()
+			}
+			w.startTimerLocked(filePath, origin, debounce, debounce)
+		}
+		w.mu.Unlock()
 		return
 	}
 
+	w.takeSnapshot(filePath, origin)
+	w.mu.Lock()
+	if w.timers != nil {
+		if current, ok := w.timers[filePath]; ok && current == timer {
+			w.deleteTimerLocked(filePath)
+		}
+		if ws != nil && ws.maxPerMinute > 0 {
+			w.recordSnapshotLocked(filePath, time.Now())
+		}
+	}
+	w.mu.Unlock()
+}
+
+// checkStable records the file's current size and mtime and reports whether
+// they match the previous observation. A file that cannot be stat'ed is
+// reported stable so takeSnapshot can handle it as usual.
+func (w *Watcher) checkStable(filePath string) bool {
+	info, err := os.Stat(filePath)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stableChecks == nil {
+		return true
+	}
+	if err != nil {
+		delete(w.stableChecks, filePath)
+		return true
+	}
+
+	current := fileState{size: info.Size(), modTime: info.ModTime()}
+	prev, seen := w.stableChecks[filePath]
+	if seen && prev.size == current.size && prev.modTime.Equal(current.modTime) {
+		delete(w.stableChecks, filePath)
+		return true
+	}
+	w.stableChecks[filePath] = current
+	return false
+}
+
+// takeSnapshot reads filePath and queues it for saving.
+func (w *Watcher) takeSnapshot(filePath, origin string) {
+	if job, ok := w.readSnapshot(filePath, origin); ok {
+		w.saveCh <- job
+	}
+}
+
+// readSnapshot reads filePath and builds its save job. It reports false if
+// the file is gone, outside its WatchSet's limits, or unreadable.
+func (w *Watcher) readSnapshot(filePath, origin string) (saveJob, bool) {
+	ws := w.findWatchSet(filePath)
+	if ws == nil {
+		return saveJob{}, false
+	}
+
 	info, err := os.Stat(filePath)
 	if err != nil {
 		// File may have been deleted between event and snapshot
-		return
+		return saveJob{}, false
 	}
 
 	if info.Size() > ws.maxFileSize {
-		return
+		return saveJob{}, false
 	}
 
-	if info.Size() == 0 {
-		return
+	if info.Size() == 0 || info.Size() < ws.minFileSize {
+		return saveJob{}, false
 	}
 
-	content, err := os.ReadFile(filePath)
+	// Only the stored part is read, unless the encoding has to be detected
+	// from the BOM at the start of the whole file.
+	var content []byte
+	var truncated bool
+	if ws.maxStoredBytes > 0 && !ws.detectEncoding {
+		content, truncated, err = readLimited(filePath, ws.maxStoredBytes, ws.keepHead)
+	} else {
+		content, err = os.ReadFile(filePath)
+	}
 	if err != nil {
-		log.Printf("failed to read file %s: %v", filePath, err)
-		return
+		w.logger.Warn("failed to read file", "path", filePath, "err", err)
+		return saveJob{}, false
 	}
 
-	if isBinary(content) {
-		return
+	// BOM-prefixed UTF-16 would otherwise look binary (NUL bytes)
+	var encoding string
+	if ws.detectEncoding {
+		if enc := textenc.Detect(content); enc != "" {
+			converted, err := textenc.ToUTF8(enc, content)
+			if err != nil {
+				w.logger.Warn("failed to decode file", "path", filePath, "encoding", enc, "err", err)
+				return saveJob{}, false
+			}
+			content, encoding = converted, enc
+		}
+	}
+	if ws.maxStoredBytes > 0 && !truncated {
+		content, truncated = truncateContent(content, ws.maxStoredBytes, ws.keepHead)
+	}
+
+	binary := isBinary(content)
+	if binary && !ws.trackBinary {
+		return saveJob{}, false
 	}
 
-	w.saveCh <- saveJob{filePath: filePath, content: content, maxSnapshots: ws.maxSnapshots}
+	return saveJob{filePath: filePath, content: content, maxSnapshots: ws.maxSnapshots, watchSet: ws.name, encoding: encoding, binary: binary, modTime: info.ModTime().Unix(), origin: origin,
+		fingerprint: db.FileFingerprint{Size: info.Size(), ModTime: info.ModTime().UnixNano()}, normalizeEOL: ws.normalizeEOL, truncated: truncated}, true
+}
+
+// followsSymlinks reports whether path's WatchSet follows directory symlinks.
+func (w *Watcher) followsSymlinks(path string) bool {
+	ws := w.findWatchSet(path)
+	return ws != nil && ws.followSymlinks
+}
+
+// WatchStats returns the current number of directory watches and whether
+// the OS watch limit has been hit.
+func (w *Watcher) WatchStats() WatchStats {
+	return WatchStats{
+		Watches:         len(w.fsWatcher.WatchList()),
+		LimitReached:    w.watchLimitHit.Load(),
+		UnavailableDirs: w.unavailableRootList(),
+	}
 }
 
+// addDirRecursive watches root and every non-excluded directory below it.
+// Hitting the OS watch limit (ENOSPC from inotify) stops the walk without
+// failing: the remaining directories stay unwatched and a warning is logged.
 func (w *Watcher) addDirRecursive(root string) error {
-	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	return w.addDirTree(root, make(map[string]struct{}))
+}
+
+// addDirTree is addDirRecursive that also descends into directory symlinks
+// of WatchSets with followSymlinks. The link's own path is watched, so
+// events keep paths inside the WatchSet. visited holds the resolved real
+// paths already walked, so circular links are walked only once.
+func (w *Watcher) addDirTree(root string, visited map[string]struct{}) error {
+	walkRoot := root
+	if info, err := os.Lstat(root); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if !w.followsSymlinks(root) {
+			return nil
+		}
+		// A trailing separator makes WalkDir resolve the link instead of
+		// reporting it as a non-directory.
+		walkRoot = root + string(filepath.Separator)
+	}
+
+	return filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		path = filepath.Clean(path)
+		if d.Type()&fs.ModeSymlink != 0 && path != root {
+			if w.followsSymlinks(path) && !w.isExcluded(path) {
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					return w.addDirTree(path, visited)
+				}
+			}
+			return nil
+		}
 		if !d.IsDir() {
 			return nil
 		}
 		if w.isExcluded(path) {
 			return fs.SkipDir
 		}
-		return w.fsWatcher.Add(path)
+		if w.followsSymlinks(path) {
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return fs.SkipDir
+			}
+			if _, seen := visited[real]; seen {
+				return fs.SkipDir
+			}
+			visited[real] = struct{}{}
+		}
+		w.loadIgnoreFile(filepath.Join(path, ignoreFileName))
+		if w.isOversizedDir(path) {
+			w.logger.Info("not watching directory: its files are mostly oversized or binary", "path", path)
+			return nil
+		}
+		if err := w.fsWatcher.Add(path); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				if !w.watchLimitHit.Swap(true) {
+					w.logger.Warn("watch limit reached; directories below are not watched. "+
+						"Raise it with: sudo sysctl fs.inotify.max_user_watches=524288", "path", path, "watches", len(w.fsWatcher.WatchList()))
+				}
+				return fs.SkipAll
+			}
+			return err
+		}
+		return nil
 	})
 }
-
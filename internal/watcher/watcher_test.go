@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/unok/local-text-history/internal/config"
+	"github.com/unok/local-text-history/internal/db"
+	"github.com/unok/local-text-history/internal/textenc"
 )
 
 // newTestConfig creates a single-WatchSet watcher Config for testing convenience.
@@ -1090,6 +1095,47 @@ func TestFindWatchSet_RootDirectory(t *testing.T) {
 	}
 }
 
+func TestFindWatchSet_RootNameEdgeCases(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "proj")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A configured dir with a trailing separator is normalized too
+	cfg := newTestConfig(root+string(filepath.Separator), nil, nil, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	sep := string(filepath.Separator)
+	tests := []struct {
+		name  string
+		path  string
+		match bool
+	}{
+		{"root itself", root, true},
+		{"root with trailing separator", root + sep, true},
+		{"file named like the root", filepath.Join(root, "proj"), true},
+		{"sibling sharing the root's name as prefix", root + ".txt", false},
+		{"sibling directory with longer name", filepath.Join(base, "proj2", "a.txt"), false},
+		{"parent of root", base, false},
+		{"doubled separators", root + sep + sep + "a.txt", true},
+		{"dot segment", root + sep + "." + sep + "a.txt", true},
+		{"escaping dot-dot", root + sep + ".." + sep + "other.txt", false},
+		// Mixed separators: on Windows Clean also turns "/" into the separator
+		{"slash separators", filepath.ToSlash(filepath.Join(root, "sub", "a.txt")), true},
+	}
+	for _, tt := range tests {
+		if got := w.findWatchSet(tt.path) != nil; got != tt.match {
+			t.Errorf("%s: findWatchSet(%q) matched = %v, want %v", tt.name, tt.path, got, tt.match)
+		}
+	}
+}
+
 func TestMultipleWatchSets_DifferentExtensions(t *testing.T) {
 	dir1 := t.TempDir()
 	dir2 := t.TempDir()
@@ -1429,3 +1475,1273 @@ func TestMultipleWatchSets_DifferentMaxFileSize(t *testing.T) {
 		t.Errorf("saved file = %s, want %s", saved[0], filepath.Join(dir2, "file.txt"))
 	}
 }
+
+func TestTakeSnapshot_JobCarriesWatchSetName(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.takeSnapshot(path, originWrite)
+
+	select {
+	case job := <-w.saveCh:
+		if job.watchSet != "test" {
+			t.Errorf("job.watchSet = %q, want %q", job.watchSet, "test")
+		}
+	default:
+		t.Fatal("takeSnapshot did not queue a save job")
+	}
+}
+
+func TestSnapshotOrigin(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.scanExistingFiles(dir)
+	if job := <-w.saveCh; job.origin != originScan {
+		t.Errorf("scan origin = %q, want %q", job.origin, originScan)
+	}
+
+	w.handleEvent(fsnotify.Event{Name: path, Op: fsnotify.Write})
+	select {
+	case job := <-w.saveCh:
+		if job.origin != originWrite {
+			t.Errorf("write origin = %q, want %q", job.origin, originWrite)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("write event did not produce a snapshot")
+	}
+}
+
+func TestHandleEvent_RenameTimeout(t *testing.T) {
+	const delay = 150 * time.Millisecond
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    bool
+	}{
+		{"window shorter than delay", 50 * time.Millisecond, false},
+		{"window longer than delay", 500 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+			cfg.RenameTimeout = tt.timeout
+			w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+				return true, nil
+			})
+			if err != nil {
+				t.Fatalf("New() error: %v", err)
+			}
+			defer w.Close()
+			w.SetRenameSaver(func(oldPath, newPath string) (string, error) { return "", nil })
+
+			oldPath := filepath.Join(dir, "old.txt")
+			newPath := filepath.Join(dir, "new.txt")
+			if err := os.WriteFile(newPath, []byte("content"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			w.handleEvent(fsnotify.Event{Name: oldPath, Op: fsnotify.Rename})
+			// A slow disk delivers the Create late
+			time.Sleep(delay)
+			if got := w.tryMatchRename(newPath); got != tt.want {
+				t.Errorf("Create after %v with %v window paired = %v, want %v", delay, tt.timeout, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanExistingFiles_ConcurrentWorkers(t *testing.T) {
+	watchDir := t.TempDir()
+	for i := range 20 {
+		f := filepath.Join(watchDir, fmt.Sprintf("file%d.go", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf("package f%d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	saved := make(map[string]struct{})
+	saver := func(path string, content []byte, maxSnapshots int) (bool, error) {
+		mu.Lock()
+		saved[path] = struct{}{}
+		mu.Unlock()
+		return true, nil
+	}
+
+	cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+	cfg.ScanConcurrency = 4
+	w, err := New(cfg, saver)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	done := make(chan struct{})
+	go w.Run(done)
+
+	// Files existed before New, so only the scan can pick them up
+	w.scanExistingFiles(watchDir)
+
+	time.Sleep(300 * time.Millisecond)
+	close(done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(saved) != 20 {
+		t.Errorf("concurrent scan: got %d distinct saves, want 20", len(saved))
+	}
+}
+
+func TestScanExistingFiles_StopsOnClose(t *testing.T) {
+	watchDir := t.TempDir()
+	for i := range 50 {
+		f := filepath.Join(watchDir, fmt.Sprintf("file%d.go", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf("package f%d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+	cfg.ScanConcurrency = 2
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	close(w.closeCh)
+	finished := make(chan struct{})
+	go func() {
+		w.scanExistingFiles(watchDir)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("scanExistingFiles did not return after closeCh was closed")
+	}
+	if n := len(w.saveCh); n != 0 {
+		t.Errorf("queued %d jobs after close, want 0", n)
+	}
+	w.fsWatcher.Close()
+}
+
+func TestCheckStable_RequiresUnchangedSizeAndModTime(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	cfg.WatchSets[0].Stabilize = true
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "download.txt")
+	if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.checkStable(path) {
+		t.Error("first check should not report stable")
+	}
+
+	// The file grows between checks: still not stable.
+	if err := os.WriteFile(path, []byte("partial, then more"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if w.checkStable(path) {
+		t.Error("check after a size change should not report stable")
+	}
+
+	if !w.checkStable(path) {
+		t.Error("check with unchanged size and mtime should report stable")
+	}
+}
+
+func TestOnDebounceFired_StabilizingSetDefersSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	cfg.WatchSets[0].Stabilize = true
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "download.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.onDebounceFired(path, originWrite, time.Hour, nil)
+
+	select {
+	case <-w.saveCh:
+		t.Fatal("snapshot queued before the file was observed stable")
+	default:
+	}
+	w.mu.Lock()
+	_, rescheduled := w.timers[path]
+	w.mu.Unlock()
+	if !rescheduled {
+		t.Error("expected the debounce timer to be rescheduled")
+	}
+
+	w.onDebounceFired(path, originWrite, time.Hour, nil)
+
+	select {
+	case <-w.saveCh:
+	default:
+		t.Fatal("snapshot not queued once the file was stable")
+	}
+}
+
+func TestOnDebounceFired_KeepsNewerTimer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 60, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "busy.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.scheduleSnapshot(path, originWrite)
+	w.mu.Lock()
+	fired := w.timers[path]
+	w.mu.Unlock()
+	// An event arrives while the first timer's snapshot is being taken
+	w.scheduleSnapshot(path, originWrite)
+	w.onDebounceFired(path, originWrite, time.Minute, fired)
+
+	select {
+	case <-w.saveCh:
+	default:
+		t.Fatal("snapshot not queued by the fired timer")
+	}
+	w.mu.Lock()
+	current, pending := w.timers[path]
+	w.mu.Unlock()
+	if !pending || current == fired {
+		t.Error("the fired timer removed the newer pending timer")
+	}
+}
+
+func TestScheduleSnapshot_ImmediateExtensions(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".go", ".log"}, []string{}, 60, 1048576)
+	cfg.WatchSets[0].ImmediateExtensions = []string{".log"}
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	logPath := filepath.Join(dir, "app.log")
+	goPath := filepath.Join(dir, "main.go")
+	for _, p := range []string{logPath, goPath} {
+		if err := os.WriteFile(p, []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.scheduleSnapshot(logPath, originWrite)
+	w.mu.Lock()
+	first := w.timers[logPath]
+	w.mu.Unlock()
+
+	// Further writes must not push back the pending flush.
+	w.scheduleSnapshot(logPath, originWrite)
+	w.scheduleSnapshot(goPath, originWrite)
+	w.mu.Lock()
+	same := w.timers[logPath] == first
+	w.mu.Unlock()
+	if !same {
+		t.Error("repeated writes replaced the pending immediate flush")
+	}
+
+	select {
+	case job := <-w.saveCh:
+		if job.filePath != logPath {
+			t.Errorf("job.filePath = %s, want %s", job.filePath, logPath)
+		}
+	case <-time.After(3 * immediateFlushInterval):
+		t.Fatal("immediate extension was not snapshotted within the flush interval")
+	}
+
+	select {
+	case job := <-w.saveCh:
+		t.Errorf("unexpected snapshot of %s before its debounce", job.filePath)
+	default:
+	}
+}
+
+func TestScheduleSnapshot_MaxPendingTimersFlushesOldest(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 60, 1048576)
+	cfg.MaxPendingTimers = 2
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	var paths []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	w.scheduleSnapshot(paths[0], originWrite)
+	w.scheduleSnapshot(paths[1], originWrite)
+	// Rescheduling a pending path neither flushes nor moves it to the back
+	w.scheduleSnapshot(paths[0], originWrite)
+	select {
+	case job := <-w.saveCh:
+		t.Fatalf("unexpected snapshot of %s below the limit", job.filePath)
+	default:
+	}
+
+	w.scheduleSnapshot(paths[2], originWrite)
+	select {
+	case job := <-w.saveCh:
+		if job.filePath != paths[0] {
+			t.Errorf("flushed %s, want oldest %s", job.filePath, paths[0])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("oldest pending timer was not flushed")
+	}
+
+	w.mu.Lock()
+	pending := len(w.timers)
+	w.mu.Unlock()
+	if pending != 2 {
+		t.Errorf("pending timers = %d, want 2", pending)
+	}
+}
+
+func TestFlushOldestTimers_LateCallbackKeepsNewTimer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 60, 1048576)
+	cfg.MaxPendingTimers = 1
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.scheduleSnapshot(path, originWrite)
+	w.mu.Lock()
+	flushed := w.timers[path]
+	w.flushOldestTimersLocked()
+	pending, queued := len(w.timers), w.timerOrder.Len()
+	w.mu.Unlock()
+	if pending != 0 || queued != 0 {
+		t.Fatalf("after flush: %d timers, %d queued, want the entry removed at once", pending, queued)
+	}
+
+	// The path changes again before the flushed callback gets to run
+	w.scheduleSnapshot(path, originWrite)
+	w.onDebounceFired(path, originWrite, time.Minute, flushed)
+
+	w.mu.Lock()
+	current, ok := w.timers[path]
+	w.mu.Unlock()
+	if !ok || current == flushed {
+		t.Error("the flushed timer's callback removed the new pending timer")
+	}
+}
+
+func TestClose_FlushesPendingTimers(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 60, 1048576)
+	var mu sync.Mutex
+	saved := make(map[string]string)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		saved[path] = string(content)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	pendingPath := filepath.Join(dir, "pending.txt")
+	deletedPath := filepath.Join(dir, "deleted.txt")
+	for _, p := range []string{pendingPath, deletedPath} {
+		if err := os.WriteFile(p, []byte("edit"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w.scheduleSnapshot(p, originWrite)
+	}
+	if err := os.Remove(deletedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if saved[pendingPath] != "edit" {
+		t.Errorf("pending snapshot not saved on Close, saved = %v", saved)
+	}
+	if _, ok := saved[deletedPath]; ok {
+		t.Error("deleted file should not be snapshotted on Close")
+	}
+}
+
+func TestProcessBatch_RoutesWatchSetSavers(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+	cfg := Config{
+		WatchSets: []config.WatchSet{
+			{Name: "shared", Dirs: []string{dir1}, DebounceSec: 1, MaxFileSize: 1048576},
+			{Name: "own", Dirs: []string{dir2}, DebounceSec: 1, MaxFileSize: 1048576},
+		},
+	}
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	recorder := func(got *[]string) SnapshotBatchSaver {
+		return func(reqs []db.SnapshotRequest) ([]bool, []error) {
+			for _, r := range reqs {
+				*got = append(*got, r.FilePath)
+			}
+			return make([]bool, len(reqs)), make([]error, len(reqs))
+		}
+	}
+	var defaultSaved, ownSaved []string
+	w.SetBatchSaver(recorder(&defaultSaved))
+	if err := w.SetWatchSetSavers("own", recorder(&ownSaved), nil); err != nil {
+		t.Fatalf("SetWatchSetSavers() error: %v", err)
+	}
+	if err := w.SetWatchSetSavers("missing", nil, nil); err == nil {
+		t.Error("SetWatchSetSavers() should error for an unknown watch set")
+	}
+
+	path1 := filepath.Join(dir1, "a.txt")
+	path2 := filepath.Join(dir2, "b.txt")
+	w.processBatch([]saveJob{
+		{filePath: path1, content: []byte("a"), watchSet: "shared"},
+		{filePath: path2, content: []byte("b"), watchSet: "own"},
+	})
+
+	if len(defaultSaved) != 1 || defaultSaved[0] != path1 {
+		t.Errorf("default saver got %v, want [%s]", defaultSaved, path1)
+	}
+	if len(ownSaved) != 1 || ownSaved[0] != path2 {
+		t.Errorf("watch set saver got %v, want [%s]", ownSaved, path2)
+	}
+}
+
+func TestWatchStats_CountsWatchedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "a/b", "node_modules"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := newTestConfig(dir, nil, []string{"**/node_modules/**"}, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	stats := w.WatchStats()
+	if stats.Watches != 3 {
+		t.Errorf("Watches = %d, want 3 (root, a, a/b)", stats.Watches)
+	}
+	if stats.LimitReached {
+		t.Error("LimitReached should be false")
+	}
+}
+
+func TestAddDirRecursive_SkipOversizedDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"text", "build", "build/src"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 6 {
+		name := fmt.Sprintf("f%d", i)
+		if err := os.WriteFile(filepath.Join(dir, "text", name+".txt"), []byte("text"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "build", name+".o"), []byte{0x7f, 'E', 'L', 'F', 0}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, skip := range []bool{false, true} {
+		cfg := newTestConfig(dir, nil, nil, 1, 1048576)
+		cfg.WatchSets[0].SkipOversizedDirs = skip
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		want := 4 // root, text, build, build/src
+		if skip {
+			want = 3 // build is skipped, but its subdirectory is still watched
+		}
+		if got := w.WatchStats().Watches; got != want {
+			t.Errorf("skipOversizedDirs=%v: Watches = %d, want %d", skip, got, want)
+		}
+		w.Close()
+	}
+}
+
+func TestCountTrackableFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":        "tracked",
+		"b.md":         "wrong extension",
+		"empty.txt":    "",
+		"skip.txt":     "excluded by pattern",
+		"ignored.txt":  "excluded by ignore file",
+		"sub/deep.txt": "not counted: subdirectory",
+		ignoreFileName: "ignored.txt\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := newTestConfig(dir, []string{".txt"}, []string{"**/skip.txt"}, 1, 1048576)
+	n, err := CountTrackableFiles(cfg.WatchSets[0])
+	if err != nil {
+		t.Fatalf("CountTrackableFiles() error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("CountTrackableFiles() = %d, want 1", n)
+	}
+
+	cfg.WatchSets[0].Dirs = []string{filepath.Join(dir, "missing")}
+	if _, err := CountTrackableFiles(cfg.WatchSets[0]); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestAddDirRecursive_FollowSymlinks(t *testing.T) {
+	base := t.TempDir()
+	proj := filepath.Join(base, "proj")
+	target := filepath.Join(base, "target")
+	for _, dir := range []string{proj, filepath.Join(target, "sub")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(target, filepath.Join(proj, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// Circular link back to the linked tree
+	if err := os.Symlink(target, filepath.Join(target, "sub", "back")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, follow := range []bool{false, true} {
+		cfg := newTestConfig(proj, nil, nil, 1, 1048576)
+		cfg.WatchSets[0].FollowSymlinks = follow
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		watched := w.fsWatcher.WatchList()
+		slices.Sort(watched)
+		want := []string{proj}
+		if follow {
+			want = []string{proj, filepath.Join(proj, "link"), filepath.Join(proj, "link", "sub")}
+		}
+		if !slices.Equal(watched, want) {
+			t.Errorf("followSymlinks=%v: watched %v, want %v", follow, watched, want)
+		}
+		w.Close()
+	}
+}
+
+func TestTakeSnapshot_DetectEncodingTranscodesUTF16(t *testing.T) {
+	utf16 := []byte{0xFF, 0xFE, 'h', 0, 'i', 0}
+
+	for _, detect := range []bool{true, false} {
+		dir := t.TempDir()
+		cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+		cfg.WatchSets[0].DetectEncoding = detect
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		path := filepath.Join(dir, "win.txt")
+		if err := os.WriteFile(path, utf16, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w.takeSnapshot(path, originWrite)
+
+		select {
+		case job := <-w.saveCh:
+			if !detect {
+				t.Error("UTF-16 file should be skipped as binary without detectEncoding")
+			} else if string(job.content) != "hi" || job.encoding != textenc.UTF16LE {
+				t.Errorf("job content = %q encoding = %q, want %q %q", job.content, job.encoding, "hi", textenc.UTF16LE)
+			}
+		default:
+			if detect {
+				t.Error("takeSnapshot did not queue a save job with detectEncoding")
+			}
+		}
+		w.Close()
+	}
+}
+
+func TestTakeSnapshot_MaxStoredBytes(t *testing.T) {
+	tests := []struct {
+		keep    string
+		limit   int64
+		content string
+		want    string
+		trunc   bool
+	}{
+		{config.TruncateKeepTail, 6, "line1\nline2\n", "line2\n", true},
+		{config.TruncateKeepHead, 6, "line1\nline2\n", "line1\n", true},
+		{config.TruncateKeepTail, 6, "short\n", "short\n", false},
+		// A multi-byte rune cut by the limit is dropped, not split
+		{config.TruncateKeepTail, 5, "xxxxéabcd", "abcd", true},
+		{config.TruncateKeepHead, 5, "abcdéxxxx", "abcd", true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := newTestConfig(dir, []string{".log"}, []string{}, 1, 1048576)
+		cfg.WatchSets[0].MaxStoredBytes = tt.limit
+		cfg.WatchSets[0].TruncateKeep = tt.keep
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		path := filepath.Join(dir, "app.log")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		job, ok := w.readSnapshot(path, originWrite)
+		if !ok {
+			t.Fatalf("readSnapshot(%q) skipped the file", tt.content)
+		}
+		if string(job.content) != tt.want || job.truncated != tt.trunc {
+			t.Errorf("keep %s of %q: content = %q truncated = %v, want %q %v",
+				tt.keep, tt.content, job.content, job.truncated, tt.want, tt.trunc)
+		}
+		w.Close()
+	}
+}
+
+func TestTakeSnapshot_TrackBinaryMetadata(t *testing.T) {
+	for _, track := range []bool{true, false} {
+		dir := t.TempDir()
+		cfg := newTestConfig(dir, []string{".dat"}, []string{}, 1, 1048576)
+		cfg.WatchSets[0].TrackBinaryMetadata = track
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		path := filepath.Join(dir, "blob.dat")
+		if err := os.WriteFile(path, []byte{0x00, 0x01, 0x02}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w.takeSnapshot(path, originWrite)
+
+		select {
+		case job := <-w.saveCh:
+			if !track {
+				t.Error("binary file should be skipped without trackBinaryMetadata")
+			} else if !job.binary {
+				t.Error("job.binary = false, want true")
+			}
+		default:
+			if track {
+				t.Error("takeSnapshot did not queue a metadata job with trackBinaryMetadata")
+			}
+		}
+		w.Close()
+	}
+}
+
+func TestScanExistingFiles_InitialScanLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFiles int
+		skip     bool
+		want     int
+	}{
+		{"unlimited", 0, false, 10},
+		{"capped", 3, false, 3},
+		{"skipped", 0, true, 0},
+	}
+	for _, tt := range tests {
+		watchDir := t.TempDir()
+		for i := range 10 {
+			f := filepath.Join(watchDir, fmt.Sprintf("file%d.go", i))
+			if err := os.WriteFile(f, []byte(fmt.Sprintf("package f%d", i)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+		cfg.WatchSets[0].MaxInitialScanFiles = tt.maxFiles
+		cfg.WatchSets[0].SkipInitialScan = tt.skip
+		w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			t.Fatalf("New() error: %v", err)
+		}
+
+		w.scanExistingFiles(watchDir)
+
+		if got := len(w.saveCh); got != tt.want {
+			t.Errorf("%s: queued %d snapshots, want %d", tt.name, got, tt.want)
+		}
+		w.Close()
+	}
+}
+
+func TestRescan_IgnoresInitialScanLimits(t *testing.T) {
+	watchDir := t.TempDir()
+	for i := range 5 {
+		f := filepath.Join(watchDir, fmt.Sprintf("file%d.go", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf("package f%d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+	cfg.WatchSets[0].SkipInitialScan = true
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Rescan("missing"); err == nil {
+		t.Error("Rescan() should error for an unknown watch set")
+	}
+	if err := w.Rescan("test"); err != nil {
+		t.Fatalf("Rescan() error: %v", err)
+	}
+	w.scanWg.Wait()
+
+	if got := len(w.saveCh); got != 5 {
+		t.Errorf("queued %d snapshots, want 5", got)
+	}
+}
+
+func TestRescan_SkipsFilesWithMatchingFingerprint(t *testing.T) {
+	watchDir := t.TempDir()
+	for i := range 3 {
+		f := filepath.Join(watchDir, fmt.Sprintf("file%d.go", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf("package f%d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Rescan(""); err != nil {
+		t.Fatalf("Rescan() error: %v", err)
+	}
+	w.scanWg.Wait()
+	recorded := make(map[string]db.FileFingerprint)
+	for len(w.saveCh) > 0 {
+		job := <-w.saveCh
+		recorded[job.filePath] = job.fingerprint
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("first scan queued %d snapshots, want 3", len(recorded))
+	}
+	w.SetFingerprintLookup(func(filePath string) (db.FileFingerprint, error) {
+		return recorded[filePath], nil
+	})
+
+	changed := filepath.Join(watchDir, "file1.go")
+	if err := os.WriteFile(changed, []byte("package changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rescan(""); err != nil {
+		t.Fatalf("Rescan() error: %v", err)
+	}
+	w.scanWg.Wait()
+	if got := len(w.saveCh); got != 1 {
+		t.Fatalf("second scan queued %d snapshots, want 1", got)
+	}
+	if job := <-w.saveCh; job.filePath != changed {
+		t.Errorf("queued %s, want %s", job.filePath, changed)
+	}
+}
+
+func TestTakeSnapshot_SkipsFilesBelowMinFileSize(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	cfg.WatchSets[0].MinFileSize = 4
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	small := filepath.Join(dir, "marker.txt")
+	large := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(small, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, []byte("enough"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w.takeSnapshot(small, originWrite)
+	w.takeSnapshot(large, originWrite)
+
+	if got := len(w.saveCh); got != 1 {
+		t.Fatalf("queued %d snapshots, want 1", got)
+	}
+	if job := <-w.saveCh; job.filePath != large {
+		t.Errorf("queued %s, want %s", job.filePath, large)
+	}
+}
+
+func TestIgnoreFile_ExcludesAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.MkdirAll(filepath.Join(sub, "build"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ignorePath := filepath.Join(sub, ignoreFileName)
+	rules := "# local excludes\n*.log\n!keep.log\nbuild/\n/secret.txt\n"
+	if err := os.WriteFile(ignorePath, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(dir, nil, []string{}, 1, 1048576)
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(sub, "app.log"), false},
+		{filepath.Join(sub, "deep", "app.log"), false},
+		{filepath.Join(sub, "keep.log"), true},
+		{filepath.Join(sub, "build", "out.txt"), false},
+		{filepath.Join(sub, "secret.txt"), false},
+		{filepath.Join(sub, "deep", "secret.txt"), true},
+		{filepath.Join(sub, "notes.txt"), true},
+		{filepath.Join(dir, "app.log"), true}, // outside the ignore file's directory
+	}
+	for _, tt := range tests {
+		if got := w.shouldTrack(tt.path); got != tt.want {
+			t.Errorf("shouldTrack(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if !w.isExcluded(filepath.Join(sub, "build")) {
+		t.Error("build/ should be excluded as a directory")
+	}
+
+	// Editing the ignore file takes effect on its next event
+	if err := os.WriteFile(ignorePath, []byte("notes.txt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.handleEvent(fsnotify.Event{Name: ignorePath, Op: fsnotify.Write})
+	if w.shouldTrack(filepath.Join(sub, "notes.txt")) {
+		t.Error("notes.txt should be ignored after reload")
+	}
+	if !w.shouldTrack(filepath.Join(sub, "app.log")) {
+		t.Error("app.log should be tracked after reload")
+	}
+
+	// Removing it drops the rules
+	if err := os.Remove(ignorePath); err != nil {
+		t.Fatal(err)
+	}
+	w.handleEvent(fsnotify.Event{Name: ignorePath, Op: fsnotify.Remove})
+	if !w.shouldTrack(filepath.Join(sub, "notes.txt")) {
+		t.Error("notes.txt should be tracked after the ignore file is removed")
+	}
+}
+
+func TestRateDelay_MaxSnapshotsPerMinute(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576), func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	p := filepath.Join(dir, "busy.txt")
+	t0 := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if d := w.rateDelayLocked(p, 2, t0); d != 0 {
+		t.Errorf("delay for unseen path = %v, want 0", d)
+	}
+	w.recordSnapshotLocked(p, t0)
+	w.recordSnapshotLocked(p, t0.Add(10*time.Second))
+
+	if d := w.rateDelayLocked(p, 3, t0.Add(20*time.Second)); d != 0 {
+		t.Errorf("delay below limit = %v, want 0", d)
+	}
+	// Two snapshots in the window: wait until the first one ages out
+	if d := w.rateDelayLocked(p, 2, t0.Add(20*time.Second)); d != 40*time.Second {
+		t.Errorf("delay at limit = %v, want 40s", d)
+	}
+	if !w.rates[p].throttled {
+		t.Error("path at limit should be marked throttled")
+	}
+	if d := w.rateDelayLocked(p, 2, t0.Add(61*time.Second)); d != 0 {
+		t.Errorf("delay after window = %v, want 0", d)
+	}
+	if w.rates[p].throttled {
+		t.Error("path back under limit should no longer be throttled")
+	}
+
+	// Idle paths are swept once per window
+	w.recordSnapshotLocked(filepath.Join(dir, "other.txt"), t0.Add(3*time.Minute))
+	if _, ok := w.rates[p]; ok {
+		t.Error("idle path should have been swept")
+	}
+}
+
+func TestProcessBatch_SplitsLargeBatches(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	cfg.MaxBatchSnapshots = 3
+	cfg.MaxBatchBytes = 10
+	w, err := New(cfg, func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	var sizes []int
+	w.SetBatchSaver(func(reqs []db.SnapshotRequest) ([]bool, []error) {
+		sizes = append(sizes, len(reqs))
+		return make([]bool, len(reqs)), make([]error, len(reqs))
+	})
+
+	// Five small jobs are capped by count; the 12-byte one exceeds the byte
+	// budget alone and gets a transaction of its own.
+	var batch []saveJob
+	for _, content := range []string{"a", "b", "c", "d", "e", strings.Repeat("x", 12), "f"} {
+		batch = append(batch, saveJob{filePath: filepath.Join(dir, content+".txt"), content: []byte(content), watchSet: cfg.WatchSets[0].Name})
+	}
+	w.processBatch(batch)
+
+	if want := []int{3, 2, 1, 1}; !slices.Equal(sizes, want) {
+		t.Errorf("transaction sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestCheckRoots_MarksMissingAndRestores(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "root")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576), func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	w.checkRoots()
+	if got := w.WatchStats().UnavailableDirs; len(got) != 0 {
+		t.Fatalf("UnavailableDirs = %v, want none", got)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	w.checkRoots()
+	if got := w.WatchStats().UnavailableDirs; !slices.Equal(got, []string{dir}) {
+		t.Fatalf("UnavailableDirs after removal = %v, want [%s]", got, dir)
+	}
+
+	// Once back, the root is watched again and files written meanwhile are scanned
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "back.txt")
+	if err := os.WriteFile(file, []byte("back"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.checkRoots()
+	if got := w.WatchStats().UnavailableDirs; len(got) != 0 {
+		t.Errorf("UnavailableDirs after restore = %v, want none", got)
+	}
+	if !slices.Contains(w.fsWatcher.WatchList(), dir) {
+		t.Errorf("watch list %v does not contain restored root", w.fsWatcher.WatchList())
+	}
+	select {
+	case job := <-w.saveCh:
+		if job.filePath != file {
+			t.Errorf("scanned %s, want %s", job.filePath, file)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("restored root was not rescanned")
+	}
+}
+
+func TestCheckRoots_RestoresOnlyDroppedRoots(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576), func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A root whose watch went away, e.g. because it was recreated, is restored
+	if err := w.fsWatcher.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	w.checkRoots()
+	if !slices.Contains(w.fsWatcher.WatchList(), dir) {
+		t.Fatalf("watch list %v does not contain the dropped root", w.fsWatcher.WatchList())
+	}
+	w.scanWg.Wait()
+	if got := len(w.saveCh); got != 1 {
+		t.Fatalf("restoring the root queued %d snapshots, want 1", got)
+	}
+	<-w.saveCh
+
+	// A root that was not in the watch list at the last check, as when
+	// adding its watch failed, is not restored and rescanned every time
+	if err := w.fsWatcher.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	delete(w.watchedRoots, dir)
+	for range 2 {
+		w.checkRoots()
+	}
+	w.scanWg.Wait()
+	if got := len(w.saveCh); got != 0 {
+		t.Errorf("checks of an unwatched root queued %d snapshots, want 0", got)
+	}
+}
+
+func TestNew_AllowMissingDirs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "later")
+	cfg := newTestConfig(dir, []string{".txt"}, []string{}, 1, 1048576)
+	save := func(path string, content []byte, maxSnapshots int) (bool, error) {
+		return true, nil
+	}
+
+	if w, err := New(cfg, save); err == nil {
+		w.Close()
+		t.Fatal("New() with a missing dir should fail by default")
+	}
+
+	cfg.AllowMissingDirs = true
+	w, err := New(cfg, save)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+	if got := w.WatchStats().UnavailableDirs; !slices.Equal(got, []string{dir}) {
+		t.Errorf("UnavailableDirs = %v, want [%s]", got, dir)
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w.checkRoots()
+	if got := w.WatchStats().UnavailableDirs; len(got) != 0 {
+		t.Errorf("UnavailableDirs after creation = %v, want none", got)
+	}
+}
+
+func TestRescan_TrackDeletionsRecordsFilesDeletedWhileStopped(t *testing.T) {
+	watchDir := t.TempDir()
+	database, err := db.New(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("db.New() error: %v", err)
+	}
+	defer database.Close()
+
+	kept := filepath.Join(watchDir, "kept.go")
+	gone := filepath.Join(watchDir, "gone.go")
+	for _, f := range []string{kept, gone} {
+		if err := os.WriteFile(f, []byte("package "+strings.TrimSuffix(filepath.Base(f), ".go")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(f)
+		if _, err := database.SaveSnapshot(f, content, 0); err != nil {
+			t.Fatalf("SaveSnapshot() error: %v", err)
+		}
+	}
+
+	// The file disappears while no watcher is running.
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(watchDir, []string{".go"}, []string{}, 1, 1048576)
+	cfg.WatchSets[0].TrackDeletions = true
+	w, err := New(cfg, database.SaveSnapshot)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w.Close()
+	w.SetDeletionTracker(database.TrackedPaths, database.SaveDeletion)
+	var notified []string
+	w.OnDelete = func(filePath string) { notified = append(notified, filePath) }
+
+	if err := w.Rescan(""); err != nil {
+		t.Fatalf("Rescan() error: %v", err)
+	}
+	w.scanWg.Wait()
+
+	if !slices.Equal(notified, []string{gone}) {
+		t.Errorf("OnDelete called with %v, want [%s]", notified, gone)
+	}
+	paths, err := database.TrackedPaths(nil)
+	if err != nil {
+		t.Fatalf("TrackedPaths() error: %v", err)
+	}
+	if !slices.Equal(paths, []string{kept}) {
+		t.Errorf("tracked paths = %v, want [%s]", paths, kept)
+	}
+	timeline, err := database.GetRecentSnapshots(10, 0, "", nil)
+	if err != nil {
+		t.Fatalf("GetRecentSnapshots() error: %v", err)
+	}
+	if len(timeline) == 0 || timeline[0].EntryType != "delete" || timeline[0].FilePath != gone {
+		t.Errorf("latest history entry = %+v, want a delete entry for %s", timeline, gone)
+	}
+
+	// Without the option, missing files stay tracked.
+	cfg.WatchSets[0].TrackDeletions = false
+	w2, err := New(cfg, database.SaveSnapshot)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer w2.Close()
+	w2.SetDeletionTracker(database.TrackedPaths, database.SaveDeletion)
+	if err := os.Remove(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.Rescan(""); err != nil {
+		t.Fatalf("Rescan() error: %v", err)
+	}
+	w2.scanWg.Wait()
+	if paths, _ := database.TrackedPaths(nil); !slices.Equal(paths, []string{kept}) {
+		t.Errorf("tracked paths without trackDeletions = %v, want [%s]", paths, kept)
+	}
+}
@@ -1,7 +1,7 @@
 import { useState, useEffect, useRef } from 'react'
 import { useHistory, useStats, useStripWatchDir } from '../lib/api'
 import { formatDateTime, formatBytes } from '../lib/format'
-import { navigate, replaceUrl } from '../lib/router'
+import { navigate, replaceUrl, withBase } from '../lib/router'
 import { useWatchSetState } from '../lib/watchSetState'
 
 const PAGE_SIZE = 30
@@ -116,7 +116,7 @@ export default function Dashboard({ query: initialQuery }: DashboardProps) {
                   key={`${entry.entryType}-${entry.snapshotId}`}
                   className="cursor-pointer hover:bg-blue-100 dark:hover:bg-blue-900/50"
                   onClick={() =>
-                    entry.entryType === 'rename'
+                    entry.entryType === 'rename' || entry.entryType === 'delete'
                       ? navigate(`/files/${entry.fileId}`)
                       : navigate(`/files/${entry.fileId}/diff/${entry.snapshotId}`)
                   }
@@ -130,7 +130,7 @@ export default function Dashboard({ query: initialQuery }: DashboardProps) {
                         <span className="text-gray-400 dark:text-gray-500">{stripWatchDir(entry.oldFilePath ?? '')}</span>
                         <span className="text-gray-400 dark:text-gray-500 mx-1">&rarr;</span>
                         <a
-                          href={`/files/${entry.fileId}`}
+                          href={withBase(`/files/${entry.fileId}`)}
                           className="text-blue-600 dark:text-blue-400 hover:underline"
                           onClick={(e) => {
                             e.preventDefault()
@@ -143,7 +143,7 @@ export default function Dashboard({ query: initialQuery }: DashboardProps) {
                       </span>
                     ) : (
                       <a
-                        href={`/files/${entry.fileId}`}
+                        href={withBase(`/files/${entry.fileId}`)}
                         className="text-blue-600 dark:text-blue-400 hover:underline"
                         onClick={(e) => {
                           e.preventDefault()
@@ -158,8 +158,15 @@ export default function Dashboard({ query: initialQuery }: DashboardProps) {
                   <td className="px-3 py-2 text-gray-500 dark:text-gray-400 text-right whitespace-nowrap">
                     {entry.entryType === 'rename' ? (
                       <span className="text-xs font-medium text-amber-600 dark:text-amber-400 bg-amber-50 dark:bg-amber-900/30 px-1.5 py-0.5 rounded">rename</span>
+                    ) : entry.entryType === 'delete' ? (
+                      <span className="text-xs font-medium text-red-600 dark:text-red-400 bg-red-50 dark:bg-red-900/30 px-1.5 py-0.5 rounded">deleted</span>
                     ) : (
-                      formatBytes(entry.size)
+                      <>
+                        {entry.becameBinary && (
+                          <span className="mr-2 text-xs font-medium text-purple-600 dark:text-purple-400 bg-purple-50 dark:bg-purple-900/30 px-1.5 py-0.5 rounded">became binary</span>
+                        )}
+                        {formatBytes(entry.size)}
+                      </>
                     )}
                   </td>
                 </tr>
@@ -1,9 +1,10 @@
 import { useState, useRef, useEffect } from 'react'
-import { useDiff } from '../lib/api'
+import { useDiff, downloadSnapshotUrl } from '../lib/api'
 import { Diff2HtmlUI } from 'diff2html/lib/ui/js/diff2html-ui-slim'
 import type { Diff2HtmlUIConfig } from 'diff2html/lib/ui/js/diff2html-ui-slim'
 import { ColorSchemeType } from 'diff2html/lib/types'
 import { useTheme } from '../lib/theme'
+import { formatBytes } from '../lib/format'
 import '../styles/diff2html-scoped.css'
 
 type OutputFormat = 'side-by-side' | 'line-by-line'
@@ -64,12 +65,34 @@ export default function DiffView({ fromId, toId }: DiffViewProps) {
     )
   }
 
+  if (data?.suppressed) {
+    return (
+      <div className="space-y-2 text-sm text-gray-500 dark:text-gray-400">
+        <p>
+          Initial snapshot {data.to.substring(0, 8)} is too large to show as a diff
+          ({data.addedLines ?? 0} lines, {formatBytes(data.size ?? 0)}).
+        </p>
+        <a
+          href={downloadSnapshotUrl(data.to)}
+          className="inline-block px-3 py-1 rounded bg-gray-200 dark:bg-gray-700 text-gray-700 dark:text-gray-200 hover:bg-gray-300 dark:hover:bg-gray-600"
+        >
+          Show anyway (download)
+        </a>
+      </div>
+    )
+  }
+
   if (!data || data.diff === '') {
     return <p className="text-gray-500 dark:text-gray-400 text-sm">No differences found.</p>
   }
 
   return (
     <div className="space-y-3">
+      {data.contentTruncated && (
+        <p className="text-xs text-amber-600 dark:text-amber-400">
+          Only part of this file is stored (maxStoredBytes); the diff covers the stored part.
+        </p>
+      )}
       <div className="flex items-center justify-between">
         <h3 className="text-sm font-semibold text-gray-700 dark:text-gray-200">
           {data.from
@@ -9,7 +9,7 @@ import {
   type RenameRecord,
 } from '../lib/api'
 import { formatDateTime, formatBytes } from '../lib/format'
-import { navigate, replaceUrl } from '../lib/router'
+import { navigate, replaceUrl, withBase } from '../lib/router'
 import DiffView from './DiffView'
 
 interface FilePageProps {
@@ -20,9 +20,11 @@ interface FilePageProps {
 
 function RenameHistory({
   renames,
+  hasMore,
   stripWatchDir,
 }: {
   renames: RenameRecord[]
+  hasMore: boolean
   stripWatchDir: (path: string) => string
 }) {
   return (
@@ -35,7 +37,7 @@ function RenameHistory({
           return (
             <li key={r.id} className="flex items-center gap-1">
               <a
-                href={`/files/${r.oldFileId}`}
+                href={withBase(`/files/${r.oldFileId}`)}
                 className="text-blue-600 dark:text-blue-400 hover:underline font-mono"
                 onClick={(e) => {
                   e.preventDefault()
@@ -46,7 +48,7 @@ function RenameHistory({
               </a>
               <span className="text-gray-400 dark:text-gray-500">&rarr;</span>
               <a
-                href={`/files/${r.newFileId}`}
+                href={withBase(`/files/${r.newFileId}`)}
                 className="text-blue-600 dark:text-blue-400 hover:underline font-mono"
                 onClick={(e) => {
                   e.preventDefault()
@@ -59,6 +61,11 @@ function RenameHistory({
           )
         })}
       </ul>
+      {hasMore && (
+        <p className="text-xs text-gray-400 dark:text-gray-500 mt-0.5">
+          Older renames not shown
+        </p>
+      )}
     </div>
   )
 }
@@ -132,7 +139,7 @@ export default function FilePage({ fileId, fromId, toId }: FilePageProps) {
     <div className="space-y-4">
       <div>
         <a
-          href="/"
+          href={withBase('/')}
           className="text-blue-600 dark:text-blue-400 hover:underline text-sm"
           onClick={(e) => {
             e.preventDefault()
@@ -144,9 +151,10 @@ export default function FilePage({ fileId, fromId, toId }: FilePageProps) {
         <h2 className="text-lg font-mono font-semibold text-gray-800 dark:text-gray-100 mt-1">
           {file ? stripWatchDir(file.path) : ''}
         </h2>
-        {renames && renames.length > 0 && (
+        {renames && renames.renames.length > 0 && (
           <RenameHistory
-            renames={renames}
+            renames={renames.renames}
+            hasMore={renames.hasMore}
             stripWatchDir={stripWatchDir}
           />
         )}
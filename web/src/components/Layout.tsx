@@ -1,7 +1,7 @@
 import { type ReactNode } from 'react'
 import { useStats, databaseDownloadUrl } from '../lib/api'
 import { formatBytes } from '../lib/format'
-import { navigate } from '../lib/router'
+import { navigate, withBase } from '../lib/router'
 import { useTheme } from '../lib/theme'
 import { useWatchSetState } from '../lib/watchSetState'
 
@@ -63,7 +63,7 @@ export default function Layout({ children }: { children: ReactNode }) {
         <div className="max-w-7xl mx-auto px-4 py-3 flex items-center justify-between">
           <div className="flex items-center gap-2">
             <a
-              href="/"
+              href={withBase('/')}
               className="text-xl font-bold text-gray-800 dark:text-gray-100 hover:text-blue-600 dark:hover:text-blue-400"
               onClick={(e) => {
                 e.preventDefault()
@@ -5,12 +5,14 @@ import {
   useQueryClient,
   type QueryClient,
 } from '@tanstack/react-query'
+import { withBase } from './router'
 
 // Types matching Go server responses
 
 export interface FileRecord {
   id: string
   path: string
+  pathRaw?: string
   created: number
   updated: number
 }
@@ -27,6 +29,10 @@ export interface DiffResult {
   diff: string
   from: string
   to: string
+  contentTruncated?: boolean
+  suppressed?: boolean
+  addedLines?: number
+  size?: number
 }
 
 export interface WatchSetInfo {
@@ -49,7 +55,9 @@ export interface HistoryEntry {
   size: number
   hash: string
   timestamp: number
-  entryType: 'save' | 'rename'
+  entryType: 'save' | 'rename' | 'binary' | 'delete'
+  origin: string
+  becameBinary: boolean
   oldFilePath?: string
 }
 
@@ -65,7 +73,7 @@ export interface RenameRecord {
 // API client
 
 async function fetchJSON<T>(url: string): Promise<T> {
-  const res = await fetch(url)
+  const res = await fetch(withBase(url))
   if (!res.ok) {
     const body = await res.json().catch(() => ({ error: res.statusText }))
     throw new Error(body.error)
@@ -74,7 +82,7 @@ async function fetchJSON<T>(url: string): Promise<T> {
 }
 
 async function deleteRequest(url: string): Promise<void> {
-  const res = await fetch(url, { method: 'DELETE' })
+  const res = await fetch(withBase(url), { method: 'DELETE' })
   if (!res.ok) {
     const body = await res.json().catch(() => ({ error: res.statusText }))
     throw new Error(body.error)
@@ -130,10 +138,15 @@ export function useFile(id: string) {
   })
 }
 
+export interface RenamesResponse {
+  renames: RenameRecord[]
+  hasMore: boolean
+}
+
 export function useRenames(fileId: string) {
   return useQuery({
     queryKey: ['renames', fileId],
-    queryFn: () => fetchJSON<RenameRecord[]>(`/api/files/${fileId}/renames`),
+    queryFn: () => fetchJSON<RenamesResponse>(`/api/files/${fileId}/renames`),
   })
 }
 
@@ -163,8 +176,10 @@ export function useHistory(limit: number, offset: number, query: string, watchSe
 
 export function useSSE(queryClient: QueryClient) {
   useEffect(() => {
-    const es = new EventSource('/api/events')
-    es.onmessage = () => {
+    const es = new EventSource(withBase('/api/events'))
+    es.onmessage = (e) => {
+      // "stats" events only follow changes already signalled by other events
+      if (JSON.parse(e.data).type === 'stats') return
       queryClient.invalidateQueries({ queryKey: ['history'] })
       queryClient.invalidateQueries({ queryKey: ['stats'] })
     }
@@ -177,11 +192,11 @@ export function useSSE(queryClient: QueryClient) {
 }
 
 export function downloadSnapshotUrl(id: string): string {
-  return `/api/snapshots/${id}/download`
+  return withBase(`/api/snapshots/${id}/download`)
 }
 
 export function databaseDownloadUrl(): string {
-  return '/api/database/download'
+  return withBase('/api/database/download')
 }
 
 export function stripWatchDir(filePath: string, dirs: string[]): string {
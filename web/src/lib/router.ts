@@ -9,8 +9,21 @@ function subscribe(listener: () => void) {
   }
 }
 
+// basePath is the path prefix the app is served under, taken from the
+// <base href> the server sets ("" when served at the root).
+export const basePath = new URL(document.baseURI).pathname.replace(/\/$/, '')
+
+// withBase prefixes an absolute app or API path with basePath.
+export function withBase(path: string): string {
+  return basePath + path
+}
+
 function getSnapshot() {
-  return window.location.pathname + window.location.search
+  let path = window.location.pathname
+  if (basePath && path.startsWith(basePath)) {
+    path = path.slice(basePath.length) || '/'
+  }
+  return path + window.location.search
 }
 
 function notifyListeners() {
@@ -20,12 +33,12 @@ function notifyListeners() {
 window.addEventListener('popstate', notifyListeners)
 
 export function navigate(path: string) {
-  window.history.pushState(null, '', path)
+  window.history.pushState(null, '', withBase(path))
   notifyListeners()
 }
 
 export function replaceUrl(path: string) {
-  window.history.replaceState(null, '', path)
+  window.history.replaceState(null, '', withBase(path))
   notifyListeners()
 }
 
@@ -4,6 +4,9 @@ import tailwindcss from '@tailwindcss/vite'
 
 export default defineConfig({
   plugins: [react(), tailwindcss()],
+  // Relative asset URLs resolve against the <base href> the server sets
+  // from basePath
+  base: './',
   server: {
     proxy: {
       '/api': 'http://localhost:9876',